@@ -0,0 +1,134 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin serves an HTTP interface for inspecting and managing a running keywhizfs cache.
+// Secret content is never exposed.
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/square/keywhizfs"
+)
+
+// Cache is the part of keywhizfs.Cache used by the admin interface.
+type Cache interface {
+	Entries() []keywhizfs.CacheEntry
+	Clear()
+	Refresh(name string) (*keywhizfs.Secret, bool)
+	SecretLatency() keywhizfs.LatencyHistogram
+	SecretListLatency() keywhizfs.LatencyHistogram
+}
+
+// entry is the JSON form of a cache entry.
+type entry struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+	State     string    `json:"state"`
+}
+
+// latency is the JSON form of the latency percentiles of a kind of backend request.
+type latency struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// newLatency estimates the percentiles of h, in milliseconds.
+func newLatency(h keywhizfs.LatencyHistogram) latency {
+	p := h.Percentiles()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return latency{h.Count, ms(p.P50), ms(p.P95), ms(p.P99)}
+}
+
+// Handler returns an http.Handler serving:
+//  * GET /cache: JSON list of cached secrets with their metadata and freshness state
+//  * POST /cache/clear: empty the cache
+//  * POST /refresh/{name}: fetch a secret from the backend right away, updating the cache
+//  * GET /stats/latency: JSON estimates of backend latency percentiles, by kind of request
+func Handler(cache Cache) http.Handler {
+	return newMux(cache)
+}
+
+// newMux returns a mux serving the cache endpoints of Handler.
+func newMux(cache Cache) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cached := cache.Entries()
+		entries := make([]entry, len(cached))
+		for i, e := range cached {
+			entries[i] = entry{e.Name, e.Owner, e.Group, e.Mode, e.FetchedAt, e.State}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+	mux.HandleFunc("/cache/clear", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cache.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/refresh/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/refresh/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := cache.Refresh(name); !ok {
+			http.Error(w, "Failed to refresh secret from the backend", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/stats/latency", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]latency{
+			"secret":      newLatency(cache.SecretLatency()),
+			"secret_list": newLatency(cache.SecretListLatency()),
+		})
+	})
+	return mux
+}
+
+// ListenAddr returns addr with localhost as the host if none is given, so an address of only a
+// port is not reachable from other machines.
+func ListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
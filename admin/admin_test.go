@@ -0,0 +1,165 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/admin"
+	"github.com/square/keywhizfs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// FailingBackend always returns ok==false
+type FailingBackend struct{}
+
+func (b FailingBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	return nil, false
+}
+
+func (b FailingBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return nil, false
+}
+
+var (
+	logConfig = log.Config{Mountpoint: "/tmp/mnt"}
+	timeouts  = keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+)
+
+func TestCacheListsMetadataWithoutContent(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("asddas"), Owner: "nobody", Group: "nobody", Mode: "0400"})
+	server := httptest.NewServer(admin.Handler(cache))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/cache")
+	assert.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	assert.NotContains(string(body), "asddas")
+	assert.NotContains(string(body), "YXNkZGFz")
+
+	var entries []map[string]interface{}
+	assert.NoError(json.Unmarshal(body, &entries))
+	assert.Len(entries, 1)
+	assert.Equal("Nobody_PgPass", entries[0]["name"])
+	assert.Equal("nobody", entries[0]["owner"])
+	assert.Equal("nobody", entries[0]["group"])
+	assert.Equal("0400", entries[0]["mode"])
+	assert.Equal("fresh", entries[0]["state"])
+	assert.NotEmpty(entries[0]["fetched_at"])
+	assert.Len(entries[0], 6)
+}
+
+func TestCacheClear(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Nobody_PgPass"})
+	server := httptest.NewServer(admin.Handler(cache))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/cache/clear")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(1, cache.Len())
+
+	resp, err = http.Post(server.URL+"/cache/clear", "", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal(0, cache.Len())
+}
+
+func TestRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := StaticBackend{keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("new")}}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("old")})
+	server := httptest.NewServer(admin.Handler(cache))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/refresh/Nobody_PgPass")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/refresh/Nobody_PgPass", "", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	s, _ := cache.Secret("Nobody_PgPass")
+	assert.EqualValues("new", s.Content, "Expected the fresh entry to be refetched")
+
+	resp, err = http.Post(server.URL+"/refresh/", "", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	failing := httptest.NewServer(admin.Handler(keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)))
+	defer failing.Close()
+	resp, err = http.Post(failing.URL+"/refresh/Nobody_PgPass", "", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestListenAddrDefaultsToLocalhost(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("localhost:9103", admin.ListenAddr(":9103"))
+	assert.Equal("0.0.0.0:9103", admin.ListenAddr("0.0.0.0:9103"))
+	assert.Equal("127.0.0.1:9103", admin.ListenAddr("127.0.0.1:9103"))
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Secret("Nobody_PgPass")
+	server := httptest.NewServer(admin.Handler(cache))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stats/latency")
+	assert.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+
+	var latency map[string]map[string]float64
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&latency))
+	assert.EqualValues(1, latency["secret"]["count"])
+	assert.Contains(latency["secret"], "p50_ms")
+	assert.Contains(latency["secret"], "p95_ms")
+	assert.Contains(latency["secret"], "p99_ms")
+	assert.EqualValues(0, latency["secret_list"]["count"])
+	assert.EqualValues(0, latency["secret_list"]["p99_ms"])
+
+	resp, err = http.Post(server.URL+"/stats/latency", "", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/square/keywhizfs"
+)
+
+// Redacted replaces the values of sensitive settings reported at /config.
+const Redacted = "REDACTED"
+
+// sensitiveWords are words in the names of settings whose values are redacted, such as the
+// "pin" of "pkcs11-pin-file".
+var sensitiveWords = map[string]bool{
+	"passphrase": true,
+	"password":   true,
+	"pin":        true,
+	"secret":     true,
+	"token":      true,
+}
+
+// Settings is the effective configuration of a running keywhizfs, as reported at /config.
+type Settings struct {
+	Config       keywhizfs.Config // the merged file and command line settings
+	Timeouts     keywhizfs.Timeouts
+	Layout       keywhizfs.Layout
+	Sanitization keywhizfs.Sanitization
+	Flags        map[string]string // every flag by name, including defaults
+}
+
+// settings is the JSON body of the config endpoint.
+type settings struct {
+	Server     string            `json:"server"`
+	Mountpoint string            `json:"mountpoint"`
+	Cert       string            `json:"cert"`
+	Key        string            `json:"key"`
+	CA         string            `json:"ca"`
+	Debug      bool              `json:"debug"`
+	LogFormat  string            `json:"log_format"`
+	Layout     string            `json:"layout"`
+	Sanitize   string            `json:"sanitize"`
+	Timeouts   timeouts          `json:"timeouts"`
+	Flags      map[string]string `json:"flags"`
+}
+
+// timeouts is the JSON form of keywhizfs.Timeouts, named like the keys of the config file.
+type timeouts struct {
+	Fresh                keywhizfs.Duration `json:"fresh"`
+	BackendDeadline      keywhizfs.Duration `json:"backend_deadline"`
+	MaxWait              keywhizfs.Duration `json:"max_wait"`
+	NegativeTTL          keywhizfs.Duration `json:"negative_ttl"`
+	StaleWhileRevalidate bool               `json:"stale_while_revalidate"`
+}
+
+// WithConfig returns an http.Handler serving every path with handler, and also:
+//  * GET /config: JSON of the settings returned by current, with sensitive values redacted
+// current is called on each request, so the response reflects settings reloaded while running.
+func WithConfig(handler http.Handler, current func() Settings) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(redact(current()))
+	})
+	mux.Handle("/", handler)
+	return mux
+}
+
+// redact converts s to its JSON form, replacing the values of sensitive flags and any passwords
+// in server URLs.
+func redact(s Settings) settings {
+	var debug bool
+	if s.Config.Debug != nil {
+		debug = *s.Config.Debug
+	}
+	flags := make(map[string]string, len(s.Flags))
+	for name, value := range s.Flags {
+		if sensitive(name) && value != "" {
+			value = Redacted
+		}
+		flags[name] = value
+	}
+	return settings{
+		Server:     redactServers(s.Config.Server),
+		Mountpoint: s.Config.Mountpoint,
+		Cert:       s.Config.Cert,
+		Key:        s.Config.Key,
+		CA:         s.Config.CA,
+		Debug:      debug,
+		LogFormat:  s.Config.LogFormat,
+		Layout:     s.Layout.String(),
+		Sanitize:   s.Sanitization.String(),
+		Timeouts: timeouts{
+			Fresh:                keywhizfs.Duration(s.Timeouts.Fresh),
+			BackendDeadline:      keywhizfs.Duration(s.Timeouts.BackendDeadline),
+			MaxWait:              keywhizfs.Duration(s.Timeouts.BackendTimeout),
+			NegativeTTL:          keywhizfs.Duration(s.Timeouts.NegativeTTL),
+			StaleWhileRevalidate: s.Timeouts.StaleWhileRevalidate,
+		},
+		Flags: flags,
+	}
+}
+
+// sensitive returns whether the setting name holds a secret, judged by the words of its name.
+func sensitive(name string) bool {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.'
+	})
+	for _, word := range words {
+		if sensitiveWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// redactServers replaces the passwords of comma-separated server URLs.
+func redactServers(servers string) string {
+	if servers == "" {
+		return ""
+	}
+	urls := strings.Split(servers, ",")
+	for i, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			urls[i] = Redacted // An unparsable URL may still hold credentials.
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), Redacted)
+			urls[i] = u.String()
+		}
+	}
+	return strings.Join(urls, ",")
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/square/keywhizfs"
+)
+
+// processStart approximates when the process started, as the time the package was initialized.
+var processStart = time.Now()
+
+// defaultPingTimeout bounds the backend ping of a health check when Checks.PingTimeout is unset.
+const defaultPingTimeout = 2 * time.Second
+
+// HealthCache is the part of keywhizfs.Cache used by the health endpoints.
+type HealthCache interface {
+	Cache
+	Len() int
+	LastBackendContact() time.Time
+	BackendTimes() keywhizfs.BackendTimes
+}
+
+// Checks are the conditions reported by the health endpoints.
+type Checks struct {
+	// Mounted returns whether the filesystem is mounted.
+	Mounted func() bool
+	// Ping makes a lightweight backend request, returning whether it succeeded.
+	Ping func(ctx context.Context) bool
+	// PingTimeout bounds Ping. Zero means two seconds.
+	PingTimeout time.Duration
+	// MountedAt returns when the filesystem was mounted, or the zero time if it is not.
+	MountedAt func() time.Time
+}
+
+// health is the JSON body of the health endpoints.
+type health struct {
+	Status             string     `json:"status"`
+	Mounted            bool       `json:"mounted"`
+	Backend            bool       `json:"backend"`
+	LastBackendContact *time.Time `json:"last_backend_contact,omitempty"`
+	CacheSize          int        `json:"cache_size"`
+}
+
+// uptime is the JSON body of the uptime endpoint. Times which have not happened are omitted.
+type uptime struct {
+	StartedAt          time.Time  `json:"started_at"`
+	UptimeSeconds      float64    `json:"uptime_seconds"`
+	MountedAt          *time.Time `json:"mounted_at,omitempty"`
+	MountUptimeSeconds float64    `json:"mount_uptime_seconds"`
+	LastBackendContact *time.Time `json:"last_backend_contact,omitempty"`
+	LastSecret         *time.Time `json:"last_secret,omitempty"`
+	LastSecretList     *time.Time `json:"last_secret_list,omitempty"`
+	LastRefresh        *time.Time `json:"last_refresh,omitempty"`
+}
+
+// optionalTime returns a pointer to t, or nil if t is the zero time.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// HandlerWithHealth returns an http.Handler serving the endpoints of Handler, and also:
+//  * GET /healthz: OK if the filesystem is mounted and a backend ping succeeds
+//  * GET /readyz: OK if healthy and a backend request has succeeded since startup
+//  * GET /stats/uptime: JSON times of process start, mount, and the last successful backend
+//    requests by kind, including the last complete listing
+func HandlerWithHealth(cache HealthCache, checks Checks) http.Handler {
+	mux := newMux(cache)
+	mux.HandleFunc("/stats/uptime", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		now := time.Now()
+		times := cache.BackendTimes()
+		u := uptime{
+			StartedAt:          processStart,
+			UptimeSeconds:      now.Sub(processStart).Seconds(),
+			LastBackendContact: optionalTime(times.Contact),
+			LastSecret:         optionalTime(times.Secret),
+			LastSecretList:     optionalTime(times.SecretList),
+			LastRefresh:        optionalTime(times.Refresh),
+		}
+		if checks.MountedAt != nil {
+			if mounted := checks.MountedAt(); !mounted.IsZero() {
+				u.MountedAt = &mounted
+				u.MountUptimeSeconds = now.Sub(mounted).Seconds()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(u)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, r, cache, checks, false)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, r, cache, checks, true)
+	})
+	return mux
+}
+
+// serveHealth runs the checks and responds with their outcome, with status 503 if any failed.
+func serveHealth(w http.ResponseWriter, r *http.Request, cache HealthCache, checks Checks, ready bool) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := checks.PingTimeout
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	h := health{
+		Mounted:   checks.Mounted != nil && checks.Mounted(),
+		Backend:   checks.Ping != nil && checks.Ping(ctx),
+		CacheSize: cache.Len(),
+	}
+	h.LastBackendContact = optionalTime(cache.LastBackendContact())
+
+	ok := h.Mounted && h.Backend && (!ready || h.LastBackendContact != nil)
+	status := http.StatusOK
+	h.Status = "ok"
+	if !ok {
+		status = http.StatusServiceUnavailable
+		h.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
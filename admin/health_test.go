@@ -0,0 +1,175 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/admin"
+	"github.com/stretchr/testify/assert"
+)
+
+// StaticBackend always returns its secret.
+type StaticBackend struct {
+	secret keywhizfs.Secret
+}
+
+func (b StaticBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	s := b.secret
+	return &s, true
+}
+
+func (b StaticBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return []keywhizfs.Secret{b.secret}, true
+}
+
+// getHealth requests path, returning the status code and decoded body.
+func getHealth(t *testing.T, url, path string) (int, map[string]interface{}) {
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestHealthReportsHealthy(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(StaticBackend{keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("asddas")}}, timeouts, logConfig)
+	checks := admin.Checks{
+		Mounted: func() bool { return true },
+		Ping:    func(ctx context.Context) bool { return true },
+	}
+	server := httptest.NewServer(admin.HandlerWithHealth(cache, checks))
+	defer server.Close()
+
+	// Healthy, but not ready until the backend has served a request.
+	status, body := getHealth(t, server.URL, "/healthz")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("ok", body["status"])
+	assert.NotContains(body, "last_backend_contact")
+	status, _ = getHealth(t, server.URL, "/readyz")
+	assert.Equal(http.StatusServiceUnavailable, status)
+
+	_, ok := cache.Secret("Nobody_PgPass")
+	assert.True(ok)
+
+	status, body = getHealth(t, server.URL, "/readyz")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("ok", body["status"])
+	assert.Equal(true, body["mounted"])
+	assert.Equal(true, body["backend"])
+	assert.Contains(body, "last_backend_contact")
+	assert.Equal(1.0, body["cache_size"])
+}
+
+func TestHealthReportsUnhealthy(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Nobody_PgPass"})
+
+	cases := []struct {
+		checks          admin.Checks
+		mounted, pinged bool
+	}{
+		{admin.Checks{Mounted: func() bool { return false }, Ping: func(ctx context.Context) bool { return true }}, false, true},
+		{admin.Checks{Mounted: func() bool { return true }, Ping: func(ctx context.Context) bool { return false }}, true, false},
+		{admin.Checks{}, false, false},
+	}
+	for _, c := range cases {
+		server := httptest.NewServer(admin.HandlerWithHealth(cache, c.checks))
+		for _, path := range []string{"/healthz", "/readyz"} {
+			status, body := getHealth(t, server.URL, path)
+			assert.Equal(http.StatusServiceUnavailable, status, "Expected %v to be unavailable", path)
+			assert.Equal("unavailable", body["status"])
+			assert.Equal(c.mounted, body["mounted"])
+			assert.Equal(c.pinged, body["backend"])
+			assert.Equal(1.0, body["cache_size"])
+		}
+		server.Close()
+	}
+}
+
+func TestHealthPingTimesOut(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	checks := admin.Checks{
+		Mounted: func() bool { return true },
+		Ping: func(ctx context.Context) bool {
+			<-ctx.Done()
+			return false
+		},
+		PingTimeout: 10 * time.Millisecond,
+	}
+	server := httptest.NewServer(admin.HandlerWithHealth(cache, checks))
+	defer server.Close()
+
+	status, body := getHealth(t, server.URL, "/healthz")
+	assert.Equal(http.StatusServiceUnavailable, status)
+	assert.Equal(false, body["backend"])
+}
+
+func TestUptimeReportsTimes(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(StaticBackend{keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("asddas")}}, timeouts, logConfig)
+	mountedAt := time.Now().Add(-time.Minute)
+	checks := admin.Checks{MountedAt: func() time.Time { return mountedAt }}
+	server := httptest.NewServer(admin.HandlerWithHealth(cache, checks))
+	defer server.Close()
+
+	status, body := getHealth(t, server.URL, "/stats/uptime")
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "started_at")
+	assert.InDelta(60, body["mount_uptime_seconds"], 5)
+	assert.NotContains(body, "last_secret")
+	assert.NotContains(body, "last_refresh")
+
+	_, ok := cache.Secret("Nobody_PgPass")
+	assert.True(ok)
+	_, body = getHealth(t, server.URL, "/stats/uptime")
+	first, err := time.Parse(time.RFC3339Nano, body["last_secret"].(string))
+	assert.NoError(err)
+	assert.Equal(body["last_secret"], body["last_backend_contact"])
+	assert.NotContains(body, "last_secret_list")
+
+	// Listings are always sent to the backend, and a complete one refreshes the cache.
+	time.Sleep(time.Millisecond)
+	assert.Len(cache.SecretList(), 1)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, body = getHealth(t, server.URL, "/stats/uptime"); body["last_refresh"] != nil {
+			break
+		}
+	}
+	assert.Contains(body, "last_refresh")
+	contact, err := time.Parse(time.RFC3339Nano, body["last_backend_contact"].(string))
+	assert.NoError(err)
+	assert.True(contact.After(first), "Expected the last backend contact to move forward")
+	assert.Contains(body, "last_secret_list")
+	assert.Equal(body["last_secret"], first.Format(time.RFC3339Nano))
+}
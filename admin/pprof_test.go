@@ -0,0 +1,62 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/admin"
+	"github.com/stretchr/testify/assert"
+)
+
+func getStatus(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProfilingOnlyWhenEnabled(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	plain := httptest.NewServer(admin.Handler(cache))
+	defer plain.Close()
+	profiled := httptest.NewServer(admin.WithProfiling(admin.Handler(cache)))
+	defer profiled.Close()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine", "/debug/pprof/cmdline"} {
+		assert.Equal(http.StatusNotFound, getStatus(t, plain.URL+path), path)
+		assert.Equal(http.StatusOK, getStatus(t, profiled.URL+path), path)
+	}
+	assert.Equal(http.StatusOK, getStatus(t, profiled.URL+"/cache"), "Other endpoints are still served")
+}
+
+func TestIsLoopback(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(admin.IsLoopback("localhost:9103"))
+	assert.True(admin.IsLoopback("127.0.0.1:9103"))
+	assert.True(admin.IsLoopback("[::1]:9103"))
+	assert.False(admin.IsLoopback(":9103"))
+	assert.False(admin.IsLoopback("0.0.0.0:9103"))
+	assert.False(admin.IsLoopback("10.0.0.1:9103"))
+	assert.False(admin.IsLoopback("9103"))
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// LoadAliases reads a JSON object mapping alias names to the names of the secrets they stand for,
+// such as {"old-name": "new-name"}, for SetAliases. Invalid aliases are an error.
+func LoadAliases(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read aliases: %v", err)
+	}
+	defer file.Close()
+
+	var aliases map[string]string
+	if err = json.NewDecoder(file).Decode(&aliases); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON aliases %v: %v", path, err)
+	}
+	if err = validateAliases(aliases); err != nil {
+		return nil, fmt.Errorf("Invalid aliases in %v: %v", path, err)
+	}
+	return aliases, nil
+}
+
+// validateAliases rejects empty names, and aliases of themselves or of other aliases.
+func validateAliases(aliases map[string]string) error {
+	for alias, target := range aliases {
+		switch _, chained := aliases[target]; {
+		case alias == "" || target == "":
+			return fmt.Errorf("alias '%v' of '%v' must name both", alias, target)
+		case alias == target:
+			return fmt.Errorf("alias '%v' names itself", alias)
+		case chained:
+			return fmt.Errorf("alias '%v' names alias '%v'", alias, target)
+		}
+	}
+	return nil
+}
+
+// SetAliases sets the aliases resolved by lookups, mapping each alias to the name of its target,
+// such as an old name of a renamed secret. Looking up an alias returns the target secret, named
+// as such, from the target's cache entry, so aliases never duplicate cached secrets. An alias
+// hides a secret of the same name. A nil map removes every alias.
+func (c *Cache) SetAliases(aliases map[string]string) error {
+	if err := validateAliases(aliases); err != nil {
+		return err
+	}
+	copied := make(map[string]string, len(aliases))
+	for alias, target := range aliases {
+		copied[alias] = target
+	}
+	c.aliases.Store(copied)
+	return nil
+}
+
+// Aliases returns the sorted aliases of target.
+func (c *Cache) Aliases(target string) []string {
+	aliases, _ := c.aliases.Load().(map[string]string)
+	var names []string
+	for alias, t := range aliases {
+		if t == target {
+			names = append(names, alias)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveAlias returns the target of name if it is an alias, or else name.
+func (c *Cache) resolveAlias(name string) string {
+	aliases, _ := c.aliases.Load().(map[string]string)
+	if target, ok := aliases[name]; ok {
+		c.Debugf("Resolved alias %v to %v", name, target)
+		return target
+	}
+	return name
+}
+
+// hasAliases returns whether any alias is set.
+func (c *Cache) hasAliases() bool {
+	aliases, _ := c.aliases.Load().(map[string]string)
+	return len(aliases) > 0
+}
+
+// withAliases returns secrets with a copy of each secret under each of its aliases, so that aliases
+// appear as files of their own. Copies leave out the bundle, so they are not bundle members.
+func (kwfs KeywhizFs) withAliases(secrets []Secret) []Secret {
+	if !kwfs.Cache.hasAliases() {
+		return secrets
+	}
+	listed := make(map[string]bool, len(secrets))
+	for _, s := range secrets {
+		listed[s.Name] = true
+	}
+	all := append([]Secret(nil), secrets...)
+	for _, s := range secrets {
+		for _, alias := range kwfs.Cache.Aliases(s.Name) {
+			if listed[alias] {
+				continue // Lookups resolve the alias, so the secret's own entry stands for it.
+			}
+			s.Name, s.Bundle = alias, ""
+			all = append(all, s)
+		}
+	}
+	return all
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheResolvesAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := &keywhizfs.Secret{Name: "new-name", Content: []byte("asddas")}
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secret.Name: secret}, calls: new(int32)}
+	fresh := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCache(backend, fresh, logConfig)
+	assert.NoError(cache.SetAliases(map[string]string{"old-name": "new-name"}))
+
+	s, ok := cache.Secret("old-name")
+	assert.True(ok)
+	assert.Equal("new-name", s.Name)
+	assert.EqualValues("asddas", s.Content)
+	s, ok = cache.Secret("new-name")
+	assert.True(ok)
+	assert.EqualValues("asddas", s.Content)
+
+	assert.Equal([]string{"new-name"}, cache.Keys(), "Expected the alias to share its target's entry")
+	assert.Equal(1, cache.Len())
+	assert.EqualValues(1, atomic.LoadInt32(backend.calls), "Expected the alias to be served from the cached target")
+	assert.Equal([]string{"old-name"}, cache.Aliases("new-name"))
+
+	assert.NoError(cache.SetAliases(nil))
+	_, ok = cache.Secret("old-name")
+	assert.False(ok)
+}
+
+func TestLoadAliases(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-aliases")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aliases.json")
+
+	assert.NoError(ioutil.WriteFile(path, []byte(`{"old-name": "new-name", "older-name": "new-name"}`), 0644))
+	aliases, err := keywhizfs.LoadAliases(path)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"old-name": "new-name", "older-name": "new-name"}, aliases)
+
+	for _, invalid := range []string{`{"a": "b", "b": "c"}`, `{"a": "a"}`, `{"": "a"}`, `{"a": ""}`, `[]`} {
+		assert.NoError(ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, err = keywhizfs.LoadAliases(path)
+		assert.Error(err, "Expected %v to be rejected", invalid)
+	}
+	_, err = keywhizfs.LoadAliases(filepath.Join(dir, "missing.json"))
+	assert.Error(err)
+}
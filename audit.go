@@ -0,0 +1,84 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one access to a secret. It never includes secret content.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Secret string    `json:"secret"`
+	Uid    uint32    `json:"uid"`
+	Gid    uint32    `json:"gid"`
+	Pid    uint32    `json:"pid"`
+	// Origin is "cache", "backend", or "fallback".
+	Origin string `json:"origin"`
+	// RequestID identifies the read, and is sent as X-Request-Id by backend requests made for it.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// AuditLog appends a JSON line for each secret access.
+type AuditLog struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// NewAuditLog initializes an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog opens path for appending audit records, creating it if necessary. The file is
+// restricted to mode 0600.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to open audit log: %v", err)
+	}
+	if err = file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Fail to restrict audit log permissions: %v", err)
+	}
+	return NewAuditLog(file), nil
+}
+
+// Record appends a single record.
+func (a *AuditLog) Record(r AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.w.Write(data)
+	return err
+}
+
+// Close closes the underlying writer, if it can be closed.
+func (a *AuditLog) Close() error {
+	if closer, ok := a.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
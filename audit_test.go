@@ -0,0 +1,66 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogAppendsRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// An existing file with loose permissions is restricted and appended to.
+	assert.NoError(ioutil.WriteFile(path, []byte("{}\n"), 0644))
+
+	audit, err := keywhizfs.OpenAuditLog(path)
+	assert.NoError(err)
+	now := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(audit.Record(keywhizfs.AuditRecord{Time: now, Secret: "Nobody_PgPass", Uid: 1, Gid: 2, Pid: 3, Origin: "cache"}))
+	assert.NoError(audit.Close())
+
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(lines, 2) {
+		return
+	}
+
+	var record map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal("Nobody_PgPass", record["secret"])
+	assert.EqualValues(1, record["uid"])
+	assert.EqualValues(2, record["gid"])
+	assert.EqualValues(3, record["pid"])
+	assert.Equal("cache", record["origin"])
+	assert.Equal("2015-01-01T00:00:00Z", record["time"])
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MissingSecretsError reports secrets which Secrets could not retrieve.
+type MissingSecretsError struct {
+	Missing []string // sorted names
+}
+
+func (e *MissingSecretsError) Error() string {
+	return fmt.Sprintf("Failed to retrieve %d secrets: %v", len(e.Missing), strings.Join(e.Missing, ", "))
+}
+
+// Secrets retrieves several secrets by name at once, keyed by name. Repeated names are looked up
+// once, and fresh cache entries are used without consulting the backend.
+//
+// If the backend is a BatchSecretFetcher, the remaining names are requested together, waiting up
+// to Timeouts.BackendTimeout. Names the batch does not return, or all remaining names if it fails,
+// are then looked up one by one as by Secret, as they are for other backends. Secrets which could
+// not be retrieved are left out and reported together as a *MissingSecretsError.
+func (c *Cache) Secrets(names []string) (map[string]*Secret, error) {
+	if c.isClosed() {
+		return nil, ErrCacheClosed
+	}
+	ctx := context.Background()
+	secrets := make(map[string]*Secret, len(names))
+	var pending []string
+	for _, name := range names {
+		if _, ok := secrets[name]; ok {
+			continue
+		}
+		secrets[name] = nil
+		if s, ok := c.freshSecret(name); ok {
+			secrets[name] = s.Clone()
+		} else {
+			pending = append(pending, name)
+		}
+	}
+
+	if c.batch != nil && len(pending) > 0 {
+		for name, s := range c.fetchBatch(ctx, pending) {
+			secrets[name] = s
+		}
+	}
+
+	var missing []string
+	for _, name := range pending {
+		if secrets[name] != nil {
+			continue
+		}
+		if s, ok := c.SecretCtx(ctx, name); ok {
+			secrets[name] = s
+			continue
+		}
+		delete(secrets, name)
+		missing = append(missing, name)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return secrets, &MissingSecretsError{Missing: missing}
+	}
+	return secrets, nil
+}
+
+// freshSecret returns the cached entry of a secret if it can be used without consulting the
+// backend, as SecretCtx would.
+func (c *Cache) freshSecret(name string) (*Secret, bool) {
+	if !c.Permits(name) {
+		return nil, false
+	}
+	s, ok := c.secretMap.Get(name)
+	now := c.clock()
+	if !ok || len(s.Secret.Content) == 0 || c.expired(s.Secret, now) {
+		return nil, false
+	}
+	if !fresh(s, now, c.Timeouts()) && !c.warming() {
+		return nil, false
+	}
+	count(&c.stats.hits)
+	return &s.Secret, true
+}
+
+// fetchBatch requests secrets from a BatchSecretFetcher backend in one request, caching those it
+// returns. Names excluded by the name filter are not requested. The request is subject to the
+// circuit breaker and request limits like that of a single secret.
+func (c *Cache) fetchBatch(ctx context.Context, names []string) map[string]*Secret {
+	var permitted []string
+	for _, name := range names {
+		if c.Permits(name) {
+			permitted = append(permitted, name)
+		}
+	}
+	if len(permitted) == 0 || !c.limit(ctx, "batch") {
+		return nil
+	}
+	release, ok := c.admit(ctx, "batch")
+	if !ok {
+		return nil
+	}
+	defer release()
+	if !c.breaker.allow(c.clock()) {
+		c.Debugf("Circuit breaker open, skipping backend: batch of %d", len(permitted))
+		count(&c.stats.shortCircuits)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeouts().BackendTimeout)
+	defer cancel()
+	count(&c.stats.backendCalls)
+	start := time.Now()
+	batch, ok := c.batch.SecretsBatch(ctx, permitted)
+	c.stats.latency.observe(time.Since(start))
+	if !ok {
+		c.Warnf("Batch request for %d secrets failed, requesting them one by one", len(permitted))
+		count(&c.stats.backendErrors)
+		if ctx.Err() != nil {
+			c.breaker.ignore()
+		} else {
+			c.breaker.failure(c.clock())
+		}
+		return nil
+	}
+	c.breaker.success()
+	c.contacted(&c.stats.lastSecret)
+
+	secrets := make(map[string]*Secret, len(batch))
+	for _, name := range permitted {
+		s, ok := batch[name]
+		if !ok || s == nil {
+			continue
+		}
+		if s, ok = c.storeSecret(name, s); ok && !c.expired(*s, c.clock()) {
+			secrets[name] = s
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// BatchBackend serves secrets from a map, recording the names of each batch request. Single
+// requests are counted.
+type BatchBackend struct {
+	CountingBackend
+	fail    bool
+	batches *[][]string
+	lock    *sync.Mutex
+}
+
+func (b BatchBackend) SecretsBatch(ctx context.Context, names []string) (map[string]*keywhizfs.Secret, bool) {
+	b.lock.Lock()
+	*b.batches = append(*b.batches, names)
+	b.lock.Unlock()
+	if b.fail {
+		return nil, false
+	}
+	secrets := make(map[string]*keywhizfs.Secret)
+	for _, name := range names {
+		if s, ok := b.secrets[name]; ok {
+			secrets[name] = s
+		}
+	}
+	return secrets, true
+}
+
+func newBatchBackend(fail bool, names ...string) BatchBackend {
+	secrets := make(map[string]*keywhizfs.Secret)
+	for _, name := range names {
+		secrets[name] = &keywhizfs.Secret{Name: name, Content: []byte(name + " content"), Mode: "0400"}
+	}
+	return BatchBackend{CountingBackend{secrets, new(int32)}, fail, new([][]string), new(sync.Mutex)}
+}
+
+func TestSecretsBatchesBackendRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := newBatchBackend(false, "cached", "first", "second")
+	timeouts := timeouts
+	timeouts.Fresh = time.Hour
+	cache := keywhizfs.NewCache(keywhizfs.Chain(backend, keywhizfs.Observe(func(string, bool, time.Duration) {})), timeouts, logConfig)
+	cache.Add(*backend.secrets["cached"])
+
+	secrets, err := cache.Secrets([]string{"cached", "first", "second", "first", "missing"})
+	assert.Equal([][]string{{"first", "second", "missing"}}, *backend.batches, "Only names without fresh entries are batched, once")
+	assert.Len(secrets, 3)
+	for _, name := range []string{"cached", "first", "second"} {
+		if assert.NotNil(secrets[name], name) {
+			assert.Equal(name+" content", string(secrets[name].Content))
+		}
+	}
+	if assert.IsType(&keywhizfs.MissingSecretsError{}, err) {
+		assert.Equal([]string{"missing"}, err.(*keywhizfs.MissingSecretsError).Missing)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(backend.calls), "A name missing from the batch is requested alone")
+
+	// Batched secrets are cached.
+	secrets, err = cache.Secrets([]string{"first", "second"})
+	assert.NoError(err)
+	assert.Len(secrets, 2)
+	assert.Len(*backend.batches, 1)
+}
+
+func TestSecretsFallsBackToSingleRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	// A backend without batch requests is asked for each secret.
+	backend := newBatchBackend(false, "first", "second")
+	cache := keywhizfs.NewCache(backend.CountingBackend, timeouts, logConfig)
+	secrets, err := cache.Secrets([]string{"first", "second", "second"})
+	assert.NoError(err)
+	assert.Len(secrets, 2)
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+
+	// A failed batch is retried one secret at a time.
+	backend = newBatchBackend(true, "first", "second")
+	cache = keywhizfs.NewCache(backend, timeouts, logConfig)
+	secrets, err = cache.Secrets([]string{"first", "second"})
+	assert.NoError(err)
+	assert.Len(secrets, 2)
+	assert.Len(*backend.batches, 1)
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+}
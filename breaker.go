@@ -0,0 +1,154 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker around a Cache's backend.
+type BreakerState int
+
+const (
+	// BreakerClosed lets backend requests through. This is the normal state.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen short-circuits backend requests, so lookups are served from cache immediately.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through to test whether the backend recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// SetCircuitBreaker enables a circuit breaker around the backend. After failures consecutive
+// backend failures within window, backend requests are short-circuited for cooldown and lookups
+// are served from cache without waiting. After the cooldown a single probe request is let
+// through, closing the breaker if it succeeds. A failures of zero disables the breaker.
+//
+// Connection errors and 5xx responses are counted as failures, while a 404 Not Found shows the
+// backend answering. A backend which does not report statuses, as StatusSecretFetcher does,
+// reports a missing secret the same way as an error, so only its failures to fetch a listing or a
+// secret which is already cached are counted.
+func (c *Cache) SetCircuitBreaker(failures int, window, cooldown time.Duration) {
+	c.breaker.lock.Lock()
+	defer c.breaker.lock.Unlock()
+	c.breaker.threshold = failures
+	c.breaker.window = window
+	c.breaker.cooldown = cooldown
+	c.breaker.state = BreakerClosed
+	c.breaker.failures = 0
+	c.breaker.probing = false
+}
+
+// breaker tracks consecutive backend failures. The zero value is disabled.
+type breaker struct {
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	state        BreakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+	lock         sync.Mutex
+}
+
+// current returns the state of the breaker at now.
+func (b *breaker) current(now time.Time) BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow returns whether a backend request may be made at now. In the half-open state, only one
+// probe is allowed until its outcome is recorded.
+func (b *breaker) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.threshold <= 0 {
+		return true
+	}
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// success records a successful backend request, closing the breaker.
+func (b *breaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed backend request at now, opening the breaker once the threshold is
+// reached or if a probe failed.
+func (b *breaker) failure(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.threshold <= 0 {
+		return
+	}
+	b.probing = false
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+		b.openedAt = now
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+// ignore records a backend request whose outcome says nothing about backend health, letting
+// another probe through if it was one.
+func (b *breaker) ignore() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// SwitchBackend serves secret until failing is set, counting calls.
+type SwitchBackend struct {
+	secret  *keywhizfs.Secret
+	failing *int32
+	calls   *int32
+}
+
+func (b SwitchBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	if atomic.LoadInt32(b.failing) != 0 {
+		return nil, false
+	}
+	return b.secret, true
+}
+
+func (b SwitchBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	if atomic.LoadInt32(b.failing) != 0 {
+		return nil, false
+	}
+	return []keywhizfs.Secret{*b.secret}, true
+}
+
+func TestCacheCircuitBreakerOpensAndCloses(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := SwitchBackend{secret: secretFixture, failing: new(int32), calls: new(int32)}
+	atomic.StoreInt32(backend.failing, 1)
+
+	clock := newFakeClock()
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}
+	cache := keywhizfs.NewCacheWithClock(backend, cacheTimeouts, logConfig, clock.Now)
+	cache.SetCircuitBreaker(2, time.Minute, 10*time.Second)
+	cache.Add(*secretFixture)
+
+	for i := 0; i < 2; i++ {
+		secret, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+		assert.Equal(secretFixture, secret)
+	}
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+	assert.Equal(keywhizfs.BreakerOpen, cache.Stats().Breaker)
+
+	// While open, the cache is used without asking the backend.
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.Len(cache.SecretList(), 1)
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+	assert.EqualValues(2, cache.Stats().ShortCircuits)
+
+	// After the cooldown, a failed probe reopens the breaker.
+	clock.Advance(10 * time.Second)
+	assert.Equal(keywhizfs.BreakerHalfOpen, cache.Stats().Breaker)
+	cache.Secret(secretFixture.Name)
+	assert.EqualValues(3, atomic.LoadInt32(backend.calls))
+	assert.Equal(keywhizfs.BreakerOpen, cache.Stats().Breaker)
+
+	// A successful probe closes it.
+	atomic.StoreInt32(backend.failing, 0)
+	clock.Advance(10 * time.Second)
+	cache.Secret(secretFixture.Name)
+	assert.EqualValues(4, atomic.LoadInt32(backend.calls))
+	assert.Equal(keywhizfs.BreakerClosed, cache.Stats().Breaker)
+}
+
+func TestCacheCircuitBreakerSkipsBackendDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := SwitchBackend{secret: secretFixture, failing: new(int32), calls: new(int32)}
+	atomic.StoreInt32(backend.failing, 1)
+
+	// The backend deadline is long enough that waiting on it would be noticed.
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}
+	slow := keywhizfs.NewCache(SlowBackend{backend, 200 * time.Millisecond}, cacheTimeouts, logConfig)
+	slow.SetCircuitBreaker(1, time.Minute, time.Minute)
+	slow.Add(*secretFixture)
+
+	slow.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.BreakerOpen, slow.Stats().Breaker)
+
+	start := time.Now()
+	secret, ok := slow.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.True(time.Since(start) < 100*time.Millisecond, "lookup waited on the backend")
+}
+
+func TestCacheCircuitBreakerIgnoresUnknownSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.SetCircuitBreaker(1, time.Minute, time.Minute)
+
+	_, ok := cache.Secret("missing")
+	assert.False(ok)
+	assert.Equal(keywhizfs.BreakerClosed, cache.Stats().Breaker)
+}
+
+// StatusBackend fails every secret request with status, as a StatusSecretFetcher.
+type StatusBackend struct {
+	status *int32
+}
+
+func (b StatusBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	return nil, false
+}
+
+func (b StatusBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return nil, false
+}
+
+func (b StatusBackend) SecretWithStatusCtx(ctx context.Context, name, etag string) (*keywhizfs.Secret, bool, int, bool) {
+	return nil, false, int(atomic.LoadInt32(b.status)), false
+}
+
+func TestCacheCircuitBreakerCountsStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		status int32
+		cached bool
+		state  keywhizfs.BreakerState
+	}{
+		{404, true, keywhizfs.BreakerClosed},
+		{404, false, keywhizfs.BreakerClosed},
+		{403, false, keywhizfs.BreakerClosed},
+		{503, true, keywhizfs.BreakerOpen},
+		{500, false, keywhizfs.BreakerOpen},
+		{0, false, keywhizfs.BreakerOpen}, // no response
+	}
+	for _, c := range cases {
+		backend := StatusBackend{status: new(int32)}
+		atomic.StoreInt32(backend.status, c.status)
+		cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+		cache.SetCircuitBreaker(1, time.Minute, time.Minute)
+		if c.cached {
+			cache.Add(keywhizfs.Secret{Name: "foo", Content: []byte("bar")})
+		}
+
+		cache.Secret("foo")
+		assert.Equal(c.state, cache.Stats().Breaker, "Expected status %d with cached %v to leave the breaker %v", c.status, c.cached, c.state)
+	}
+}
+
+// SlowBackend delays each response of another backend.
+type SlowBackend struct {
+	backend keywhizfs.SecretBackend
+	delay   time.Duration
+}
+
+func (b SlowBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	time.Sleep(b.delay)
+	return b.backend.Secret(name)
+}
+
+func (b SlowBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	time.Sleep(b.delay)
+	return b.backend.SecretList()
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bundle is a snapshot of the secrets sharing a Secret.Bundle name, such as a certificate, its
+// key, and its chain. The members of a bundle are only replaced together, so that a snapshot never
+// mixes old and new content.
+type Bundle struct {
+	Name string
+	// Generation identifies the snapshot. It increases whenever the content or version of a member
+	// changes, or a member is added or removed.
+	Generation uint64
+	Secrets    []Secret // sorted by name
+	FetchedAt  time.Time
+}
+
+// copy returns the bundle with private copies of the content of its secrets.
+func (b *Bundle) copy() *Bundle {
+	c := *b
+	c.Secrets = make([]Secret, len(b.Secrets))
+	for i, s := range b.Secrets {
+		c.Secrets[i] = s
+		c.Secrets[i].Content = s.Content.clone()
+	}
+	return &c
+}
+
+// wipe zeroes the content of the secrets of the bundle.
+func (b *Bundle) wipe() {
+	for _, s := range b.Secrets {
+		s.Content.wipe()
+	}
+}
+
+// sameSecrets returns whether secrets are those of the bundle, with the same content and versions.
+func (b *Bundle) sameSecrets(secrets []Secret) bool {
+	if len(secrets) != len(b.Secrets) {
+		return false
+	}
+	for i, s := range secrets {
+		held := b.Secrets[i]
+		if s.Name != held.Name || s.Version != held.Version || !bytes.Equal(s.Content, held.Content) {
+			return false
+		}
+	}
+	return true
+}
+
+// bundleState holds the current and previous snapshots of a bundle, so that a reader which
+// resolved the current generation can finish reading it after a refresh.
+type bundleState struct {
+	current, previous *Bundle
+	lock              sync.Mutex // held while refreshing
+}
+
+// bundleSet holds the snapshots of each bundle by name.
+type bundleSet struct {
+	m    map[string]*bundleState
+	lock sync.Mutex
+}
+
+// get returns the state of the bundle name, creating it if necessary.
+func (s *bundleSet) get(name string) *bundleState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.m[name]
+	if !ok {
+		state = &bundleState{}
+		s.m[name] = state
+	}
+	return state
+}
+
+// clear drops every snapshot, zeroing their content.
+func (s *bundleSet) clear() {
+	s.lock.Lock()
+	states := s.m
+	s.m = make(map[string]*bundleState)
+	s.lock.Unlock()
+	for _, state := range states {
+		state.lock.Lock()
+		for _, b := range []*Bundle{state.current, state.previous} {
+			if b != nil {
+				b.wipe()
+			}
+		}
+		state.lock.Unlock()
+	}
+}
+
+// Bundle returns the current snapshot of the bundle name, whose members are the named secrets. A
+// snapshot more recent than Timeouts.Fresh with the same members is used as is. Otherwise every
+// member is fetched from the backend, in one batch request if it is a BatchSecretFetcher, and the
+// snapshot is replaced if any changed. If a member cannot be fetched or has expired, the current
+// snapshot is kept, and ok is false if there is none.
+func (c *Cache) Bundle(ctx context.Context, name string, members []string) (bundle *Bundle, ok bool) {
+	ok = c.withBundle(ctx, name, members, func(b *Bundle) { bundle = b.copy() })
+	return bundle, ok
+}
+
+// currentGeneration returns the generation of the current snapshot of the bundle name, refreshed
+// as by Bundle, without copying the content of its secrets.
+func (c *Cache) currentGeneration(ctx context.Context, name string, members []string) (generation uint64, ok bool) {
+	ok = c.withBundle(ctx, name, members, func(b *Bundle) { generation = b.Generation })
+	return generation, ok
+}
+
+// withBundle calls use with the current snapshot of the bundle name, refreshed as by Bundle, while
+// holding its lock. use must not retain the snapshot or the content of its secrets, which are
+// zeroed once the snapshot is replaced. Returns false, without calling use, if there is none.
+func (c *Cache) withBundle(ctx context.Context, name string, members []string, use func(*Bundle)) bool {
+	members = append([]string(nil), members...)
+	sort.Strings(members)
+	state := c.bundles.get(name)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	current := state.current
+	if current != nil && current.hasMembers(members) && fresh(SecretTime{Time: current.FetchedAt}, c.clock(), c.Timeouts()) {
+		use(current)
+		return true
+	}
+	secrets, ok := c.fetchBundle(ctx, members)
+	switch {
+	case !ok && current == nil:
+		return false
+	case !ok:
+		c.Warnf("Keeping generation %d of bundle %v", current.Generation, name)
+		use(current)
+		return true
+	case current != nil && current.sameSecrets(secrets):
+		current.FetchedAt = c.clock()
+		(&Bundle{Secrets: secrets}).wipe()
+		use(current)
+		return true
+	}
+
+	next := &Bundle{Name: name, Generation: 1, Secrets: secrets, FetchedAt: c.clock()}
+	if current != nil {
+		next.Generation = current.Generation + 1
+	}
+	if state.previous != nil {
+		state.previous.wipe()
+	}
+	state.previous, state.current = current, next
+	c.Infof("Bundle %v updated to generation %d", name, next.Generation)
+	use(next)
+	return true
+}
+
+// BundleGeneration returns a snapshot of the bundle name by generation, if it is the current or
+// previous one. No backend request is made.
+func (c *Cache) BundleGeneration(name string, generation uint64) (bundle *Bundle, ok bool) {
+	ok = c.withBundleGeneration(name, generation, func(b *Bundle) { bundle = b.copy() })
+	return bundle, ok
+}
+
+// withBundleGeneration calls use with the snapshot of the bundle name by generation, as returned
+// by BundleGeneration, while holding its lock, without copying it. use must not retain the snapshot
+// or the content of its secrets. Returns false, without calling use, if it is not held.
+func (c *Cache) withBundleGeneration(name string, generation uint64, use func(*Bundle)) bool {
+	state := c.bundles.get(name)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, b := range []*Bundle{state.current, state.previous} {
+		if b != nil && b.Generation == generation {
+			use(b)
+			return true
+		}
+	}
+	return false
+}
+
+// hasMembers returns whether the bundle holds exactly the secrets named by sorted members.
+func (b *Bundle) hasMembers(members []string) bool {
+	if len(members) != len(b.Secrets) {
+		return false
+	}
+	for i, name := range members {
+		if b.Secrets[i].Name != name {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchBundle requests every member of a bundle from the backend, returning copies of the secrets
+// sorted by name. Returns false if any member could not be fetched or has expired.
+func (c *Cache) fetchBundle(ctx context.Context, members []string) ([]Secret, bool) {
+	if len(members) == 0 {
+		return nil, false
+	}
+	var batch map[string]*Secret
+	if c.batch != nil {
+		batch = c.fetchBatch(ctx, members)
+	}
+	secrets := make([]Secret, 0, len(members))
+	for _, name := range members {
+		s, ok := batch[name]
+		if !ok {
+			s, ok = c.refreshSecret(ctx, name)
+		}
+		var copied Secret
+		ok = ok && !c.expired(*s, c.clock()) && c.withContent(s, func(s *Secret) {
+			copied = *s
+			copied.Content = s.Content.clone()
+		})
+		if !ok {
+			c.Warnf("Could not fetch bundle member %v", name)
+			(&Bundle{Secrets: secrets}).wipe()
+			return nil, false
+		}
+		secrets = append(secrets, copied)
+	}
+	return secrets, true
+}
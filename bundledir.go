@@ -0,0 +1,221 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	gocontext "context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// bundlesDir is the directory of bundles. Each bundle appears as a symlink to the directory of its
+// current generation, as in ".bundles/tls -> tls@3", so that a reader resolving the link once sees
+// every member of a single snapshot.
+const bundlesDir = ".bundles"
+
+// splitBundlePath splits a path of the form ".bundles/<bundle>", ".bundles/<bundle>@<generation>"
+// or ".bundles/<bundle>@<generation>/<file>". The generation is zero for the link of a bundle.
+func splitBundlePath(path string) (bundle string, generation uint64, file string, ok bool) {
+	rest := strings.TrimPrefix(path, bundlesDir+"/")
+	if rest == path || rest == "" {
+		return "", 0, "", false
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, file = rest[:i], rest[i+1:]
+		if file == "" || strings.Contains(file, "/") {
+			return "", 0, "", false
+		}
+	}
+	name, version, versioned := splitVersion(rest)
+	if !versioned {
+		return rest, 0, "", file == ""
+	}
+	generation, err := strconv.ParseUint(version, 10, 64)
+	if err != nil || generation == 0 {
+		return "", 0, "", false
+	}
+	return name, generation, file, true
+}
+
+// bundleLink returns the target of the link of the bundle name, the directory of its generation.
+func bundleLink(name string, generation uint64) string {
+	return fmt.Sprintf("%s%s%d", name, versionSeparator, generation)
+}
+
+// bundleNames returns the sorted names of the bundles of listed secrets. Names which cannot be
+// represented in a path are ignored.
+func (kwfs KeywhizFs) bundleNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range kwfs.dirSecretList() {
+		name := s.Bundle
+		if name == "" || seen[name] || strings.Contains(name, "/") || strings.Contains(name, versionSeparator) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bundleMembers returns the names of the listed secrets in the bundle name.
+func (kwfs KeywhizFs) bundleMembers(name string) []string {
+	var members []string
+	for _, s := range kwfs.dirSecretList() {
+		if s.Bundle == name {
+			members = append(members, s.Name)
+		}
+	}
+	return members
+}
+
+// currentGeneration returns the generation of the current snapshot of the bundle name,
+// refreshing it with ctx if it is no longer fresh.
+func (kwfs KeywhizFs) currentGeneration(ctx gocontext.Context, name string) (uint64, bool) {
+	members := kwfs.bundleMembers(name)
+	if len(members) == 0 {
+		return 0, false
+	}
+	return kwfs.Cache.currentGeneration(ctx, name, members)
+}
+
+// withBundleGeneration calls use with a held generation of the bundle name, which must still be
+// listed, without copying it. use must not retain the snapshot.
+func (kwfs KeywhizFs) withBundleGeneration(name string, generation uint64, use func(*Bundle)) bool {
+	if len(kwfs.bundleMembers(name)) == 0 {
+		return false
+	}
+	return kwfs.Cache.withBundleGeneration(name, generation, use)
+}
+
+// bundleSecret returns the member of b with the file name file.
+func (kwfs KeywhizFs) bundleSecret(b *Bundle, file string) (*Secret, bool) {
+	for i := range b.Secrets {
+		if kwfs.fileName(b.Secrets[i].Name) == file {
+			return &b.Secrets[i], true
+		}
+	}
+	return nil, false
+}
+
+// bundleAttr constructs a fuse.Attr for path under the bundles directory, refreshing the current
+// generation of a bundle with ctx. Returns nil if there is nothing at path.
+func (kwfs KeywhizFs) bundleAttr(ctx gocontext.Context, path string) *fuse.Attr {
+	if path == bundlesDir {
+		if len(kwfs.bundleNames()) == 0 {
+			return nil
+		}
+		return kwfs.directoryAttr(0, 0755)
+	}
+	name, generation, file, ok := splitBundlePath(path)
+	if !ok {
+		return nil
+	}
+	if generation == 0 {
+		current, ok := kwfs.currentGeneration(ctx, name)
+		if !ok {
+			return nil
+		}
+		return kwfs.linkAttr(bundleLink(name, current))
+	}
+	var attr *fuse.Attr
+	held := kwfs.withBundleGeneration(name, generation, func(b *Bundle) {
+		if file == "" {
+			attr = kwfs.directoryAttr(0, 0755)
+		} else if secret, ok := kwfs.bundleSecret(b, file); ok {
+			attr = kwfs.secretAttr(secret)
+		}
+	})
+	if !held {
+		return nil
+	}
+	return attr
+}
+
+// openBundleFile opens a member file of a bundle generation, auditing the access under requestID.
+func (kwfs KeywhizFs) openBundleFile(ctx gocontext.Context, path string, context *fuse.Context, requestID string) (nodefs.File, fuse.Status) {
+	name, generation, file, ok := splitBundlePath(path)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if file == "" {
+		if kwfs.bundleAttr(ctx, path) == nil {
+			return nil, fuse.ENOENT
+		}
+		return nil, EISDIR
+	}
+	var opened nodefs.File
+	var secretName string
+	status := fuse.ENOENT
+	kwfs.withBundleGeneration(name, generation, func(b *Bundle) {
+		secret, ok := kwfs.bundleSecret(b, file)
+		switch {
+		case !ok:
+		case !kwfs.permitted(path, kwfs.secretAttr(secret).Uid, context):
+			status = fuse.EACCES
+		default:
+			opened = newFormattedSecretFile(secret, kwfs.traceOpen(path, context))
+			secretName, status = secret.Name, fuse.OK
+		}
+	})
+	if status != fuse.OK {
+		return nil, status
+	}
+	label := fmt.Sprintf("%s (bundle %s)", secretName, bundleLink(name, generation))
+	kwfs.Infof("Access to %s by uid %d, with gid %d, request_id=%v", label, context.Uid, context.Gid, requestID)
+	kwfs.audit(secretName, OriginCache, context, requestID)
+	return opened, fuse.OK
+}
+
+// bundleListing produces the entries of the bundles directory, or of a bundle generation.
+func (kwfs KeywhizFs) bundleListing(path string) []fuse.DirEntry {
+	var entries []fuse.DirEntry
+	if path == bundlesDir {
+		for _, name := range kwfs.bundleNames() {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFLNK})
+		}
+		return entries
+	}
+	name, generation, file, ok := splitBundlePath(path)
+	if !ok || generation == 0 || file != "" {
+		return nil
+	}
+	kwfs.withBundleGeneration(name, generation, func(b *Bundle) {
+		for _, s := range b.Secrets {
+			entries = append(entries, fuse.DirEntry{Name: kwfs.fileName(s.Name), Mode: fuse.S_IFREG})
+		}
+	})
+	return entries
+}
+
+// readBundleLink returns the target of the link of a bundle, refreshing its current generation
+// with ctx.
+func (kwfs KeywhizFs) readBundleLink(ctx gocontext.Context, path string) (string, bool) {
+	name, generation, _, ok := splitBundlePath(path)
+	if !ok || generation != 0 {
+		return "", false
+	}
+	current, ok := kwfs.currentGeneration(ctx, name)
+	if !ok {
+		return "", false
+	}
+	return bundleLink(name, current), true
+}
@@ -15,6 +15,11 @@
 package keywhizfs
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/square/keywhizfs/log"
@@ -26,57 +31,546 @@ type SecretBackend interface {
 	SecretList() (secretList []Secret, ok bool)
 }
 
-// Timeouts contains configuration for timeouts:
-// timeout_backend_deadline: optimistic timeout to wait for cache
-// timeout_max_wait: timeout for client to get data from server
+// SecretBackendContext is a SecretBackend whose requests can be cancelled. Cache prefers it when a
+// backend implements it, so that abandoned lookups abort their backend requests.
+type SecretBackendContext interface {
+	SecretCtx(ctx context.Context, name string) (secret *Secret, ok bool)
+	SecretListCtx(ctx context.Context) (secretList []Secret, ok bool)
+}
+
+// PartialSecretLister is implemented by backends which can tell when a listing is incomplete, such
+// as when some entries could not be decoded. Cache merges a partial listing with its cached entries
+// instead of replacing them.
+type PartialSecretLister interface {
+	SecretListPartialCtx(ctx context.Context) (secretList []Secret, partial bool, ok bool)
+}
+
+// StreamingSecretLister is implemented by backends which can deliver a listing entry by entry, with
+// partial and ok as for PartialSecretLister. Cache prefers it, so that a listing still in progress
+// at BackendDeadline gives the entries received so far, completed with cached entries.
+type StreamingSecretLister interface {
+	SecretListStreamCtx(ctx context.Context, emit func(Secret)) (partial bool, ok bool)
+}
+
+// ConditionalSecretFetcher is implemented by backends which can skip sending a secret unchanged
+// since a previous response, identified by the ETag stored in Secret.ETag. Cache then only
+// refreshes the timestamp of its entry.
+type ConditionalSecretFetcher interface {
+	SecretIfNoneMatchCtx(ctx context.Context, name, etag string) (secret *Secret, notModified bool, ok bool)
+}
+
+// ForbiddenSecretFetcher is implemented by backends which can tell a secret the client is not
+// authorized to read from a missing one. Requests are conditional as for ConditionalSecretFetcher,
+// and forbidden reports that the backend refused the secret. Cache then remembers the refusal, so
+// that it can be reported by Forbidden.
+type ForbiddenSecretFetcher interface {
+	SecretOrForbiddenCtx(ctx context.Context, name, etag string) (secret *Secret, notModified, forbidden, ok bool)
+}
+
+// StatusSecretFetcher is implemented by backends which answer with HTTP statuses, such as Client.
+// Requests are conditional as for ConditionalSecretFetcher, and status is that of the final
+// response, or zero if none was received. Cache then only remembers a secret as not found when the
+// backend answered 404 Not Found, rather than after any failure.
+type StatusSecretFetcher interface {
+	SecretWithStatusCtx(ctx context.Context, name, etag string) (secret *Secret, notModified bool, status int, ok bool)
+}
+
+// FallbackSecretFetcher is implemented by backends holding last-resort copies of secrets, such as
+// those wrapped by Fallback. Cache asks for a copy only when a lookup found nothing cached and the
+// backend failed.
+type FallbackSecretFetcher interface {
+	FallbackSecretCtx(ctx context.Context, name string) (secret *Secret, ok bool)
+}
+
+// BatchSecretFetcher is implemented by backends which can fetch several secrets in one request.
+// Cache.Secrets then requests every name without a fresh cache entry at once. The secrets returned
+// are keyed by name, and names missing from them were not found.
+type BatchSecretFetcher interface {
+	SecretsBatch(ctx context.Context, names []string) (secrets map[string]*Secret, ok bool)
+}
+
+// RangeSecretFetcher is implemented by backends which can read part of the content of a secret,
+// such as with HTTP Range requests. KeywhizFs then streams secrets of at least its StreamThreshold
+// from the backend as they are read, instead of holding their content whole. ok is false if the
+// request failed or ranges are not supported for the secret. Data is only short at the end of the
+// content.
+//
+// A range is only read from the version of the content tagged etag, unless it is empty, and tag
+// is the version read from. Backends without versions fail every range with an etag. status is the
+// HTTP status of the response, zero without one, or statusUnknown.
+type RangeSecretFetcher interface {
+	SecretRangeCtx(ctx context.Context, name string, off int64, size int, etag string) (data []byte, tag string, status int, ok bool)
+}
+
+// statusUnknown is the status of a failed request to a backend which is not a
+// StatusSecretFetcher, and so cannot tell a missing secret from an error.
+const statusUnknown = -1
+
+// withStatus returns backend as a StatusSecretFetcher, adapting it if necessary to report a
+// refused secret as 403 Forbidden, and other failures with statusUnknown.
+func withStatus(backend SecretBackend) StatusSecretFetcher {
+	if b, ok := backend.(StatusSecretFetcher); ok {
+		return b
+	}
+	return statuslessFetcher{withForbidden(backend)}
+}
+
+// statuslessFetcher adapts a backend which does not report statuses.
+type statuslessFetcher struct {
+	ForbiddenSecretFetcher
+}
+
+func (b statuslessFetcher) SecretWithStatusCtx(ctx context.Context, name, etag string) (*Secret, bool, int, bool) {
+	secret, notModified, forbidden, ok := b.SecretOrForbiddenCtx(ctx, name, etag)
+	switch {
+	case ok && notModified:
+		return secret, true, http.StatusNotModified, true
+	case ok:
+		return secret, false, http.StatusOK, true
+	case forbidden:
+		return nil, false, http.StatusForbidden, false
+	default:
+		return nil, false, statusUnknown, false
+	}
+}
+
+// withForbidden returns backend as a ForbiddenSecretFetcher, adapting it to never report a secret
+// forbidden if necessary.
+func withForbidden(backend SecretBackend) ForbiddenSecretFetcher {
+	if b, ok := backend.(ForbiddenSecretFetcher); ok {
+		return b
+	}
+	return permissiveFetcher{withConditional(backend)}
+}
+
+// permissiveFetcher adapts a backend which does not distinguish forbidden secrets.
+type permissiveFetcher struct {
+	ConditionalSecretFetcher
+}
+
+func (b permissiveFetcher) SecretOrForbiddenCtx(ctx context.Context, name, etag string) (*Secret, bool, bool, bool) {
+	secret, notModified, ok := b.SecretIfNoneMatchCtx(ctx, name, etag)
+	return secret, notModified, false, ok
+}
+
+// withConditional returns backend as a ConditionalSecretFetcher, adapting it to always send the
+// secret if necessary.
+func withConditional(backend SecretBackend) ConditionalSecretFetcher {
+	if b, ok := backend.(ConditionalSecretFetcher); ok {
+		return b
+	}
+	return unconditionalFetcher{withContext(backend)}
+}
+
+// unconditionalFetcher adapts a backend which does not support conditional requests.
+type unconditionalFetcher struct {
+	SecretBackendContext
+}
+
+func (b unconditionalFetcher) SecretIfNoneMatchCtx(ctx context.Context, name, etag string) (*Secret, bool, bool) {
+	secret, ok := b.SecretCtx(ctx, name)
+	return secret, false, ok
+}
+
+// withPartial returns backend as a PartialSecretLister, adapting it to report every listing as
+// complete if necessary.
+func withPartial(backend SecretBackend) PartialSecretLister {
+	if b, ok := backend.(PartialSecretLister); ok {
+		return b
+	}
+	return completeLister{withContext(backend)}
+}
+
+// completeLister adapts a backend whose listings are always complete.
+type completeLister struct {
+	SecretBackendContext
+}
+
+func (b completeLister) SecretListPartialCtx(ctx context.Context) ([]Secret, bool, bool) {
+	secrets, ok := b.SecretListCtx(ctx)
+	return secrets, false, ok
+}
+
+// withStreaming returns backend as a StreamingSecretLister, adapting it to emit a whole listing at
+// once if necessary.
+func withStreaming(backend SecretBackend) StreamingSecretLister {
+	if b, ok := backend.(StreamingSecretLister); ok {
+		return b
+	}
+	return batchLister{withPartial(backend)}
+}
+
+// batchLister adapts a backend which delivers a listing only once it is complete.
+type batchLister struct {
+	PartialSecretLister
+}
+
+func (b batchLister) SecretListStreamCtx(ctx context.Context, emit func(Secret)) (bool, bool) {
+	secrets, partial, ok := b.SecretListPartialCtx(ctx)
+	if ok {
+		for _, s := range secrets {
+			emit(s)
+		}
+	}
+	return partial, ok
+}
+
+// withFallback returns backend as a FallbackSecretFetcher, adapting it to have no copies if
+// necessary.
+func withFallback(backend SecretBackend) FallbackSecretFetcher {
+	if b, ok := backend.(FallbackSecretFetcher); ok {
+		return b
+	}
+	return noFallback{}
+}
+
+// noFallback adapts a backend without last-resort copies of secrets.
+type noFallback struct{}
+
+func (noFallback) FallbackSecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	return nil, false
+}
+
+// withRanges returns backend as a RangeSecretFetcher, adapting it to never support ranges if
+// necessary.
+func withRanges(backend SecretBackend) RangeSecretFetcher {
+	if b, ok := backend.(RangeSecretFetcher); ok {
+		return b
+	}
+	return noRanges{}
+}
+
+// noRanges adapts a backend which only reads secrets whole.
+type noRanges struct{}
+
+func (noRanges) SecretRangeCtx(ctx context.Context, name string, off int64, size int, etag string) ([]byte, string, int, bool) {
+	return nil, "", statusUnknown, false
+}
+
+// withContext returns backend as a SecretBackendContext, adapting it if necessary.
+func withContext(backend SecretBackend) SecretBackendContext {
+	if b, ok := backend.(SecretBackendContext); ok {
+		return b
+	}
+	return contextlessBackend{backend}
+}
+
+// contextlessBackend adapts a SecretBackend which does not support cancellation. Requests run to
+// completion regardless of their context.
+type contextlessBackend struct {
+	SecretBackend
+}
+
+func (b contextlessBackend) SecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	return b.Secret(name)
+}
+
+func (b contextlessBackend) SecretListCtx(ctx context.Context) ([]Secret, bool) {
+	return b.SecretList()
+}
+
+// Timeouts contains configuration for timeouts. A lookup first consults the cache, then waits up to
+// BackendDeadline for the backend before using a cached entry, and gives up on the backend
+// altogether after BackendTimeout.
 type Timeouts struct {
 	// FUSE may make many lookups in quick succession. If cached data is recent within the threshold,
-	// a backend request is not attempted.
+	// a backend request is not attempted. A secret's own TTL takes precedence when set. Zero always
+	// consults the backend, and FreshForever never does once a secret is cached.
 	Fresh time.Duration
-	// BackendDeadline is distinct from the backend timeout. It is an optimistic timeout to wait
-	// until resorting to cached data.
+	// BackendDeadline is an optimistic timeout to wait for the backend until resorting to cached
+	// data. It should not exceed BackendTimeout.
 	BackendDeadline time.Duration
-	MaxWait         time.Duration
+	// BackendTimeout is how long a lookup waits for the backend at most. Lookups with nothing
+	// cached fail once it passes.
+	BackendTimeout time.Duration
+	// NegativeTTL is how long a not-found answer from the backend is remembered. Lookups of the
+	// same name within the threshold fail without a backend request. Zero disables negative
+	// caching.
+	NegativeTTL time.Duration
+	// StaleWhileRevalidate serves a cached entry which is no longer fresh immediately, refreshing
+	// it from the backend in the background, instead of waiting up to BackendDeadline.
+	StaleWhileRevalidate bool
+}
+
+// FreshForever is a Timeouts.Fresh threshold under which cached secrets are always fresh, so they
+// are only fetched again by a refresh.
+const FreshForever time.Duration = -1
+
+// Validate reports timeouts which would make lookups misbehave: negative durations other than
+// FreshForever, a zero BackendTimeout, or a BackendDeadline longer than BackendTimeout.
+func (t Timeouts) Validate() error {
+	switch {
+	case t.Fresh < 0 && t.Fresh != FreshForever, t.BackendDeadline < 0, t.NegativeTTL < 0:
+		return fmt.Errorf("timeouts must not be negative: %+v", t)
+	case t.BackendTimeout <= 0:
+		return fmt.Errorf("backend timeout must be positive, got %v", t.BackendTimeout)
+	case t.BackendDeadline > t.BackendTimeout:
+		return fmt.Errorf("backend deadline %v exceeds backend timeout %v", t.BackendDeadline, t.BackendTimeout)
+	}
+	return nil
+}
+
+// Origin identifies where the result of a lookup came from.
+type Origin int
+
+const (
+	OriginCache Origin = iota
+	OriginBackend
+	OriginFallback // a last-resort copy, see FallbackSecretFetcher
+)
+
+func (o Origin) String() string {
+	switch o {
+	case OriginCache:
+		return "cache"
+	case OriginBackend:
+		return "backend"
+	case OriginFallback:
+		return "fallback"
+	default:
+		return "unknown"
+	}
 }
 
 // Cache contains necessary state to return secrets, using previously cached content or retrieving
 // from a server if necessary.
 type Cache struct {
+	stats cacheCounters // first, so 64-bit atomic operations are aligned
 	*log.Logger
-	secretMap *SecretMap
-	backend   SecretBackend
-	timeouts  Timeouts
+	secretMap  *SecretMap
+	backend    SecretBackendContext
+	lister     StreamingSecretLister
+	fetcher    StatusSecretFetcher
+	fallback   FallbackSecretFetcher
+	batch      BatchSecretFetcher // nil unless the backend fetches several secrets at once
+	ranges     RangeSecretFetcher
+	timeouts   atomic.Value // Timeouts, replaced whole by SetTimeouts
+	maxEntries int
+	notFound   notFoundSet
+	forbidden  notFoundSet // names the backend refused, with the same bookkeeping as notFound
+	stale      staleSet
+	clock      func() time.Time
+	flight     flightGroup
+	breaker    breaker
+	limiter    tokenBucket
+	slots      semaphore    // bounds concurrent backend requests
+	onChange   atomic.Value // func(name string)
+	onMembers  atomic.Value // func(), called when secrets are added or removed
+	filter     atomic.Value // *NameFilter
+	warmUntil  atomic.Value // time.Time, before which cached entries are fresh
+	clockSkew  atomic.Value // time.Duration tolerated between the clock and expiry times
+	aliases    atomic.Value // map[string]string of alias names to their target secrets
+	refreshMax atomic.Value // time.Duration bounding the refresh interval while backing off
+	refreshIn  atomic.Value // time.Duration until the next round of StartRefresh
+	persistTo  atomic.Value // string naming the file written by Close
+	validators validators
+	conflicts  conflictPolicies
+	bundles    bundleSet
+	// lockContent is non-zero when cached content is locked against swapping, and lockErrors
+	// counts failures to lock it.
+	lockContent, lockErrors int32
+	// caseInsensitive is non-zero when names are looked up regardless of case.
+	caseInsensitive int32
+	// closed is non-zero once Close was called, and done is closed with it, stopping background
+	// goroutines.
+	closed int32
+	done   chan struct{}
+	// subscribers receive the events of Subscribe.
+	subscribers subscribers
 }
 
 // NewCache initializes a Cache.
 func NewCache(backend SecretBackend, timeouts Timeouts, logConfig log.Config) *Cache {
+	return NewCacheWithLimit(backend, timeouts, logConfig, 0)
+}
+
+// NewCacheWithLimit initializes a Cache holding at most maxEntries secrets. When the limit is
+// exceeded, the least recently used secret is evicted. A maxEntries of zero means no limit.
+func NewCacheWithLimit(backend SecretBackend, timeouts Timeouts, logConfig log.Config, maxEntries int) *Cache {
+	return newCache(backend, timeouts, logConfig, maxEntries, time.Now)
+}
+
+// NewCacheWithClock initializes a Cache which reads the current time from clock when stamping and
+// judging the freshness of entries. This is most useful for testing.
+func NewCacheWithClock(backend SecretBackend, timeouts Timeouts, logConfig log.Config, clock func() time.Time) *Cache {
+	return newCache(backend, timeouts, logConfig, 0, clock)
+}
+
+func newCache(backend SecretBackend, timeouts Timeouts, logConfig log.Config, maxEntries int, clock func() time.Time) *Cache {
 	logger := log.New("kwfs_cache", logConfig)
-	return &Cache{logger, NewSecretMap(), backend, timeouts}
+	c := &Cache{Logger: logger, backend: withContext(backend), lister: withStreaming(backend), fetcher: withStatus(backend), fallback: withFallback(backend), ranges: withRanges(backend), maxEntries: maxEntries, clock: clock}
+	if err := timeouts.Validate(); err != nil {
+		c.Warnf("Invalid timeouts: %v", err)
+	}
+	c.timeouts.Store(timeouts)
+	c.batch, _ = backend.(BatchSecretFetcher)
+	c.notFound.m = make(map[string]time.Time)
+	c.forbidden.m = make(map[string]time.Time)
+	c.stale.m = make(map[string]time.Time)
+	c.bundles.m = make(map[string]*bundleState)
+	c.done = make(chan struct{})
+	c.secretMap = c.newSecretMap()
+	c.SetValidator(TypePEM, ValidatePEM)
+	c.SetValidator(TypeJSON, ValidateJSON)
+	return c
+}
+
+// Timeouts returns the timeouts currently in effect.
+func (c *Cache) Timeouts() Timeouts {
+	return c.timeouts.Load().(Timeouts)
+}
+
+// SetTimeouts replaces the timeouts of a running cache. Lookups already in progress keep the
+// timeouts they started with; each lookup sees either the old or the new timeouts, never a mix.
+func (c *Cache) SetTimeouts(timeouts Timeouts) {
+	if err := timeouts.Validate(); err != nil {
+		c.Warnf("Invalid timeouts: %v", err)
+	}
+	c.timeouts.Store(timeouts)
+	c.Infof("Timeouts updated: %+v", timeouts)
+}
+
+// SetOnChange registers fn to be called with the name of a cached secret whenever a backend
+// request replaces its content or version. fn runs in its own goroutine.
+func (c *Cache) SetOnChange(fn func(name string)) {
+	c.onChange.Store(fn)
+}
+
+// SetOnMembershipChange registers fn to be called whenever a backend request finds a secret added
+// to or removed from the cache. fn is called before the request returns, so it must not block.
+func (c *Cache) SetOnMembershipChange(fn func()) {
+	c.onMembers.Store(fn)
 }
 
-// Clear empties the internal cache.
+// SetLockContent sets whether the content of cached secrets is kept in memory locked against
+// swapping, on Linux. It applies to secrets cached afterwards, so it should be set before the cache
+// is used. Memory which cannot be locked is logged and left unlocked.
+func (c *Cache) SetLockContent(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&c.lockContent, flag)
+	c.secretMap.setLockContent(enabled, c.lockError)
+}
+
+// lockError logs a failure to lock content. Only the first failure is logged as an error, since
+// the cause is usually a resource limit which applies to every secret.
+func (c *Cache) lockError(err error) {
+	if atomic.AddInt32(&c.lockErrors, 1) == 1 {
+		c.Errorf("%v", err)
+		return
+	}
+	c.Debugf("%v", err)
+}
+
+// changed reports a change of content or version to the registered SetOnChange function, if any,
+// and to subscribers.
+func (c *Cache) changed(name string) {
+	c.Debugf("Cached content changed: %v", name)
+	c.publish(SecretUpdated, name)
+	if fn, ok := c.onChange.Load().(func(string)); ok && fn != nil {
+		go fn(name)
+	}
+}
+
+// Clear empties the internal cache, zeroing the content of cached secrets.
 func (c *Cache) Clear() {
 	c.Infof("Cache cleared")
-	c.secretMap = NewSecretMap()
+	c.secretMap.Overwrite(c.newSecretMap())
+	c.notFound.clear()
+	c.forbidden.clear()
+	c.stale.clear()
+	c.bundles.clear()
 }
 
-// Secret retrieves a Secret by name from cache or a server.
+// Secret retrieves a Secret by name from cache or a server. See SecretCtx.
+//
+// The returned secret is a copy which the caller owns, as are those of SecretCtx and
+// SecretWithOrigin, so modifying it leaves the cache unaffected.
+func (c *Cache) Secret(name string) (*Secret, bool) {
+	return c.SecretCtx(context.Background(), name)
+}
+
+// SecretCtx retrieves a Secret by name from cache or a server.
 //
 // Cache logic:
-//  * If cache hit and very recent: return cache entry
+//  * If excluded by SetNameFilter: pretend file doesn't exist
+//  * If backend recently reported the secret not found or forbidden: pretend file doesn't exist
+//  * If cache hit and very recent, or the cache is warming up: return cache entry
+//  * If cache hit and stale_while_revalidate: return cache entry, background update cache
 //  * Ask backend w/ timeout
 //  * If backend returns fast: update cache, return
 //  * If timeout_backend_deadline AND cache hit: return cache entry, background update cache when
 //    backend returns
-//  * If timeout_max_wait: log error and pretend file doesn't exist
-func (c *Cache) Secret(name string) (*Secret, bool) {
-	failureDeadline := time.After(c.timeouts.MaxWait)
+//  * If timeout_backend: log error and pretend file doesn't exist
+//  * If backend fails or times out with no cache hit: return a FallbackSecretFetcher copy, if any
+//
+// Expired secrets are treated as not found, whether cached or returned by the backend, though an
+// expired cache entry still causes a backend request in case a newer version exists.
+//
+// When the backend reports a secret missing and nothing is cached, the answer is remembered for
+// Timeouts.NegativeTTL. A secret the backend refuses as forbidden is removed from the cache, and
+// the refusal is remembered likewise.
+//
+// An alias set by SetAliases is first resolved to its target. If case-insensitive lookups are
+// enabled, name is then resolved as by SetCaseInsensitive.
+//
+// If ctx is cancelled, the lookup returns any cached entry and the backend request is aborted. A
+// backend request shared by concurrent lookups of the same name runs under the context of the
+// lookup which started it.
+func (c *Cache) SecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	secret, _, ok := c.SecretWithOrigin(ctx, name)
+	return secret, ok
+}
+
+// SecretWithOrigin retrieves a Secret by name like SecretCtx, also reporting whether the answer
+// came from the cache or the backend.
+func (c *Cache) SecretWithOrigin(ctx context.Context, name string) (*Secret, Origin, bool) {
+	secret, origin, ok := c.secretWithOrigin(ctx, name)
+	if secret == nil {
+		return nil, origin, ok
+	}
+	var copied *Secret
+	if !c.withContent(secret, func(s *Secret) { copied = s.Clone() }) {
+		return nil, origin, false
+	}
+	return copied, origin, ok
+}
+
+// secretWithOrigin retrieves a Secret like SecretWithOrigin, without copying it for the caller.
+// Internal callers use it to read secrets they do not modify or retain. A secret served from the
+// cache has no content, which is read with withContent.
+func (c *Cache) secretWithOrigin(ctx context.Context, name string) (*Secret, Origin, bool) {
+	if c.isClosed() {
+		c.Debugf("Cache closed, not looking up %v", name)
+		return nil, OriginCache, false
+	}
+	name = c.resolveAlias(name)
+	timeouts := c.Timeouts()
+	if c.notFound.contains(name, c.clock(), timeouts.NegativeTTL) || c.forbidden.contains(name, c.clock(), timeouts.NegativeTTL) {
+		c.Debugf("Cache negative hit: %v", name)
+		count(&c.stats.hits)
+		return nil, OriginCache, false
+	}
+	// The filter applies before resolving case, so excluded names never cause a listing, and after.
+	if !c.Permits(name) {
+		c.Debugf("Secret excluded by name filter: %v", name)
+		return nil, OriginCache, false
+	}
+	name = c.canonicalName(ctx, name)
+	if !c.Permits(name) {
+		c.Debugf("Secret excluded by name filter: %v", name)
+		return nil, OriginCache, false
+	}
+
+	failureDeadline := time.After(timeouts.BackendTimeout)
 	var backendDeadline <-chan time.Time // inactive, until backend request starts
 
 	var cachedSecret *Secret
-	resultFromCache := func() (*Secret, bool) {
+	resultFromCache := func() (*Secret, Origin, bool) {
 		success := cachedSecret != nil
-		return cachedSecret, success
+		return cachedSecret, OriginCache, success
 	}
 
 	cacheDone := c.cacheSecret(name)
@@ -87,66 +581,194 @@ func (c *Cache) Secret(name string) (*Secret, bool) {
 		case s := <-backendDone:
 			backendDone = nil
 			if s != nil { // Always return successful value from backend
-				return s, true
+				if c.expired(*s, c.clock()) {
+					c.Debugf("Backend secret expired: %v", name)
+					return nil, OriginBackend, false
+				}
+				return s, OriginBackend, true
 			}
 
 			// Backend failed and cache lookup already finished
 			if cacheDone == nil {
+				if c.forbidden.has(name) {
+					return nil, OriginBackend, false
+				}
+				if cachedSecret == nil {
+					return c.fallbackSecret(ctx, name)
+				}
+				count(&c.stats.hits)
+				c.servedStale(name)
 				return resultFromCache()
 			}
 		case s := <-cacheDone:
 			cacheDone = nil
+			if s != nil && c.expired(s.Secret, c.clock()) {
+				c.Debugf("Cache entry expired: %v", name)
+				s = nil
+			}
 			if s != nil {
 				cachedSecret = &s.Secret
 
-				// If cache entry very recent, return cache result
-				if time.Since(s.Time) < c.timeouts.Fresh {
+				// If cache entry very recent, or the cache is warming up, return cache result
+				if fresh(*s, c.clock(), timeouts) || c.warming() {
+					count(&c.stats.hits)
 					return resultFromCache()
 				}
+
+				// Serve stale entry and revalidate it without blocking the caller
+				if timeouts.StaleWhileRevalidate {
+					if c.revalidate(name) {
+						c.Debugf("Serving stale entry while revalidating: %v", name)
+					}
+					count(&c.stats.hits)
+					return resultFromCache()
+				}
+			} else {
+				count(&c.stats.misses)
 			}
 
 			// Start backend request and wait until optimistic deadline
-			backendDone = c.backendSecret(name)
-			backendDeadline = time.After(c.timeouts.BackendDeadline)
+			backendDone = c.backendSecret(ctx, name)
+			backendDeadline = time.After(timeouts.BackendDeadline)
 		case <-backendDeadline:
 			if cachedSecret != nil {
-				return cachedSecret, true
+				count(&c.stats.backendTimeouts)
+				count(&c.stats.hits)
+				c.servedStale(name)
+				return cachedSecret, OriginCache, true
 			}
+		case <-ctx.Done():
+			c.Debugf("Lookup cancelled: %v (%v)", name, ctx.Err())
+			return resultFromCache()
 		case <-failureDeadline:
+			count(&c.stats.backendTimeouts)
 			c.Errorf("Cache and backend timeout: %v", name)
-			return nil, false
+			return c.fallbackSecret(ctx, name)
+		}
+	}
+}
+
+// fallbackSecret looks up the last-resort copy of a secret which neither the cache nor the backend
+// could provide. Copies are not cached.
+func (c *Cache) fallbackSecret(ctx context.Context, name string) (*Secret, Origin, bool) {
+	secret, ok := c.fallback.FallbackSecretCtx(ctx, name)
+	if !ok {
+		return nil, OriginBackend, false
+	}
+	if c.expired(*secret, c.clock()) {
+		c.Debugf("Fallback secret expired: %v", name)
+		return nil, OriginFallback, false
+	}
+	c.Warnf("Serving fallback copy of secret: %v", name)
+	return secret, OriginFallback, true
+}
+
+// withContent calls use with s and its content. A secret served from the cache has no content of
+// its own, so use is called with the cached entry, under the lock of its shard, without copying its
+// content. use must not modify or retain the content. Returns false, without calling use, if the
+// secret has since left the cache.
+func (c *Cache) withContent(s *Secret, use func(*Secret)) bool {
+	if len(s.Content) > 0 || s.ContentLength() == 0 {
+		use(s)
+		return true
+	}
+	found := false
+	c.secretMap.view(s.Name, func(e SecretTime) {
+		if len(e.Secret.Content) > 0 {
+			found = true
+			use(&e.Secret)
 		}
+	})
+	if !found {
+		c.Debugf("Secret left the cache while read: %v", s.Name)
 	}
+	return found
 }
 
-// SecretList returns a listing of Secrets from cache or a server.
+// SecretList returns a listing of Secrets from cache or a server. See SecretListCtx.
+func (c *Cache) SecretList() []Secret {
+	return c.SecretListCtx(context.Background())
+}
+
+// SecretListCtx returns a listing of Secrets from cache or a server.
 //
 // Cache logic:
 //  * Ask backend w/ timeout
 //  * If backend returns fast: update cache, return
-//  * If timeout_backend_deadline: return cache entries, background update cache when
-//    backend returns
-//  * If timeout_max_wait: log error and pretend no files
-func (c *Cache) SecretList() []Secret {
-	failureDeadline := time.After(c.timeouts.MaxWait)
+//  * If backend fails: return cache entries
+//  * If timeout_backend_deadline: return cache entries, with any entries the backend sent
+//    so far in their place, background update cache when backend returns
+//  * If timeout_backend: log error and pretend no files
+//
+// Expired secrets are excluded from the listing. If ctx is cancelled, the listing returns any
+// cached entries and the backend request is aborted.
+func (c *Cache) SecretListCtx(ctx context.Context) []Secret {
+	return c.secretList(ctx, false)
+}
+
+// SecretListFiltered returns a listing of Secrets like SecretList, including expired secrets if
+// includeExpired is set, such as for tooling which cleans them up.
+func (c *Cache) SecretListFiltered(includeExpired bool) []Secret {
+	return c.secretList(context.Background(), includeExpired)
+}
+
+// secretList implements SecretListCtx, keeping expired secrets if includeExpired is set.
+func (c *Cache) secretList(ctx context.Context, includeExpired bool) []Secret {
+	if c.isClosed() {
+		c.Debugf("Cache closed, not listing secrets")
+		return make([]Secret, 0)
+	}
+	keep := c.unexpired
+	if includeExpired {
+		keep = func(secrets []Secret) []Secret { return secrets }
+	}
+	timeouts := c.Timeouts()
+	failureDeadline := time.After(timeouts.BackendTimeout)
 	// Optimistically wait for a backend response before using a cached response.
-	backendDeadline := time.After(c.timeouts.BackendDeadline)
+	backendDeadline := time.After(timeouts.BackendDeadline)
 
 	cacheDone := c.cacheSecretList()
-	backendDone := c.backendSecretList()
+	progress := &listProgress{}
+	backendDone := c.backendSecretList(ctx, progress)
 
 	var cachedSecrets []Secret
 	for {
 		select {
-		case secrets := <-backendDone:
-			return secrets
+		case secrets, ok := <-backendDone:
+			if ok {
+				return keep(secrets)
+			}
+
+			// Backend failed and cache lookup already finished
+			backendDone = nil
+			if cacheDone == nil {
+				count(&c.stats.hits)
+				return keep(cachedSecrets)
+			}
 		case cachedSecrets = <-cacheDone:
 			cacheDone = nil
+			if backendDone == nil {
+				count(&c.stats.hits)
+				return keep(cachedSecrets)
+			}
 		case <-backendDeadline:
 			if cachedSecrets != nil {
-				return cachedSecrets
+				count(&c.stats.backendTimeouts)
+				count(&c.stats.hits)
+				if received := progress.values(); len(received) > 0 {
+					c.Debugf("Listing incomplete at deadline, merging %d received secrets with cache", len(received))
+					return keep(completeListing(received, cachedSecrets))
+				}
+				return keep(cachedSecrets)
+			}
+		case <-ctx.Done():
+			c.Debugf("Listing cancelled (%v)", ctx.Err())
+			if cachedSecrets == nil {
+				return make([]Secret, 0)
 			}
+			return keep(cachedSecrets)
 		case <-failureDeadline:
+			count(&c.stats.backendTimeouts)
 			c.Errorf("Cache and backend timeout: secretList()")
 			return make([]Secret, 0)
 		}
@@ -155,17 +777,81 @@ func (c *Cache) SecretList() []Secret {
 
 // Add inserts a secret into the cache. If a secret is already in the cache with a matching
 // identifier, it will be overridden  This method is most useful for testing since lookups
-// may add data to the cache.
+// may add data to the cache. The cache takes ownership of the content, which is zeroed once the
+// secret leaves the cache.
 func (c *Cache) Add(s Secret) {
+	if c.isClosed() {
+		s.Content.wipe()
+		return
+	}
+	c.notFound.remove(s.Name)
+	c.forbidden.remove(s.Name)
 	c.secretMap.Put(s.Name, s)
 }
 
+// Delete removes a single secret from the cache, leaving other entries available as fallback. The
+// content of the deleted secret is zeroed. Returns whether the secret was cached.
+func (c *Cache) Delete(name string) bool {
+	c.stale.remove(name)
+	return c.secretMap.Delete(name)
+}
+
+// Forbidden returns whether the backend refused its last request for a secret because the client
+// is not authorized to read it. The refusal is forgotten once the backend answers otherwise, the
+// secret is added, or the cache is cleared.
+func (c *Cache) Forbidden(name string) bool {
+	return c.forbidden.has(c.resolveAlias(name))
+}
+
+// Keys returns the sorted names of all cached secrets. No backend request is made.
+func (c *Cache) Keys() []string {
+	return c.secretMap.Keys()
+}
+
+// CacheEntry describes a cached secret without its content.
+type CacheEntry struct {
+	Name      string
+	Owner     string
+	Group     string
+	Mode      string
+	FetchedAt time.Time
+	// State is "fresh" if the entry is used without consulting the backend, "expired" if the
+	// secret has expired, and "stale" otherwise.
+	State string
+}
+
+// Entries describes each cached secret, most recently used first. No backend request is made.
+func (c *Cache) Entries() []CacheEntry {
+	timeouts := c.Timeouts()
+	now := c.clock()
+	values := c.secretMap.Values()
+	entries := make([]CacheEntry, len(values))
+	for i, v := range values {
+		state := "stale"
+		switch {
+		case c.expired(v.Secret, now):
+			state = "expired"
+		case fresh(v, now, timeouts):
+			state = "fresh"
+		}
+		entries[i] = CacheEntry{
+			Name:      v.Secret.Name,
+			Owner:     v.Secret.Owner,
+			Group:     v.Secret.Group,
+			Mode:      v.Secret.Mode,
+			FetchedAt: v.Time,
+			State:     state,
+		}
+	}
+	return entries
+}
+
 // Len returns the number of values stored in the cache. This method is most useful for testing.
 func (c *Cache) Len() int {
 	return c.secretMap.Len()
 }
 
-// cacheSecret retrieves a secret from the cache.
+// cacheSecret retrieves the metadata of a secret from the cache, without its content.
 //
 // Cache lookup may block, so retrieval is concurrent and a channel is returned to communicate a
 // successful value. The channel will not be fulfilled on error.
@@ -173,10 +859,16 @@ func (c *Cache) cacheSecret(name string) chan *SecretTime {
 	secretc := make(chan *SecretTime, 1)
 	go func() {
 		defer close(secretc)
-		secret, ok := c.secretMap.Get(name)
-		if ok && len(secret.Secret.Content) > 0 {
+		var secret *SecretTime
+		c.secretMap.view(name, func(s SecretTime) {
+			if len(s.Secret.Content) > 0 {
+				s = s.metadata()
+				secret = &s
+			}
+		})
+		if secret != nil {
 			c.Debugf("Cache hit: %v", name)
-			secretc <- &secret
+			secretc <- secret
 		} else {
 			c.Debugf("Cache miss: %v", name)
 			secretc <- nil
@@ -198,7 +890,7 @@ func (c *Cache) cacheSecretList() chan []Secret {
 		for i, v := range values {
 			secrets[i] = v.Secret
 		}
-		secretsc <- secrets
+		secretsc <- c.permitted(secrets)
 	}()
 	return secretsc
 }
@@ -206,49 +898,324 @@ func (c *Cache) cacheSecretList() chan []Secret {
 // backendSecret retrieves a secret from the backend and updates the cache.
 //
 // Retrieval is concurrent, so a channel is returned to communicate a successful value. The channel
-// will not be fulfilled on error.
-func (c *Cache) backendSecret(name string) chan *Secret {
-	secretc := make(chan *Secret)
+// will not be fulfilled on error. Concurrent retrievals of the same name share a single backend
+// request.
+func (c *Cache) backendSecret(ctx context.Context, name string) chan *Secret {
+	secretc := make(chan *Secret, 1) // buffered, so an abandoned request does not block forever
 	go func() {
 		defer close(secretc)
-		secret, ok := c.backend.Secret(name)
+		secret, ok := c.refreshSecret(ctx, name)
 		if !ok {
 			secretc <- nil
 			return
 		}
 
 		secretc <- secret
-		c.secretMap.Put(name, *secret)
 	}()
 	return secretc
 }
 
-// backendSecretList retrieves a secret listing from the backend and updates the cache.
+// backendSecretList retrieves a secret listing from the backend and updates the cache. Entries are
+// added to progress as the backend sends them.
 //
-// Retrieval is concurrent, so a channel is returned to communicate successful values. The channel
-// will not be fulfilled on error.
-func (c *Cache) backendSecretList() chan []Secret {
+// Retrieval is concurrent, so a channel is returned to communicate successful values. If the
+// backend fails after sending some entries, they are merged with the cache and the merged listing
+// is sent. Otherwise the channel is closed without a value on error.
+func (c *Cache) backendSecretList(ctx context.Context, progress *listProgress) chan []Secret {
 	secretsc := make(chan []Secret, 1)
 	go func() {
-		secrets, ok := c.backend.SecretList()
+		if !c.limit(ctx, "secretList()") {
+			close(secretsc)
+			return
+		}
+		release, admitted := c.admit(ctx, "secretList()")
+		if !admitted {
+			close(secretsc)
+			return
+		}
+		if !c.breaker.allow(c.clock()) {
+			release()
+			c.Debugf("Circuit breaker open, skipping backend: secretList()")
+			count(&c.stats.shortCircuits)
+			close(secretsc)
+			return
+		}
+
+		count(&c.stats.backendCalls)
+		start := time.Now()
+		partial, ok := c.lister.SecretListStreamCtx(ctx, func(s Secret) {
+			if c.Permits(s.Name) {
+				progress.add(s)
+			}
+		})
+		elapsed := time.Since(start)
+		c.stats.latency.observe(elapsed)
+		c.stats.listLatency.observe(elapsed)
+		release()
+		secrets := progress.values()
 		if !ok {
+			if ctx.Err() != nil {
+				c.breaker.ignore()
+			} else {
+				count(&c.stats.backendErrors)
+				c.breaker.failure(c.clock())
+			}
+			if len(secrets) > 0 {
+				c.Warnf("Backend listing failed after %d secrets, merging with cache", len(secrets))
+				secretsc <- c.mergeSecretList(secrets)
+			}
+			close(secretsc)
+			return
+		}
+		c.breaker.success()
+		c.contacted(&c.stats.lastSecretList)
+
+		if partial {
+			c.Warnf("Backend returned a partial listing of %d secrets, merging with cache", len(secrets))
+			secretsc <- c.mergeSecretList(secrets)
+			close(secretsc)
 			return
 		}
 
 		secretsc <- secrets
 		close(secretsc)
 
-		newMap := NewSecretMap()
+		newMap := c.newSecretMap()
+		var rotated, added []string
+		listed := make(map[string]bool, len(secrets))
+		before := c.secretMap.Keys()
 
 		for _, backendSecret := range secrets {
-			// If the cache contains a secret with content, keep it over backendSecret.
-			if s, ok := c.secretMap.Get(backendSecret.Name); ok && len(s.Secret.Content) > 0 {
-				newMap.Put(backendSecret.Name, s.Secret)
-			} else { // Otherwise, cache the latest information.
+			listed[backendSecret.Name] = true
+			if !c.secretMap.Contains(backendSecret.Name) {
+				added = append(added, backendSecret.Name)
+			}
+			if cached, keep, changed := c.listedSecret(backendSecret); keep {
+				newMap.Put(backendSecret.Name, cached)
+			} else {
+				if changed {
+					rotated = append(rotated, backendSecret.Name)
+				}
+				backendSecret.Content = backendSecret.Content.clone()
 				newMap.Put(backendSecret.Name, backendSecret)
 			}
 		}
 		c.secretMap.Overwrite(newMap)
+		atomic.StoreInt64(&c.stats.lastRefresh, c.clock().UnixNano())
+		for _, name := range added {
+			c.publish(SecretAdded, name)
+		}
+		for _, name := range rotated {
+			c.changed(name)
+		}
+		for _, name := range before {
+			if !listed[name] {
+				c.publish(SecretRemoved, name)
+			}
+		}
 	}()
 	return secretsc
 }
+
+// mergeSecretList updates the cache with the secrets of a partial listing, keeping cached secrets
+// which are not listed. Returns the merged listing.
+func (c *Cache) mergeSecretList(secrets []Secret) []Secret {
+	listed := make(map[string]bool, len(secrets))
+	merged := make([]Secret, 0, len(secrets))
+	for _, backendSecret := range secrets {
+		listed[backendSecret.Name] = true
+		merged = append(merged, backendSecret)
+		var keep, changed bool
+		c.secretMap.view(backendSecret.Name, func(s SecretTime) { keep, changed = listedChange(s.Secret, backendSecret) })
+		if !keep {
+			backendSecret.Content = backendSecret.Content.clone()
+			if added, _ := c.secretMap.putChanged(backendSecret.Name, backendSecret); added {
+				c.publish(SecretAdded, backendSecret.Name)
+			}
+			if changed {
+				c.changed(backendSecret.Name)
+			}
+		}
+	}
+	for _, v := range c.secretMap.Values() {
+		if !listed[v.Secret.Name] {
+			merged = append(merged, v.Secret)
+		}
+	}
+	return merged
+}
+
+// completeListing returns the received entries of an incomplete listing, followed by the cached
+// secrets which were not received.
+func completeListing(received, cached []Secret) []Secret {
+	listed := make(map[string]bool, len(received))
+	merged := make([]Secret, 0, len(received)+len(cached))
+	for _, s := range received {
+		listed[s.Name] = true
+		merged = append(merged, s)
+	}
+	for _, s := range cached {
+		if !listed[s.Name] {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// listProgress collects the entries of a listing as the backend sends them.
+type listProgress struct {
+	secrets []Secret
+	lock    sync.Mutex
+}
+
+func (p *listProgress) add(s Secret) {
+	p.lock.Lock()
+	p.secrets = append(p.secrets, s)
+	p.lock.Unlock()
+}
+
+// values returns a copy of the entries received so far.
+func (p *listProgress) values() []Secret {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Secret(nil), p.secrets...)
+}
+
+// listedSecret compares a secret from a listing with the cache. If the cache holds content of the
+// same version, it should be kept over the listed secret, and is returned with keep set. Otherwise
+// changed reports whether a cached entry has a different version.
+func (c *Cache) listedSecret(backendSecret Secret) (cached Secret, keep, changed bool) {
+	c.secretMap.view(backendSecret.Name, func(s SecretTime) {
+		if keep, changed = listedChange(s.Secret, backendSecret); keep {
+			cached = s.Secret
+			cached.Content = s.Secret.Content.clone()
+		}
+	})
+	return cached, keep, changed
+}
+
+// listedChange compares a cached secret with its entry in a listing, as listedSecret does, without
+// copying its content.
+func listedChange(cached, listed Secret) (keep, changed bool) {
+	if cached.Version != listed.Version {
+		return false, true
+	}
+	return len(cached.Content) > 0, false
+}
+
+// SetClockSkew sets the clock skew tolerated when judging whether secrets have expired, as by
+// Secret.ExpiredWithSkew. Zero, the default, compares expiry times to the clock exactly.
+func (c *Cache) SetClockSkew(skew time.Duration) {
+	c.clockSkew.Store(skew)
+}
+
+// expired returns whether a secret has expired at now, tolerating the clock skew.
+func (c *Cache) expired(s Secret, now time.Time) bool {
+	skew, _ := c.clockSkew.Load().(time.Duration)
+	return s.ExpiredWithSkew(now, skew)
+}
+
+// unexpired filters out expired secrets.
+func (c *Cache) unexpired(secrets []Secret) []Secret {
+	now := c.clock()
+	valid := make([]Secret, 0, len(secrets))
+	for _, s := range secrets {
+		if !c.expired(s, now) {
+			valid = append(valid, s)
+		}
+	}
+	return valid
+}
+
+// fresh returns whether a cached secret is used at now without consulting the backend: if it is
+// more recent than its own TTL if set, otherwise than Timeouts.Fresh. A zero threshold is never
+// fresh, even at the instant the secret was cached, and FreshForever always is.
+func fresh(s SecretTime, now time.Time, timeouts Timeouts) bool {
+	threshold := timeouts.Fresh
+	if s.Secret.TTL > 0 {
+		threshold = s.Secret.TTL
+	}
+	switch threshold {
+	case FreshForever:
+		return true
+	case 0:
+		return false
+	}
+	return now.Sub(s.Time) < threshold
+}
+
+// newSecretMap initializes an empty SecretMap with the limits of this cache.
+func (c *Cache) newSecretMap() *SecretMap {
+	m := NewSecretMapWithLimit(c.maxEntries)
+	m.now = c.clock
+	m.onEvict = func(s SecretTime) {
+		count(&c.stats.evictions)
+		c.stale.remove(s.Secret.Name)
+	}
+	m.lockContent = atomic.LoadInt32(&c.lockContent) != 0
+	m.onLockError = c.lockError
+	return m
+}
+
+// notFoundSet remembers when names were reported missing by the backend.
+type notFoundSet struct {
+	m    map[string]time.Time
+	lock sync.Mutex
+}
+
+// notFoundSweepSize is the number of markers after which expired markers are swept on insert,
+// bounding memory when many distinct missing names are looked up.
+const notFoundSweepSize = 1024
+
+// contains returns whether name was reported missing within ttl of now. Expired markers are
+// dropped.
+func (n *notFoundSet) contains(name string, now time.Time, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	t, ok := n.m[name]
+	if !ok {
+		return false
+	}
+	if now.Sub(t) >= ttl {
+		delete(n.m, name)
+		return false
+	}
+	return true
+}
+
+// add records name as missing as of now.
+func (n *notFoundSet) add(name string, now time.Time, ttl time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.m) >= notFoundSweepSize {
+		for k, t := range n.m {
+			if now.Sub(t) >= ttl {
+				delete(n.m, k)
+			}
+		}
+	}
+	n.m[name] = now
+}
+
+// has returns whether name is marked, regardless of when.
+func (n *notFoundSet) has(name string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	_, ok := n.m[name]
+	return ok
+}
+
+func (n *notFoundSet) remove(name string) {
+	n.lock.Lock()
+	delete(n.m, name)
+	n.lock.Unlock()
+}
+
+func (n *notFoundSet) clear() {
+	n.lock.Lock()
+	n.m = make(map[string]time.Time)
+	n.lock.Unlock()
+}
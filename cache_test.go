@@ -15,6 +15,11 @@
 package keywhizfs_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -53,7 +58,7 @@ func (b ChannelBackend) SecretList() ([]keywhizfs.Secret, bool) {
 	return secretList, true
 }
 
-var timeouts = keywhizfs.Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond}
+var timeouts = keywhizfs.Timeouts{Fresh: 0, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
 
 func TestCacheSecretUsesValuesFromClient(t *testing.T) {
 	assert := assert.New(t)
@@ -140,7 +145,7 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 	secretc <- fixture1
 
 	// 1 Hour fresh threshold is sure to be fresh
-	timeouts := keywhizfs.Timeouts{1 * time.Hour, 10 * time.Millisecond, 20 * time.Millisecond}
+	timeouts := keywhizfs.Timeouts{Fresh: 1 * time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
 	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
 	cache.Add(*fixture2)
 
@@ -151,11 +156,11 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 	assert.True(ok)
 	assert.Equal(fixture2, secret)
 
-	// 1 Nanosecond fresh threshold is sure to make a server request
-	timeouts = keywhizfs.Timeouts{1 * time.Nanosecond, 10 * time.Millisecond, 20 * time.Millisecond}
-	cache = keywhizfs.NewCache(backend, timeouts, logConfig)
+	// A zero fresh threshold is sure to make a server request, even without time passing
+	clock := newFakeClock()
+	timeouts = keywhizfs.Timeouts{Fresh: 0, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache = keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
 	cache.Add(*fixture2)
-	time.Sleep(2 * time.Nanosecond)
 
 	secret, ok = cache.Secret(fixture2.Name)
 	assert.True(ok)
@@ -230,6 +235,41 @@ func TestCacheSecretListUsesClientOverCache(t *testing.T) {
 	assert.Equal(1, cache.Len())
 }
 
+// PartialBackend returns its secrets as a partial listing.
+type PartialBackend struct {
+	FailingBackend
+	secrets []keywhizfs.Secret
+}
+
+func (b PartialBackend) SecretListPartialCtx(ctx context.Context) ([]keywhizfs.Secret, bool, bool) {
+	return b.secrets, true, true
+}
+
+func TestCacheSecretListMergesPartialListing(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	listed := *fixture1
+	listed.Content = nil
+	backend := PartialBackend{secrets: []keywhizfs.Secret{listed}}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+
+	// Although the backend only lists fixture1, its listing is partial, so fixture2 survives.
+	list := cache.SecretList()
+	assert.Len(list, 2)
+	assert.Contains(list, listed)
+	assert.Contains(list, *fixture2)
+
+	assert.Equal([]string{fixture1.Name, fixture2.Name}, cache.Keys())
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1.Content, secret.Content, "Cached content should be kept")
+}
+
 func TestCacheClears(t *testing.T) {
 	assert := assert.New(t)
 
@@ -242,3 +282,959 @@ func TestCacheClears(t *testing.T) {
 	cache.Clear()
 	assert.Equal(0, cache.Len())
 }
+
+func TestCacheZeroesContentOnClearAndDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(nil, timeouts, logConfig)
+
+	cleared, deleted := []byte("cleared"), []byte("deleted")
+	cache.Add(keywhizfs.Secret{Name: "foo", Content: cleared})
+	cache.Add(keywhizfs.Secret{Name: "bar", Content: deleted})
+
+	// The backing arrays retained here are the ones owned by the cache.
+	assert.True(cache.Delete("bar"))
+	assert.Equal(make([]byte, len(deleted)), deleted)
+	assert.EqualValues("cleared", cleared)
+
+	cache.Clear()
+	assert.Equal(make([]byte, len(cleared)), cleared)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	const limit = 3
+	cache := keywhizfs.NewCacheWithLimit(FailingBackend{}, timeouts, logConfig, limit)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	for i := 0; i <= limit; i++ {
+		s := *secretFixture
+		s.Name = fmt.Sprintf("secret-%d", i)
+		cache.Add(s)
+		assert.True(cache.Len() <= limit)
+	}
+	assert.Equal(limit, cache.Len())
+
+	// The first entry added is the oldest and was evicted.
+	secret, ok := cache.Secret("secret-0")
+	assert.False(ok)
+	assert.Nil(secret)
+
+	for i := 1; i <= limit; i++ {
+		_, ok := cache.Secret(fmt.Sprintf("secret-%d", i))
+		assert.True(ok)
+	}
+}
+
+func TestCacheSecretLookupBumpsRecency(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCacheWithLimit(FailingBackend{}, timeouts, logConfig, 2)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	fixture3, _ := keywhizfs.ParseSecret(fixture("secretWithoutBase64Padding.json"))
+
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+
+	// Using fixture1 makes fixture2 the eviction candidate.
+	_, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	cache.Add(*fixture3)
+
+	_, ok = cache.Secret(fixture2.Name)
+	assert.False(ok)
+	_, ok = cache.Secret(fixture1.Name)
+	assert.True(ok)
+}
+
+func TestCacheDeletesSingleEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+
+	assert.True(cache.Delete(fixture1.Name))
+	assert.Equal(1, cache.Len())
+	assert.False(cache.Delete(fixture1.Name))
+
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.False(ok)
+	assert.Nil(secret)
+
+	// Other entries keep serving while the backend is failing.
+	secret, ok = cache.Secret(fixture2.Name)
+	assert.True(ok)
+	assert.Equal(fixture2, secret)
+}
+
+// CountingBackend counts requests and serves secrets from a map.
+type CountingBackend struct {
+	secrets map[string]*keywhizfs.Secret
+	calls   *int32
+}
+
+func (b CountingBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	secret, ok := b.secrets[name]
+	return secret, ok
+}
+
+func (b CountingBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	var secrets []keywhizfs.Secret
+	for _, s := range b.secrets {
+		secrets = append(secrets, *s)
+	}
+	return secrets, true
+}
+
+func TestCacheFreshThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+	lookup := func(fresh time.Duration, age time.Duration) (calls int32) {
+		atomic.StoreInt32(backend.calls, 0)
+		clock := newFakeClock()
+		timeouts := timeouts
+		timeouts.Fresh = fresh
+		cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+		cache.Add(*secretFixture)
+		clock.Advance(age)
+		_, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+		return atomic.LoadInt32(backend.calls)
+	}
+
+	assert.EqualValues(1, lookup(0, 0), "Zero always consults the backend")
+	assert.EqualValues(0, lookup(time.Minute, time.Minute-time.Nanosecond), "Within the threshold")
+	assert.EqualValues(1, lookup(time.Minute, time.Minute), "Past the threshold")
+	assert.EqualValues(0, lookup(keywhizfs.FreshForever, 1000*time.Hour), "FreshForever never does")
+}
+
+func TestCacheRemembersNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{}, calls: new(int32)}
+
+	clock := newFakeClock()
+	timeouts := timeouts
+	timeouts.NegativeTTL = time.Minute
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.EqualValues(1, atomic.LoadInt32(backend.calls))
+
+	// Within NegativeTTL the backend is not consulted.
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Nil(secret)
+	assert.EqualValues(1, atomic.LoadInt32(backend.calls))
+
+	// Once the marker expires, a recreated secret becomes visible.
+	backend.secrets[secretFixture.Name] = secretFixture
+	clock.Advance(timeouts.NegativeTTL)
+	secret, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+}
+
+func TestCacheDoesNotRememberTimeoutAsNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+
+	timeouts := timeouts
+	timeouts.NegativeTTL = time.Hour
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	// Backend blocks until the lookup times out.
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+
+	secretc <- secretFixture // completes the timed out request
+	secretc <- secretFixture
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+}
+
+func TestCacheFreshnessUsesClock(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	fixture2.Name = fixture1.Name
+
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+	secretc <- fixture1
+
+	clock := newFakeClock()
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	cache.Add(*fixture2)
+
+	// Just inside the threshold the cached entry is fresh.
+	clock.Advance(time.Minute - time.Nanosecond)
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture2, secret)
+
+	// At the threshold the backend is consulted.
+	clock.Advance(time.Nanosecond)
+	secret, ok = cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1, secret)
+}
+
+func TestCacheCoalescesConcurrentBackendRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: 2 * time.Second}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make(chan *keywhizfs.Secret, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secret, _ := cache.Secret(secretFixture.Name)
+			results <- secret
+		}()
+	}
+
+	// Let every caller block on the single backend request before answering it.
+	time.Sleep(20 * time.Millisecond)
+	secretc <- secretFixture
+	wg.Wait()
+	close(results)
+
+	for secret := range results {
+		assert.Equal(secretFixture, secret)
+	}
+
+	// A second request would still be waiting on the channel and consume this value.
+	secretc <- secretFixture
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(secretc, 1)
+	assert.EqualValues(1, cache.Stats().BackendCalls)
+}
+
+func TestCacheKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+
+	// Channels are nil, so any backend request would block.
+	cache := keywhizfs.NewCache(ChannelBackend{}, timeouts, logConfig)
+	assert.Empty(cache.Keys())
+
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+	assert.Equal([]string{fixture1.Name, fixture2.Name}, cache.Keys())
+	assert.Zero(cache.Stats().BackendCalls)
+}
+
+func TestCacheFreshnessPrefersSecretTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secretWithTTL.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretWithTTL.json"))
+	fixture2.Owner = "rotated"
+
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+	secretc <- fixture2
+
+	// The global threshold alone would always consult the backend.
+	clock := newFakeClock()
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	cache.Add(*fixture1)
+
+	clock.Advance(fixture1.TTL - time.Second)
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1, secret)
+
+	clock.Advance(time.Second)
+	secret, ok = cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture2, secret)
+}
+
+func TestCacheServesStaleWhileRevalidating(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	fixture2.Name = fixture1.Name
+
+	secretc := make(chan *keywhizfs.Secret)
+	backend := ChannelBackend{secretc: secretc}
+
+	clock := newFakeClock()
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: time.Hour, BackendTimeout: time.Hour, StaleWhileRevalidate: true}
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	cache.Add(*fixture1)
+	clock.Advance(2 * time.Minute)
+
+	// Stale reads return at once, even though the backend has not answered.
+	for i := 0; i < 3; i++ {
+		secret, ok := cache.Secret(fixture1.Name)
+		assert.True(ok)
+		assert.Equal(fixture1, secret)
+	}
+	assert.True(eventually(func() bool { return cache.Stats().BackendCalls == 1 }, time.Second))
+
+	// Answer the single background refresh; later reads see the refreshed value.
+	secretc <- fixture2
+	assert.True(eventually(func() bool {
+		secret, ok := cache.Secret(fixture1.Name)
+		return ok && secret.Owner == fixture2.Owner
+	}, time.Second))
+}
+
+func TestCacheHidesSecretExpiringBetweenReads(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secretWithExpiry.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{}, calls: new(int32)}
+
+	clock := newFakeClock()
+	secretFixture.ExpiresAt = clock.Now().Add(time.Minute)
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	cache.Add(*secretFixture)
+
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+
+	// Once expired, the cache entry is hidden but the backend is still asked.
+	clock.Advance(time.Minute)
+	calls := atomic.LoadInt32(backend.calls)
+	secret, ok = cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Nil(secret)
+	assert.Equal(calls+1, atomic.LoadInt32(backend.calls))
+
+	// A renewed version from the backend is served.
+	renewed := *secretFixture
+	renewed.ExpiresAt = clock.Now().Add(time.Hour)
+	backend.secrets[renewed.Name] = &renewed
+	secret, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(&renewed, secret)
+}
+
+func TestCacheToleratesClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secretWithExpiry.json"))
+	clock := newFakeClock()
+	secretFixture.ExpiresAt = clock.Now().Add(time.Minute)
+	cache := keywhizfs.NewCacheWithClock(FailingBackend{}, timeouts, logConfig, clock.Now)
+	cache.Add(*secretFixture)
+
+	// With a positive skew, the secret is served until the skew has passed since its expiry.
+	cache.SetClockSkew(10 * time.Second)
+	clock.Advance(time.Minute)
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Len(cache.SecretList(), 1)
+	clock.Advance(10 * time.Second)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Empty(cache.SecretList())
+
+	// With a negative skew, the secret is hidden the skew before its expiry.
+	secretFixture.ExpiresAt = clock.Now().Add(time.Minute)
+	cache.Add(*secretFixture)
+	cache.SetClockSkew(-10 * time.Second)
+	clock.Advance(49 * time.Second)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	clock.Advance(time.Second)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Empty(cache.SecretList())
+}
+
+func TestCacheSecretListExcludesExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secretWithExpiry.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+
+	// From the backend
+	secretListc := make(chan []keywhizfs.Secret, 1)
+	secretListc <- []keywhizfs.Secret{*fixture1, *fixture2}
+	cache := keywhizfs.NewCache(ChannelBackend{secretListc: secretListc}, timeouts, logConfig)
+	list := cache.SecretList()
+	assert.Len(list, 1)
+	assert.Contains(list, *fixture2)
+
+	// From the cache
+	cache = keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+	list = cache.SecretList()
+	assert.Len(list, 1)
+	assert.Contains(list, *fixture2)
+}
+
+func TestCacheSecretListFiltered(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secretWithExpiry.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+
+	for _, cached := range []bool{false, true} {
+		var cache *keywhizfs.Cache
+		if cached {
+			cache = keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+			cache.Add(*fixture1)
+			cache.Add(*fixture2)
+		} else {
+			backend := CountingBackend{map[string]*keywhizfs.Secret{fixture1.Name: fixture1, fixture2.Name: fixture2}, new(int32)}
+			cache = keywhizfs.NewCache(backend, timeouts, logConfig)
+		}
+
+		list := cache.SecretListFiltered(false)
+		assert.Equal([]keywhizfs.Secret{*fixture2}, list, "cached=%v", cached)
+
+		list = cache.SecretListFiltered(true)
+		assert.Len(list, 2, "cached=%v", cached)
+		assert.Contains(list, *fixture1, "cached=%v", cached)
+		assert.Contains(list, *fixture2, "cached=%v", cached)
+	}
+}
+
+// CancellableBackend blocks until the request context is done, reporting each cancellation.
+type CancellableBackend struct {
+	cancelled chan error
+}
+
+func (b CancellableBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	panic("Secret called instead of SecretCtx")
+}
+
+func (b CancellableBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	panic("SecretList called instead of SecretListCtx")
+}
+
+func (b CancellableBackend) SecretCtx(ctx context.Context, name string) (*keywhizfs.Secret, bool) {
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return nil, false
+}
+
+func (b CancellableBackend) SecretListCtx(ctx context.Context) ([]keywhizfs.Secret, bool) {
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return nil, false
+}
+
+func TestCacheCancelsBackendRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := CancellableBackend{cancelled: make(chan error, 2)}
+	cache := keywhizfs.NewCache(backend, keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}, logConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	secret, ok := cache.SecretCtx(ctx, "foo")
+	assert.False(ok)
+	assert.Nil(secret)
+	select {
+	case err := <-backend.cancelled:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Error("Backend request was not cancelled")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	assert.Empty(cache.SecretListCtx(ctx))
+	select {
+	case err := <-backend.cancelled:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Error("Backend listing was not cancelled")
+	}
+}
+
+// ContextChannelBackend reads secrets from a channel, as ChannelBackend does, until the request
+// context is done, reporting each cancellation.
+type ContextChannelBackend struct {
+	secretc   chan *keywhizfs.Secret
+	cancelled chan error
+}
+
+func (b ContextChannelBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	panic("Secret called instead of SecretCtx")
+}
+
+func (b ContextChannelBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	panic("SecretList called instead of SecretListCtx")
+}
+
+func (b ContextChannelBackend) SecretCtx(ctx context.Context, name string) (*keywhizfs.Secret, bool) {
+	select {
+	case secret := <-b.secretc:
+		return secret, true
+	case <-ctx.Done():
+		b.cancelled <- ctx.Err()
+		return nil, false
+	}
+}
+
+func (b ContextChannelBackend) SecretListCtx(ctx context.Context) ([]keywhizfs.Secret, bool) {
+	<-ctx.Done()
+	return nil, false
+}
+
+func TestCacheSharedRequestOutlivesCancelledLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := ContextChannelBackend{secretc: make(chan *keywhizfs.Secret), cancelled: make(chan error, 1)}
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+
+	lookup := func(ctx context.Context) chan bool {
+		okc := make(chan bool, 1)
+		go func() {
+			_, ok := cache.SecretCtx(ctx, secretFixture.Name)
+			okc <- ok
+		}()
+		return okc
+	}
+
+	// The first lookup starts the request, and is cancelled while a second lookup shares it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := lookup(ctx)
+	time.Sleep(10 * time.Millisecond)
+	second := lookup(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.False(<-first)
+	select {
+	case err := <-backend.cancelled:
+		t.Errorf("Shared request was cancelled with a lookup still waiting: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case backend.secretc <- secretFixture:
+		assert.True(<-second)
+	case <-time.After(time.Second):
+		t.Error("Shared request ended before answering")
+	}
+	assert.EqualValues(1, cache.Stats().BackendCalls)
+
+	// Once every lookup sharing a request is cancelled, so is the request.
+	cache.Clear()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	first, second = lookup(ctx1), lookup(ctx2)
+	time.Sleep(10 * time.Millisecond)
+	cancel1()
+	assert.False(<-first)
+	cancel2()
+	assert.False(<-second)
+	select {
+	case err := <-backend.cancelled:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Error("Backend request was not cancelled")
+	}
+}
+
+func TestCacheCancelledLookupIsNotRememberedAsNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	cancellable := CancellableBackend{cancelled: make(chan error, 2)}
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute, NegativeTTL: time.Hour}
+	cache := keywhizfs.NewCache(cancellable, cacheTimeouts, logConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, ok := cache.SecretCtx(ctx, "foo")
+	assert.False(ok)
+	<-cancellable.cancelled
+
+	// Nothing was cached, so a fresh lookup of "foo" reaches the backend again.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	cache.SecretCtx(ctx, "foo")
+	select {
+	case <-cancellable.cancelled:
+	case <-time.After(time.Second):
+		t.Error("Lookup did not reach the backend")
+	}
+}
+
+func TestCacheEntriesReportState(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := newFakeClock()
+	cacheTimeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCacheWithClock(FailingBackend{}, cacheTimeouts, logConfig, clock.Now)
+
+	cache.Add(keywhizfs.Secret{Name: "stale", Owner: "nobody"})
+	clock.Advance(time.Hour)
+	cache.Add(keywhizfs.Secret{Name: "expired", ExpiresAt: clock.Now()})
+	cache.Add(keywhizfs.Secret{Name: "fresh", Mode: "0400"})
+
+	entries := cache.Entries()
+	assert.Len(entries, 3)
+	states := make(map[string]keywhizfs.CacheEntry)
+	for _, e := range entries {
+		states[e.Name] = e
+	}
+	assert.Equal("stale", states["stale"].State)
+	assert.Equal("nobody", states["stale"].Owner)
+	assert.Equal("expired", states["expired"].State)
+	assert.Equal("fresh", states["fresh"].State)
+	assert.Equal("0400", states["fresh"].Mode)
+	assert.Equal(clock.Now(), states["fresh"].FetchedAt)
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := []keywhizfs.Timeouts{
+		timeouts,
+		{Fresh: time.Second, BackendDeadline: time.Second, BackendTimeout: time.Second},
+		{BackendTimeout: time.Second, NegativeTTL: time.Minute, StaleWhileRevalidate: true},
+		{Fresh: keywhizfs.FreshForever, BackendTimeout: time.Second},
+	}
+	for _, v := range valid {
+		assert.NoError(v.Validate(), "Expected %+v to be valid", v)
+	}
+
+	invalid := []keywhizfs.Timeouts{
+		{},
+		{Fresh: -time.Second, BackendTimeout: time.Second},
+		{Fresh: keywhizfs.FreshForever - 1, BackendTimeout: time.Second},
+		{BackendDeadline: -time.Second, BackendTimeout: time.Second},
+		{BackendTimeout: time.Second, NegativeTTL: -time.Second},
+		{BackendTimeout: -time.Second},
+		{BackendDeadline: 2 * time.Second, BackendTimeout: time.Second},
+	}
+	for _, v := range invalid {
+		assert.Error(v.Validate(), "Expected %+v to be invalid", v)
+	}
+}
+
+// ConditionalBackend serves a secret tagged with an ETag, answering requests carrying that ETag as
+// not modified.
+type ConditionalBackend struct {
+	secret            keywhizfs.Secret
+	sent, notModified *int32
+}
+
+func (b ConditionalBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	secret, _, ok := b.SecretIfNoneMatchCtx(context.Background(), name, "")
+	return secret, ok
+}
+
+func (b ConditionalBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return []keywhizfs.Secret{b.secret}, true
+}
+
+func (b ConditionalBackend) SecretIfNoneMatchCtx(ctx context.Context, name, etag string) (*keywhizfs.Secret, bool, bool) {
+	if name != b.secret.Name {
+		return nil, false, false
+	}
+	if etag == b.secret.ETag {
+		atomic.AddInt32(b.notModified, 1)
+		return nil, true, true
+	}
+	atomic.AddInt32(b.sent, 1)
+	secret := b.secret
+	return &secret, false, true
+}
+
+func TestCacheRevalidatesWithETag(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	secretFixture.ETag = `"v1"`
+	backend := ConditionalBackend{*secretFixture, new(int32), new(int32)}
+	clock := newFakeClock()
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.EqualValues(1, atomic.LoadInt32(backend.sent))
+
+	// Once stale, the entry is revalidated without downloading the content again.
+	clock.Advance(2 * time.Minute)
+	secret, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.EqualValues(1, atomic.LoadInt32(backend.sent))
+	assert.EqualValues(1, atomic.LoadInt32(backend.notModified))
+	if entries := cache.Entries(); assert.Len(entries, 1) {
+		assert.Equal(clock.Now(), entries[0].FetchedAt)
+		assert.Equal("fresh", entries[0].State)
+	}
+
+	// The refreshed timestamp makes the entry fresh again.
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.EqualValues(1, atomic.LoadInt32(backend.notModified))
+}
+
+// StreamingBackend streams its first listed secret, then stalls until stall is closed before
+// streaming the rest. The listing fails after the first secret if fail is set.
+type StreamingBackend struct {
+	FailingBackend
+	secrets []keywhizfs.Secret
+	stall   chan struct{}
+	fail    bool
+}
+
+func (b StreamingBackend) SecretListStreamCtx(ctx context.Context, emit func(keywhizfs.Secret)) (bool, bool) {
+	emit(b.secrets[0])
+	if b.fail {
+		return false, false
+	}
+	select {
+	case <-b.stall:
+	case <-ctx.Done():
+		return false, false
+	}
+	for _, s := range b.secrets[1:] {
+		emit(s)
+	}
+	return false, true
+}
+
+func TestCacheSecretListMergesEntriesReceivedBeforeDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	listed1, listed2 := *fixture1, *fixture2
+	listed1.Content, listed2.Content = nil, nil
+	listed1.Version = "2"
+	backend := StreamingBackend{secrets: []keywhizfs.Secret{listed1, listed2}, stall: make(chan struct{})}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+
+	// The backend stalls after listing fixture1, which replaces its cached entry in the listing.
+	list := cache.SecretList()
+	assert.Len(list, 2)
+	assert.Contains(list, listed1)
+	assert.Contains(list, *fixture2)
+	assert.EqualValues(1, cache.Stats().BackendTimeouts)
+
+	// Once the listing completes, the content cached for the old version is dropped.
+	close(backend.stall)
+	assert.True(eventually(func() bool {
+		_, ok := cache.Secret(fixture1.Name)
+		return !ok
+	}, time.Second))
+}
+
+func TestCacheSecretListMergesEntriesReceivedBeforeFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	listed := *fixture1
+	listed.Content = nil
+	backend := StreamingBackend{secrets: []keywhizfs.Secret{listed}, fail: true}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*fixture2)
+
+	list := cache.SecretList()
+	assert.Len(list, 2)
+	assert.Contains(list, listed)
+	assert.Contains(list, *fixture2)
+	assert.Equal([]string{fixture1.Name, fixture2.Name}, cache.Keys())
+	assert.EqualValues(1, cache.Stats().BackendErrors)
+}
+
+// RotatingBackend serves a secret whose whole content and version alternate on every request.
+type RotatingBackend struct {
+	FailingBackend
+	calls *int32
+}
+
+func (b RotatingBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	n := atomic.AddInt32(b.calls, 1) % 2
+	return &keywhizfs.Secret{Name: name, Content: bytes.Repeat([]byte{'a' + byte(n)}, 4096), Version: fmt.Sprint(n)}, true
+}
+
+func TestCacheRefreshNeverTearsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(RotatingBackend{calls: new(int32)}, timeouts, logConfig)
+	stop := cache.StartRefresh(time.Millisecond)
+	defer stop()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var torn int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				secret, ok := cache.Secret("rotating")
+				if !ok {
+					continue
+				}
+				want := bytes.Repeat([]byte{'a' + secret.Version[0] - '0'}, 4096)
+				if !bytes.Equal(want, secret.Content) {
+					atomic.AddInt32(&torn, 1)
+				}
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	assert.EqualValues(0, atomic.LoadInt32(&torn), "Every read should see one complete version")
+}
+
+// stressSecrets returns count secrets named secret-0 and onwards, keyed by name.
+func stressSecrets(count int) ([]string, map[string]*keywhizfs.Secret) {
+	names := make([]string, count)
+	secrets := make(map[string]*keywhizfs.Secret, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("secret-%d", i)
+		secrets[names[i]] = &keywhizfs.Secret{Name: names[i], Content: []byte(names[i])}
+	}
+	return names, secrets
+}
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	const limit = 32
+	names, secrets := stressSecrets(64)
+	backend := CountingBackend{secrets: secrets, calls: new(int32)}
+	cache := keywhizfs.NewCacheWithLimit(backend, timeouts, logConfig, limit)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				name := names[(g*7+i)%len(names)]
+				switch i % 4 {
+				case 0, 1:
+					if s, ok := cache.Secret(name); ok {
+						assert.Equal(name, string(s.Content))
+					}
+				case 2:
+					cache.Add(keywhizfs.Secret{Name: name, Content: []byte(name)})
+				case 3:
+					list := cache.SecretList()
+					seen := make(map[string]bool, len(list))
+					for _, s := range list {
+						assert.False(seen[s.Name], "Listed %v twice", s.Name)
+						seen[s.Name] = true
+					}
+				}
+				if n := cache.Len(); n > limit {
+					assert.Fail("Cache over its limit", "%d entries", n)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	keys := cache.Keys()
+	assert.Len(keys, cache.Len())
+	assert.True(len(keys) <= limit)
+}
+
+func BenchmarkCacheSecretParallel(b *testing.B) {
+	names, secrets := stressSecrets(256)
+	fresh := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCache(CountingBackend{secrets: secrets, calls: new(int32)}, fresh, logConfig)
+	for _, name := range names {
+		cache.Secret(name)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			name := names[i%len(names)]
+			if i%16 == 0 {
+				cache.Add(keywhizfs.Secret{Name: name, Content: []byte(name)})
+			} else {
+				cache.Secret(name)
+			}
+			i++
+		}
+	})
+}
+
+func TestCacheSecretReturnsCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := &keywhizfs.Secret{Name: "foo", Content: []byte("content"), Groups: []string{"web"}}
+	fresh := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secret.Name: secret}, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, fresh, logConfig)
+
+	// Mutate both the secret answered by the backend and the one served from the cache.
+	for i := 0; i < 2; i++ {
+		s, ok := cache.Secret("foo")
+		if !assert.True(ok) {
+			return
+		}
+		assert.EqualValues("content", s.Content, "lookup %d", i)
+		assert.Equal([]string{"web"}, s.Groups, "lookup %d", i)
+		s.Content[0] = 'X'
+		s.Groups[0] = "db"
+		s.Owner = "root"
+	}
+	assert.EqualValues(1, atomic.LoadInt32(backend.calls), "Expected the second lookup to hit the cache")
+
+	s, _ := cache.Secret("foo")
+	assert.EqualValues("content", s.Content)
+	assert.Equal([]string{"web"}, s.Groups)
+	assert.Empty(s.Owner)
+	assert.EqualValues("content", secret.Content, "Expected the backend's secret to be unaffected")
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+)
+
+// SetCaseInsensitive sets whether secrets are looked up regardless of the case of their names. A
+// name is resolved to the backend's spelling of a cached or listed secret, preferring an exact
+// match. A name matching several secrets which differ only in case is ambiguous and not resolved.
+func (c *Cache) SetCaseInsensitive(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&c.caseInsensitive, flag)
+}
+
+// canonicalName resolves name to the backend's spelling when case-insensitive lookups are enabled.
+// Cached names are consulted first, then a listing from the backend. Returns name unchanged if no
+// secret matches it unambiguously.
+func (c *Cache) canonicalName(ctx context.Context, name string) string {
+	if atomic.LoadInt32(&c.caseInsensitive) == 0 || c.secretMap.Contains(name) {
+		return name
+	}
+	if canonical, ok := c.foldMatch(name, c.secretMap.Keys()); ok {
+		return canonical
+	}
+
+	listed := c.SecretListCtx(ctx)
+	names := make([]string, len(listed))
+	for i, s := range listed {
+		names[i] = s.Name
+	}
+	if canonical, ok := c.foldMatch(name, names); ok {
+		return canonical
+	}
+	return name
+}
+
+// foldMatch returns the one of names equal to name, or else the only one equal to name regardless
+// of case.
+func (c *Cache) foldMatch(name string, names []string) (string, bool) {
+	var matches []string
+	for _, n := range names {
+		if n == name {
+			return n, true
+		}
+		if strings.EqualFold(n, name) {
+			matches = append(matches, n)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", false
+	case 1:
+		c.Debugf("Resolved %v to %v", name, matches[0])
+		return matches[0], true
+	default:
+		c.Warnf("Ambiguous secret name %v matches %v", name, strings.Join(matches, ", "))
+		return "", false
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheCaseInsensitiveLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := &keywhizfs.Secret{Name: "Password-File", Content: []byte("asddas")}
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secret.Name: secret}, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	_, ok := cache.Secret("password-file")
+	assert.False(ok, "Lookups are case-sensitive by default")
+
+	cache.SetCaseInsensitive(true)
+	for _, name := range []string{"password-file", "PASSWORD-FILE", "Password-File"} {
+		s, ok := cache.Secret(name)
+		if assert.True(ok, "Expected %v to be found", name) {
+			assert.Equal("Password-File", s.Name)
+			assert.Equal("asddas", string(s.Content))
+		}
+	}
+	assert.Equal([]string{"Password-File"}, cache.Keys(), "The backend's spelling should be cached")
+
+	_, ok = cache.Secret("password-files")
+	assert.False(ok)
+}
+
+func TestCacheCaseInsensitiveLookupPrefersExactMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	upper := &keywhizfs.Secret{Name: "DB-Pass", Content: []byte("upper")}
+	lower := &keywhizfs.Secret{Name: "db-pass", Content: []byte("lower")}
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{upper.Name: upper, lower.Name: lower}, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.SetCaseInsensitive(true)
+
+	s, ok := cache.Secret("db-pass")
+	assert.True(ok)
+	assert.Equal("lower", string(s.Content))
+	s, ok = cache.Secret("DB-Pass")
+	assert.True(ok)
+	assert.Equal("upper", string(s.Content))
+
+	// Without an exact match, the name is ambiguous.
+	_, ok = cache.Secret("Db-Pass")
+	assert.False(ok)
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	klog "github.com/square/keywhizfs/log"
+)
+
+// CheckResult is the outcome of one validation performed by CheckSetup.
+type CheckResult struct {
+	Check  string // what was validated
+	Detail string // findings of a successful check
+	Err    error  // nil if the check passed
+}
+
+// CheckSetup validates a configuration without mounting or writing anything: that the
+// certificate, key, and ca files load, that the servers answer a listing of secrets, and that the
+// mountpoint is a directory the current user may write. The server is not contacted if the files
+// fail to load. Returns the results in order, and whether every check passed.
+func CheckSetup(certFile, keyFile, caFile string, serverURLs []string, mountpoint string, timeout time.Duration, logConfig klog.Config) (results []CheckResult, ok bool) {
+	ok = true
+	add := func(check, detail string, err error) {
+		results = append(results, CheckResult{check, detail, err})
+		ok = ok && err == nil
+	}
+
+	socket, err := SocketPath(serverURLs)
+	var client *Client
+	switch {
+	case err != nil:
+		add("server", "", err)
+	case socket != "":
+		add("tls", "not used with a unix socket", nil)
+		c := NewUnixClient(socket, timeout, logConfig, false)
+		client = &c
+	default:
+		params := httpClientParams{certFile, keyFile, caFile, timeout, nil, nil}
+		if _, err := params.buildClient(); err != nil {
+			add("tls", "", fmt.Errorf("loading certificate, key, or ca: %v", err))
+			break
+		}
+		add("tls", fmt.Sprintf("loaded %v, %v, and %v", certFile, keyFile, caFile), nil)
+		c := NewClientWithServers(certFile, keyFile, caFile, serverURLs, timeout, logConfig, false)
+		client = &c
+	}
+	if client != nil {
+		if secrets, listed := client.SecretList(); listed {
+			add("server", fmt.Sprintf("%d secrets visible", len(secrets)), nil)
+		} else {
+			add("server", "", fmt.Errorf("listing secrets failed, see the log for details"))
+		}
+	}
+
+	add("mountpoint", mountpoint, checkMountpoint(mountpoint))
+	return results, ok
+}
+
+// checkMountpoint returns an error unless path is a directory writable by the current user.
+func checkMountpoint(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", path)
+	}
+	const writable = 2 // W_OK
+	if err := syscall.Access(path, writable); err != nil {
+		return fmt.Errorf("%v is not writable: %v", path, err)
+	}
+	return nil
+}
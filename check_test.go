@@ -0,0 +1,83 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSetupPasses(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	defer server.Close()
+	mountpoint, err := ioutil.TempDir("", "keywhizfs")
+	assert.NoError(err)
+	defer os.RemoveAll(mountpoint)
+
+	results, ok := keywhizfs.CheckSetup(clientFile, clientFile, caFile, []string{server.URL}, mountpoint, time.Second, logConfig)
+	assert.True(ok)
+	if assert.Len(results, 3) {
+		assert.Equal("tls", results[0].Check)
+		assert.Equal("server", results[1].Check)
+		assert.Equal("2 secrets visible", results[1].Detail)
+		assert.Equal("mountpoint", results[2].Check)
+	}
+	for _, r := range results {
+		assert.NoError(r.Err, r.Check)
+	}
+}
+
+func TestCheckSetupReportsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "keywhizfs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	notDir := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(notDir, nil, 0600))
+
+	results, ok := keywhizfs.CheckSetup(clientFile, clientFile, caFile, []string{server.URL}, notDir, time.Second, logConfig)
+	assert.False(ok)
+	if assert.Len(results, 3) {
+		assert.NoError(results[0].Err)
+		assert.Error(results[1].Err, "A refused listing should fail")
+		assert.Error(results[2].Err, "A file is not a mountpoint")
+	}
+
+	results, ok = keywhizfs.CheckSetup("missing.pem", "missing.pem", caFile, []string{server.URL}, dir, time.Second, logConfig)
+	assert.False(ok)
+	if assert.Len(results, 2, "The server should not be contacted without certificates") {
+		assert.Equal("tls", results[0].Check)
+		assert.Error(results[0].Err)
+		assert.NoError(results[1].Err)
+	}
+}
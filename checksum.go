@@ -0,0 +1,53 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// checksumSuffix names the sibling file holding the checksum of a secret, as in
+// "Nobody_PgPass.sha256".
+const checksumSuffix = ".sha256"
+
+// lookupSecretChecksum resolves a checksum path to the secret at the path without the suffix,
+// looked up with ctx. Returns false if the secret has no checksum.
+func (kwfs KeywhizFs) lookupSecretChecksum(ctx context.Context, path string) (*Secret, bool) {
+	secretPath := strings.TrimSuffix(path, checksumSuffix)
+	if secretPath == path || secretPath == "" || strings.HasSuffix(secretPath, "/") {
+		return nil, false
+	}
+	secret, _, ok := kwfs.lookupSecret(ctx, secretPath)
+	if !ok || secret.Checksum == "" {
+		return nil, false
+	}
+	return secret, true
+}
+
+// checksumContent returns the content of the checksum file of s, its lower case hex checksum.
+func checksumContent(s *Secret) []byte {
+	return []byte(strings.ToLower(s.Checksum))
+}
+
+// checksumAttr constructs a fuse.Attr for the checksum file of s, owned like the secret itself:
+// the checksum of a guessable secret would reveal its content.
+func (kwfs KeywhizFs) checksumAttr(s *Secret) *fuse.Attr {
+	attr := kwfs.secretAttr(s)
+	attr.Size = uint64(len(s.Checksum))
+	return attr
+}
@@ -15,12 +15,28 @@
 package keywhizfs
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	klog "github.com/square/keywhizfs/log"
@@ -45,7 +61,57 @@ var ciphers = []uint16{
 type Client struct {
 	*klog.Logger
 	http func() *http.Client
-	url  string
+	urls []string
+	// preferred is the index of the server tried first, shared by copies of the client.
+	preferred *int32
+	timeout   time.Duration
+	reload    chan chan error
+	// modTime returns the latest modification time of the certificate files, nil for a Unix
+	// socket client.
+	modTime func() time.Time
+	// MaxRetries is the number of times a request is retried after a connection error, 5xx
+	// response, or 429 response. Not found and authorization failures are never retried.
+	MaxRetries int
+	// BaseBackoff is the wait before the first retry. Each subsequent retry waits twice as long,
+	// with jitter.
+	BaseBackoff time.Duration
+	// MaxRetryAfter caps the wait before retrying a 429 response, which is given by its
+	// Retry-After header if present. A request which would wait longer, or past its deadline,
+	// fails at once instead, so that a cached value can be used. Zero caps it by the deadline only.
+	MaxRetryAfter time.Duration
+	// MaxSecretSize is the largest content in bytes accepted for a secret. Larger secrets are
+	// rejected, as reported by TooLarge. The response is read no further than needed for content
+	// of that size encoded in base64, with some allowance for metadata. Zero means no limit.
+	MaxSecretSize int
+	// UserAgent is sent with every request. Empty means "keywhizfs/" followed by VERSION.
+	UserAgent string
+	// oversized holds the names of secrets last rejected for exceeding MaxSecretSize, shared by
+	// copies of the client.
+	oversized *nameSet
+}
+
+// Default retry behavior of a Client.
+const (
+	defaultMaxRetries  = 2
+	defaultBaseBackoff = 100 * time.Millisecond
+)
+
+// CertificateSource returns the client certificate presented to servers, such as one whose private
+// key is held by a hardware security module. It is called whenever the TLS configuration is
+// rebuilt.
+type CertificateSource func() (tls.Certificate, error)
+
+// PKCS11Config locates a client certificate and private key held by a PKCS#11 token, for
+// PKCS11Certificate.
+type PKCS11Config struct {
+	// Module is the path of the PKCS#11 library of the token.
+	Module string
+	// Slot is the number of the slot holding the token.
+	Slot int
+	// PIN logs in to the token.
+	PIN string
+	// Label names the private key and certificate on the token.
+	Label string
 }
 
 // httpClientParams are values necessary for constructing a TLS client.
@@ -53,16 +119,48 @@ type httpClientParams struct {
 	certFile,
 	keyFile,
 	caFile string
-	timeout time.Duration
+	timeout     time.Duration
+	base        *http.Client      // optional client whose transport settings are kept
+	certificate CertificateSource // optional, used instead of certFile and keyFile
 }
 
 // NewClient produces a read-to-use client struct given PEM-encoded certificate file, key file, and
 // ca file with the list of trusted certificate authorities.
 func NewClient(certFile, keyFile, caFile, serverURL string, timeout time.Duration, logConfig klog.Config, ping bool) (client Client) {
+	return NewClientWithServers(certFile, keyFile, caFile, []string{serverURL}, timeout, logConfig, ping)
+}
+
+// NewClientWithServers produces a client which fails over between several servers. Servers are
+// tried in order when one returns a connection error or 5xx response, and the last healthy server
+// is tried first on subsequent requests. Any other response, including not found, is
+// authoritative.
+func NewClientWithServers(certFile, keyFile, caFile string, serverURLs []string, timeout time.Duration, logConfig klog.Config, ping bool) (client Client) {
+	return newClient(httpClientParams{certFile, keyFile, caFile, timeout, nil, nil}, serverURLs, logConfig, ping)
+}
+
+// NewClientWithCertificate produces a client like NewClientWithServers, presenting the certificate
+// returned by certificate instead of one loaded from files.
+func NewClientWithCertificate(certificate CertificateSource, caFile string, serverURLs []string, timeout time.Duration, logConfig klog.Config, ping bool) (client Client) {
+	return newClient(httpClientParams{"", "", caFile, timeout, nil, certificate}, serverURLs, logConfig, ping)
+}
+
+// NewClientWithHTTPClient produces a client like NewClientWithServers, sending requests with copies
+// of base. The timeout, proxy, dialer, and connection pooling settings of base are kept, and the
+// TLS configuration of its transport is augmented with the certificate, key, and ca files. The
+// transport of base must be nil or an *http.Transport. base must not be modified afterwards.
+func NewClientWithHTTPClient(certFile, keyFile, caFile string, serverURLs []string, base *http.Client, logConfig klog.Config, ping bool) (client Client) {
+	return newClient(httpClientParams{certFile, keyFile, caFile, base.Timeout, base, nil}, serverURLs, logConfig, ping)
+}
+
+func newClient(params httpClientParams, serverURLs []string, logConfig klog.Config, ping bool) (client Client) {
+	if len(serverURLs) == 0 {
+		panic("keywhizfs: no server URLs")
+	}
+
 	logger := klog.New("kwfs_client", logConfig)
-	params := httpClientParams{certFile, keyFile, caFile, timeout}
 
 	reqc := make(chan http.Client)
+	reloadc := make(chan chan error)
 
 	// Getter from channel.
 	getClient := func() *http.Client {
@@ -75,97 +173,413 @@ func NewClient(certFile, keyFile, caFile, serverURL string, timeout time.Duratio
 		panic(err)
 	}
 
-	// Asynchronously updates client and owns current reference.
+	// Asynchronously updates client and owns current reference. A failed update keeps the current
+	// client, so a bad certificate on disk does not break requests.
 	go func() {
 		var current = *initial
+		update := func() error {
+			c, err := params.buildClient()
+			if err != nil {
+				logger.Errorf("Error refreshing http client: %v", err)
+				return err
+			}
+			current = *c
+			return nil
+		}
+
+		refresh := time.NewTicker(clientRefresh)
 		for {
 			select {
-			case t := <-time.Tick(clientRefresh): // Periodically update client.
+			case t := <-refresh.C: // Periodically update client.
 				logger.Infof("Updating http client at %v", t)
-				if c, err := params.buildClient(); err != nil {
-					logger.Errorf("Error refreshing http client: %v", err)
-				} else {
-					current = *c
-				}
+				update()
+			case errc := <-reloadc: // Service explicit reload.
+				errc <- update()
 			case reqc <- current: // Service request for current client.
 			}
 		}
 	}()
 
-	client = Client{logger, getClient, serverURL}
+	client = Client{
+		Logger:      logger,
+		http:        getClient,
+		urls:        serverURLs,
+		preferred:   new(int32),
+		oversized:   newNameSet(),
+		timeout:     params.timeout,
+		reload:      reloadc,
+		modTime:     params.modTime,
+		MaxRetries:  defaultMaxRetries,
+		BaseBackoff: defaultBaseBackoff,
+	}
 	if ping {
 		if _, ok := client.SecretList(); !ok {
-			log.Fatalf("Failed startup /secrets ping to %v", client.url)
+			log.Fatalf("Failed startup /secrets ping to %v", strings.Join(client.urls, ", "))
 		}
 	}
 
 	return client
 }
 
+// unixScheme prefixes a server URL naming a Unix domain socket, as in unix:///run/keywhiz.sock.
+const unixScheme = "unix://"
+
+// SocketPath returns the socket path of a single unix:// server URL, or "" if every server is
+// reached over TCP. Unix sockets and TCP servers cannot be mixed, and there may be only one socket.
+func SocketPath(serverURLs []string) (string, error) {
+	var path string
+	for _, u := range serverURLs {
+		if !strings.HasPrefix(u, unixScheme) {
+			continue
+		}
+		if len(serverURLs) > 1 {
+			return "", fmt.Errorf("unix socket %v cannot be combined with other servers", u)
+		}
+		path = strings.TrimPrefix(u, unixScheme)
+		if path == "" {
+			return "", fmt.Errorf("unix socket URL %v has no path", u)
+		}
+	}
+	return path, nil
+}
+
+// NewUnixClient produces a client which speaks plain HTTP to a local proxy listening on the Unix
+// domain socket at socketPath. TLS is not used, since access to the socket is controlled by its
+// file permissions.
+func NewUnixClient(socketPath string, timeout time.Duration, logConfig klog.Config, ping bool) (client Client) {
+	var dialer net.Dialer
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: timeout}
+
+	client = Client{
+		Logger:      klog.New("kwfs_client", logConfig),
+		http:        func() *http.Client { return httpClient },
+		urls:        []string{"http://unix"}, // The host is ignored by the dialer.
+		preferred:   new(int32),
+		oversized:   newNameSet(),
+		timeout:     timeout,
+		MaxRetries:  defaultMaxRetries,
+		BaseBackoff: defaultBaseBackoff,
+	}
+	if ping {
+		if _, ok := client.SecretList(); !ok {
+			log.Fatalf("Failed startup /secrets ping to %v", socketPath)
+		}
+	}
+
+	return client
+}
+
+// ReloadCertificates rebuilds the TLS configuration from the certificate, key, and ca files, so
+// that subsequent connections present the new certificate. On error, the previous configuration
+// remains in use.
+//
+// Certificate files are only checked for changes once WatchCertificates is called.
+func (c Client) ReloadCertificates() error {
+	if c.reload == nil { // A Unix socket client has no certificates.
+		return nil
+	}
+	errc := make(chan error)
+	c.reload <- errc
+	return <-errc
+}
+
+// WatchCertificates checks every interval whether the certificate, key, or ca file was modified,
+// and if so reloads them like ReloadCertificates. A failed reload is logged, and the previous
+// certificate stays in use until the files change again. The files are polled by modification
+// time, which also notices files replaced by a rename or through a swapped symlink. The returned
+// function stops watching.
+func (c Client) WatchCertificates(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	if c.modTime != nil {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			modified := c.modTime()
+			for {
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+				if m := c.modTime(); !m.Equal(modified) {
+					modified = m
+					c.Infof("Certificate files changed, updating http client")
+					c.ReloadCertificates()
+				}
+			}
+		}()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
 // RawSecret returns raw JSON from requesting a secret.
 func (c Client) RawSecret(name string) (data []byte, ok bool) {
-	now := time.Now()
-	resp, err := c.http().Get(fmt.Sprintf("%v/secret/%v", c.url, name))
+	return c.RawSecretCtx(context.Background(), name)
+}
+
+// RawSecretCtx returns raw JSON from requesting a secret. The request is aborted if ctx is
+// cancelled.
+func (c Client) RawSecretCtx(ctx context.Context, name string) (data []byte, ok bool) {
+	_, data, _, ok = c.rawSecret(ctx, name, "")
+	return data, ok
+}
+
+// rawSecret requests a secret like getSecret. Secrets whose content exceeds MaxSecretSize are
+// rejected, which requires decoding them, so the decoded copy is wiped.
+func (c Client) rawSecret(ctx context.Context, name, etag string) (status int, data []byte, respETag string, ok bool) {
+	status, data, respETag, ok = c.getSecret(ctx, name, etag)
+	if !ok || status != 200 || c.MaxSecretSize <= 0 {
+		return status, data, respETag, ok
+	}
+	secret, err := ParseSecretWithLimit(data, c.MaxSecretSize)
+	if errors.Is(err, ErrSecretTooLarge) {
+		c.reject(name, err)
+		return status, nil, "", false
+	}
+	if secret != nil {
+		secret.Content.wipe()
+	}
+	return status, data, respETag, true
+}
+
+// reject records that a secret was rejected as exceeding MaxSecretSize.
+func (c Client) reject(name string, err error) {
+	c.Errorf("Rejected secret %v: %v", name, err)
+	c.oversized.add(name)
+}
+
+// getSecret requests a secret unless it matches a non-empty etag. Returns the response status,
+// body, and ETag, and whether the status was 200 or 304 Not Modified. Bodies exceeding the limit
+// for MaxSecretSize are rejected, but the content is not decoded to check its size.
+func (c Client) getSecret(ctx context.Context, name, etag string) (status int, data []byte, respETag string, ok bool) {
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-None-Match": {etag}}
+	}
+	status, data, respHeader, err := c.getWithRetry(ctx, "/secret/"+url.PathEscape(name), header, c.bodyLimit())
+	if errors.Is(err, ErrSecretTooLarge) {
+		c.reject(name, err)
+		return 0, nil, "", false
+	}
 	if err != nil {
 		c.Errorf("Error retrieving secret %v: %v", name, err)
-		return nil, false
+		return 0, nil, "", false
 	}
-	c.Infof("GET /secret/%v %d %v", name, resp.StatusCode, time.Since(now))
-	defer resp.Body.Close()
+	c.oversized.remove(name)
+
+	switch status {
+	case 200:
+		return status, data, respHeader.Get("ETag"), true
+	case 304:
+		if etag == "" {
+			c.Errorf("Unexpected response code getting secret %v without an ETag: (status=%v)", name, status)
+			return status, nil, "", false
+		}
+		return status, nil, etag, true
+	case 403:
+		c.Warnf("Access to secret %v forbidden", name)
+		return status, nil, "", false
+	case 404:
+		c.Warnf("Secret %v not found", name)
+		return status, nil, "", false
+	default:
+		c.Errorf("Bad response code getting secret %v: (status=%v, msg='%v')", name, status, data)
+		return status, nil, "", false
+	}
+}
+
+// RawSecretVersion returns raw JSON from requesting a specific version of a secret.
+func (c Client) RawSecretVersion(name, version string) (data []byte, ok bool) {
+	return c.RawSecretVersionCtx(context.Background(), name, version)
+}
 
-	data, err = ioutil.ReadAll(resp.Body)
+// RawSecretVersionCtx returns raw JSON from requesting a specific version of a secret. The request
+// is aborted if ctx is cancelled.
+func (c Client) RawSecretVersionCtx(ctx context.Context, name, version string) (data []byte, ok bool) {
+	status, data, _, err := c.getWithRetry(ctx, fmt.Sprintf("/secret/%v?version=%v", url.PathEscape(name), url.QueryEscape(version)), nil, c.bodyLimit())
 	if err != nil {
-		c.Errorf("Error reading response body for secret %v: %v", name, err)
+		c.Errorf("Error retrieving secret %v version %v: %v", name, version, err)
 		return nil, false
 	}
 
-	switch resp.StatusCode {
+	switch status {
 	case 200:
 		return data, true
 	case 404:
-		c.Warnf("Secret %v not found", name)
+		c.Warnf("Secret %v version %v not found", name, version)
 		return nil, false
 	default:
-		c.Errorf("Bad response code getting secret %v: (status=%v, msg='%v')", name, resp.StatusCode, data)
+		c.Errorf("Bad response code getting secret %v version %v: (status=%v, msg='%v')", name, version, status, data)
+		return nil, false
+	}
+}
+
+// SecretVersion returns an unmarshalled Secret struct after requesting a specific version of a
+// secret. A response for any other version, such as from a server ignoring the version, is treated
+// as not found.
+func (c Client) SecretVersion(name, version string) (secret *Secret, ok bool) {
+	return c.SecretVersionCtx(context.Background(), name, version)
+}
+
+// SecretVersionCtx requests a specific version of a secret like SecretVersion. The request is
+// aborted if ctx is cancelled.
+func (c Client) SecretVersionCtx(ctx context.Context, name, version string) (secret *Secret, ok bool) {
+	data, ok := c.RawSecretVersionCtx(ctx, name, version)
+	if !ok {
 		return nil, false
 	}
+
+	secret, err := ParseSecretWithLimit(data, c.MaxSecretSize)
+	if err != nil {
+		c.Errorf("Error decoding retrieved secret %v version %v: %v", name, version, err)
+		return nil, false
+	}
+	if secret.Version != version {
+		c.Warnf("Secret %v version %v not found, server returned version '%v'", name, version, secret.Version)
+		return nil, false
+	}
+	return secret, true
 }
 
 // Secret returns an unmarshalled Secret struct after requesting a secret.
 func (c Client) Secret(name string) (secret *Secret, ok bool) {
-	data, ok := c.RawSecret(name)
+	return c.SecretCtx(context.Background(), name)
+}
+
+// SecretCtx returns an unmarshalled Secret struct after requesting a secret. The request is
+// aborted if ctx is cancelled.
+func (c Client) SecretCtx(ctx context.Context, name string) (secret *Secret, ok bool) {
+	secret, _, ok = c.SecretIfNoneMatchCtx(ctx, name, "")
+	return secret, ok
+}
+
+// SecretIfNoneMatchCtx requests a secret like SecretCtx, sending etag, the ETag of a previous
+// response, as If-None-Match. notModified reports that the server answered 304 Not Modified, in
+// which case no secret is returned. An empty etag requests the secret unconditionally. The ETag of
+// the response is stored in the returned secret.
+func (c Client) SecretIfNoneMatchCtx(ctx context.Context, name, etag string) (secret *Secret, notModified bool, ok bool) {
+	secret, notModified, _, ok = c.SecretOrForbiddenCtx(ctx, name, etag)
+	return secret, notModified, ok
+}
+
+// SecretOrForbiddenCtx requests a secret like SecretIfNoneMatchCtx. forbidden reports that the
+// server answered 403 Forbidden, because the client is not authorized to read the secret.
+func (c Client) SecretOrForbiddenCtx(ctx context.Context, name, etag string) (secret *Secret, notModified, forbidden, ok bool) {
+	secret, notModified, status, ok := c.SecretWithStatusCtx(ctx, name, etag)
+	return secret, notModified, status == 403, ok
+}
+
+// SecretWithStatusCtx requests a secret like SecretIfNoneMatchCtx, also returning the status of the
+// response, or zero if no response was received.
+func (c Client) SecretWithStatusCtx(ctx context.Context, name, etag string) (secret *Secret, notModified bool, status int, ok bool) {
+	status, data, respETag, ok := c.getSecret(ctx, name, etag)
 	if !ok {
-		return nil, false
+		return nil, false, status, false
+	}
+	if status == 304 {
+		return nil, true, status, true
 	}
 
-	secret, err := ParseSecret(data)
+	// The content is decoded once, checking its size as rawSecret does.
+	secret, err := ParseSecretWithLimit(data, c.MaxSecretSize)
+	if errors.Is(err, ErrSecretTooLarge) {
+		c.reject(name, err)
+		return nil, false, status, false
+	}
 	if err != nil {
 		c.Errorf("Error decoding retrieved secret %v: %v", name, err)
-		return nil, false
+		return nil, false, status, false
 	}
+	secret.ETag = respETag
 
-	return secret, true
+	return secret, false, status, true
+}
+
+// SecretRangeCtx requests size bytes of the raw content of a secret from offset off, with an HTTP
+// Range request accepting application/octet-stream. Only a 206 Partial Content answer for the
+// requested offset is used; any other answer means the server does not support ranges, and its
+// body is not read. Ranges are not limited by MaxSecretSize.
+//
+// If etag is not empty, the range must be of that version of the content: it is sent in If-Match
+// and If-Range headers, so that the server answers 412 Precondition Failed, or 200 OK with the
+// whole current content, once the secret has rotated. The ETag of the answer is returned as tag.
+func (c Client) SecretRangeCtx(ctx context.Context, name string, off int64, size int, etag string) (data []byte, tag string, status int, ok bool) {
+	if off < 0 || size <= 0 {
+		return nil, "", 0, false
+	}
+	header := http.Header{
+		"Accept":          {"application/octet-stream"},
+		"Accept-Encoding": {"identity"}, // ranges of compressed content would be of the encoding
+		"Range":           {fmt.Sprintf("bytes=%d-%d", off, off+int64(size)-1)},
+	}
+	if etag != "" {
+		header.Set("If-Match", etag)
+		header.Set("If-Range", etag)
+	}
+	path := "/secret/" + url.PathEscape(name)
+	var contentRange string
+	status, err := c.eachServer(ctx, func(url string) (int, error) {
+		resp, body, err := c.open(ctx, url, path, header)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		contentRange = resp.Header.Get("Content-Range")
+		tag = resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusPartialContent {
+			return resp.StatusCode, nil
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(body, int64(size)))
+		if err != nil {
+			return 0, fmt.Errorf("Error reading response body: %v", err)
+		}
+		return resp.StatusCode, nil
+	})
+	switch {
+	case err != nil:
+		c.Errorf("Error retrieving range of secret %v: %v", name, err)
+		return nil, "", status, false
+	case etag != "" && (status == http.StatusPreconditionFailed || status == http.StatusOK):
+		c.Warnf("Secret %v changed from version %v while streamed: (status=%v)", name, etag, status)
+		return nil, tag, status, false
+	case status != http.StatusPartialContent:
+		c.Debugf("No range of secret %v: (status=%v)", name, status)
+		return nil, tag, status, false
+	case etag != "" && tag != "" && tag != etag:
+		c.Warnf("Secret %v changed from version %v while streamed: (ETag='%v')", name, etag, tag)
+		return nil, tag, http.StatusPreconditionFailed, false
+	case !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", off)):
+		c.Errorf("Bad range of secret %v: (requested offset %d, Content-Range='%v')", name, off, contentRange)
+		return nil, tag, status, false
+	}
+	return data, tag, status, true
 }
 
 // RawSecretList returns raw JSON from requesting a listing of secrets.
 func (c Client) RawSecretList() (data []byte, ok bool) {
-	now := time.Now()
-	resp, err := c.http().Get(fmt.Sprintf("%v/secrets", c.url))
-	if err != nil {
-		c.Errorf("Error retrieving secrets: %v", err)
-		return nil, false
-	}
-	c.Infof("GET /secrets %d %v", resp.StatusCode, time.Since(now))
-	defer resp.Body.Close()
+	return c.RawSecretListCtx(context.Background())
+}
 
-	data, err = ioutil.ReadAll(resp.Body)
+// RawSecretListCtx returns raw JSON from requesting a listing of secrets. The request is aborted
+// if ctx is cancelled.
+func (c Client) RawSecretListCtx(ctx context.Context) (data []byte, ok bool) {
+	status, data, _, err := c.getWithRetry(ctx, "/secrets", nil, 0)
 	if err != nil {
-		c.Errorf("Error reading response body for secrets: %v", err)
+		c.Errorf("Error retrieving secrets: %v", err)
 		return nil, false
 	}
 
-	if resp.StatusCode != 200 {
-		c.Errorf("Bad response code getting secrets: (status=%v, msg='%v')", resp.StatusCode, data)
+	if status != 200 {
+		c.Errorf("Bad response code getting secrets: (status=%v, msg='%v')", status, data)
 		return nil, false
 	}
 	return data, true
@@ -173,7 +587,13 @@ func (c Client) RawSecretList() (data []byte, ok bool) {
 
 // SecretList returns a slice of unmarshalled Secret structs after requesting a listing of secrets.
 func (c Client) SecretList() (secrets []Secret, ok bool) {
-	data, ok := c.RawSecretList()
+	return c.SecretListCtx(context.Background())
+}
+
+// SecretListCtx returns a slice of unmarshalled Secret structs after requesting a listing of
+// secrets. The request is aborted if ctx is cancelled.
+func (c Client) SecretListCtx(ctx context.Context) (secrets []Secret, ok bool) {
+	data, ok := c.RawSecretListCtx(ctx)
 	if !ok {
 		return nil, false
 	}
@@ -186,9 +606,428 @@ func (c Client) SecretList() (secrets []Secret, ok bool) {
 	return secrets, true
 }
 
-// buildClient constructs a new TLS client.
+// SecretListPartialCtx returns a listing of secrets like SecretListCtx, skipping entries which
+// cannot be decoded rather than failing the whole listing. partial reports whether any were
+// skipped.
+func (c Client) SecretListPartialCtx(ctx context.Context) (secrets []Secret, partial bool, ok bool) {
+	data, ok := c.RawSecretListCtx(ctx)
+	if !ok {
+		return nil, false, false
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		c.Errorf("Error decoding retrieved secrets: %v", err)
+		return nil, false, false
+	}
+	secrets = make([]Secret, 0, len(elements))
+	for i, element := range elements {
+		s, err := parseListElement(element)
+		if err != nil {
+			c.Warnf("Skipping undecodable secret at index %d: %v", i, err)
+			partial = true
+			continue
+		}
+		secrets = append(secrets, *s)
+	}
+	return secrets, partial, true
+}
+
+// SecretListStreamCtx requests a listing of secrets and passes each entry to emit as soon as it is
+// decoded, without waiting for the rest of the response. Entries which cannot be decoded are
+// skipped and reported by partial, as by SecretListPartialCtx. ok reports whether the whole
+// listing was read; entries emitted before a failure remain valid.
+func (c Client) SecretListStreamCtx(ctx context.Context, emit func(Secret)) (partial bool, ok bool) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var resp *http.Response
+	var body io.Reader
+	_, err := c.retry(ctx, "/secrets", func() (int, http.Header, error) {
+		status, err := c.eachServer(ctx, func(url string) (status int, err error) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			resp, body, err = c.open(ctx, url, "/secrets", nil)
+			if err != nil {
+				return 0, err
+			}
+			return resp.StatusCode, nil
+		})
+		if resp == nil {
+			return status, nil, err
+		}
+		return status, resp.Header, err
+	})
+	if err != nil {
+		c.Errorf("Error retrieving secrets: %v", err)
+		return false, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		data, _ := ioutil.ReadAll(body)
+		c.Errorf("Bad response code getting secrets: (status=%v, msg='%v')", resp.StatusCode, data)
+		return false, false
+	}
+
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		c.Errorf("Error decoding retrieved secrets: expected an array, got %v (%v)", token, err)
+		return false, false
+	}
+	for i := 0; decoder.More(); i++ {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			c.Errorf("Error decoding retrieved secrets after %d entries: %v", i, err)
+			return partial, false
+		}
+		s, err := parseListElement(element)
+		if err != nil {
+			c.Warnf("Skipping undecodable secret at index %d: %v", i, err)
+			partial = true
+			continue
+		}
+		emit(*s)
+	}
+	if _, err := decoder.Token(); err != nil {
+		c.Errorf("Error decoding retrieved secrets: %v", err)
+		return partial, false
+	}
+	return partial, true
+}
+
+// parseListElement decodes a single entry of a listing, which must not be null.
+func parseListElement(element json.RawMessage) (*Secret, error) {
+	s, err := ParseSecret(element)
+	if err == nil && s == nil {
+		err = fmt.Errorf("secret is null")
+	}
+	return s, err
+}
+
+// Ping checks that a server responds successfully to a listing request, without retrying or
+// parsing the response. The request is aborted if ctx is cancelled.
+func (c Client) Ping(ctx context.Context) bool {
+	status, _, _, err := c.getAny(ctx, "/secrets", nil, 0)
+	if err != nil {
+		c.Warnf("Ping failed: %v", err)
+		return false
+	}
+	if status != 200 {
+		c.Warnf("Ping failed: (status=%v)", status)
+		return false
+	}
+	return true
+}
+
+// getWithRetry issues a GET request for path with the given request headers on the server,
+// returning the response status, body, and headers. Requests are retried as by retry, within the
+// client timeout. Bodies are limited as by get.
+func (c Client) getWithRetry(ctx context.Context, path string, header http.Header, limit int64) (status int, data []byte, respHeader http.Header, err error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	status, err = c.retry(ctx, path, func() (int, http.Header, error) {
+		var err error
+		status, data, respHeader, err = c.getAny(ctx, path, header, limit)
+		return status, respHeader, err
+	})
+	return
+}
+
+// retry calls attempt until it gives a response which is not retryable. Connection errors and 5xx
+// and 429 responses are retried up to MaxRetries times with exponential backoff and jitter, as
+// long as another attempt fits within the deadline of ctx. A 429 response with a Retry-After
+// header is retried after the wait it requests instead, unless that exceeds MaxRetryAfter. Returns
+// the status and error of the last attempt.
+func (c Client) retry(ctx context.Context, path string, attempt func() (int, http.Header, error)) (status int, err error) {
+	for n := 0; ; n++ {
+		var header http.Header
+		status, header, err = attempt()
+		if !retryable(ctx, status, err) || n >= c.MaxRetries {
+			return
+		}
+
+		backoff := c.backoff(n)
+		if status == http.StatusTooManyRequests {
+			if wait, ok := retryAfter(header, time.Now()); ok {
+				if c.MaxRetryAfter > 0 && wait > c.MaxRetryAfter {
+					c.Warnf("Rate limited on GET %v, not waiting the requested %v", path, wait)
+					return
+				}
+				backoff = wait
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			if status == http.StatusTooManyRequests {
+				c.Warnf("Rate limited on GET %v, not waiting %v past the deadline", path, backoff)
+			}
+			return
+		}
+		c.Warnf("Retrying GET %v in %v (attempt %d of %d)", path, backoff, n+1, c.MaxRetries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getAny issues a GET request for path on each server in turn, as by eachServer.
+func (c Client) getAny(ctx context.Context, path string, header http.Header, limit int64) (status int, data []byte, respHeader http.Header, err error) {
+	status, err = c.eachServer(ctx, func(url string) (int, error) {
+		var err error
+		status, data, respHeader, err = c.get(ctx, url, path, header, limit)
+		return status, err
+	})
+	return
+}
+
+// eachServer calls attempt with each server URL in turn, starting with the preferred one, until one
+// gives a response which is not retryable. That server becomes preferred. Returns the status and
+// error of the last attempt.
+func (c Client) eachServer(ctx context.Context, attempt func(url string) (int, error)) (status int, err error) {
+	start := int(atomic.LoadInt32(c.preferred))
+	for i := range c.urls {
+		n := (start + i) % len(c.urls)
+		status, err = attempt(c.urls[n])
+		if !retryable(ctx, status, err) {
+			if err == nil && n != start {
+				c.Warnf("Failing over to server %v", c.urls[n])
+				atomic.StoreInt32(c.preferred, int32(n))
+			}
+			return
+		}
+		if len(c.urls) > 1 {
+			c.Warnf("Server %v failed: (status=%v, err=%v)", c.urls[n], status, err)
+		}
+	}
+	return
+}
+
+// retryable returns whether a request failed with a connection error, 5xx response, or 429
+// response, and may succeed if attempted again. Secrets rejected as too large are not retried.
+func retryable(ctx context.Context, status int, err error) bool {
+	return (err != nil && ctx.Err() == nil && !errors.Is(err, ErrSecretTooLarge)) || status >= 500 ||
+		status == http.StatusTooManyRequests
+}
+
+// retryAfter returns the wait requested by the Retry-After header of a response received at now,
+// given either in seconds or as an HTTP date. A date in the past requests no wait.
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// get issues a single GET request for path with the given request headers on the server at url
+// bound to ctx, returning the response status, body, and headers. A successful response with a
+// body longer than a positive limit fails with an error wrapping ErrSecretTooLarge.
+func (c Client) get(ctx context.Context, url, path string, header http.Header, limit int64) (status int, data []byte, respHeader http.Header, err error) {
+	resp, body, err := c.open(ctx, url, path, header)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if limit > 0 && resp.StatusCode == 200 {
+		body = io.LimitReader(body, limit+1)
+	}
+	data, err = ioutil.ReadAll(body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("Error reading response body: %v", err)
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return 0, nil, nil, fmt.Errorf("%w: response body exceeds %d bytes", ErrSecretTooLarge, limit)
+	}
+	return resp.StatusCode, data, resp.Header, nil
+}
+
+// metadataAllowance is the room left in a secret response for fields other than content.
+const metadataAllowance = 64 << 10
+
+// bodyLimit returns the largest secret response accepted under MaxSecretSize, or zero if there is
+// no limit.
+func (c Client) bodyLimit() int64 {
+	if c.MaxSecretSize <= 0 {
+		return 0
+	}
+	return (int64(c.MaxSecretSize)+2)/3*4 + metadataAllowance
+}
+
+// TooLarge returns whether the last request for a secret was rejected for exceeding
+// MaxSecretSize.
+func (c Client) TooLarge(name string) bool {
+	return c.oversized.has(name)
+}
+
+// nameSet is a set of names, safe for concurrent use. A nil set is empty and ignores additions.
+type nameSet struct {
+	m    map[string]bool
+	lock sync.Mutex
+}
+
+func newNameSet() *nameSet {
+	return &nameSet{m: make(map[string]bool)}
+}
+
+func (s *nameSet) add(name string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.m[name] = true
+	s.lock.Unlock()
+}
+
+func (s *nameSet) remove(name string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	delete(s.m, name)
+	s.lock.Unlock()
+}
+
+func (s *nameSet) has(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.m[name]
+}
+
+// open issues a single GET request like get, returning the response and a reader of its
+// decompressed body. The caller must close the response body. The request sends the request ID of
+// ctx, or a new one, as X-Request-Id.
+func (c Client) open(ctx context.Context, url, path string, header http.Header) (resp *http.Response, body io.Reader, err error) {
+	req, err := http.NewRequest("GET", url+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	req.Header.Set("User-Agent", c.userAgent())
+	id, ok := RequestID(ctx)
+	if !ok {
+		id = NewRequestID()
+	}
+	req.Header.Set(requestIDHeader, id)
+
+	now := time.Now()
+	resp, err = c.http().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("request %v: %w", id, err)
+	}
+	c.Infof("GET %v %d %v request_id=%v", path, resp.StatusCode, time.Since(now), id)
+
+	body, err = decodeBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("Error decoding response body: %v", err)
+	}
+	return resp, body, nil
+}
+
+// userAgent returns the User-Agent sent with requests.
+func (c Client) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return "keywhizfs/" + VERSION
+}
+
+// acceptEncoding lists the compressed encodings which decodeBody understands.
+const acceptEncoding = "gzip, deflate"
+
+// decodeBody returns a reader of the decompressed body of resp, according to its
+// Content-Encoding. The body is returned as is if it has no encoding, as when a server ignores
+// Accept-Encoding. Deflate is accepted with or without the zlib wrapper, since servers send both.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		body := bufio.NewReader(resp.Body)
+		header, err := body.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+			return zlib.NewReader(body)
+		}
+		return flate.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%v'", encoding)
+	}
+}
+
+// backoff returns the wait before retrying after the given attempt: BaseBackoff doubled for each
+// previous attempt, of which a random half is jitter.
+func (c Client) backoff(attempt int) time.Duration {
+	d := c.BaseBackoff << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// modTime returns the latest modification time of the certificate, key, and ca files. Files which
+// cannot be read are ignored.
+func (p httpClientParams) modTime() (latest time.Time) {
+	for _, file := range []string{p.certFile, p.keyFile, p.caFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return
+}
+
+// buildClient constructs a new TLS client, from a copy of the base client if there is one.
 func (p httpClientParams) buildClient() (client *http.Client, err error) {
-	keyPair, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	transport, config := &http.Transport{}, &tls.Config{}
+	if p.base != nil {
+		switch base := p.base.Transport.(type) {
+		case nil:
+		case *http.Transport:
+			transport = base.Clone()
+			if transport.TLSClientConfig != nil {
+				config = transport.TLSClientConfig
+			}
+		default:
+			return nil, fmt.Errorf("unsupported transport %T, need *http.Transport", base)
+		}
+	}
+
+	var keyPair tls.Certificate
+	if p.certificate != nil {
+		keyPair, err = p.certificate()
+	} else {
+		keyPair, err = tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	}
 	if err != nil {
 		return
 	}
@@ -200,13 +1039,22 @@ func (p httpClientParams) buildClient() (client *http.Client, err error) {
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		RootCAs:      caCertPool,
-		MinVersion:   tls.VersionTLS12, // TLSv1.2 and up is required
-		CipherSuites: ciphers,
+	config.Certificates = []tls.Certificate{keyPair}
+	config.RootCAs = caCertPool
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12 // TLSv1.2 and up is required
+	}
+	if config.CipherSuites == nil {
+		config.CipherSuites = ciphers
 	}
 	config.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: config}
-	return &http.Client{Transport: transport, Timeout: p.timeout}, nil
+	transport.TLSClientConfig = config
+
+	client = &http.Client{}
+	if p.base != nil {
+		*client = *p.base
+	}
+	client.Transport = transport
+	client.Timeout = p.timeout
+	return client, nil
 }
@@ -15,10 +15,28 @@
 package keywhizfs_test
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -67,3 +85,827 @@ func TestClientCallsServer(t *testing.T) {
 	_, ok = client.Secret("non-existent")
 	assert.False(ok)
 }
+
+func TestClientRequestsSecretVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/secret/Tagged_PgPass" && r.URL.Query().Get("version") == "3":
+			fmt.Fprint(w, string(fixture("secretWithMetadata.json")))
+		case r.URL.Path == "/secret/Nobody_PgPass":
+			fmt.Fprint(w, string(fixture("secret.json"))) // ignores the version
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	secret, ok := client.SecretVersion("Tagged_PgPass", "3")
+	if assert.True(ok) {
+		assert.Equal("3", secret.Version)
+		assert.Equal("asddas", string(secret.Content))
+	}
+
+	data, ok := client.RawSecretVersion("Tagged_PgPass", "3")
+	assert.True(ok)
+	assert.Equal(fixture("secretWithMetadata.json"), data)
+
+	_, ok = client.SecretVersion("Tagged_PgPass", "2")
+	assert.False(ok)
+	_, ok = client.SecretVersion("Nobody_PgPass", "2")
+	assert.False(ok, "A response for another version should be rejected")
+}
+
+func TestClientPingDoesNotRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls, healthy int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path != "/secrets" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	assert.False(client.Ping(context.Background()))
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.True(client.Ping(context.Background()))
+}
+
+func TestClientUsesInjectedTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	var identified int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			atomic.AddInt32(&identified, 1)
+		}
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	var dials int32
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{ServerName: "example.com"},
+	}
+	base := &http.Client{Transport: transport, Timeout: time.Second}
+	client := keywhizfs.NewClientWithHTTPClient(clientFile, clientFile, caFile, []string{server.URL}, base, logConfig, false)
+
+	_, ok := client.Secret("Nobody_PgPass")
+	assert.True(ok)
+	_, ok = client.Secret("Nobody_PgPass")
+	assert.True(ok)
+	assert.EqualValues(1, atomic.LoadInt32(&dials), "Connections should be dialed by the transport and reused")
+	assert.EqualValues(2, atomic.LoadInt32(&identified), "The client certificate should be presented")
+	assert.Empty(transport.TLSClientConfig.Certificates, "The injected transport should not be modified")
+}
+
+func TestUnixClientCallsServer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keywhizfs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "keywhiz.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			fmt.Fprint(w, string(fixture("secrets.json")))
+		case "/secret/Nobody_PgPass":
+			fmt.Fprint(w, string(fixture("secret.json")))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	path, err := keywhizfs.SocketPath([]string{"unix://" + socket})
+	assert.NoError(err)
+	assert.Equal(socket, path)
+
+	client := keywhizfs.NewUnixClient(path, time.Second, logConfig, false)
+	secret, ok := client.Secret("Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal("Nobody_PgPass", secret.Name)
+	_, ok = client.SecretList()
+	assert.True(ok)
+	_, ok = client.Secret("unknown")
+	assert.False(ok)
+	assert.NoError(client.ReloadCertificates())
+}
+
+func TestSocketPath(t *testing.T) {
+	assert := assert.New(t)
+
+	path, err := keywhizfs.SocketPath([]string{"https://a:4444", "https://b:4444"})
+	assert.NoError(err)
+	assert.Empty(path)
+
+	_, err = keywhizfs.SocketPath([]string{"https://a:4444", "unix:///run/keywhiz.sock"})
+	assert.Error(err, "A socket cannot be combined with TCP servers")
+	_, err = keywhizfs.SocketPath([]string{"unix:///a.sock", "unix:///b.sock"})
+	assert.Error(err, "Only one socket is allowed")
+	_, err = keywhizfs.SocketPath([]string{"unix://"})
+	assert.Error(err)
+}
+
+func TestClientSkipsUndecodableListEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[%s, {"name": "Broken", "secret": "!!!"}, null]`, fixture("secret.json"))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	secrets, partial, ok := client.SecretListPartialCtx(context.Background())
+	assert.True(ok)
+	assert.True(partial)
+	if assert.Len(secrets, 1) {
+		assert.Equal("Nobody_PgPass", secrets[0].Name)
+	}
+
+	_, ok = client.SecretList()
+	assert.False(ok, "A strict listing should fail")
+}
+
+func TestClientStreamsListing(t *testing.T) {
+	assert := assert.New(t)
+
+	stall := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[%s, null,`, fixture("secret.json"))
+		w.(http.Flusher).Flush()
+		<-stall
+		fmt.Fprintf(w, `%s]`, fixture("secretNormalOwner.json"))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	names := make(chan string, 2)
+	done := make(chan bool, 1)
+	go func() {
+		partial, ok := client.SecretListStreamCtx(context.Background(), func(s keywhizfs.Secret) { names <- s.Name })
+		done <- partial && ok
+	}()
+
+	// The first secret arrives while the server stalls on the rest.
+	select {
+	case name := <-names:
+		assert.Equal("Nobody_PgPass", name)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the first secret before the listing completes")
+	}
+	close(stall)
+	assert.True(<-done, "Expected a complete listing with the null entry skipped")
+	assert.Len(names, 1)
+}
+
+func TestClientAbortsCancelledRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Minute, logConfig, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, ok := client.SecretCtx(ctx, "foo")
+	assert.False(ok)
+	assert.True(time.Since(start) < time.Second, "request was not aborted")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start = time.Now()
+	_, ok = client.SecretListCtx(ctx)
+	assert.False(ok)
+	assert.True(time.Since(start) < time.Second, "request was not aborted")
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/secrets"):
+			fmt.Fprint(w, string(fixture("secrets.json")))
+		default:
+			fmt.Fprint(w, string(fixture("secret.json")))
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	client.MaxRetries = 3
+	client.BaseBackoff = time.Millisecond
+
+	secret, ok := client.Secret("foo")
+	assert.True(ok)
+	assert.Equal("Nobody_PgPass", secret.Name)
+	assert.EqualValues(3, atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	secrets, ok := client.SecretList()
+	assert.True(ok)
+	assert.Len(secrets, 2)
+	assert.EqualValues(3, atomic.LoadInt32(&requests))
+}
+
+func TestClientGivesUpAfterMaxRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	client.MaxRetries = 2
+	client.BaseBackoff = time.Millisecond
+
+	_, ok := client.Secret("foo")
+	assert.False(ok)
+	assert.EqualValues(3, atomic.LoadInt32(&requests))
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, code := range []int{401, 403, 404} {
+		var requests int32
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(code)
+		}))
+
+		client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+		client.MaxRetries = 3
+		client.BaseBackoff = time.Millisecond
+
+		_, ok := client.Secret("foo")
+		assert.False(ok)
+		_, ok = client.SecretList()
+		assert.False(ok)
+		assert.EqualValues(2, atomic.LoadInt32(&requests), "status %d", code)
+		server.Close()
+	}
+}
+
+func TestClientRetriesRespectTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, 200*time.Millisecond, logConfig, false)
+	client.MaxRetries = 5
+	client.BaseBackoff = time.Second
+
+	start := time.Now()
+	_, ok := client.Secret("foo")
+	assert.False(ok)
+	assert.True(time.Since(start) < time.Second, "retries exceeded the client timeout")
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		retryAfter string
+		wait       time.Duration
+	}{
+		{"1", time.Second},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0}, // a past date waits no longer
+		{"", 0}, // without the header, the usual backoff applies
+	} {
+		var requests int32
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				if c.retryAfter != "" {
+					w.Header().Set("Retry-After", c.retryAfter)
+				}
+				w.WriteHeader(429)
+				return
+			}
+			fmt.Fprint(w, string(fixture("secret.json")))
+		}))
+
+		client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, 5*time.Second, logConfig, false)
+		client.MaxRetries = 2
+		client.BaseBackoff = time.Millisecond
+
+		start := time.Now()
+		_, ok := client.Secret("Nobody_PgPass")
+		elapsed := time.Since(start)
+		assert.True(ok, "Retry-After '%v'", c.retryAfter)
+		assert.EqualValues(2, atomic.LoadInt32(&requests))
+		assert.True(elapsed >= c.wait, "Retried after %v, expected %v", elapsed, c.wait)
+		assert.True(elapsed < c.wait+time.Second, "Retried after %v, expected %v", elapsed, c.wait)
+		server.Close()
+	}
+}
+
+func TestClientDoesNotWaitPastRetryAfterLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(429)
+	}))
+	defer server.Close()
+
+	// Waiting would exceed MaxRetryAfter, and then the client timeout.
+	for _, c := range []struct{ timeout, maxRetryAfter time.Duration }{
+		{10 * time.Second, 100 * time.Millisecond},
+		{500 * time.Millisecond, 0},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, c.timeout, logConfig, false)
+		client.MaxRetries = 2
+		client.MaxRetryAfter = c.maxRetryAfter
+
+		start := time.Now()
+		_, ok := client.Secret("Nobody_PgPass")
+		assert.False(ok)
+		assert.True(time.Since(start) < 200*time.Millisecond, "Waited for Retry-After")
+		assert.EqualValues(1, atomic.LoadInt32(&requests))
+	}
+
+	// A lookup then falls back to the cache at once, instead of at the backend deadline.
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, 10*time.Second, logConfig, false)
+	client.MaxRetryAfter = 100 * time.Millisecond
+	cache := keywhizfs.NewCache(&client, keywhizfs.Timeouts{BackendDeadline: 5 * time.Second, BackendTimeout: 10 * time.Second}, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Nobody_PgPass", Content: []byte("asddas")})
+	start := time.Now()
+	secret, ok := cache.Secret("Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal("asddas", string(secret.Content))
+	assert.True(time.Since(start) < time.Second, "Waited for the backend deadline")
+}
+
+func TestCacheRemembersOnlyReportedNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/secret/missing":
+			w.WriteHeader(404)
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	client.MaxRetries = 0
+	observed := keywhizfs.Chain(&client, keywhizfs.Observe(func(string, bool, time.Duration) {}))
+	for _, backend := range []keywhizfs.SecretBackend{&client, observed} {
+		lock.Lock()
+		requests = make(map[string]int)
+		lock.Unlock()
+		cache := keywhizfs.NewCache(backend, keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Second, NegativeTTL: time.Hour}, logConfig)
+
+		// Only the secret the server reported not found is remembered missing.
+		for i := 0; i < 2; i++ {
+			_, ok := cache.Secret("missing")
+			assert.False(ok)
+			_, ok = cache.Secret("failing")
+			assert.False(ok)
+		}
+		lock.Lock()
+		assert.Equal(map[string]int{"/secret/missing": 1, "/secret/failing": 2}, requests)
+		lock.Unlock()
+	}
+}
+
+// writeClientCert generates a self-signed client certificate with the given common name, writing
+// the certificate and key in PEM format to path.
+func writeClientCert(t *testing.T, path, commonName string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReloadsCertificates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-certs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.pem")
+	writeClientCert(t, certFile, "first")
+
+	presented := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented <- r.TLS.PeerCertificates[0].Subject.CommonName
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := keywhizfs.NewClient(certFile, certFile, caFile, server.URL, time.Second, logConfig, false)
+
+	_, ok := client.SecretList()
+	assert.True(ok)
+	assert.Equal("first", <-presented)
+
+	writeClientCert(t, certFile, "second")
+	assert.NoError(client.ReloadCertificates())
+	_, ok = client.SecretList()
+	assert.True(ok)
+	assert.Equal("second", <-presented)
+
+	// A broken certificate is rejected and the previous one stays in use.
+	assert.NoError(ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	assert.Error(client.ReloadCertificates())
+	_, ok = client.SecretList()
+	assert.True(ok)
+	assert.Equal("second", <-presented)
+}
+
+func TestClientWatchesCertificates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-certs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.pem")
+	writeClientCert(t, certFile, "first")
+
+	var presented atomic.Value
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := keywhizfs.NewClient(certFile, certFile, caFile, server.URL, time.Second, logConfig, false)
+	stop := client.WatchCertificates(10 * time.Millisecond)
+	defer stop()
+
+	_, ok := client.SecretList()
+	assert.True(ok)
+	assert.Equal("first", presented.Load())
+
+	// The rewritten file is noticed without an explicit reload.
+	writeClientCert(t, certFile, "second")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, later, later))
+	deadline := time.Now().Add(5 * time.Second)
+	for presented.Load() != "second" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		client.SecretList()
+	}
+	assert.Equal("second", presented.Load())
+}
+
+func TestClientFailsOverToHealthyServer(t *testing.T) {
+	assert := assert.New(t)
+
+	down := httptest.NewTLSServer(http.NotFoundHandler())
+	down.Close()
+
+	var failingRequests, healthyRequests int32
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingRequests, 1)
+		w.WriteHeader(503)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyRequests, 1)
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	defer healthy.Close()
+
+	servers := []string{down.URL, failing.URL, healthy.URL}
+	client := keywhizfs.NewClientWithServers(clientFile, clientFile, caFile, servers, time.Second, logConfig, false)
+	client.MaxRetries = 0
+
+	secret, ok := client.Secret("foo")
+	assert.True(ok)
+	assert.Equal("Nobody_PgPass", secret.Name)
+	assert.EqualValues(1, atomic.LoadInt32(&failingRequests))
+	assert.EqualValues(1, atomic.LoadInt32(&healthyRequests))
+
+	// The healthy server is now preferred.
+	_, ok = client.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues(1, atomic.LoadInt32(&failingRequests))
+	assert.EqualValues(2, atomic.LoadInt32(&healthyRequests))
+}
+
+func TestClientDoesNotFailOverOnNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	first := httptest.NewTLSServer(http.NotFoundHandler())
+	defer first.Close()
+	var secondRequests int32
+	second := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondRequests, 1)
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	defer second.Close()
+
+	servers := []string{first.URL, second.URL}
+	client := keywhizfs.NewClientWithServers(clientFile, clientFile, caFile, servers, time.Second, logConfig, false)
+
+	_, ok := client.Secret("foo")
+	assert.False(ok)
+	assert.EqualValues(0, atomic.LoadInt32(&secondRequests))
+}
+
+func TestClientConditionalSecretRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	secret, notModified, ok := client.SecretIfNoneMatchCtx(context.Background(), "Nobody_PgPass", "")
+	assert.True(ok)
+	assert.False(notModified)
+	assert.Equal(`"v1"`, secret.ETag)
+
+	secret, notModified, ok = client.SecretIfNoneMatchCtx(context.Background(), "Nobody_PgPass", `"v1"`)
+	assert.True(ok)
+	assert.True(notModified)
+	assert.Nil(secret)
+
+	secret, notModified, ok = client.SecretIfNoneMatchCtx(context.Background(), "Nobody_PgPass", `"v0"`)
+	assert.True(ok)
+	assert.False(notModified)
+	assert.Equal("Nobody_PgPass", secret.Name)
+}
+
+func TestClientReportsForbiddenSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secret/Forbidden_Pass":
+			w.WriteHeader(403)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+
+	_, _, forbidden, ok := client.SecretOrForbiddenCtx(context.Background(), "Forbidden_Pass", "")
+	assert.False(ok)
+	assert.True(forbidden)
+
+	_, _, forbidden, ok = client.SecretOrForbiddenCtx(context.Background(), "Missing_Pass", "")
+	assert.False(ok)
+	assert.False(forbidden)
+}
+
+func TestClientRejectsOversizedSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	var hugeRequests int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secret/Small_Token":
+			w.Write(fixture("secretUnderSizeLimit.json"))
+		case "/secret/Large_Token":
+			w.Write(fixture("secretOverSizeLimit.json"))
+		case "/secret/Huge_Token":
+			atomic.AddInt32(&hugeRequests, 1)
+			fmt.Fprintf(w, `{"name": "Huge_Token", "secret": "%s"}`, strings.Repeat("eHh4", 1<<20))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	client.MaxSecretSize = 16
+
+	secret, ok := client.Secret("Small_Token")
+	assert.True(ok)
+	assert.Len(secret.Content, 16)
+	assert.False(client.TooLarge("Small_Token"))
+
+	_, ok = client.Secret("Large_Token")
+	assert.False(ok)
+	assert.True(client.TooLarge("Large_Token"))
+
+	// Raw JSON is checked the same way, and returned unchanged by the check.
+	data, ok := client.RawSecret("Small_Token")
+	assert.True(ok)
+	assert.Equal(fixture("secretUnderSizeLimit.json"), data)
+	_, ok = client.RawSecret("Large_Token")
+	assert.False(ok)
+
+	// A response far over the limit is abandoned without reading it whole, and not retried.
+	_, ok = client.Secret("Huge_Token")
+	assert.False(ok)
+	assert.True(client.TooLarge("Huge_Token"))
+	assert.EqualValues(1, atomic.LoadInt32(&hugeRequests))
+
+	// Once the limit allows it, the secret is accepted again.
+	client.MaxSecretSize = 0
+	_, ok = client.Secret("Large_Token")
+	assert.True(ok)
+	assert.False(client.TooLarge("Large_Token"))
+
+	_, ok = client.Secret("Missing_Token")
+	assert.False(ok)
+	assert.False(client.TooLarge("Missing_Token"))
+}
+
+func TestClientSendsIdentifyingHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	var userAgents, requestIDs []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		requestIDs = append(requestIDs, r.Header.Get("X-Request-Id"))
+		lock.Unlock()
+		w.Write(fixture("secret.json"))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	_, ok := client.Secret("Nobody_PgPass")
+	assert.True(ok)
+	_, ok = client.Secret("Nobody_PgPass")
+	assert.True(ok)
+
+	client.UserAgent = "deploy-agent/1.0"
+	ctx := keywhizfs.WithRequestID(context.Background(), "0123456789abcdef")
+	_, ok = client.SecretCtx(ctx, "Nobody_PgPass")
+	assert.True(ok)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal([]string{"keywhizfs/" + keywhizfs.VERSION, "keywhizfs/" + keywhizfs.VERSION, "deploy-agent/1.0"}, userAgents)
+	assert.Len(requestIDs, 3)
+	assert.NotEmpty(requestIDs[0])
+	assert.NotEqual(requestIDs[0], requestIDs[1], "Expected a new ID for each request")
+	assert.Equal("0123456789abcdef", requestIDs[2])
+}
+
+func TestClientUsesCertificateSource(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write(fixture("secret.json"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	var calls int32
+	source := func() (tls.Certificate, error) {
+		atomic.AddInt32(&calls, 1)
+		return tls.LoadX509KeyPair(clientFile, clientFile)
+	}
+	client := keywhizfs.NewClientWithCertificate(source, caFile, []string{server.URL}, time.Second, logConfig, false)
+	_, ok := client.Secret("Nobody_PgPass")
+	assert.True(ok)
+
+	// Reloading asks the source again.
+	assert.NoError(client.ReloadCertificates())
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+}
+
+func TestClientDecompressesResponses(t *testing.T) {
+	assert := assert.New(t)
+
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+		"": nil, // The server ignores Accept-Encoding.
+	}
+	for encoding, encoder := range encoders {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+			if encoder == nil {
+				fmt.Fprint(w, string(fixture("secrets.json")))
+				return
+			}
+			if encoding == "raw" {
+				w.Header().Set("Content-Encoding", "deflate")
+			} else {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			body := encoder(w)
+			body.Write(fixture("secrets.json"))
+			body.Close()
+		}))
+
+		client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+		secrets, ok := client.SecretList()
+		assert.True(ok, "Expected %v response to be decoded", encoding)
+		assert.Len(secrets, 2)
+		server.Close()
+	}
+}
+
+func TestClientRejectsCorruptCompressedResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	client.MaxRetries = 0
+	_, ok := client.SecretList()
+	assert.False(ok)
+}
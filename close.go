@@ -0,0 +1,56 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrCacheClosed is returned by the methods of a Cache after Close, including Close itself.
+var ErrCacheClosed = errors.New("cache closed")
+
+// SetPersistPath sets a file to which Close writes the cache, as Persist does, before zeroing it.
+// An empty path, the default, means Close does not persist the cache.
+func (c *Cache) SetPersistPath(path string) {
+	c.persistTo.Store(path)
+}
+
+// Close stops the goroutines of StartRefresh and StartWarmup, persists the cache if a path was set
+// by SetPersistPath, zeroes the content of cached secrets, and closes the channels returned by
+// Subscribe. Backend requests already in flight complete, but are no longer cached.
+//
+// Lookups on a closed cache find nothing, and methods returning an error return ErrCacheClosed,
+// as does calling Close again.
+func (c *Cache) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrCacheClosed
+	}
+	close(c.done)
+
+	var err error
+	if path, _ := c.persistTo.Load().(string); path != "" {
+		err = c.persist(path)
+	}
+	c.Clear()
+	c.subscribers.closeAll()
+	c.Infof("Cache closed")
+	return err
+}
+
+// isClosed returns whether Close was called.
+func (c *Cache) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheCloseStopsRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cached := *secretFixture
+	cached.Content = append([]byte(nil), secretFixture.Content...)
+	cache.Add(cached)
+	events, cancel := cache.Subscribe()
+
+	cache.StartRefresh(time.Millisecond)
+	assert.True(eventually(func() bool { return atomic.LoadInt32(backend.calls) > 1 }, time.Second))
+
+	assert.NoError(cache.Close())
+	time.Sleep(5 * time.Millisecond) // for a refresh already in flight
+	calls := atomic.LoadInt32(backend.calls)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(calls, atomic.LoadInt32(backend.calls))
+
+	// Cached content is zeroed, and subscriptions end.
+	assert.Equal(make([]byte, len(cached.Content)), []byte(cached.Content))
+	assert.Equal(0, cache.Len())
+	for range events {
+	}
+	cancel() // safe after Close
+
+	// Later calls report the cache closed, and Close is idempotent.
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Empty(cache.SecretList())
+	_, err := cache.Secrets([]string{secretFixture.Name})
+	assert.Equal(keywhizfs.ErrCacheClosed, err)
+	assert.Equal(keywhizfs.ErrCacheClosed, cache.Prefetch(1))
+	assert.Equal(keywhizfs.ErrCacheClosed, cache.Close())
+	assert.Equal(keywhizfs.ErrCacheClosed, cache.Close())
+	later, _ := cache.Subscribe()
+	_, open := <-later
+	assert.False(open)
+}
+
+func TestCacheClosePersists(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-close")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.SetPersistPath(path)
+	cache.Add(*secretFixture.Clone())
+	assert.NoError(cache.Close())
+	assert.Equal(keywhizfs.ErrCacheClosed, cache.Persist(path))
+	assert.Equal(keywhizfs.ErrCacheClosed, cache.Load(path))
+
+	restored := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	assert.NoError(restored.Load(path))
+	secret, ok := restored.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture.Content, secret.Content)
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetMaxBackendConcurrency limits the number of backend requests outstanding at once across all
+// names. Further requests wait for a slot until BackendTimeout, after which they are abandoned and
+// lookups fall back to the cache. A max of zero or less removes the limit. It should be set before
+// the cache is used.
+func (c *Cache) SetMaxBackendConcurrency(max int) {
+	c.slots.lock.Lock()
+	defer c.slots.lock.Unlock()
+	c.slots.c = nil
+	if max > 0 {
+		c.slots.c = make(chan struct{}, max)
+	}
+}
+
+// admit waits for a backend request slot, for up to BackendTimeout. Returns whether the request
+// may proceed, and if so a function to release the slot once the request is done.
+func (c *Cache) admit(ctx context.Context, name string) (release func(), ok bool) {
+	releaseSlot, ok := c.slots.acquire(ctx, c.Timeouts().BackendTimeout)
+	if !ok {
+		c.Debugf("Too many backend requests in flight, skipping backend: %v", name)
+		count(&c.stats.rateLimited)
+		return nil, false
+	}
+	atomic.AddInt64(&c.stats.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&c.stats.inFlight, -1)
+		releaseSlot()
+	}, true
+}
+
+// semaphore bounds concurrent holders to the capacity of its channel. The zero value is unbounded.
+type semaphore struct {
+	c    chan struct{}
+	lock sync.Mutex
+}
+
+// acquire takes a slot, waiting up to max for one to be released. Returns false if none was
+// released in time, or if ctx is done while waiting.
+func (s *semaphore) acquire(ctx context.Context, max time.Duration) (release func(), ok bool) {
+	s.lock.Lock()
+	slots := s.c
+	s.lock.Unlock()
+	if slots == nil {
+		return func() {}, true
+	}
+
+	release = func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	timer := time.NewTimer(max)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
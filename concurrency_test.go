@@ -0,0 +1,98 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// ConcurrencyBackend serves every name after a delay, recording the most requests in flight.
+type ConcurrencyBackend struct {
+	delay             time.Duration
+	inFlight, maxSeen *int32
+}
+
+func (b ConcurrencyBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	n := atomic.AddInt32(b.inFlight, 1)
+	defer atomic.AddInt32(b.inFlight, -1)
+	for {
+		seen := atomic.LoadInt32(b.maxSeen)
+		if n <= seen || atomic.CompareAndSwapInt32(b.maxSeen, seen, n) {
+			break
+		}
+	}
+	time.Sleep(b.delay)
+	return &keywhizfs.Secret{Name: name, Content: []byte("asddas")}, true
+}
+
+func (b ConcurrencyBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return nil, false
+}
+
+func TestCacheSerializesBackendRequestsAtConcurrencyOne(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ConcurrencyBackend{delay: 10 * time.Millisecond, inFlight: new(int32), maxSeen: new(int32)}
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Second}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	cache.SetMaxBackendConcurrency(1)
+
+	var wg sync.WaitGroup
+	var found int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := cache.Secret(fmt.Sprintf("secret-%d", i)); ok {
+				atomic.AddInt32(&found, 1)
+			}
+		}(i)
+	}
+
+	// Requests beyond the limit are reported in flight only once admitted.
+	assert.True(eventually(func() bool { return cache.Stats().BackendInFlight == 1 }, time.Second))
+	wg.Wait()
+
+	assert.EqualValues(5, found)
+	assert.EqualValues(1, atomic.LoadInt32(backend.maxSeen))
+	assert.EqualValues(0, cache.Stats().BackendInFlight)
+	assert.EqualValues(5, cache.Stats().BackendCalls)
+}
+
+func TestCacheConcurrencyLimitFallsBackToCache(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ConcurrencyBackend{delay: 500 * time.Millisecond, inFlight: new(int32), maxSeen: new(int32)}
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: 20 * time.Millisecond, BackendTimeout: 200 * time.Millisecond}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	cache.SetMaxBackendConcurrency(1)
+	cache.Add(keywhizfs.Secret{Name: "cached", Content: []byte("cached")})
+
+	// Hold the only slot, so the lookup of the cached secret cannot reach the backend.
+	go cache.Secret("slow")
+	assert.True(eventually(func() bool { return atomic.LoadInt32(backend.inFlight) == 1 }, time.Second))
+
+	secret, ok := cache.Secret("cached")
+	assert.True(ok)
+	assert.Equal("cached", string(secret.Content))
+	assert.True(eventually(func() bool { return cache.Stats().RateLimited == 1 }, time.Second))
+}
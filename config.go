@@ -0,0 +1,181 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/square/keywhizfs/log"
+)
+
+// Config holds settings read from a JSON configuration file. Fields left out of the file are empty
+// and leave the corresponding setting unchanged.
+type Config struct {
+	// Server is a server URL, or several separated by commas.
+	Server     string `json:"server"`
+	Mountpoint string `json:"mountpoint"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	CA         string `json:"ca"`
+
+	Fresh           *Duration `json:"fresh"`
+	BackendDeadline *Duration `json:"backend_deadline"`
+	MaxWait         *Duration `json:"max_wait"` // sets Timeouts.BackendTimeout
+	NegativeTTL     *Duration `json:"negative_ttl"`
+
+	Debug     *bool  `json:"debug"`
+	LogFormat string `json:"log_format"`
+}
+
+// Duration is a time.Duration written in JSON as a string accepted by time.ParseDuration, such as
+// "200ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string, got '%s' (%v)", data, err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads a configuration file. Unknown keys are an error. Environment variables written
+// as ${VAR} or $VAR are expanded in the server, mountpoint, cert, key and ca settings, and a
+// variable which is not set is an error.
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read config: %v", err)
+	}
+	defer file.Close()
+
+	var config Config
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON config %v: %v", path, err)
+	}
+	if err = config.expandPaths(); err != nil {
+		return nil, fmt.Errorf("Fail to expand config %v: %v", path, err)
+	}
+	return &config, nil
+}
+
+// expandPaths expands environment variables in the path-valued settings, failing on the first
+// variable which is not set rather than leaving an empty path.
+func (c *Config) expandPaths() error {
+	fields := []struct {
+		key   string
+		value *string
+	}{
+		{"server", &c.Server},
+		{"mountpoint", &c.Mountpoint},
+		{"cert", &c.Cert},
+		{"key", &c.Key},
+		{"ca", &c.CA},
+	}
+	for _, f := range fields {
+		var undefined []string
+		expanded := os.Expand(*f.value, func(name string) string {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				undefined = append(undefined, name)
+			}
+			return value
+		})
+		if len(undefined) > 0 {
+			return fmt.Errorf("%v refers to undefined environment variables: %v", f.key, strings.Join(undefined, ", "))
+		}
+		*f.value = expanded
+	}
+	return nil
+}
+
+// ApplyLog returns logConfig with the log settings in the config replaced.
+func (c Config) ApplyLog(logConfig log.Config) log.Config {
+	if c.Debug != nil {
+		logConfig.Debug = *c.Debug
+	}
+	if c.LogFormat != "" {
+		logConfig.Format = c.LogFormat
+	}
+	return logConfig
+}
+
+// RestartRequired returns the keys of settings which are set, differ from running, and cannot be
+// changed while mounted.
+func (c Config) RestartRequired(running Config) (keys []string) {
+	fields := []struct {
+		key            string
+		value, current string
+	}{
+		{"server", c.Server, running.Server},
+		{"mountpoint", c.Mountpoint, running.Mountpoint},
+		{"cert", c.Cert, running.Cert},
+		{"key", c.Key, running.Key},
+		{"ca", c.CA, running.CA},
+		{"log_format", c.LogFormat, running.LogFormat},
+	}
+	for _, f := range fields {
+		if f.value != "" && f.value != f.current {
+			keys = append(keys, f.key)
+		}
+	}
+	return keys
+}
+
+// ApplyTimeouts returns timeouts with the values set in the config replaced.
+func (c Config) ApplyTimeouts(timeouts Timeouts) Timeouts {
+	if c.Fresh != nil {
+		timeouts.Fresh = time.Duration(*c.Fresh)
+	}
+	if c.BackendDeadline != nil {
+		timeouts.BackendDeadline = time.Duration(*c.BackendDeadline)
+	}
+	if c.MaxWait != nil {
+		timeouts.BackendTimeout = time.Duration(*c.MaxWait)
+	}
+	if c.NegativeTTL != nil {
+		timeouts.NegativeTTL = time.Duration(*c.NegativeTTL)
+	}
+	return timeouts
+}
+
+// Reload applies the settings in config which can change while mounted: the cache timeouts and
+// debug logging.
+func (kwfs KeywhizFs) Reload(config *Config) {
+	kwfs.Cache.SetTimeouts(config.ApplyTimeouts(kwfs.Cache.Timeouts()))
+	if config.Debug != nil {
+		kwfs.SetDebug(*config.Debug)
+		kwfs.Cache.SetDebug(*config.Debug)
+		if kwfs.Client != nil {
+			kwfs.Client.SetDebug(*config.Debug)
+		}
+	}
+	kwfs.Infof("Configuration reloaded")
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := keywhizfs.LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	assert.True(*config.Debug)
+	assert.Nil(config.NegativeTTL)
+
+	initial := keywhizfs.Timeouts{Fresh: time.Second, BackendDeadline: time.Second, BackendTimeout: time.Second, NegativeTTL: time.Minute}
+	expected := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 250 * time.Millisecond, BackendTimeout: 5 * time.Second, NegativeTTL: time.Minute}
+	assert.Equal(expected, config.ApplyTimeouts(initial))
+
+	_, err = keywhizfs.LoadConfig("fixtures/non-existent.json")
+	assert.Error(err)
+}
+
+func TestLoadConfigSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := keywhizfs.LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	assert.Equal("https://keywhiz-a.example.com:4444,https://keywhiz-b.example.com:4444", config.Server)
+	assert.Equal("/run/secrets", config.Mountpoint)
+	assert.Equal("client.crt", config.Cert)
+	assert.Equal("client.key", config.Key)
+	assert.Equal("cacert.crt", config.CA)
+
+	expected := log.Config{Debug: true, Mountpoint: "/run/secrets", Format: log.FormatJSON}
+	assert.Equal(expected, config.ApplyLog(log.Config{Mountpoint: "/run/secrets"}))
+
+	// Empty settings leave the log config unchanged.
+	assert.Equal(expected, keywhizfs.Config{}.ApplyLog(expected))
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	_, err := keywhizfs.LoadConfig("fixtures/configWithUnknownKey.json")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fresh_threshold")
+}
+
+func TestLoadConfigExpandsEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-config")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	os.Setenv("KWFS_TEST_HOST", "keywhiz.example.com")
+	os.Setenv("KWFS_TEST_DIR", "/etc/keywhiz")
+	defer os.Unsetenv("KWFS_TEST_HOST")
+	defer os.Unsetenv("KWFS_TEST_DIR")
+	os.Unsetenv("KWFS_TEST_UNSET")
+
+	data := `{"server": "https://${KWFS_TEST_HOST}:4444", "mountpoint": "/run/$KWFS_TEST_HOST", "cert": "${KWFS_TEST_DIR}/client.crt", "key": "$KWFS_TEST_DIR/client.key", "ca": "cacert.crt"}`
+	assert.NoError(ioutil.WriteFile(path, []byte(data), 0644))
+	config, err := keywhizfs.LoadConfig(path)
+	if assert.NoError(err) {
+		assert.Equal("https://keywhiz.example.com:4444", config.Server)
+		assert.Equal("/run/keywhiz.example.com", config.Mountpoint)
+		assert.Equal("/etc/keywhiz/client.crt", config.Cert)
+		assert.Equal("/etc/keywhiz/client.key", config.Key)
+		assert.Equal("cacert.crt", config.CA)
+	}
+
+	// An unset variable is an error, rather than an empty path.
+	assert.NoError(ioutil.WriteFile(path, []byte(`{"cert": "${KWFS_TEST_UNSET}/client.crt"}`), 0644))
+	_, err = keywhizfs.LoadConfig(path)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "cert")
+		assert.Contains(err.Error(), "KWFS_TEST_UNSET")
+	}
+
+	// A variable set to be empty is expanded.
+	os.Setenv("KWFS_TEST_UNSET", "")
+	defer os.Unsetenv("KWFS_TEST_UNSET")
+	config, err = keywhizfs.LoadConfig(path)
+	if assert.NoError(err) {
+		assert.Equal("/client.crt", config.Cert)
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	assert := assert.New(t)
+
+	running, err := keywhizfs.LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+
+	reloaded := *running
+	fresh := keywhizfs.Duration(time.Minute)
+	reloaded.Fresh = &fresh
+	assert.Empty(reloaded.RestartRequired(*running))
+
+	reloaded.Mountpoint = "/tmp/elsewhere"
+	reloaded.Key = "other.key"
+	assert.Equal([]string{"mountpoint", "key"}, reloaded.RestartRequired(*running))
+}
+
+func TestReloadChangesFreshThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, "https://localhost:0", timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, err := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{}, timeouts, logConfig)
+	assert.NoError(err)
+	kwfs.Cache = keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	kwfs.Cache.Add(*secretFixture)
+
+	// Not fresh, so the failing backend is asked before falling back to the cache.
+	kwfs.Cache.Secret(secretFixture.Name)
+	assert.EqualValues(1, kwfs.Cache.Stats().BackendCalls)
+
+	config, err := keywhizfs.LoadConfig("fixtures/config.json")
+	assert.NoError(err)
+	kwfs.Reload(config)
+	assert.Equal(time.Hour, kwfs.Cache.Timeouts().Fresh)
+
+	// Fresh under the reloaded threshold, so served without the backend.
+	kwfs.Cache.Add(*secretFixture)
+	kwfs.Cache.Secret(secretFixture.Name)
+	assert.EqualValues(1, kwfs.Cache.Stats().BackendCalls)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConflictPolicy determines which value is served when the backend answers with content for a
+// secret which fails validation. See SetValidator.
+type ConflictPolicy int
+
+const (
+	// ConflictValidatedBackendWins rejects invalid content. The cached value, if any, is served
+	// instead, and the backend asked again on the next lookup which finds it no longer fresh.
+	ConflictValidatedBackendWins ConflictPolicy = iota
+	// ConflictBackendWins caches and serves content from the backend even if it fails validation.
+	ConflictBackendWins
+	// ConflictSticky rejects invalid content like ConflictValidatedBackendWins, and also renews the
+	// cached value as though the backend had answered with it, so it is served as fresh without
+	// asking the backend again until Timeouts.Fresh passes.
+	ConflictSticky
+)
+
+// ParseConflictPolicy returns the ConflictPolicy named by s, either "validated-backend-wins",
+// "backend-wins" or "sticky".
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "validated-backend-wins":
+		return ConflictValidatedBackendWins, nil
+	case "backend-wins":
+		return ConflictBackendWins, nil
+	case "sticky":
+		return ConflictSticky, nil
+	}
+	return ConflictValidatedBackendWins, fmt.Errorf("unknown conflict policy '%v'", s)
+}
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictValidatedBackendWins:
+		return "validated-backend-wins"
+	case ConflictBackendWins:
+		return "backend-wins"
+	case ConflictSticky:
+		return "sticky"
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// conflictPolicies holds the conflict policy of every secret, overridden for some by name.
+type conflictPolicies struct {
+	global ConflictPolicy
+	m      map[string]ConflictPolicy
+	lock   sync.RWMutex
+}
+
+func (p *conflictPolicies) get(name string) ConflictPolicy {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if policy, ok := p.m[name]; ok {
+		return policy
+	}
+	return p.global
+}
+
+// SetConflictPolicy sets the policy applied when the backend answers with invalid content, for
+// secrets without their own policy. ConflictValidatedBackendWins is the default.
+func (c *Cache) SetConflictPolicy(policy ConflictPolicy) {
+	c.conflicts.lock.Lock()
+	defer c.conflicts.lock.Unlock()
+	c.conflicts.global = policy
+}
+
+// SetSecretConflictPolicy sets the conflict policy of the secret name, overriding the policy set
+// by SetConflictPolicy.
+func (c *Cache) SetSecretConflictPolicy(name string, policy ConflictPolicy) {
+	c.conflicts.lock.Lock()
+	defer c.conflicts.lock.Unlock()
+	if c.conflicts.m == nil {
+		c.conflicts.m = make(map[string]ConflictPolicy)
+	}
+	c.conflicts.m[name] = policy
+}
+
+// rejectSecret handles content for name which failed validation with err, under a policy other
+// than ConflictBackendWins. Returns the cached value, if any.
+func (c *Cache) rejectSecret(name string, policy ConflictPolicy, err error) (*Secret, bool) {
+	c.Warnf("Rejected secret %v, keeping cached value: %v", name, err)
+	count(&c.stats.backendErrors)
+	var cached SecretTime
+	var found bool
+	if policy == ConflictSticky {
+		cached, found = c.secretMap.renew(name)
+	} else {
+		found = c.secretMap.view(name, func(s SecretTime) { cached = s.metadata() })
+	}
+	if found {
+		return &cached.Secret, true
+	}
+	return nil, false
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber. Once full, the oldest
+// event is dropped to make room, so a slow subscriber never blocks the cache.
+const subscriberBuffer = 64
+
+// SecretEventKind is the kind of change reported by a SecretEvent.
+type SecretEventKind int
+
+const (
+	// SecretAdded reports a secret which was not cached before.
+	SecretAdded SecretEventKind = iota
+	// SecretUpdated reports a cached secret whose content or version changed.
+	SecretUpdated
+	// SecretRemoved reports a cached secret which a listing no longer includes.
+	SecretRemoved
+)
+
+func (k SecretEventKind) String() string {
+	switch k {
+	case SecretAdded:
+		return "added"
+	case SecretUpdated:
+		return "updated"
+	case SecretRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("SecretEventKind(%d)", int(k))
+}
+
+// SecretEvent reports a change to a cached secret detected by a backend request.
+type SecretEvent struct {
+	Kind SecretEventKind
+	Name string
+}
+
+// subscribers fans out events to the channels returned by Subscribe.
+type subscribers struct {
+	chans  map[chan SecretEvent]bool
+	closed bool // set by closeAll, after which no channels are added
+	lock   sync.Mutex
+}
+
+// closeAll closes every channel and refuses later subscriptions.
+func (s *subscribers) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for events := range s.chans {
+		close(events)
+	}
+	s.chans, s.closed = nil, true
+}
+
+// Subscribe returns a channel receiving an event whenever a backend request, such as a listing or
+// background refresh, finds a secret added, updated, or removed compared to the cache. Events are
+// buffered, and the oldest are dropped if the subscriber falls behind. The returned function
+// cancels the subscription and closes the channel, as does Close.
+func (c *Cache) Subscribe() (<-chan SecretEvent, func()) {
+	events := make(chan SecretEvent, subscriberBuffer)
+	s := &c.subscribers
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		close(events)
+		return events, func() {}
+	}
+	if s.chans == nil {
+		s.chans = make(map[chan SecretEvent]bool)
+	}
+	s.chans[events] = true
+	s.lock.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.chans[events] {
+				delete(s.chans, events)
+				close(events)
+			}
+		})
+	}
+}
+
+// publish sends an event to every subscriber without blocking. Additions and removals are also
+// reported to the SetOnMembershipChange function, if any.
+func (c *Cache) publish(kind SecretEventKind, name string) {
+	if fn, ok := c.onMembers.Load().(func()); ok && fn != nil && kind != SecretUpdated {
+		fn()
+	}
+	event := SecretEvent{kind, name}
+	s := &c.subscribers
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for events := range s.chans {
+		for sent := false; !sent; {
+			select {
+			case events <- event:
+				sent = true
+			default:
+				select {
+				case dropped := <-events:
+					c.Debugf("Subscriber fell behind, dropping event: %v %v", dropped.Kind, dropped.Name)
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// MutableListBackend lists whichever secrets were last stored in it.
+type MutableListBackend struct {
+	FailingBackend
+	secrets *atomic.Value // []keywhizfs.Secret
+}
+
+func (b MutableListBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	return b.secrets.Load().([]keywhizfs.Secret), true
+}
+
+// nextEvent waits briefly for an event from events.
+func nextEvent(events <-chan keywhizfs.SecretEvent) (keywhizfs.SecretEvent, bool) {
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(time.Second):
+		return keywhizfs.SecretEvent{}, false
+	}
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := MutableListBackend{secrets: new(atomic.Value)}
+	backend.secrets.Store([]keywhizfs.Secret{*secretFixture})
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	events, cancel := cache.Subscribe()
+
+	cache.SecretList()
+	event, ok := nextEvent(events)
+	assert.True(ok)
+	assert.Equal(keywhizfs.SecretEvent{Kind: keywhizfs.SecretAdded, Name: secretFixture.Name}, event)
+
+	rotated := *secretFixture
+	rotated.Version = "2"
+	backend.secrets.Store([]keywhizfs.Secret{rotated})
+	cache.SecretList()
+	event, ok = nextEvent(events)
+	assert.True(ok)
+	assert.Equal(keywhizfs.SecretEvent{Kind: keywhizfs.SecretUpdated, Name: secretFixture.Name}, event)
+
+	backend.secrets.Store([]keywhizfs.Secret{})
+	cache.SecretList()
+	event, ok = nextEvent(events)
+	assert.True(ok)
+	assert.Equal(keywhizfs.SecretEvent{Kind: keywhizfs.SecretRemoved, Name: secretFixture.Name}, event)
+	assert.Equal("removed", event.Kind.String())
+
+	cancel()
+	_, ok = <-events
+	assert.False(ok, "Cancelling should close the channel")
+	cancel()
+}
+
+// AnyNameBackend serves a secret of every name.
+type AnyNameBackend struct {
+	FailingBackend
+}
+
+func (b AnyNameBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	return &keywhizfs.Secret{Name: name}, true
+}
+
+func TestCacheSubscribeDropsOldestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(AnyNameBackend{}, timeouts, logConfig)
+	events, cancel := cache.Subscribe()
+	defer cancel()
+
+	// Nothing reads events while secrets are fetched, and the cache is not blocked.
+	for i := 0; i < 100; i++ {
+		_, ok := cache.Secret(fmt.Sprintf("secret%03d", i))
+		assert.True(ok)
+	}
+	assert.Equal(cap(events), len(events))
+
+	first := <-events
+	assert.Equal(fmt.Sprintf("secret%03d", 100-cap(events)), first.Name, "The oldest events should be dropped")
+	var last keywhizfs.SecretEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	assert.Equal(keywhizfs.SecretEvent{Kind: keywhizfs.SecretAdded, Name: "secret099"}, last)
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import "github.com/hanwen/go-fuse/fuse"
+
+// FakeNotifier records the kernel cache invalidations of a filesystem served by ServeNotifier.
+type FakeNotifier struct {
+	Files chan string // paths passed to FileNotify
+}
+
+// NewFakeNotifier returns a FakeNotifier buffering up to size invalidations.
+func NewFakeNotifier(size int) *FakeNotifier {
+	return &FakeNotifier{Files: make(chan string, size)}
+}
+
+func (n *FakeNotifier) FileNotify(path string, off int64, length int64) fuse.Status {
+	select {
+	case n.Files <- path:
+	default:
+	}
+	return fuse.OK
+}
+
+func (n *FakeNotifier) EntryNotify(dir string, name string) fuse.Status {
+	return fuse.OK
+}
+
+// ServeNotifier marks kwfs as mounted and served, sending its kernel cache invalidations to n, so
+// that tests observe them without mounting.
+func (kwfs KeywhizFs) ServeNotifier(n *FakeNotifier) {
+	m := kwfs.mount
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.notifier, m.serving = n, true
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/square/keywhizfs/log"
+)
+
+// secretFile is an open file holding secret data, which is copied once at Open so that every
+// read, of any range, is served from memory.
+type secretFile struct {
+	nodefs.File
+	data  content
+	trace *log.Logger // logs reads and the release at debug level, if set
+	reads int32
+}
+
+// newSecretFile returns an open file of data. The data is copied, and the copy is zeroed when the
+// file is released. Reads and the release are logged to trace, if not nil.
+func newSecretFile(data []byte, trace *log.Logger) nodefs.File {
+	return &secretFile{File: nodefs.NewDefaultFile(), data: content(data).clone(), trace: trace}
+}
+
+// newFormattedSecretFile returns an open file of the formatted content of s, as newSecretFile. A
+// format transforming the content into a new buffer has that buffer zeroed once copied.
+func newFormattedSecretFile(s *Secret, trace *log.Logger) nodefs.File {
+	formatted := s.Formatted()
+	defer s.wipeFormatted(formatted)
+	return newSecretFile(formatted, trace)
+}
+
+func (f *secretFile) String() string {
+	return fmt.Sprintf("secretFile(%d bytes)", len(f.data))
+}
+
+func (f *secretFile) GetAttr(out *fuse.Attr) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(f.data))
+	return fuse.OK
+}
+
+// Read returns the requested range of data. Ranges extending past the end are truncated, and
+// those starting at or after the end are empty.
+func (f *secretFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if f.trace != nil {
+		atomic.AddInt32(&f.reads, 1)
+		f.trace.Debugf("Read offset=%d size=%d", off, len(buf))
+	}
+	if off < 0 {
+		return nil, fuse.EINVAL
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(f.data[off:end]), fuse.OK
+}
+
+// Release zeroes the data once the file is closed.
+func (f *secretFile) Release() {
+	if f.trace != nil {
+		f.trace.Debugf("Release after %d reads", atomic.LoadInt32(&f.reads))
+	}
+	f.data.wipe()
+}
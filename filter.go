@@ -0,0 +1,108 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NameFilter restricts which secrets are exposed, by glob patterns on their names as matched by
+// path.Match. A name matching a deny pattern is excluded. Otherwise it is included if it matches
+// an allow pattern, or if there are no allow patterns.
+type NameFilter struct {
+	allow, deny []string
+}
+
+// NewNameFilter returns a NameFilter with the given allow and deny patterns. Returns an error if a
+// pattern is malformed.
+func NewNameFilter(allow, deny []string) (*NameFilter, error) {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern '%v': %v", pattern, err)
+		}
+	}
+	return &NameFilter{allow: allow, deny: deny}, nil
+}
+
+// ParseNameFilter returns a NameFilter from comma-separated lists of allow and deny patterns.
+// Empty lists impose no restriction.
+func ParseNameFilter(allow, deny string) (*NameFilter, error) {
+	return NewNameFilter(splitPatterns(allow), splitPatterns(deny))
+}
+
+func splitPatterns(s string) (patterns []string) {
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return
+}
+
+// Permits returns whether the secret named name is exposed. A nil filter permits every name.
+func (f *NameFilter) Permits(name string) bool {
+	if f == nil {
+		return true
+	}
+	if matchAny(f.deny, name) {
+		return false
+	}
+	return len(f.allow) == 0 || matchAny(f.allow, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetNameFilter restricts the secrets served by the cache to those f permits. Other secrets are
+// never requested from the backend or cached, and are omitted from listings, as if they did not
+// exist. Cached secrets f excludes are deleted. A nil filter permits every secret.
+func (c *Cache) SetNameFilter(f *NameFilter) {
+	c.filter.Store(f)
+	for _, name := range c.secretMap.Keys() {
+		if !f.Permits(name) {
+			c.Delete(name)
+			c.Debugf("Deleted cached secret excluded by name filter: %v", name)
+		}
+	}
+}
+
+// Permits returns whether the name filter of the cache permits the secret named name.
+func (c *Cache) Permits(name string) bool {
+	f, _ := c.filter.Load().(*NameFilter)
+	return f.Permits(name)
+}
+
+// permitted filters out secrets excluded by the name filter.
+func (c *Cache) permitted(secrets []Secret) []Secret {
+	f, _ := c.filter.Load().(*NameFilter)
+	if f == nil {
+		return secrets
+	}
+	kept := make([]Secret, 0, len(secrets))
+	for _, s := range secrets {
+		if f.Permits(s.Name) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		allow, deny string
+		permitted   []string
+		excluded    []string
+	}{
+		{"", "", []string{"app_db", "Nobody_PgPass"}, nil},
+		{"app_*, db_?", "", []string{"app_db", "db_1"}, []string{"Nobody_PgPass", "db_10"}},
+		{"", "*_admin,Nobody_*", []string{"app_db"}, []string{"app_admin", "Nobody_PgPass"}},
+		{"app_*", "*_admin", []string{"app_db"}, []string{"app_admin", "Nobody_PgPass"}},
+		{"[a-c]*", "", []string{"app_db", "cert"}, []string{"db_1"}},
+	}
+	for _, c := range cases {
+		f, err := keywhizfs.ParseNameFilter(c.allow, c.deny)
+		if !assert.NoError(err) {
+			continue
+		}
+		for _, name := range c.permitted {
+			assert.True(f.Permits(name), "Expected allow=%q deny=%q to permit %v", c.allow, c.deny, name)
+		}
+		for _, name := range c.excluded {
+			assert.False(f.Permits(name), "Expected allow=%q deny=%q to exclude %v", c.allow, c.deny, name)
+		}
+	}
+
+	var nilFilter *keywhizfs.NameFilter
+	assert.True(nilFilter.Permits("anything"))
+}
+
+func TestNameFilterRejectsMalformedPatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := keywhizfs.ParseNameFilter("app_[", "")
+	assert.Error(err)
+	_, err = keywhizfs.ParseNameFilter("", "[]")
+	assert.Error(err)
+	_, err = keywhizfs.NewNameFilter([]string{`app_\`}, nil)
+	assert.Error(err)
+}
+
+func TestCacheNameFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	var calls int32
+	backend := CountingBackend{map[string]*keywhizfs.Secret{fixture1.Name: fixture1, fixture2.Name: fixture2}, &calls}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*fixture2)
+	filter, err := keywhizfs.ParseNameFilter("Nobody_*,hmac*", "hmac*")
+	assert.NoError(err)
+	cache.SetNameFilter(filter)
+	assert.Equal(0, cache.Len(), "Excluded cached secrets should be deleted")
+
+	// A denied secret is never requested from the backend.
+	_, ok := cache.Secret(fixture2.Name)
+	assert.False(ok)
+	assert.EqualValues(0, atomic.LoadInt32(&calls))
+
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1, secret)
+
+	list := cache.SecretList()
+	assert.Equal([]keywhizfs.Secret{*fixture1}, list)
+	assert.Equal([]string{fixture1.Name}, cache.Keys())
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent backend requests for the same secret so that only one request
+// is in flight per name and its result is shared by every caller.
+type flightGroup struct {
+	calls map[string]*flightCall
+	lock  sync.Mutex
+}
+
+// flightCall is an in-flight or completed request. done is closed once secret and ok are set.
+// The request runs with ctx, which is cancelled once no caller is waiting for its result.
+type flightCall struct {
+	done    chan struct{}
+	secret  *Secret
+	ok      bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int // guarded by the lock of the flightGroup
+}
+
+// do executes fn for key, unless a call for key is already in flight, in which case it waits for
+// and returns the result of that call. Since the result is shared, fn runs with a context carrying
+// the values of ctx but not its cancellation. A caller whose ctx is done stops waiting and returns
+// false, and the call is cancelled once no caller is waiting.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (*Secret, bool)) (*Secret, bool) {
+	call, started := g.join(ctx, key)
+	if started {
+		go g.run(key, call, fn)
+	}
+	select {
+	case <-call.done:
+		return call.secret, call.ok
+	case <-ctx.Done():
+		g.leave(key, call)
+		return nil, false
+	}
+}
+
+// start executes fn for key in the background, unless a call for key is already in flight.
+// Returns whether a new call was started. The background call counts as a caller which never stops
+// waiting, so it is not cancelled when other callers do.
+func (g *flightGroup) start(key string, fn func(context.Context) (*Secret, bool)) bool {
+	call, started := g.join(context.Background(), key)
+	if started {
+		go g.run(key, call, fn)
+	}
+	return started
+}
+
+// join returns the in-flight call for key, counting the caller as waiting for it, or registers a
+// new call with a context detached from ctx, which the caller must run.
+func (g *flightGroup) join(ctx context.Context, key string) (call *flightCall, started bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+	call = &flightCall{done: make(chan struct{}), waiters: 1}
+	call.ctx, call.cancel = context.WithCancel(detachedContext{ctx})
+	g.calls[key] = call
+	return call, true
+}
+
+// leave stops a caller waiting for call, cancelling it if no caller remains. Later callers then
+// start a new call rather than join the cancelled one.
+func (g *flightGroup) leave(key string, call *flightCall) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		g.forget(key, call)
+	}
+}
+
+// forget removes call from the calls in flight, unless a later call replaced it. The lock must be
+// held.
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// run executes fn, publishing its result to callers waiting on call.
+func (g *flightGroup) run(key string, call *flightCall, fn func(context.Context) (*Secret, bool)) {
+	call.secret, call.ok = fn(call.ctx)
+	call.cancel()
+
+	g.lock.Lock()
+	g.forget(key, call)
+	g.lock.Unlock()
+	close(call.done)
+}
+
+// detachedContext carries the values of a context, such as its request ID, without its deadline or
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
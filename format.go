@@ -0,0 +1,102 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// Formats which transform secret content when it is read from the filesystem.
+const (
+	// FormatPEMBundle rewrites the PEM blocks of the content with certificates first and keys
+	// last, each ending in a newline. Content without PEM blocks is left unchanged.
+	FormatPEMBundle = "pem-bundle"
+	// FormatTrim removes leading and trailing whitespace.
+	FormatTrim = "trim"
+	// FormatBase64 encodes the content in standard base64.
+	FormatBase64 = "base64"
+)
+
+// checkFormat returns an error unless format is empty or a known format.
+func checkFormat(format string) error {
+	switch format {
+	case "", FormatPEMBundle, FormatTrim, FormatBase64:
+		return nil
+	}
+	return fmt.Errorf("%w '%v'", ErrUnknownFormat, format)
+}
+
+// Formatted returns the content of the secret transformed according to its format.
+func (s Secret) Formatted() []byte {
+	switch s.Format {
+	case FormatPEMBundle:
+		return pemBundle(s.Content)
+	case FormatTrim:
+		return bytes.TrimSpace(s.Content)
+	case FormatBase64:
+		return []byte(base64.StdEncoding.EncodeToString(s.Content))
+	}
+	return s.Content
+}
+
+// FormattedLength returns the size in bytes of the formatted content. Secrets fetched without
+// content report the length given by the server, since their formatted length is unknown.
+func (s Secret) FormattedLength() int {
+	if len(s.Content) == 0 || s.Format == "" {
+		return s.ContentLength()
+	}
+	formatted := s.Formatted()
+	defer s.wipeFormatted(formatted)
+	return len(formatted)
+}
+
+// wipeFormatted zeroes formatted, as returned by Formatted, unless it shares the content of s.
+func (s Secret) wipeFormatted(formatted []byte) {
+	if !content(formatted).sameArray(s.Content) {
+		content(formatted).wipe()
+	}
+}
+
+// pemBundle reorders the PEM blocks in data, placing certificates before keys.
+func pemBundle(data []byte) []byte {
+	var certs, others, keys bytes.Buffer
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		found = true
+		switch {
+		case strings.Contains(block.Type, "CERTIFICATE"):
+			pem.Encode(&certs, block)
+		case strings.Contains(block.Type, "KEY"):
+			pem.Encode(&keys, block)
+		default:
+			pem.Encode(&others, block)
+		}
+	}
+	if !found {
+		return data
+	}
+	certs.Write(others.Bytes())
+	certs.Write(keys.Bytes())
+	return certs.Bytes()
+}
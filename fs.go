@@ -15,8 +15,11 @@
 package keywhizfs
 
 import (
+	gocontext "context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +33,7 @@ import (
 const (
 	VERSION = "2.0"
 	EISDIR  = fuse.Status(unix.EISDIR)
+	EFBIG   = fuse.Status(unix.EFBIG)
 )
 
 // KeywhizFs is the central struct for dispatching filesystem operations.
@@ -40,22 +44,87 @@ type KeywhizFs struct {
 	Cache     *Cache
 	StartTime time.Time
 	Ownership Ownership
+	// Audit, if set, records every access to secret content.
+	Audit *AuditLog
+	// Layout arranges secret files in the filesystem. It defaults to LayoutFlat.
+	Layout Layout
+	// LayoutLinks, if set with a Layout other than LayoutFlat, places every secret file in the base
+	// directory as if flat, and fills the owner or group directories with symlinks to them.
+	LayoutLinks bool
+	// Sanitization encodes characters of secret names which are unsafe in file names. It defaults
+	// to SanitizeNone.
+	Sanitization Sanitization
+	// EnforceOwner, if set, denies reads of secret content to callers other than root and the
+	// owner of the file, regardless of its mode.
+	EnforceOwner bool
+	// RootMode is the permission bits of the base directory. Zero means 0755.
+	RootMode uint32
+	// Umask is permission bits removed from the mode of every secret file, such as 0077 to deny
+	// access to its group and others. It never adds permissions.
+	Umask uint32
+	// RootOwnership, if set, owns the base directory instead of Ownership.
+	RootOwnership *Ownership
+	// OversizedStatus is the error for secrets the client rejects for exceeding its
+	// MaxSecretSize, either EFBIG or fuse.ENOENT. Zero means fuse.ENOENT.
+	OversizedStatus fuse.Status
+	// ListingTTL is how long a secret listing is reused for directory entries, until a secret is
+	// found added or removed. Zero lists secrets for every directory read.
+	ListingTTL time.Duration
+	// LifecycleSampling is the interval within which only the first open of each secret file is
+	// traced at debug level, with its reads and release. Zero means one second, and a negative
+	// interval traces every open.
+	LifecycleSampling time.Duration
+	// RequestContext, if set, returns the context of the backend requests made for a FUSE request,
+	// so that they are cancelled once the kernel interrupts it. The go-fuse version in use does not
+	// report interrupts to path filesystems, so by default backend requests are never cancelled.
+	RequestContext func(context *fuse.Context) gocontext.Context
+	// StreamThreshold, if positive, is the listed content length from which a secret is streamed:
+	// each read of an open file requests just that range from the backend, rather than the whole
+	// content being held for every open. Secrets are read whole if the backend does not support
+	// ranges, as a RangeSecretFetcher, or if they have a Format.
+	StreamThreshold int
+	mount           *mountState
+	listing         *listingCache
+	tracer          *openTracer
 }
 
 // NewKeywhizFs readies a KeywhizFs struct and its parent filesystem objects.
 func NewKeywhizFs(client *Client, ownership Ownership, timeouts Timeouts, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
+	return NewKeywhizFsWithCache(client, NewCache(client, timeouts, logConfig), ownership, logConfig)
+}
+
+// NewKeywhizFsWithCache readies a KeywhizFs struct serving secrets from cache, which should be backed by
+// client.
+func NewKeywhizFsWithCache(client *Client, cache *Cache, ownership Ownership, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
 	logger := log.New("kwfs", logConfig)
-	cache := NewCache(client, timeouts, logConfig)
 
 	defaultfs := pathfs.NewDefaultFileSystem()            // Returns ENOSYS by default
 	readonlyfs := pathfs.NewReadonlyFileSystem(defaultfs) // R/W calls return EPERM
 
-	kwfs = &KeywhizFs{readonlyfs, logger, client, cache, time.Now(), ownership}
+	kwfs = &KeywhizFs{
+		FileSystem: readonlyfs,
+		Logger:     logger,
+		Client:     client,
+		Cache:      cache,
+		StartTime:  time.Now(),
+		Ownership:  ownership,
+	}
 	nfs := pathfs.NewPathNodeFs(kwfs, nil)
 	nfs.SetDebug(logConfig.Debug)
+	cache.SetOnChange(func(name string) { kwfs.invalidate(name) })
+	kwfs.listing = &listingCache{}
+	kwfs.tracer = &openTracer{}
+	cache.SetOnMembershipChange(kwfs.listing.invalidate)
+	kwfs.mount = &mountState{root: nfs.Root(), notifier: nfs}
 	return kwfs, nfs.Root(), nil
 }
 
+// SetDebug turns debugging output on or off.
+func (kwfs KeywhizFs) SetDebug(debug bool) {
+	kwfs.FileSystem.SetDebug(debug)
+	kwfs.Logger.SetDebug(debug)
+}
+
 // GetAttr is a FUSE function which tells FUSE which files and directories exist.
 //
 // name is empty when getting information on the base directory
@@ -63,9 +132,14 @@ func (kwfs KeywhizFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	kwfs.Debugf("GetAttr called with '%v'", name)
 
 	var attr *fuse.Attr
+	missing := fuse.ENOENT
 	switch {
 	case name == "": // Base directory
-		attr = kwfs.directoryAttr(1, 0755) // Writability necessary for .clear_cache
+		subdirs := 1 + len(kwfs.layoutDirs())
+		if len(kwfs.bundleNames()) > 0 {
+			subdirs++
+		}
+		attr = kwfs.rootAttr(uint32(subdirs))
 	case name == ".version":
 		size := uint64(len(VERSION))
 		attr = kwfs.fileAttr(size, 0444)
@@ -74,41 +148,70 @@ func (kwfs KeywhizFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	case name == ".running":
 		size := uint64(len(running()))
 		attr = kwfs.fileAttr(size, 0444)
+	case name == ".metadata.json":
+		size := uint64(len(kwfs.metadataListing()))
+		attr = kwfs.fileAttr(size, 0444)
 	case name == ".json":
 		attr = kwfs.directoryAttr(1, 0700)
 	case name == ".json/secret":
 		attr = kwfs.directoryAttr(0, 0700)
 	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+		data, ok := kwfs.rawSecretList()
 		if ok {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0400)
 		}
 	case strings.HasPrefix(name, ".json/secret/"):
-		name = name[len(".json/secret/"):]
-		data, ok := kwfs.Client.RawSecret(name)
-		if ok {
-			size := uint64(len(data))
-			attr = kwfs.fileAttr(size, 0400)
+		name, ok := kwfs.Sanitization.decode(name[len(".json/secret/"):])
+		if !ok {
+			break
 		}
+		data, status := kwfs.rawSecret(kwfs.requestContext(context), name)
+		if status == fuse.OK {
+			attr = kwfs.rawSecretAttr(data)
+		}
+		missing = status
+	case name == bundlesDir, strings.HasPrefix(name, bundlesDir+"/"):
+		attr = kwfs.bundleAttr(kwfs.requestContext(context), name)
+	case kwfs.isLayoutDir(name):
+		attr = kwfs.layoutDirAttr(name)
 	default:
-		secret, ok := kwfs.Cache.Secret(name)
+		ctx := kwfs.requestContext(context)
+		if secret, ok := kwfs.streamedSecret(name); ok {
+			attr = kwfs.secretAttr(secret)
+			break
+		}
+		secret, _, ok := kwfs.lookupSecret(ctx, name)
+		if !ok {
+			secret, ok = kwfs.lookupSecretVersion(ctx, name)
+		}
 		if ok {
 			attr = kwfs.secretAttr(secret)
+		} else if secret, ok = kwfs.lookupSecretChecksum(ctx, name); ok {
+			attr = kwfs.checksumAttr(secret)
+		} else if target, ok := kwfs.lookupSecretLink(ctx, name); ok {
+			attr = kwfs.linkAttr(target)
+		} else {
+			missing = kwfs.missingStatus(name)
 		}
 	}
 
 	if attr != nil {
 		return attr, fuse.OK
 	}
-	return nil, fuse.ENOENT
+	return nil, missing
 }
 
 // Open is a FUSE function where an in-memory open file struct is constructed.
 func (kwfs KeywhizFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	kwfs.Debugf("Open called with '%v'", name)
 
+	// Backend requests made for the open carry the request ID recorded in the audit log.
+	id := NewRequestID()
+	ctx := WithRequestID(kwfs.requestContext(context), id)
+
 	var file nodefs.File
+	missing := fuse.ENOENT
 	switch {
 	case name == "", name == ".json", name == ".json/secret":
 		return nil, EISDIR
@@ -118,31 +221,139 @@ func (kwfs KeywhizFs) Open(name string, flags uint32, context *fuse.Context) (no
 		file = nodefs.NewDevNullFile()
 	case name == ".running":
 		file = nodefs.NewDataFile(running())
+	case name == ".metadata.json":
+		file = nodefs.NewDataFile(kwfs.metadataListing())
 	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+		if !kwfs.permitted(name, kwfs.Ownership.Uid, context) {
+			return nil, fuse.EACCES
+		}
+		data, ok := kwfs.rawSecretList()
 		if ok {
-			file = nodefs.NewDataFile(data)
+			file = newSecretFile(data, kwfs.traceOpen(name, context))
 		}
 	case strings.HasPrefix(name, ".json/secret/"):
-		name = name[len(".json/secret/"):]
-		data, ok := kwfs.Client.RawSecret(name)
-		if ok {
-			file = nodefs.NewDataFile(data)
-			kwfs.Infof("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+		path := name
+		name, ok := kwfs.Sanitization.decode(name[len(".json/secret/"):])
+		if !ok {
+			break
+		}
+		data, status := kwfs.rawSecret(ctx, name)
+		if status == fuse.OK && !kwfs.permitted(path, kwfs.rawSecretAttr(data).Uid, context) {
+			content(data).wipe()
+			return nil, fuse.EACCES
+		}
+		if status == fuse.OK {
+			file = newSecretFile(data, kwfs.traceOpen(".json/secret/"+name, context))
+			kwfs.Infof("Access to %s by uid %d, with gid %d, request_id=%v", name, context.Uid, context.Gid, id)
+			kwfs.audit(name, OriginBackend, context, id)
 		}
+		missing = status
+	case name == bundlesDir && kwfs.bundleAttr(ctx, name) != nil:
+		return nil, EISDIR
+	case strings.HasPrefix(name, bundlesDir+"/"):
+		file, missing = kwfs.openBundleFile(ctx, name, context, id)
+	case kwfs.isLayoutDir(name):
+		return nil, EISDIR
 	default:
-		secret, ok := kwfs.Cache.Secret(name)
+		if streamed, status, ok := kwfs.openStreamed(ctx, name, context, id); ok {
+			file, missing = streamed, status
+			break
+		}
+		var label string // names the version too, if one was requested
+		var checksum []byte
+		secret, origin, ok := kwfs.lookupSecret(ctx, name)
 		if ok {
-			file = nodefs.NewDataFile(secret.Content)
-			kwfs.Infof("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+			label = secret.Name
+		} else if secret, ok = kwfs.lookupSecretVersion(ctx, name); ok {
+			origin, label = OriginBackend, secret.Name+versionSeparator+secret.Version
+		} else if secret, ok = kwfs.lookupSecretChecksum(ctx, name); ok {
+			checksum = checksumContent(secret)
+		}
+		if ok && !kwfs.permitted(name, kwfs.secretAttr(secret).Uid, context) {
+			return nil, fuse.EACCES
+		}
+		switch {
+		case ok && checksum != nil: // Not the content of the secret, so not audited.
+			file = newSecretFile(checksum, kwfs.traceOpen(name, context))
+		case ok:
+			trace := kwfs.traceOpen(name, context)
+			if !kwfs.Cache.withContent(secret, func(s *Secret) { file = newFormattedSecretFile(s, trace) }) {
+				missing = kwfs.missingStatus(name)
+				break
+			}
+			kwfs.Infof("Access to %s by uid %d, with gid %d, request_id=%v", label, context.Uid, context.Gid, id)
+			kwfs.audit(label, origin, context, id)
+		default:
+			missing = kwfs.missingStatus(name)
 		}
 	}
 
 	if file != nil {
-		file = nodefs.NewReadOnlyFile(file)
+		// Direct I/O bypasses the kernel page cache, which is shared by every handle of a file and
+		// sized by its last attributes. Each handle then serves the complete content it was opened
+		// with, even if the secret is refreshed while it is read.
+		file = &nodefs.WithFlags{File: nodefs.NewReadOnlyFile(file), FuseFlags: fuse.FOPEN_DIRECT_IO}
 		return file, fuse.OK
 	}
-	return nil, fuse.ENOENT
+	return nil, missing
+}
+
+// rawSecret requests the raw JSON of a secret from the server, returning EACCES if the server
+// refuses it as forbidden, OversizedStatus if it is too large, and ENOENT if it cannot be retrieved
+// otherwise or is excluded by the name filter of the cache. The request is made with ctx.
+func (kwfs KeywhizFs) rawSecret(ctx gocontext.Context, name string) ([]byte, fuse.Status) {
+	if !kwfs.Cache.Permits(name) {
+		return nil, fuse.ENOENT
+	}
+	status, data, _, ok := kwfs.Client.rawSecret(ctx, name, "")
+	switch {
+	case ok:
+		return data, fuse.OK
+	case status == 403:
+		return nil, fuse.EACCES
+	case kwfs.Client.TooLarge(name):
+		return nil, kwfs.oversizedStatus()
+	default:
+		return nil, fuse.ENOENT
+	}
+}
+
+// rawSecretAttr constructs a fuse.Attr for the raw JSON data of a secret, owned like the secret's
+// own file, since it holds the same content.
+func (kwfs KeywhizFs) rawSecretAttr(data []byte) *fuse.Attr {
+	attr := kwfs.fileAttr(uint64(len(data)), 0400)
+	var ownership struct{ Owner, Group string }
+	if err := json.Unmarshal(data, &ownership); err != nil {
+		kwfs.Warnf("Error reading ownership of raw secret: %v", err)
+		return attr
+	}
+	if ownership.Owner != "" {
+		attr.Uid = kwfs.ownerUid(ownership.Owner)
+	}
+	if ownership.Group != "" {
+		attr.Gid = kwfs.groupGid(ownership.Group)
+	}
+	return attr
+}
+
+// ParseOversizedStatus returns the status named by s, either "enoent" or "efbig", for use as
+// OversizedStatus.
+func ParseOversizedStatus(s string) (fuse.Status, error) {
+	switch s {
+	case "enoent":
+		return fuse.ENOENT, nil
+	case "efbig":
+		return EFBIG, nil
+	}
+	return fuse.ENOENT, fmt.Errorf("unknown oversized status '%v'", s)
+}
+
+// oversizedStatus returns the error for secrets rejected as too large.
+func (kwfs KeywhizFs) oversizedStatus() fuse.Status {
+	if kwfs.OversizedStatus == fuse.OK {
+		return fuse.ENOENT
+	}
+	return kwfs.OversizedStatus
 }
 
 // OpenDir is a FUSE function called when performing a directory listing.
@@ -152,11 +363,20 @@ func (kwfs KeywhizFs) OpenDir(name string, context *fuse.Context) (stream []fuse
 	var entries []fuse.DirEntry
 	switch name {
 	case "": // Base directory
-		entries = kwfs.secretsDirListing(
+		if !kwfs.rootPermitted(unix.R_OK, context) {
+			return nil, fuse.EACCES
+		}
+		extra := []fuse.DirEntry{
 			fuse.DirEntry{Name: ".clear_cache", Mode: fuse.S_IFREG},
 			fuse.DirEntry{Name: ".json", Mode: fuse.S_IFDIR},
+			fuse.DirEntry{Name: ".metadata.json", Mode: fuse.S_IFREG},
 			fuse.DirEntry{Name: ".running", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: ".version", Mode: fuse.S_IFREG})
+			fuse.DirEntry{Name: ".version", Mode: fuse.S_IFREG},
+		}
+		if len(kwfs.bundleNames()) > 0 {
+			extra = append(extra, fuse.DirEntry{Name: bundlesDir, Mode: fuse.S_IFDIR})
+		}
+		entries = kwfs.baseDirListing(extra...)
 	case ".json":
 		entries = []fuse.DirEntry{
 			fuse.DirEntry{Name: "secret", Mode: fuse.S_IFDIR},
@@ -164,6 +384,12 @@ func (kwfs KeywhizFs) OpenDir(name string, context *fuse.Context) (stream []fuse
 		}
 	case ".json/secret":
 		entries = kwfs.secretsDirListing()
+	default:
+		if name == bundlesDir || strings.HasPrefix(name, bundlesDir+"/") {
+			entries = kwfs.bundleListing(name)
+		} else if kwfs.isLayoutDir(name) {
+			entries = kwfs.layoutDirListing(name)
+		}
 	}
 
 	if len(entries) == 0 {
@@ -172,52 +398,215 @@ func (kwfs KeywhizFs) OpenDir(name string, context *fuse.Context) (stream []fuse
 	return entries, fuse.OK
 }
 
+// StatFs is a FUSE function called when querying the filesystem, such as by df. No capacity is
+// reported, but answering lets CheckMount identify the mount.
+func (kwfs KeywhizFs) StatFs(name string) *fuse.StatfsOut {
+	return &fuse.StatfsOut{Bsize: 4096, Frsize: 4096, NameLen: 255}
+}
+
+// Readlink is a FUSE function returning the target of a symlink: the link of a bundle, or of a
+// secret in an owner or group directory with LayoutLinks.
+func (kwfs KeywhizFs) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	kwfs.Debugf("Readlink called with '%v'", name)
+
+	ctx := kwfs.requestContext(context)
+	if target, ok := kwfs.readBundleLink(ctx, name); ok {
+		return target, fuse.OK
+	}
+	if target, ok := kwfs.lookupSecretLink(ctx, name); ok {
+		return target, fuse.OK
+	}
+	return "", kwfs.missingStatus(name)
+}
+
 // Unlink is a FUSE function called when an object is deleted.
 func (kwfs KeywhizFs) Unlink(name string, context *fuse.Context) fuse.Status {
 	kwfs.Debugf("Unlink called with '%v'", name)
 	if name == ".clear_cache" {
 		kwfs.Cache.Clear()
+		if kwfs.listing != nil {
+			kwfs.listing.invalidate()
+		}
 		return fuse.OK
 	}
 	return fuse.EACCES
 }
 
+// invalidate drops the kernel's cached attributes and data of the files of a secret whose content
+// changed, and of their checksum files, so that readers and watchers observe the new content.
+// Nothing is done unless Mounted, as the cache may be refreshed before mounting, or used without
+// ever mounting.
+func (kwfs KeywhizFs) invalidate(name string) {
+	if !kwfs.Mounted() {
+		return
+	}
+	n := kwfs.mount.notifier
+	for _, secretPath := range kwfs.secretPaths(name) {
+		for _, path := range []string{secretPath, secretPath + checksumSuffix} {
+			dir, file := "", path
+			if i := strings.LastIndex(path, "/"); i >= 0 {
+				dir, file = path[:i], path[i+1:]
+			}
+			if status := n.FileNotify(path, 0, 0); status != fuse.OK && status != fuse.ENOENT {
+				kwfs.Warnf("Error invalidating data of %v: %v", path, status)
+			}
+			if status := n.EntryNotify(dir, file); status != fuse.OK && status != fuse.ENOENT {
+				kwfs.Warnf("Error invalidating entry of %v: %v", path, status)
+			}
+		}
+	}
+}
+
+// permitted returns whether the caller may read a file owned by uid. Unless EnforceOwner is set,
+// access is left to the kernel's permission checks.
+func (kwfs KeywhizFs) permitted(name string, uid uint32, context *fuse.Context) bool {
+	if !kwfs.EnforceOwner {
+		return true
+	}
+	if context == nil || (context.Uid != 0 && context.Uid != uid) {
+		caller := int64(-1)
+		if context != nil {
+			caller = int64(context.Uid)
+		}
+		kwfs.Warnf("Denied access to %s by uid %d, owned by uid %d", name, caller, uid)
+		return false
+	}
+	return true
+}
+
+// audit records an access to a secret with the ID of the request triggering it, if auditing is
+// enabled.
+func (kwfs KeywhizFs) audit(name string, origin Origin, context *fuse.Context, requestID string) {
+	if kwfs.Audit == nil {
+		return
+	}
+	record := AuditRecord{Time: time.Now(), Secret: name, Origin: origin.String(), RequestID: requestID}
+	if context != nil {
+		record.Uid, record.Gid, record.Pid = context.Uid, context.Gid, context.Pid
+	}
+	if err := kwfs.Audit.Record(record); err != nil {
+		kwfs.Errorf("Error writing audit record for %v: %v", name, err)
+	}
+}
+
+// rawSecretList requests the raw JSON listing of secrets from the server. If the cache has a name
+// filter, the listing is re-encoded without the entries it excludes.
+func (kwfs KeywhizFs) rawSecretList() ([]byte, bool) {
+	data, ok := kwfs.Client.RawSecretList()
+	if !ok {
+		return nil, false
+	}
+	if f, _ := kwfs.Cache.filter.Load().(*NameFilter); f == nil {
+		return data, true
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		kwfs.Errorf("Error decoding secret listing to filter: %v", err)
+		return nil, false
+	}
+	kept := make([]json.RawMessage, 0, len(elements))
+	for _, element := range elements {
+		var entry struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(element, &entry) == nil && kwfs.Cache.Permits(entry.Name) {
+			kept = append(kept, element)
+		}
+	}
+	filtered, err := json.Marshal(kept)
+	if err != nil {
+		kwfs.Errorf("Error encoding filtered secret listing: %v", err)
+		return nil, false
+	}
+	return filtered, true
+}
+
 // secretsDirListing produces directory entries containing all secret files. Extra entries passed
 // to this function are included.
 func (kwfs KeywhizFs) secretsDirListing(extraEntries ...fuse.DirEntry) []fuse.DirEntry {
-	secrets := kwfs.Cache.SecretList()
+	secrets := kwfs.dirSecretList()
 	entries := make([]fuse.DirEntry, 0, len(secrets)+len(extraEntries))
 	for _, s := range secrets {
-		entries = append(entries, fuse.DirEntry{Name: s.Name, Mode: fuse.S_IFREG})
+		entries = append(entries, fuse.DirEntry{Name: kwfs.fileName(s.Name), Mode: fuse.S_IFREG})
 	}
 	entries = append(entries, extraEntries...)
 	return entries
 }
 
-// secretAttr constructs a fuse.Attr based on a given Secret.
+// requestContext returns the context of the backend requests made for a FUSE request, from
+// RequestContext if set.
+func (kwfs KeywhizFs) requestContext(context *fuse.Context) gocontext.Context {
+	if kwfs.RequestContext == nil || context == nil {
+		return gocontext.Background()
+	}
+	if ctx := kwfs.RequestContext(context); ctx != nil {
+		return ctx
+	}
+	return gocontext.Background()
+}
+
+// ParseUmask parses an octal umask for secret files, such as "0077".
+func ParseUmask(s string) (uint32, error) {
+	umask, err := strconv.ParseUint(s, 8 /* base */, 32 /* bits */)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("invalid umask '%v', expected octal permissions such as 0077", s)
+	}
+	return uint32(umask), nil
+}
+
+// secretAttr constructs a fuse.Attr based on a given Secret, with its mode masked by Umask. The
+// mtime is when the secret was last updated, and the ctime when it was created, since FUSE has no
+// birth time.
 func (kwfs KeywhizFs) secretAttr(s *Secret) *fuse.Attr {
-	created := uint64(s.CreatedAt.Unix())
+	modified, created := s.ModifiedAt(), s.CreatedAt
+	if created.IsZero() {
+		created = modified
+	}
+	size := s.FormattedLength()
+	if s.Format != "" && len(s.Content) == 0 { // a cached secret, whose content is not copied
+		kwfs.Cache.withContent(s, func(s *Secret) { size = s.FormattedLength() })
+	}
 	attr := &fuse.Attr{
-		Size: s.Length,
-		// The resolution for nsec time (uint32) is too small.
-		Atime: created,
-		Mtime: created,
-		Ctime: created,
-		Mode:  s.ModeValue(),
+		Size: uint64(size),
+		Mode: s.ModeValue() &^ (kwfs.Umask & 0777),
 	}
+	attr.SetTimes(&modified, &modified, &created)
 
 	attr.Uid = kwfs.Ownership.Uid
 	attr.Gid = kwfs.Ownership.Gid
 
 	if s.Owner != "" {
-		attr.Uid = lookupUid(s.Owner)
+		attr.Uid = kwfs.ownerUid(s.Owner)
 	}
 	if s.Group != "" {
-		attr.Gid = lookupGid(s.Group)
+		attr.Gid = kwfs.groupGid(s.Group)
 	}
 	return attr
 }
 
+// ownerUid resolves the owner of a secret to a numeric id. Unknown owners belong to the mounting
+// user, so that a stat never fails on ownership.
+func (kwfs KeywhizFs) ownerUid(owner string) uint32 {
+	uid, err := resolveUid(owner)
+	if err != nil {
+		uid = uint32(os.Geteuid())
+		kwfs.Warnf("%v, using uid %d", err, uid)
+	}
+	return uid
+}
+
+// groupGid resolves the group of a secret to a numeric id. Unknown groups fall back to the
+// mounting user's group.
+func (kwfs KeywhizFs) groupGid(group string) uint32 {
+	gid, err := resolveGid(group)
+	if err != nil {
+		gid = uint32(os.Getegid())
+		kwfs.Warnf("%v, using gid %d", err, gid)
+	}
+	return gid
+}
+
 // fileAttr constructs a generic file fuse.Attr with the given parameters.
 func (kwfs KeywhizFs) fileAttr(size uint64, mode uint32) *fuse.Attr {
 	created := uint64(kwfs.StartTime.Unix())
@@ -233,6 +622,13 @@ func (kwfs KeywhizFs) fileAttr(size uint64, mode uint32) *fuse.Attr {
 	return &attr
 }
 
+// linkAttr constructs a symlink fuse.Attr pointing at target.
+func (kwfs KeywhizFs) linkAttr(target string) *fuse.Attr {
+	attr := kwfs.fileAttr(uint64(len(target)), 0)
+	attr.Mode = fuse.S_IFLNK | 0777
+	return attr
+}
+
 // directoryAttr constructs a generic directory fuse.Attr with the given parameters.
 func (kwfs KeywhizFs) directoryAttr(subdirCount, mode uint32) *fuse.Attr {
 	// 4K is typically the minimum size of inode storage for a directory.
@@ -252,6 +648,57 @@ func (kwfs KeywhizFs) directoryAttr(subdirCount, mode uint32) *fuse.Attr {
 	return &attr
 }
 
+// secretMetadata is the metadata of a secret listed in .metadata.json.
+type secretMetadata struct {
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner,omitempty"`
+	Mode      string     `json:"mode"`
+	Length    int        `json:"length"`
+	Version   string     `json:"version,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Expiry    *time.Time `json:"expiry,omitempty"`
+	Expired   bool       `json:"expired,omitempty"`
+}
+
+// metadataListing provides a JSON array of the metadata of all secrets, without their content.
+// Unlike directories, it includes expired secrets, marked as such.
+func (kwfs KeywhizFs) metadataListing() []byte {
+	secrets := kwfs.Cache.SecretListFiltered(true)
+	now := kwfs.Cache.clock()
+	metadata := make([]secretMetadata, 0, len(secrets))
+	for _, s := range secrets {
+		m := secretMetadata{
+			Name:    s.Name,
+			Owner:   s.Owner,
+			Mode:    fmt.Sprintf("%04o", s.ModeValue()&0777),
+			Length:  s.FormattedLength(),
+			Version: s.Version,
+			Expired: kwfs.Cache.expired(s, now),
+		}
+		if !s.CreatedAt.IsZero() {
+			created := s.CreatedAt
+			m.CreatedAt = &created
+		}
+		if !s.UpdatedAt.IsZero() {
+			updated := s.UpdatedAt
+			m.UpdatedAt = &updated
+		}
+		if !s.ExpiresAt.IsZero() {
+			expiry := s.ExpiresAt
+			m.Expiry = &expiry
+		}
+		metadata = append(metadata, m)
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		kwfs.Errorf("Error encoding secret metadata: %v", err)
+		return []byte("[]")
+	}
+	return data
+}
+
 // running provides a formatted string with the current process ID.
 func running() []byte {
 	return []byte(fmt.Sprintf("pid=%d", os.Getpid()))
@@ -0,0 +1,172 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build integration
+
+// Integration tests mount a filesystem, so they require FUSE and permission to mount. Run with:
+//   go test -tags integration
+
+package keywhizfs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshUpdatesReaders(t *testing.T) {
+	assert := assert.New(t)
+
+	var rotated int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := "YXNkZGFz" // asddas
+		if atomic.LoadInt32(&rotated) != 0 {
+			content = "cm90YXRlZA==" // rotated
+		}
+		fmt.Fprintf(w, `{"name": "Nobody_PgPass", "secret": "%s", "mode": "0444"}`, content)
+	}))
+	defer server.Close()
+
+	mountpoint, err := ioutil.TempDir("", "kwfs-mount")
+	assert.NoError(err)
+	defer os.RemoveAll(mountpoint)
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: 2 * time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, err := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}, timeouts, logConfig)
+	assert.NoError(err)
+
+	if err := kwfs.Mount(mountpoint, &fuse.MountOptions{}); err != nil {
+		t.Skipf("Cannot mount: %v", err)
+	}
+	go kwfs.Serve()
+	defer kwfs.Unmount()
+
+	path := filepath.Join(mountpoint, "Nobody_PgPass")
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("asddas", string(data))
+
+	// The kernel caches the file's size for an hour, so only the invalidation lets it be reread.
+	atomic.StoreInt32(&rotated, 1)
+	stop := kwfs.Cache.StartRefresh(10 * time.Millisecond)
+	defer stop()
+
+	assert.True(eventually(func() bool {
+		data, err := ioutil.ReadFile(path)
+		return err == nil && string(data) == "rotated"
+	}, 2*time.Second), "Rotated content was not read")
+}
+
+func TestMountServeUnmount(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	defer server.Close()
+
+	mountpoint, err := ioutil.TempDir("", "kwfs-mount")
+	assert.NoError(err)
+	defer os.RemoveAll(mountpoint)
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: 2 * time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, err := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}, timeouts, logConfig)
+	assert.NoError(err)
+
+	if err := kwfs.Mount(mountpoint, &fuse.MountOptions{}); err != nil {
+		t.Skipf("Cannot mount: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- kwfs.Serve() }()
+	assert.True(eventually(kwfs.Mounted, 5*time.Second))
+	assert.Error(kwfs.Mount(mountpoint, nil), "A filesystem can be mounted only once")
+
+	data, err := ioutil.ReadFile(filepath.Join(mountpoint, ".version"))
+	assert.NoError(err)
+	assert.Equal(keywhizfs.VERSION, string(data))
+
+	assert.NoError(kwfs.Unmount())
+	select {
+	case err := <-served:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Unmount")
+	}
+	assert.False(kwfs.Mounted())
+}
+
+func TestWatchMountReportsLostMount(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, string(fixture("secrets.json")))
+	}))
+	defer server.Close()
+
+	mountpoint, err := ioutil.TempDir("", "kwfs-mount")
+	assert.NoError(err)
+	defer os.RemoveAll(mountpoint)
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: 2 * time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, err := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}, timeouts, logConfig)
+	assert.NoError(err)
+
+	if err := kwfs.Mount(mountpoint, &fuse.MountOptions{}); err != nil {
+		t.Skipf("Cannot mount: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- kwfs.Serve() }()
+	assert.True(eventually(kwfs.Mounted, 5*time.Second))
+	assert.NoError(keywhizfs.CheckMount(mountpoint))
+
+	lost, stop := kwfs.WatchMount(10 * time.Millisecond)
+	defer stop()
+
+	// An open file keeps the lazily unmounted filesystem served, so only the watch notices.
+	f, err := os.Open(filepath.Join(mountpoint, ".version"))
+	assert.NoError(err)
+	if output, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput(); err != nil {
+		f.Close()
+		kwfs.Unmount()
+		t.Skipf("Cannot unmount: %v (%s)", err, output)
+	}
+	select {
+	case err := <-lost:
+		assert.Contains(err.Error(), mountpoint)
+	case <-time.After(5 * time.Second):
+		t.Error("Lost mount was not reported")
+	}
+
+	f.Close()
+	select {
+	case err := <-served:
+		assert.Error(err, "An external unmount is unexpected")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the mount was released")
+	}
+}
@@ -17,22 +17,47 @@
 package keywhizfs_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/user"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/unix"
 )
 
 const _SomeUID uint32 = 12345
 
+// largeContent is the content of a secret spanning several kernel read chunks.
+var largeContent = func() []byte {
+	b := make([]byte, 300000)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}()
+
 var fuseContext = &fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 0}}
 
 type FsTestSuite struct {
@@ -43,8 +68,8 @@ type FsTestSuite struct {
 }
 
 func (suite *FsTestSuite) SetupTest() {
-	timeouts := keywhizfs.Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond}
-	client := keywhizfs.NewClient(clientFile, clientFile, caFile, suite.url, timeouts.MaxWait, logConfig, false)
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, suite.url, timeouts.BackendTimeout, logConfig, false)
 	ownership := keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}
 	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, ownership, timeouts, logConfig)
 	suite.fs = kwfs
@@ -61,6 +86,7 @@ func (suite *FsTestSuite) TestSpecialFileAttrs() {
 		{"", 4096, 0755 | fuse.S_IFDIR},
 		{".version", len(keywhizfs.VERSION), 0444 | fuse.S_IFREG},
 		{".running", -1, 0444 | fuse.S_IFREG},
+		{".metadata.json", -1, 0444 | fuse.S_IFREG},
 		{".clear_cache", 0, 0440 | fuse.S_IFREG},
 		{".json", 4096, 0700 | fuse.S_IFDIR},
 		{".json/secret", 4096, 0700 | fuse.S_IFDIR},
@@ -106,6 +132,31 @@ func (suite *FsTestSuite) TestFileAttrs() {
 	}
 }
 
+func (suite *FsTestSuite) TestFileAttrTimes() {
+	assert := suite.assert
+
+	created := time.Date(2011, time.September, 29, 15, 46, 0, 232000000, time.UTC)
+	updated := time.Date(2015, time.March, 12, 8, 30, 15, 500000000, time.UTC)
+
+	cases := []struct {
+		filename string
+		size     uint64
+		modified time.Time
+	}{
+		{"Nobody_PgPass", 6, created},
+		{"rotated.key", 15, updated},
+	}
+	// The ctime is the creation time, even of a secret updated since.
+
+	for _, c := range cases {
+		attr, status := suite.fs.GetAttr(c.filename, fuseContext)
+		assert.Equal(fuse.OK, status, "Expected %v attr status to be fuse.OK", c.filename)
+		assert.Equal(c.size, attr.Size, "Expected %v size to match", c.filename)
+		assert.True(c.modified.Equal(time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))), "Expected %v mtime to match", c.filename)
+		assert.True(created.Equal(time.Unix(int64(attr.Ctime), int64(attr.Ctimensec))), "Expected %v ctime to be its creation", c.filename)
+	}
+}
+
 func (suite *FsTestSuite) TestFileAttrOwnership() {
 	assert := suite.assert
 
@@ -134,6 +185,40 @@ func (suite *FsTestSuite) TestFileAttrOwnership() {
 	assert.NotEqual(0, attr.Gid, "Expected %v gid to be set", filename)
 }
 
+func (suite *FsTestSuite) TestFileAttrSecretOwnership() {
+	assert := suite.assert
+
+	nobody, err := user.Lookup("nobody")
+	assert.NoError(err)
+	// The nobody group is named nogroup on some systems, in which case the mounting user's is used.
+	nobodyGid := strconv.Itoa(os.Getegid())
+	if group, err := user.LookupGroup("nobody"); err == nil {
+		nobodyGid = group.Gid
+	}
+
+	cases := []struct {
+		filename string
+		uid      string
+		gid      string
+		mode     uint32
+	}{
+		{"Nobody_PgPass", nobody.Uid, nobodyGid, 0400 | fuse.S_IFREG},
+		{"Root_PgPass", "0", "0", 0600 | fuse.S_IFREG},
+		// The raw JSON of a secret is owned like the secret.
+		{".json/secret/Nobody_PgPass", nobody.Uid, nobodyGid, 0400 | fuse.S_IFREG},
+		// Unknown owners fall back to the mounting user, and the default group is kept.
+		{"NonexistentOwner_Pass", strconv.Itoa(os.Geteuid()), fmt.Sprint(_SomeUID), 0400 | fuse.S_IFREG},
+	}
+
+	for _, c := range cases {
+		attr, status := suite.fs.GetAttr(c.filename, fuseContext)
+		assert.Equal(fuse.OK, status, "Expected %v attr status to be fuse.OK", c.filename)
+		assert.Equal(c.uid, fmt.Sprint(attr.Uid), "Expected %v uid to match", c.filename)
+		assert.Equal(c.gid, fmt.Sprint(attr.Gid), "Expected %v gid to match", c.filename)
+		assert.Equal(c.mode, attr.Mode, "Expected %v mode %#o, was %#o", c.filename, c.mode, attr.Mode)
+	}
+}
+
 func (suite *FsTestSuite) TestSpecialFileOpen() {
 	assert := suite.assert
 
@@ -157,6 +242,29 @@ func (suite *FsTestSuite) TestSpecialFileOpen() {
 	assert.Contains(string(read(file)), "pid=")
 }
 
+func (suite *FsTestSuite) TestMetadataListing() {
+	assert := suite.assert
+
+	attr, status := suite.fs.GetAttr(".metadata.json", fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	file, status := suite.fs.Open(".metadata.json", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.EqualValues(len(data), attr.Size)
+
+	var metadata []map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &metadata))
+	assert.Equal([]map[string]interface{}{
+		{"name": "Nobody_PgPass", "owner": "nobody", "mode": "0400", "length": 6.0, "createdAt": "2011-09-29T15:46:00.232Z"},
+		{"name": "General_Password..0be68f903f8b7d86", "mode": "0440", "length": 6.0, "createdAt": "2011-09-29T15:46:00.312Z"},
+	}, metadata)
+	assert.NotContains(string(data), "YXNkZGFz")
+	assert.NotContains(string(data), "asddas")
+}
+
 func (suite *FsTestSuite) TestOpen() {
 	assert := suite.assert
 
@@ -191,6 +299,223 @@ func (suite *FsTestSuite) TestOpen() {
 	}
 }
 
+func (suite *FsTestSuite) TestReadRanges() {
+	assert := suite.assert
+
+	// The large fixture takes longer to serve than the suite's timeouts allow under load.
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, suite.url, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	file, status := kwfs.Open("Large_Keystore", 0, fuseContext)
+	if !assert.Equal(fuse.OK, status) {
+		return
+	}
+	defer file.Release()
+
+	const chunk = 128 * 1024
+	size := int64(len(largeContent))
+	cases := []struct {
+		off, size int64
+		start     int64
+		end       int64
+	}{
+		{0, chunk, 0, chunk},
+		{chunk, chunk, chunk, 2 * chunk},
+		{2 * chunk, chunk, 2 * chunk, size}, // partial tail
+		{1000, 10, 1000, 1010},
+		{size - 1, chunk, size - 1, size},
+		{size, chunk, size, size},        // at EOF
+		{size + 5000, chunk, size, size}, // past EOF
+	}
+
+	for _, c := range cases {
+		buf := make([]byte, c.size)
+		res, status := file.Read(buf, c.off)
+		assert.Equal(fuse.OK, status, "Expected read at %d to be fuse.OK", c.off)
+		data, _ := res.Bytes(buf)
+		assert.Equal(int(c.end-c.start), len(data), "Expected read at %d to return %d bytes", c.off, c.end-c.start)
+		assert.True(bytes.Equal(largeContent[c.start:c.end], data), "Expected read at %d to match content", c.off)
+	}
+}
+
+func (suite *FsTestSuite) TestOpenFormatted() {
+	assert := suite.assert
+
+	attr, status := suite.fs.GetAttr("Trimmed_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len("asddas"), attr.Size)
+
+	file, status := suite.fs.Open("Trimmed_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("asddas", string(data))
+
+	// The raw API is not transformed.
+	file, status = suite.fs.Open(".json/secret/Trimmed_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	res, _ = file.Read(buf, 0)
+	data, _ = res.Bytes(buf)
+	assert.Equal(fixture("secretWithTrimFormat.json"), data)
+}
+
+func (suite *FsTestSuite) TestOpenVersion() {
+	assert := suite.assert
+
+	attr, status := suite.fs.GetAttr("Tagged_PgPass@3", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len("asddas"), attr.Size)
+
+	file, status := suite.fs.Open("Tagged_PgPass@3", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("asddas", string(data))
+
+	// The server only has version 3, and other paths lack a secret or a version.
+	for _, name := range []string{"Tagged_PgPass@2", "Tagged_PgPass@", "@3", "non-existent@3"} {
+		_, status = suite.fs.GetAttr(name, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v status to be fuse.ENOENT", name)
+		_, status = suite.fs.Open(name, 0, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v status to be fuse.ENOENT", name)
+	}
+}
+
+func (suite *FsTestSuite) TestOpenChecksum() {
+	assert := suite.assert
+	checksum := "14fff2e41f738a470c7f35768238b9ae28bd4dd3a25f0aa932769918c217643f" // of asddas
+
+	attr, status := suite.fs.GetAttr("Tagged_PgPass.sha256", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len(checksum), attr.Size)
+	secretAttr, _ := suite.fs.GetAttr("Tagged_PgPass", fuseContext)
+	assert.Equal(secretAttr.Mode, attr.Mode, "A checksum is as private as its secret")
+	assert.Equal(secretAttr.Owner, attr.Owner)
+
+	file, status := suite.fs.Open("Tagged_PgPass.sha256", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal(checksum, string(data))
+
+	// Nobody_PgPass has no checksum, and other paths lack a secret.
+	for _, name := range []string{"Nobody_PgPass.sha256", ".sha256", "non-existent.sha256"} {
+		_, status = suite.fs.GetAttr(name, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v status to be fuse.ENOENT", name)
+		_, status = suite.fs.Open(name, 0, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v status to be fuse.ENOENT", name)
+	}
+}
+
+func (suite *FsTestSuite) TestOpenCaseInsensitive() {
+	assert := suite.assert
+
+	_, status := suite.fs.GetAttr("nobody_pgpass", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	suite.fs.Cache.SetCaseInsensitive(true)
+	defer suite.fs.Cache.SetCaseInsensitive(false)
+
+	_, status = suite.fs.GetAttr("nobody_pgpass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	file, status := suite.fs.Open("NOBODY_PGPASS", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("asddas", string(data))
+
+	// Listings keep the server's spelling.
+	entries, _ := suite.fs.OpenDir("", fuseContext)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	assert.Contains(names, "Nobody_PgPass")
+	assert.NotContains(names, "nobody_pgpass")
+}
+
+func (suite *FsTestSuite) TestOpenRecordsAudit() {
+	assert := suite.assert
+
+	var buf bytes.Buffer
+	suite.fs.Audit = keywhizfs.NewAuditLog(&buf)
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 1002}, Pid: 42}
+
+	_, status := suite.fs.Open("Nobody_PgPass", 0, context)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open(".json/secret/hmac.key", 0, context)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open(".version", 0, context)
+	assert.Equal(fuse.OK, status)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(lines, 2) {
+		return
+	}
+
+	var record keywhizfs.AuditRecord
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal("Nobody_PgPass", record.Secret)
+	assert.EqualValues(1001, record.Uid)
+	assert.EqualValues(1002, record.Gid)
+	assert.EqualValues(42, record.Pid)
+	assert.Equal("backend", record.Origin)
+	assert.False(record.Time.IsZero())
+
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal("hmac.key", record.Secret)
+	assert.Equal("backend", record.Origin)
+
+	// Content never appears.
+	nobodySecret, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	assert.NotContains(buf.String(), string(nobodySecret.Content))
+}
+
+func (suite *FsTestSuite) TestOpenEnforceOwner() {
+	assert := suite.assert
+
+	nobody, err := user.Lookup("nobody")
+	assert.NoError(err)
+	nobodyUid, _ := strconv.Atoi(nobody.Uid)
+
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: uint32(nobodyUid), Gid: 0}}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 0}}
+	defaultOwner := &fuse.Context{Owner: fuse.Owner{Uid: _SomeUID, Gid: 0}}
+
+	// Without enforcement, access is left to the kernel.
+	_, status := suite.fs.Open("Nobody_PgPass", 0, other)
+	assert.Equal(fuse.OK, status)
+
+	suite.fs.EnforceOwner = true
+	cases := []struct {
+		filename string
+		context  *fuse.Context
+		status   fuse.Status
+	}{
+		{"Nobody_PgPass", owner, fuse.OK},
+		{"Nobody_PgPass", fuseContext, fuse.OK}, // root
+		{"Nobody_PgPass", other, fuse.EACCES},
+		{"Nobody_PgPass", defaultOwner, fuse.EACCES},
+		{"hmac.key", defaultOwner, fuse.OK},
+		{"hmac.key", other, fuse.EACCES},
+		{".json/secret/Nobody_PgPass", owner, fuse.OK},
+		{".json/secret/Nobody_PgPass", defaultOwner, fuse.EACCES},
+		{".json/secret/Nobody_PgPass", other, fuse.EACCES},
+		{".json/secrets", other, fuse.EACCES},
+		{".version", other, fuse.OK},
+	}
+
+	for _, c := range cases {
+		_, status := suite.fs.Open(c.filename, 0, c.context)
+		assert.Equal(c.status, status, "Expected %v open status by uid %d to match", c.filename, c.context.Uid)
+	}
+}
+
 func (suite *FsTestSuite) TestOpenBadFiles() {
 	assert := suite.assert
 
@@ -210,6 +535,48 @@ func (suite *FsTestSuite) TestOpenBadFiles() {
 	}
 }
 
+func (suite *FsTestSuite) TestForbiddenFiles() {
+	assert := suite.assert
+
+	for _, filename := range []string{"Forbidden_Pass", ".json/secret/Forbidden_Pass"} {
+		_, status := suite.fs.GetAttr(filename, fuseContext)
+		assert.Equal(fuse.EACCES, status, "Expected %v attr status to match", filename)
+		_, status = suite.fs.Open(filename, 0, fuseContext)
+		assert.Equal(fuse.EACCES, status, "Expected %v open status to match", filename)
+	}
+}
+
+func (suite *FsTestSuite) TestNameFilterHidesFiles() {
+	assert := suite.assert
+
+	filter, _ := keywhizfs.ParseNameFilter("", "Nobody_*")
+	suite.fs.Cache.SetNameFilter(filter)
+
+	for _, filename := range []string{"Nobody_PgPass", ".json/secret/Nobody_PgPass"} {
+		_, status := suite.fs.GetAttr(filename, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v attr status to match", filename)
+		_, status = suite.fs.Open(filename, 0, fuseContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v open status to match", filename)
+	}
+
+	file, status := suite.fs.Open(".json/secrets", 0, fuseContext)
+	if assert.Equal(fuse.OK, status) {
+		buf := make([]byte, 4000)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		secrets, err := keywhizfs.ParseSecretList(data)
+		assert.NoError(err)
+		if assert.Len(secrets, 1) {
+			assert.Equal("General_Password..0be68f903f8b7d86", secrets[0].Name)
+		}
+	}
+
+	entries, _ := suite.fs.OpenDir("", fuseContext)
+	for _, e := range entries {
+		assert.NotEqual("Nobody_PgPass", e.Name)
+	}
+}
+
 func (suite *FsTestSuite) TestOpenDir() {
 	assert := suite.assert
 
@@ -220,10 +587,11 @@ func (suite *FsTestSuite) TestOpenDir() {
 		{
 			"",
 			map[string]bool{
-				".version":     true,
-				".running":     true,
-				".clear_cache": true,
-				".json":        false,
+				".version":       true,
+				".running":       true,
+				".clear_cache":   true,
+				".metadata.json": true,
+				".json":          false,
 				"General_Password..0be68f903f8b7d86": true,
 				"Nobody_PgPass":                      true,
 			},
@@ -257,6 +625,217 @@ func (suite *FsTestSuite) TestOpenDir() {
 	}
 }
 
+func (suite *FsTestSuite) TestXAttrs() {
+	assert := suite.assert
+
+	expected := map[string]string{
+		"user.keywhiz.owner":     "nobody",
+		"user.keywhiz.mode":      "0440",
+		"user.keywhiz.checksum":  "14fff2e41f738a470c7f35768238b9ae28bd4dd3a25f0aa932769918c217643f",
+		"user.keywhiz.version":   "3",
+		"user.keywhiz.stale":     "false",
+		"user.keywhiz.expiry":    "2099-01-01T00:00:00Z",
+		"user.keywhiz.createdAt": "2011-09-29T15:46:00.232Z",
+		"user.keywhiz.updatedAt": "2015-03-12T08:30:15.5Z",
+	}
+
+	names, status := suite.fs.ListXAttr("Tagged_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Len(names, len(expected))
+	for _, name := range names {
+		value, status := suite.fs.GetXAttr("Tagged_PgPass", name, fuseContext)
+		assert.Equal(fuse.OK, status, "Expected %v status to be fuse.OK", name)
+		assert.Equal(expected[name], string(value), "Expected %v to match", name)
+		assert.NotContains(string(value), "asddas")
+	}
+
+	// Unset metadata is absent rather than empty.
+	names, status = suite.fs.ListXAttr("hmac.key", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]string{"user.keywhiz.createdAt", "user.keywhiz.mode", "user.keywhiz.stale", "user.keywhiz.updatedAt"}, names)
+	_, status = suite.fs.GetXAttr("hmac.key", "user.keywhiz.owner", fuseContext)
+	assert.Equal(fuse.ENODATA, status)
+
+	names, status = suite.fs.ListXAttr(".version", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Empty(names)
+	_, status = suite.fs.GetXAttr("non-existent", "user.keywhiz.owner", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func (suite *FsTestSuite) TestOpenDirByOwner() {
+	assert := suite.assert
+	suite.fs.Layout = keywhizfs.LayoutByOwner
+
+	cases := []struct {
+		directory string
+		contents  map[string]bool // name -> isFile?
+	}{
+		{
+			"",
+			map[string]bool{
+				".version":       true,
+				".running":       true,
+				".clear_cache":   true,
+				".metadata.json": true,
+				".json":          false,
+				"nobody":         false,
+				"General_Password..0be68f903f8b7d86": true,
+			},
+		},
+		{
+			"nobody",
+			map[string]bool{
+				"Nobody_PgPass": true,
+			},
+		},
+		{
+			".json/secret",
+			map[string]bool{
+				"General_Password..0be68f903f8b7d86": true,
+				"Nobody_PgPass":                      true,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		fsEntries, status := suite.fs.OpenDir(c.directory, fuseContext)
+		assert.Equal(fuse.OK, status)
+		assert.Len(fsEntries, len(c.contents))
+
+		for _, fsEntry := range fsEntries {
+			expectedIsFile, ok := c.contents[fsEntry.Name]
+			assert.True(ok, "Unexpected entry %v in '%v'", fsEntry.Name, c.directory)
+			assert.Equal(expectedIsFile, fsEntry.Mode&fuse.S_IFREG == fuse.S_IFREG)
+		}
+	}
+
+	_, status := suite.fs.OpenDir("non-existent", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func (suite *FsTestSuite) TestFileAttrsByOwner() {
+	assert := suite.assert
+	suite.fs.Layout = keywhizfs.LayoutByOwner
+
+	attr, status := suite.fs.GetAttr("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(4, attr.Nlink, "Expected base directory to count .json and nobody")
+
+	attr, status = suite.fs.GetAttr("nobody", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0755|fuse.S_IFDIR, attr.Mode)
+	assert.NotEqual(_SomeUID, attr.Uid, "Expected owner directory to belong to its owner")
+
+	cases := []struct {
+		filename string
+		status   fuse.Status
+	}{
+		{"nobody/Nobody_PgPass", fuse.OK},
+		{"hmac.key", fuse.OK},
+		{"Nobody_PgPass", fuse.ENOENT},
+		{"nobody/hmac.key", fuse.ENOENT},
+		{"other/Nobody_PgPass", fuse.ENOENT},
+	}
+
+	for _, c := range cases {
+		_, status := suite.fs.GetAttr(c.filename, fuseContext)
+		assert.Equal(c.status, status, "Expected %v attr status to match", c.filename)
+	}
+}
+
+func (suite *FsTestSuite) TestOpenByOwner() {
+	assert := suite.assert
+	suite.fs.Layout = keywhizfs.LayoutByOwner
+
+	nobodySecret, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+
+	file, status := suite.fs.Open("nobody/Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal([]byte(nobodySecret.Content), data)
+
+	_, status = suite.fs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	_, status = suite.fs.Open("nobody", 0, fuseContext)
+	assert.Equal(keywhizfs.EISDIR, status)
+}
+
+func (suite *FsTestSuite) TestRootAttrs() {
+	assert := suite.assert
+
+	attr, status := suite.fs.GetAttr("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0755|fuse.S_IFDIR, attr.Mode)
+	assert.Equal(_SomeUID, attr.Uid)
+
+	suite.fs.RootMode = 0750
+	suite.fs.RootOwnership = &keywhizfs.Ownership{Uid: 4000, Gid: 5000}
+	attr, status = suite.fs.GetAttr("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0750|fuse.S_IFDIR, attr.Mode)
+	assert.EqualValues(4000, attr.Uid)
+	assert.EqualValues(5000, attr.Gid)
+}
+
+func (suite *FsTestSuite) TestRootPermissions() {
+	assert := suite.assert
+	suite.fs.RootMode = 0750
+	suite.fs.RootOwnership = &keywhizfs.Ownership{Uid: 4000, Gid: 5000}
+
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: 4000, Gid: 1}}
+	member := &fuse.Context{Owner: fuse.Owner{Uid: 4001, Gid: 5000}}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 4002, Gid: 1}}
+
+	for _, context := range []*fuse.Context{fuseContext, owner, member} {
+		_, status := suite.fs.OpenDir("", context)
+		assert.Equal(fuse.OK, status, "Expected uid %d to list the base directory", context.Uid)
+	}
+	_, status := suite.fs.OpenDir("", other)
+	assert.Equal(fuse.EACCES, status)
+
+	assert.Equal(fuse.OK, suite.fs.Access("", unix.R_OK|unix.X_OK, member))
+	assert.Equal(fuse.EACCES, suite.fs.Access("", unix.W_OK, member))
+	assert.Equal(fuse.OK, suite.fs.Access("", unix.W_OK, owner))
+	assert.Equal(fuse.EACCES, suite.fs.Access("", unix.R_OK, other))
+}
+
+func TestParseRootMode(t *testing.T) {
+	assert := assert.New(t)
+
+	mode, err := keywhizfs.ParseRootMode("0750")
+	assert.NoError(err)
+	assert.EqualValues(0750, mode)
+
+	for _, s := range []string{"", "0", "abc", "0999", "01777"} {
+		_, err = keywhizfs.ParseRootMode(s)
+		assert.Error(err, "Expected %v to be rejected", s)
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	layout, err := keywhizfs.ParseLayout("flat")
+	assert.NoError(err)
+	assert.Equal(keywhizfs.LayoutFlat, layout)
+
+	layout, err = keywhizfs.ParseLayout("by-owner")
+	assert.NoError(err)
+	assert.Equal(keywhizfs.LayoutByOwner, layout)
+	assert.Equal("by-owner", layout.String())
+
+	layout, err = keywhizfs.ParseLayout("by-group")
+	assert.NoError(err)
+	assert.Equal(keywhizfs.LayoutByGroup, layout)
+	assert.Equal("by-group", layout.String())
+
+	_, err = keywhizfs.ParseLayout("nested")
+	assert.Error(err)
+}
+
 func TestFsTestSuite(t *testing.T) {
 	// Starts a server for the duration of the test
 	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -265,8 +844,22 @@ func TestFsTestSuite(t *testing.T) {
 			fmt.Fprint(w, string(fixture("secrets.json")))
 		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/hmac.key"):
 			fmt.Fprint(w, string(fixture("secretNormalOwner.json")))
-		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Nobody_PgPass"):
+		case r.Method == "GET" && r.URL.Path == "/secret/Nobody_PgPass":
 			fmt.Fprint(w, string(fixture("secret.json")))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Large_Keystore"):
+			fmt.Fprintf(w, `{"name": "Large_Keystore", "secret": "%s", "mode": "0400"}`, base64.StdEncoding.EncodeToString(largeContent))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Trimmed_PgPass"):
+			fmt.Fprint(w, string(fixture("secretWithTrimFormat.json")))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Root_PgPass"):
+			fmt.Fprint(w, string(fixture("secretRootOwner.json")))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/NonexistentOwner_Pass"):
+			fmt.Fprint(w, string(fixture("secretWithoutBase64Padding.json")))
+		case r.Method == "GET" && r.URL.Path == "/secret/Tagged_PgPass": // exact, for versioned paths
+			fmt.Fprint(w, string(fixture("secretWithMetadata.json")))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/rotated.key"):
+			fmt.Fprint(w, string(fixture("secretWithUpdateDate.json")))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Forbidden_Pass"):
+			w.WriteHeader(403)
 		default:
 			w.WriteHeader(404)
 		}
@@ -279,3 +872,979 @@ func TestFsTestSuite(t *testing.T) {
 
 	suite.Run(t, fsSuite)
 }
+
+func TestFileAttrFollowsRefreshedContent(t *testing.T) {
+	assert := assert.New(t)
+
+	var content atomic.Value
+	content.Store("YXNkZGFz") // asddas
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"name": "Nobody_PgPass", "secret": "%s", "mode": "0400"}`, content.Load())
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	attr, status := kwfs.GetAttr("Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(6, attr.Size)
+
+	content.Store("bG9uZ2VyIGNvbnRlbnQ=") // longer content
+	attr, status = kwfs.GetAttr("Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(14, attr.Size)
+}
+
+func TestChecksumFollowsRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	var content atomic.Value
+	content.Store("asddas")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/secret/Nobody_PgPass" {
+			w.WriteHeader(404)
+			return
+		}
+		c := content.Load().(string)
+		sum := sha256.Sum256([]byte(c))
+		fmt.Fprintf(w, `{"name": "Nobody_PgPass", "secret": "%s", "mode": "0400", "checksum": "%s"}`,
+			base64.StdEncoding.EncodeToString([]byte(c)), hex.EncodeToString(sum[:]))
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	notifier := keywhizfs.NewFakeNotifier(16)
+	kwfs.ServeNotifier(notifier)
+
+	read := func() string {
+		file, status := kwfs.Open("Nobody_PgPass.sha256", 0, fuseContext)
+		assert.Equal(fuse.OK, status)
+		if file == nil {
+			return ""
+		}
+		buf := make([]byte, 4000)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	assert.Equal("14fff2e41f738a470c7f35768238b9ae28bd4dd3a25f0aa932769918c217643f", read())
+
+	content.Store("rotated")
+	sum := sha256.Sum256([]byte("rotated"))
+	assert.Equal(hex.EncodeToString(sum[:]), read())
+
+	// The kernel must drop its cached checksum file along with the secret file.
+	invalidated := make(map[string]bool)
+	timeout := time.After(time.Second)
+	for !invalidated["Nobody_PgPass.sha256"] {
+		select {
+		case path := <-notifier.Files:
+			invalidated[path] = true
+		case <-timeout:
+			assert.Fail("Expected the checksum file to be invalidated", "invalidated %v", invalidated)
+			return
+		}
+	}
+	assert.True(invalidated["Nobody_PgPass"], "Expected the secret file to be invalidated")
+}
+
+func TestRefreshInvalidatesKernelCache(t *testing.T) {
+	assert := assert.New(t)
+
+	var rotated int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := "YXNkZGFz" // asddas
+		if atomic.LoadInt32(&rotated) != 0 {
+			content = "cm90YXRlZA==" // rotated
+		}
+		fmt.Fprintf(w, `{"name": "Nobody_PgPass", "secret": "%s", "mode": "0444"}`, content)
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	notifier := keywhizfs.NewFakeNotifier(16)
+	kwfs.ServeNotifier(notifier)
+
+	_, status := kwfs.GetAttr("Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	atomic.StoreInt32(&rotated, 1)
+	stop := kwfs.Cache.StartRefresh(10 * time.Millisecond)
+	defer stop()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case path := <-notifier.Files:
+			if path == "Nobody_PgPass" {
+				return
+			}
+		case <-timeout:
+			assert.Fail("Expected the refreshed secret file to be invalidated")
+			return
+		}
+	}
+}
+
+func TestStatDoesNotCopyContent(t *testing.T) {
+	assert := assert.New(t)
+
+	const size = 1 << 20
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(keywhizfs.Secret{Name: "Large_Keystore", Content: make([]byte, size), Mode: "0400"})
+	cache.Add(keywhizfs.Secret{Name: "Trimmed_Keystore", Content: make([]byte, size), Mode: "0400", Format: keywhizfs.FormatTrim})
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, logConfig)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 20; i++ {
+		for _, name := range []string{"Large_Keystore", "Trimmed_Keystore"} {
+			attr, status := kwfs.GetAttr(name, fuseContext)
+			if !assert.Equal(fuse.OK, status) {
+				return
+			}
+			assert.EqualValues(size, attr.Size)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	assert.True(after.TotalAlloc-before.TotalAlloc < size, "Stats should not copy the content: %d bytes allocated", after.TotalAlloc-before.TotalAlloc)
+
+	file, status := kwfs.Open("Large_Keystore", 0, fuseContext)
+	if assert.Equal(fuse.OK, status) {
+		var attr fuse.Attr
+		file.GetAttr(&attr)
+		assert.EqualValues(size, attr.Size, "An open file should still hold the content")
+		file.Release()
+	}
+}
+
+func TestBundleSwapsTogether(t *testing.T) {
+	assert := assert.New(t)
+
+	var generation, failing int32 = 1, 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			fmt.Fprint(w, `[{"name": "tls.crt", "bundle": "tls"}, {"name": "tls.key", "bundle": "tls"}]`)
+		case "/secret/tls.crt", "/secret/tls.key":
+			if r.URL.Path == "/secret/tls.key" && atomic.LoadInt32(&failing) != 0 {
+				w.WriteHeader(500)
+				return
+			}
+			name := r.URL.Path[len("/secret/"):]
+			content := fmt.Sprintf("%s-%d", name, atomic.LoadInt32(&generation))
+			fmt.Fprintf(w, `{"name": "%s", "secret": "%s", "mode": "0400", "bundle": "tls"}`,
+				name, base64.StdEncoding.EncodeToString([]byte(content)))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	read := func(name string) string {
+		file, status := kwfs.Open(name, 0, fuseContext)
+		assert.Equal(fuse.OK, status, name)
+		if file == nil {
+			return ""
+		}
+		buf := make([]byte, 4000)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	readBundle := func() (target string, crt, key string) {
+		target, status := kwfs.Readlink(".bundles/tls", fuseContext)
+		assert.Equal(fuse.OK, status)
+		return target, read(".bundles/" + target + "/tls.crt"), read(".bundles/" + target + "/tls.key")
+	}
+
+	entries, status := kwfs.OpenDir(".bundles", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "tls", Mode: fuse.S_IFLNK}}, entries)
+	attr, status := kwfs.GetAttr(".bundles/tls", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFLNK|0777, attr.Mode)
+
+	target, crt, key := readBundle()
+	assert.Equal("tls@1", target)
+	assert.Equal("tls.crt-1", crt)
+	assert.Equal("tls.key-1", key)
+	entries, status = kwfs.OpenDir(".bundles/tls@1", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, 2)
+
+	// A refresh with new content moves both files to the next generation, and the previous one
+	// stays readable for readers which resolved the link before.
+	atomic.StoreInt32(&generation, 2)
+	target, crt, key = readBundle()
+	assert.Equal("tls@2", target)
+	assert.Equal("tls.crt-2", crt)
+	assert.Equal("tls.key-2", key)
+	assert.Equal("tls.key-1", read(".bundles/tls@1/tls.key"))
+
+	// When a member fails to refresh, neither is replaced.
+	atomic.StoreInt32(&generation, 3)
+	atomic.StoreInt32(&failing, 1)
+	target, crt, key = readBundle()
+	assert.Equal("tls@2", target)
+	assert.Equal("tls.crt-2", crt)
+	assert.Equal("tls.key-2", key)
+
+	_, status = kwfs.Open(".bundles/tls@5/tls.crt", 0, fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func TestBundleLinkFollowsRequestContext(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/secrets" {
+			fmt.Fprint(w, `[{"name": "tls.crt", "bundle": "tls"}, {"name": "tls.key", "bundle": "tls"}]`)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: 5 * time.Second, BackendTimeout: 5 * time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	kwfs.RequestContext = func(request *fuse.Context) context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return ctx
+	}
+
+	start := time.Now()
+	_, status := kwfs.Readlink(".bundles/tls", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	_, status = kwfs.GetAttr(".bundles/tls", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	assert.True(time.Since(start) < time.Second, "Bundle links should stop waiting once the request is interrupted")
+}
+
+func TestOpenRevokedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	var revoked int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&revoked) != 0 {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	_, status := kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	// Once access is revoked, the cached secret is no longer served.
+	atomic.StoreInt32(&revoked, 1)
+	_, status = kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.EACCES, status)
+	assert.Equal(0, kwfs.Cache.Len())
+
+	atomic.StoreInt32(&revoked, 0)
+	_, status = kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.False(kwfs.Cache.Forbidden("Nobody_PgPass"))
+}
+
+func TestExpiredSecretsOnlyInMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	expired, _ := keywhizfs.ParseSecret(fixture("secretWithExpiry.json"))
+	current, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{map[string]*keywhizfs.Secret{expired.Name: expired, current.Name: current}, new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, logConfig)
+
+	entries, status := kwfs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	var names []string
+	for _, e := range entries {
+		if e.Name[0] != '.' {
+			names = append(names, e.Name)
+		}
+	}
+	assert.Equal([]string{current.Name}, names, "Expected the expired secret to be hidden")
+
+	file, status := kwfs.Open(".metadata.json", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	var metadata []map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &metadata))
+	marked := make(map[string]interface{})
+	for _, m := range metadata {
+		marked[m["name"].(string)] = m["expired"]
+	}
+	assert.Equal(map[string]interface{}{expired.Name: true, current.Name: nil}, marked)
+}
+
+func TestInterruptedRequestCancelsBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := CancellableBackend{cancelled: make(chan error, 1)}
+	cache := keywhizfs.NewCache(backend, keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}, logConfig)
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, logConfig)
+
+	// Each request is interrupted shortly after it starts, as by a signal to the reading process.
+	var interrupted *fuse.Context
+	kwfs.RequestContext = func(request *fuse.Context) context.Context {
+		interrupted = request
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return ctx
+	}
+
+	for _, request := range []func() fuse.Status{
+		func() fuse.Status { _, status := kwfs.Open("foo", 0, fuseContext); return status },
+		func() fuse.Status { _, status := kwfs.GetAttr("foo", fuseContext); return status },
+		func() fuse.Status {
+			_, status := kwfs.GetXAttr("foo", "user.keywhiz.owner", fuseContext)
+			return status
+		},
+	} {
+		assert.Equal(fuse.ENOENT, request())
+		assert.Equal(fuseContext, interrupted)
+		select {
+		case err := <-backend.cancelled:
+			assert.Equal(context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Error("Backend request was not cancelled")
+		}
+	}
+}
+
+func TestSecretTimestamps(t *testing.T) {
+	assert := assert.New(t)
+
+	rotated, _ := keywhizfs.ParseSecret(fixture("secretWithUpdateDate.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*rotated)
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, logConfig)
+
+	attr, status := kwfs.GetAttr(rotated.Name, fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.True(rotated.UpdatedAt.Equal(time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))))
+	assert.True(rotated.CreatedAt.Equal(time.Unix(int64(attr.Ctime), int64(attr.Ctimensec))))
+
+	created, _ := kwfs.GetXAttr(rotated.Name, "user.keywhiz.createdAt", fuseContext)
+	updated, _ := kwfs.GetXAttr(rotated.Name, "user.keywhiz.updatedAt", fuseContext)
+	assert.Equal("2011-09-29T15:46:00.232Z", string(created))
+	assert.Equal("2015-03-12T08:30:15.5Z", string(updated))
+
+	file, status := kwfs.Open(".metadata.json", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	var metadata []map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &metadata))
+	if assert.Len(metadata, 1) {
+		assert.Equal("2011-09-29T15:46:00.232Z", metadata[0]["createdAt"])
+		assert.Equal("2015-03-12T08:30:15.5Z", metadata[0]["updatedAt"])
+	}
+}
+
+func TestAliasesListedAsFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	secret, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{map[string]*keywhizfs.Secret{secret.Name: secret}, new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	assert.NoError(cache.SetAliases(map[string]string{"Old_Alias": secret.Name, "Missing_Alias": "missing"}))
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, logConfig)
+
+	entries, status := kwfs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	var names []string
+	for _, e := range entries {
+		if e.Name[0] != '.' {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	assert.Equal([]string{secret.Name, "Old_Alias"}, names)
+
+	attr, status := kwfs.GetAttr("Old_Alias", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len(secret.Content), attr.Size)
+	file, status := kwfs.Open("Old_Alias", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4000)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.EqualValues(secret.Content, data)
+
+	_, status = kwfs.GetAttr("Missing_Alias", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	assert.Equal(1, cache.Len())
+}
+
+func TestParseUmask(t *testing.T) {
+	assert := assert.New(t)
+
+	umask, err := keywhizfs.ParseUmask("0077")
+	assert.NoError(err)
+	assert.EqualValues(0077, umask)
+	umask, err = keywhizfs.ParseUmask("0")
+	assert.NoError(err)
+	assert.EqualValues(0, umask)
+
+	for _, s := range []string{"", "abc", "0999", "01777", "-1"} {
+		_, err = keywhizfs.ParseUmask(s)
+		assert.Error(err, "Expected %v to be rejected", s)
+	}
+}
+
+func TestUmaskStripsSecretModes(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secret/Shared_Config":
+			fmt.Fprint(w, `{"name": "Shared_Config", "secret": "YXNkZGFz", "mode": "0644"}`)
+		case "/secret/Private_Key":
+			fmt.Fprint(w, `{"name": "Private_Key", "secret": "YXNkZGFz", "mode": "0400"}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	mode := func(name string) uint32 {
+		attr, status := kwfs.GetAttr(name, fuseContext)
+		assert.Equal(fuse.OK, status, name)
+		if attr == nil {
+			return 0
+		}
+		return attr.Mode
+	}
+	assert.EqualValues(fuse.S_IFREG|0644, mode("Shared_Config"))
+
+	kwfs.Umask = 0077
+	assert.EqualValues(fuse.S_IFREG|0600, mode("Shared_Config"))
+	assert.EqualValues(fuse.S_IFREG|0400, mode("Private_Key"), "Expected the umask not to add permissions")
+
+	// Bits beyond the permissions are ignored, so the file type is kept.
+	kwfs.Umask = 0177777
+	assert.EqualValues(fuse.S_IFREG, mode("Shared_Config"))
+}
+
+func TestLayoutByGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	grouped := string(fixture("secretWithGroups.json"))
+	ungrouped := string(fixture("secret.json"))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			fmt.Fprintf(w, "[%s, %s]", grouped, ungrouped)
+		case "/secret/Shared_DbPass":
+			fmt.Fprint(w, grouped)
+		case "/secret/Nobody_PgPass":
+			fmt.Fprint(w, ungrouped)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	kwfs.Layout = keywhizfs.LayoutByGroup
+
+	names := func(dir string) []string {
+		entries, status := kwfs.OpenDir(dir, fuseContext)
+		assert.Equal(fuse.OK, status, "OpenDir %q", dir)
+		var names []string
+		for _, e := range entries {
+			if e.Name[0] != '.' {
+				names = append(names, e.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	assert.Equal([]string{"Nobody_PgPass", "db", "web"}, names(""))
+	assert.Equal([]string{"Shared_DbPass"}, names("db"))
+	assert.Equal([]string{"Shared_DbPass"}, names("web"))
+
+	attr, status := kwfs.GetAttr("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(5, attr.Nlink, "Expected base directory to count .json and both groups")
+	attr, status = kwfs.GetAttr("web", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0755|fuse.S_IFDIR, attr.Mode)
+
+	for _, path := range []string{"db/Shared_DbPass", "web/Shared_DbPass"} {
+		file, status := kwfs.Open(path, 0, fuseContext)
+		assert.Equal(fuse.OK, status, "Open %v", path)
+		if file != nil {
+			buf := make([]byte, 100)
+			res, _ := file.Read(buf, 0)
+			data, _ := res.Bytes(buf)
+			assert.Equal("shared", string(data))
+		}
+	}
+
+	cases := []struct {
+		filename string
+		status   fuse.Status
+	}{
+		{"Nobody_PgPass", fuse.OK},
+		{"Shared_DbPass", fuse.ENOENT},
+		{"web/Nobody_PgPass", fuse.ENOENT},
+		{"other/Shared_DbPass", fuse.ENOENT},
+		{"other", fuse.ENOENT},
+	}
+	for _, c := range cases {
+		_, status := kwfs.GetAttr(c.filename, fuseContext)
+		assert.Equal(c.status, status, "Expected %v attr status to match", c.filename)
+	}
+}
+
+func TestLayoutLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	grouped := string(fixture("secretWithGroups.json"))
+	ungrouped := string(fixture("secret.json"))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			fmt.Fprintf(w, "[%s, %s]", grouped, ungrouped)
+		case "/secret/Shared_DbPass":
+			fmt.Fprint(w, grouped)
+		case "/secret/Nobody_PgPass":
+			fmt.Fprint(w, ungrouped)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	kwfs.Layout = keywhizfs.LayoutByGroup
+	kwfs.LayoutLinks = true
+
+	entries := func(dir string) map[string]uint32 {
+		listed, status := kwfs.OpenDir(dir, fuseContext)
+		assert.Equal(fuse.OK, status, "OpenDir %q", dir)
+		modes := make(map[string]uint32)
+		for _, e := range listed {
+			if e.Name[0] != '.' {
+				modes[e.Name] = e.Mode
+			}
+		}
+		return modes
+	}
+	assert.Equal(map[string]uint32{
+		"Nobody_PgPass": fuse.S_IFREG,
+		"Shared_DbPass": fuse.S_IFREG,
+		"db":            fuse.S_IFDIR,
+		"web":           fuse.S_IFDIR,
+	}, entries(""))
+	assert.Equal(map[string]uint32{"Shared_DbPass": fuse.S_IFLNK}, entries("db"))
+
+	// Each grouped view links to the one file in the base directory.
+	for _, link := range []string{"db/Shared_DbPass", "web/Shared_DbPass"} {
+		attr, status := kwfs.GetAttr(link, fuseContext)
+		assert.Equal(fuse.OK, status, link)
+		assert.EqualValues(fuse.S_IFLNK|0777, attr.Mode, link)
+
+		target, status := kwfs.Readlink(link, fuseContext)
+		assert.Equal(fuse.OK, status, link)
+		assert.Equal("../Shared_DbPass", target)
+		assert.EqualValues(len(target), attr.Size)
+
+		resolved := path.Clean(path.Join(path.Dir(link), target))
+		assert.Equal("Shared_DbPass", resolved)
+		attr, status = kwfs.GetAttr(resolved, fuseContext)
+		assert.Equal(fuse.OK, status)
+		assert.EqualValues(fuse.S_IFREG|0400, attr.Mode)
+		file, status := kwfs.Open(resolved, 0, fuseContext)
+		assert.Equal(fuse.OK, status)
+		if file != nil {
+			buf := make([]byte, 100)
+			res, _ := file.Read(buf, 0)
+			data, _ := res.Bytes(buf)
+			assert.Equal("shared", string(data))
+		}
+	}
+
+	_, status := kwfs.Open("db/Shared_DbPass", 0, fuseContext)
+	assert.Equal(fuse.ENOENT, status, "Expected no file behind the link itself")
+	_, status = kwfs.Readlink("web/Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	_, status = kwfs.Readlink("Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func TestOversizedSecretStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secret/Small_Token":
+			w.Write(fixture("secretUnderSizeLimit.json"))
+		case "/secret/Large_Token":
+			w.Write(fixture("secretOverSizeLimit.json"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	client.MaxSecretSize = 16
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	_, status := kwfs.GetAttr("Small_Token", fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.GetAttr("Large_Token", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	assert.Equal([]string{"Small_Token"}, kwfs.Cache.Keys(), "Expected the oversized secret not to be cached")
+
+	kwfs.OversizedStatus, _ = keywhizfs.ParseOversizedStatus("efbig")
+	for _, name := range []string{"Large_Token", ".json/secret/Large_Token"} {
+		_, status = kwfs.GetAttr(name, fuseContext)
+		assert.Equal(keywhizfs.EFBIG, status, "GetAttr %v", name)
+		_, status = kwfs.Open(name, 0, fuseContext)
+		assert.Equal(keywhizfs.EFBIG, status, "Open %v", name)
+	}
+	_, status = kwfs.GetAttr("Missing_Token", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	_, err := keywhizfs.ParseOversizedStatus("eio")
+	assert.Error(err)
+}
+
+func TestAuditRecordsRequestID(t *testing.T) {
+	assert := assert.New(t)
+
+	requestIDs := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- r.Header.Get("X-Request-Id")
+		w.Write(fixture("secret.json"))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	var buf bytes.Buffer
+	kwfs.Audit = keywhizfs.NewAuditLog(&buf)
+
+	_, status := kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	var record keywhizfs.AuditRecord
+	assert.NoError(json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal("backend", record.Origin)
+	assert.NotEmpty(record.RequestID)
+	assert.Equal(<-requestIDs, record.RequestID)
+}
+
+func TestOpenDirReusesListing(t *testing.T) {
+	assert := assert.New(t)
+
+	var lists int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			atomic.AddInt32(&lists, 1)
+			w.Write(fixture("secrets.json"))
+		case "/secret/Shared_DbPass":
+			w.Write(fixture("secretWithGroups.json"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	kwfs.ListingTTL = time.Minute
+
+	_, status := kwfs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	entries, status := kwfs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	assert.Contains(names, "Nobody_PgPass")
+	assert.EqualValues(1, atomic.LoadInt32(&lists), "Expected one listing within the TTL")
+
+	// A secret found by a lookup is added to the cache, so the next listing is fresh.
+	_, status = kwfs.Open("Shared_DbPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(2, atomic.LoadInt32(&lists))
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes by loggers.
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestSecretFileLifecycleIsTraced(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture("secret.json"))
+	}))
+	defer server.Close()
+
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	output := &lockedBuffer{}
+	kwfs.Logger = log.New("kwfs", log.Config{Debug: true, Mountpoint: "/tmp/mnt", Output: output})
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 1002}, Pid: 42}
+
+	file, status := kwfs.Open("Nobody_PgPass", 0, context)
+	assert.Equal(fuse.OK, status)
+	_, status = file.Read(make([]byte, 4096), 0)
+	assert.Equal(fuse.OK, status)
+	file.Release()
+
+	// A second open within the sampling interval is not traced, but counted by the next one.
+	file, _ = kwfs.Open("Nobody_PgPass", 0, context)
+	file.Read(make([]byte, 4096), 0)
+	file.Release()
+	kwfs.LifecycleSampling = -1
+	file, _ = kwfs.Open("Nobody_PgPass", 0, context)
+	file.Release()
+
+	logged := output.String()
+	fields := "file=Nobody_PgPass handle=1 pid=42 uid=1001"
+	assert.Contains(logged, "Open "+fields)
+	assert.Contains(logged, "Read offset=0 size=4096 "+fields)
+	assert.Contains(logged, "Release after 1 reads "+fields)
+	assert.NotContains(logged, "handle=2")
+	assert.Contains(logged, "Open, after 1 opens not traced file=Nobody_PgPass handle=3")
+	assert.Contains(logged, "Release after 0 reads file=Nobody_PgPass handle=3")
+
+	nobodySecret, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	assert.NotContains(logged, string(nobodySecret.Content))
+
+	// Nothing is traced without debugging.
+	kwfs.Logger.SetDebug(false)
+	kwfs.Open("Nobody_PgPass", 0, context)
+	assert.NotContains(output.String(), "handle=4")
+}
+
+func TestOpenFileKeepsContentAcrossRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	var content atomic.Value
+	content.Store("YXNkZGFz") // asddas
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"name": "Nobody_PgPass", "secret": "%s", "mode": "0400"}`, content.Load())
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: 0, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+
+	read := func(f nodefs.File) string {
+		buf := make([]byte, 100)
+		res, _ := f.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+
+	before, status := kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	if withFlags, ok := before.(*nodefs.WithFlags); assert.True(ok) {
+		assert.NotZero(withFlags.FuseFlags&fuse.FOPEN_DIRECT_IO, "Secret files should bypass the page cache")
+	}
+
+	content.Store("bG9uZ2VyIGNvbnRlbnQ=") // longer content
+	after, status := kwfs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	assert.Equal("longer content", read(after))
+	assert.Equal("asddas", read(before), "An open file should keep the content it was opened with")
+}
+
+func TestStreamedSecretReadsRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	listing := fmt.Sprintf(`[{"name": "Huge_Blob", "secretLength": %d, "mode": "0400"}]`, len(content))
+	secret := fmt.Sprintf(`{"name": "Huge_Blob", "secret": "%s", "secretLength": %d, "mode": "0400"}`, base64.StdEncoding.EncodeToString(content), len(content))
+
+	for _, ranges := range []bool{true, false} {
+		var whole, partial int32
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/secrets":
+				w.Write([]byte(listing))
+			case r.URL.Path != "/secret/Huge_Blob":
+				w.WriteHeader(404)
+			case r.Header.Get("Range") == "":
+				atomic.AddInt32(&whole, 1)
+				w.Write([]byte(secret))
+			case ranges && r.Header.Get("Accept") == "application/octet-stream":
+				atomic.AddInt32(&partial, 1)
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			default: // A server without ranges ignores the Range header.
+				w.Write([]byte(secret))
+			}
+		}))
+
+		timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: time.Second, BackendTimeout: time.Second}
+		client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+		kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+		kwfs.StreamThreshold = 1024
+
+		attr, status := kwfs.GetAttr("Huge_Blob", fuseContext)
+		if assert.Equal(fuse.OK, status) {
+			assert.EqualValues(len(content), attr.Size)
+		}
+		file, status := kwfs.Open("Huge_Blob", 0, fuseContext)
+		if !assert.Equal(fuse.OK, status, "ranges=%v", ranges) {
+			server.Close()
+			continue
+		}
+		for _, r := range []struct{ off, size, end int }{{0, 100, 100}, {5000, 4096, 9096}, {9990, 100, 10000}, {10000, 100, 10000}} {
+			buf := make([]byte, r.size)
+			res, status := file.Read(buf, int64(r.off))
+			if assert.Equal(fuse.OK, status) {
+				data, _ := res.Bytes(buf)
+				assert.Equal(string(content[r.off:r.end]), string(data), "ranges=%v, offset %d", ranges, r.off)
+			}
+		}
+
+		if ranges {
+			assert.Zero(atomic.LoadInt32(&whole), "A streamed secret should never be fetched whole")
+			assert.Equal(int32(4), atomic.LoadInt32(&partial), "Expected a range request at open and for each read in range")
+		} else {
+			assert.Equal(int32(1), atomic.LoadInt32(&whole), "Without ranges, the secret should be read whole at open")
+		}
+		server.Close()
+	}
+}
+
+func TestStreamedSecretKeepsOpenedVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	var version atomic.Value
+	version.Store("v1")
+	var available int32 = 1
+	listing := `[{"name": "Huge_Blob", "secretLength": 2048, "mode": "0640", "owner": "root"}]`
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/secrets":
+			w.Write([]byte(listing))
+		case atomic.LoadInt32(&available) == 0:
+			w.WriteHeader(503)
+		case r.URL.Path != "/secret/Huge_Blob":
+			w.WriteHeader(404)
+		case r.Header.Get("Range") != "":
+			v := version.Load().(string)
+			w.Header().Set("ETag", `"`+v+`"`)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(strings.Repeat(v, 1024)))
+		default:
+			w.Write([]byte(`{"name": "Huge_Blob", "secretLength": 2048, "mode": "0640", "owner": "root", "secret": ""}`))
+		}
+	}))
+	defer server.Close()
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, timeouts.BackendTimeout, logConfig, false)
+	kwfs, _, _ := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, logConfig)
+	kwfs.StreamThreshold = 1024
+	kwfs.Umask = 0027
+	kwfs.Cache.SetCircuitBreaker(1, time.Minute, time.Minute)
+
+	stat, status := kwfs.GetAttr("Huge_Blob", fuseContext)
+	if !assert.Equal(fuse.OK, status) {
+		return
+	}
+	file, status := kwfs.Open("Huge_Blob", 0, fuseContext)
+	if !assert.Equal(fuse.OK, status) {
+		return
+	}
+	defer file.Release()
+	kwfs.Cache.SetRateLimit(0.001, 1) // a single request, after the open
+
+	var fstat fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&fstat))
+	assert.Equal(*stat, fstat, "An open streamed file should have the attributes of the secret")
+	assert.EqualValues(fuse.S_IFREG|0640, fstat.Mode)
+	assert.EqualValues(0, fstat.Uid)
+
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		res, status := file.Read(buf, int64(i*2))
+		if assert.Equal(fuse.OK, status, "Reads of an open file should not be rate limited") {
+			data, _ := res.Bytes(buf)
+			assert.Equal("v1v1", string(data))
+		}
+	}
+
+	version.Store("v2")
+	_, status = file.Read(buf, 0)
+	assert.Equal(fuse.EIO, status, "A read after rotation should fail rather than mix versions")
+
+	atomic.StoreInt32(&available, 0)
+	_, status = file.Read(buf, 0)
+	assert.Equal(fuse.EIO, status)
+	_, status = file.Read(buf, 0)
+	assert.Equal(fuse.EIO, status)
+	assert.EqualValues(1, kwfs.Cache.Stats().ShortCircuits, "Streamed reads should be skipped while the breaker is open")
+}
@@ -17,14 +17,20 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/square/keywhizfs"
+	"github.com/square/keywhizfs/admin"
 	klog "github.com/square/keywhizfs/log"
+	"github.com/square/keywhizfs/metrics"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,65 +40,602 @@ var (
 	caFile         = flag.String("ca", "cacert.crt", "PEM-encoded CA certificates file")
 	user           = flag.String("asuser", "keywhiz", "Default user to own files")
 	group          = flag.String("group", "keywhiz", "Default group to own files")
+	pkcs11Module   = flag.String("pkcs11-module", "", "PKCS#11 library of a token holding the client certificate and key, instead of -cert and -key")
+	pkcs11Slot     = flag.Int("pkcs11-slot", 0, "Slot of the token for -pkcs11-module")
+	pkcs11PINFile  = flag.String("pkcs11-pin-file", "", "File containing the PIN of the token for -pkcs11-module")
+	pkcs11Label    = flag.String("pkcs11-label", "keywhizfs", "Label of the certificate and key on the token for -pkcs11-module")
 	ping           = flag.Bool("ping", false, "Enable startup ping to server")
+	prefetch       = flag.Bool("prefetch", false, "Fetch every secret in the background on startup")
 	debug          = flag.Bool("debug", false, "Enable debugging output")
 	timeoutSeconds = flag.Uint("timeout", 20, "Timeout for communication with server")
+	cacheFile      = flag.String("cache-file", "", "File to persist cached secrets to, and restore them from on startup; also written on exit")
+	warmGrace      = flag.Duration("warm-grace", time.Minute, "How long secrets restored from -cache-file are served without waiting for the server while every secret is fetched, disabled if zero")
+	listingTTL     = flag.Duration("listing-ttl", time.Second, "How long a secret listing is reused for directory reads, disabled if zero")
+	certCheck      = flag.Duration("cert-check-interval", 0, "Interval between checks of the -cert, -key, and -ca files for changes, reloading them when changed, disabled if zero")
+	mountCheck     = flag.Duration("mount-check-interval", 10*time.Second, "Interval between checks that the mountpoint is still mounted, exiting if it was lost, disabled if zero")
+	logFormat      = flag.String("log-format", "text", "Log format, either text or json")
+	mlockContent   = flag.Bool("mlock", false, "Keep secret contents in memory locked against swapping, on Linux")
+	backendRPS     = flag.Float64("backend-rps", 0, "Maximum average backend requests per second, unlimited if zero")
+	backendBurst   = flag.Int("backend-burst", 10, "Maximum burst of backend requests when -backend-rps is set")
+	maxSecretSize  = flag.Int("max-secret-size", 0, "Largest secret content in bytes accepted from the server, unlimited if zero")
+	oversized      = flag.String("oversized", "enoent", "Error for secrets over -max-secret-size, either enoent or efbig")
+	maxRetryAfter  = flag.Duration("max-retry-after", 0, "Longest Retry-After wait of a rate-limited request before falling back to the cache, the backend deadline if zero")
+	maxBackendConc = flag.Int("max-backend-concurrency", 0, "Maximum backend requests in flight at once, unlimited if zero")
+	enforceOwner   = flag.Bool("enforce-owner", false, "Deny reads of secrets to users other than root and the owner")
+	conflictPolicy = flag.String("conflict-policy", "validated-backend-wins", "Handling of fetched secrets failing validation, either validated-backend-wins, backend-wins, or sticky")
+	aliasFile      = flag.String("aliases", "", "JSON file mapping alias names to the secrets they resolve to, each served as a file of its own")
+	fallbackDir    = flag.String("fallback-dir", "", "Directory of last-resort secret copies, verified against its SHA256SUMS file, read when the server fails")
+	foldCase       = flag.Bool("case-insensitive", false, "Look up secret files regardless of the case of their names")
+	rootMode       = flag.String("root-mode", "0755", "Permissions of the mount's base directory, in octal")
+	umask          = flag.String("umask", "0000", "Permissions removed from the mode of every secret file, in octal")
+	rootOwner      = flag.String("root-owner", "", "Owner of the mount's base directory, as user or user:group, instead of -asuser and -group")
+	layout         = flag.String("layout", "flat", "Arrangement of secret files, either flat, by-owner or by-group")
+	layoutLinks    = flag.Bool("layout-symlinks", false, "With -layout, keep every secret file in the top level directory and place symlinks to it in the owner or group directories")
+	sanitize       = flag.String("sanitize", "none", "Encoding of unsafe characters in secret file names, either none, percent, or strict")
+	allow          = flag.String("allow", "", "Comma-separated glob patterns of secret names to expose, all if empty")
+	deny           = flag.String("deny", "", "Comma-separated glob patterns of secret names to hide, taking precedence over -allow")
+	adminAddr      = flag.String("admin-addr", "", "Address to serve the admin interface on, localhost if only a port is given")
+	pprofEnabled   = flag.Bool("pprof", false, "Serve runtime profiles at /debug/pprof/ on -admin-addr, which must be on localhost")
+	auditLog       = flag.String("audit-log", "", "File to append a record of every secret access to")
+	checkOnly      = flag.Bool("check", false, "Validate the certificates, server, and mountpoint, then exit without mounting")
+	clockSkew      = flag.Duration("clock-skew", 0, "Tolerance added to secret expiry times for a skewed local clock, negative to hide secrets early")
+	configFile     = flag.String("config", "", "JSON configuration file, overridden by flags and re-read on SIGHUP")
+	metricsAddr    = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. localhost:9102")
+	statsdAddr     = flag.String("statsd-addr", "", "UDP address of a statsd server to send metrics to, e.g. localhost:8125")
+	statsdInterval = flag.Duration("statsd-interval", 10*time.Second, "Interval between metrics sent to -statsd-addr")
+	userAgent      = flag.String("user-agent", "", "User-Agent sent to the server, keywhizfs/<version> if empty")
+	allowOther     = flag.Bool("allow-other", true, "Let users other than the one mounting the filesystem access it, which requires user_allow_other in /etc/fuse.conf; false restricts it to the mounting user")
+	streamSize     = flag.Int("stream-threshold", 0, "Secret size in bytes from which files are read from the server range by range, if it supports ranges, disabled if zero")
+	fuseOptions    optionList
 	logger         *klog.Logger
 )
 
+func init() {
+	flag.Var(&fuseOptions, "fuse-option", "FUSE mount option as name or name=value, such as max_read=131072, repeated for each option")
+}
+
+// optionList collects the values of a flag given several times.
+type optionList []string
+
+func (l *optionList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *optionList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// cachePersistInterval is how often the cache is written to -cache-file.
+const cachePersistInterval = time.Minute
+
+// Circuit breaker settings: after breakerFailures backend failures within breakerWindow, the
+// backend is skipped for breakerCooldown.
+const (
+	breakerFailures = 5
+	breakerWindow   = time.Minute
+	breakerCooldown = 30 * time.Second
+)
+
+// prefetchConcurrency is the number of secrets fetched at once by -prefetch.
+const prefetchConcurrency = 8
+
 func main() {
 	var Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] url mountpoint\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [url[,url...] mountpoint]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
-	if flag.NArg() != 2 {
+	if flag.NArg() != 0 && flag.NArg() != 2 {
 		Usage()
 		os.Exit(1)
 	}
 
-	serverURL, mountpoint := flag.Args()[0], flag.Args()[1]
+	var config keywhizfs.Config
+	if *configFile != "" {
+		loaded, err := keywhizfs.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		config = *loaded
+	}
+	applyConfig(&config)
+
+	if config.Server == "" || config.Mountpoint == "" {
+		Usage()
+		os.Exit(1)
+	}
+	serverURLs, mountpoint := strings.Split(config.Server, ","), config.Mountpoint
 
-	logConfig := klog.Config{*debug, mountpoint}
+	logConfig := klog.Config{Debug: *debug, Mountpoint: mountpoint, Format: *logFormat}
 	logger = klog.New("kwfs_main", logConfig)
 	defer logger.Close()
 
 	if *certFile == "" {
 		logger.Debugf("Certificate file not specified, assuming certificate also in %s", *keyFile)
 		certFile = keyFile
+		config.Cert = *certFile
+	}
+	live := &liveConfig{config: config}
+
+	clientTimeout := time.Duration(*timeoutSeconds) * time.Second
+	if *checkOnly {
+		if *pkcs11Module != "" {
+			log.Fatalf("-check cannot be used with -pkcs11-module\n")
+		}
+		os.Exit(check(serverURLs, mountpoint, clientTimeout, logConfig))
 	}
 
 	lockMemory()
 
-	clientTimeout := time.Duration(*timeoutSeconds) * time.Second
 	freshThreshold := 200 * time.Millisecond
 	backendDeadline := 500 * time.Millisecond
-	maxWait := clientTimeout + backendDeadline
-	timeouts := keywhizfs.Timeouts{freshThreshold, backendDeadline, maxWait}
+	backendTimeout := clientTimeout + backendDeadline
+	timeouts := keywhizfs.Timeouts{Fresh: freshThreshold, BackendDeadline: backendDeadline, BackendTimeout: backendTimeout}
+	timeouts = config.ApplyTimeouts(timeouts)
 
-	client := keywhizfs.NewClient(*certFile, *keyFile, *caFile, serverURL, clientTimeout, logConfig, *ping)
+	client := newClient(serverURLs, clientTimeout, logConfig)
+	if *certCheck > 0 {
+		client.WatchCertificates(*certCheck)
+	}
+	client.MaxSecretSize = *maxSecretSize
+	client.UserAgent = *userAgent
+	client.MaxRetryAfter = *maxRetryAfter
+	if client.MaxRetryAfter == 0 {
+		client.MaxRetryAfter = timeouts.BackendDeadline
+	}
 
 	ownership := keywhizfs.NewOwnership(*user, *group)
-	kwfs, root, err := keywhizfs.NewKeywhizFs(&client, ownership, timeouts, logConfig)
+	var backend keywhizfs.SecretBackend = &client
+	if *fallbackDir != "" {
+		backend = keywhizfs.Chain(backend, keywhizfs.Fallback(keywhizfs.NewLocalBackend(*fallbackDir, logConfig)))
+	}
+	kwfs, _, err := keywhizfs.NewKeywhizFsWithCache(&client, keywhizfs.NewCache(backend, timeouts, logConfig), ownership, logConfig)
 	if err != nil {
 		log.Fatalf("KeywhizFs init fail: %v\n", err)
 	}
 
-	mountOptions := &fuse.MountOptions{
-		AllowOther: true,
-		Name:       kwfs.String(),
-		Options:    []string{"default_permissions"},
+	kwfs.Cache.SetCircuitBreaker(breakerFailures, breakerWindow, breakerCooldown)
+	kwfs.Cache.SetLockContent(*mlockContent)
+	kwfs.Cache.SetRateLimit(*backendRPS, *backendBurst)
+	kwfs.Cache.SetMaxBackendConcurrency(*maxBackendConc)
+	kwfs.Cache.SetCaseInsensitive(*foldCase)
+	kwfs.Cache.SetClockSkew(*clockSkew)
+	filter, err := keywhizfs.ParseNameFilter(*allow, *deny)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.Cache.SetNameFilter(filter)
+	policy, err := keywhizfs.ParseConflictPolicy(*conflictPolicy)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.Cache.SetConflictPolicy(policy)
+	if *aliasFile != "" {
+		aliases, err := keywhizfs.LoadAliases(*aliasFile)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		kwfs.Cache.SetAliases(aliases)
 	}
 
-	// Empty Options struct avoids setting a global uid/gid override.
-	conn := nodefs.NewFileSystemConnector(root, &nodefs.Options{})
-	server, err := fuse.NewServer(conn.RawFS(), mountpoint, mountOptions)
+	kwfs.EnforceOwner = *enforceOwner
+	kwfs.ListingTTL = *listingTTL
+	kwfs.StreamThreshold = *streamSize
+	kwfs.Layout, err = keywhizfs.ParseLayout(*layout)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.LayoutLinks = *layoutLinks
+	kwfs.Sanitization, err = keywhizfs.ParseSanitization(*sanitize)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.RootMode, err = keywhizfs.ParseRootMode(*rootMode)
 	if err != nil {
-		log.Fatalf("Mount fail: %v\n", err)
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.Umask, err = keywhizfs.ParseUmask(*umask)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	kwfs.OversizedStatus, err = keywhizfs.ParseOversizedStatus(*oversized)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	mountOptions, err := kwfs.MountOptions(fuseOptions, *allowOther)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if *rootOwner != "" {
+		owner := keywhizfs.ParseRootOwner(*rootOwner, *group)
+		kwfs.RootOwnership = &owner
+	}
+
+	if *auditLog != "" {
+		audit, err := keywhizfs.OpenAuditLog(*auditLog)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer audit.Close()
+		kwfs.Audit = audit
 	}
 
-	server.Serve()
+	var restored bool
+	if *cacheFile != "" {
+		restored = persistCache(kwfs.Cache, *cacheFile)
+	}
+
+	// A restored cache is instead warmed up once mounted, serving restored secrets meanwhile.
+	warm := restored && *warmGrace > 0
+	if *prefetch && !warm {
+		go func() {
+			if err := kwfs.Cache.Prefetch(prefetchConcurrency); err != nil {
+				logger.Warnf("%v", err)
+			}
+		}()
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(kwfs.Cache, *metricsAddr)
+	}
+	if *statsdAddr != "" {
+		cache := kwfs.Cache
+		metrics.StartStatsd(*statsdAddr, *statsdInterval, func() metrics.Snapshot { return cacheSnapshot(cache) }, logger.Warnf)
+	}
+
+	if *pprofEnabled && !admin.IsLoopback(admin.ListenAddr(*adminAddr)) {
+		log.Printf("-pprof requires -admin-addr on localhost\n")
+		exit(kwfs.Cache)
+	}
+	if *adminAddr != "" {
+		checks := admin.Checks{
+			Mounted:   kwfs.Mounted,
+			Ping:      client.Ping,
+			MountedAt: kwfs.MountedAt,
+		}
+		settings := func() admin.Settings {
+			return admin.Settings{
+				Config:       live.get(),
+				Timeouts:     kwfs.Cache.Timeouts(),
+				Layout:       kwfs.Layout,
+				Sanitization: kwfs.Sanitization,
+				Flags:        flagValues(),
+			}
+		}
+		serveAdmin(kwfs.Cache, checks, admin.ListenAddr(*adminAddr), *pprofEnabled, settings)
+	}
+
+	if err := kwfs.Mount(mountpoint, mountOptions); err != nil {
+		log.Printf("Mount fail: %v\n", err)
+		exit(kwfs.Cache)
+	}
+	if warm {
+		done := kwfs.Cache.StartWarmup(*warmGrace, prefetchConcurrency)
+		go func() {
+			if err := <-done; err != nil {
+				logger.Warnf("%v", err)
+			}
+		}()
+	}
+
+	handleSignals(kwfs, mountpoint)
+	if *mountCheck > 0 {
+		exitOnLostMount(kwfs, *mountCheck)
+	}
+	if *configFile != "" {
+		reloadOnHangup(kwfs, *configFile, config, live)
+	}
+	if err := kwfs.Serve(); err != nil {
+		log.Printf("%v\n", err)
+		exit(kwfs.Cache)
+	}
+	if err := kwfs.Cache.Close(); err == keywhizfs.ErrCacheClosed {
+		// Another exit path closed the cache first, and exits once it is persisted.
+		select {}
+	} else if err != nil {
+		logger.Errorf("%v", err)
+	}
+}
+
+// exit closes the cache, persisting it and zeroing its secrets, then exits with an error. When
+// the cache was already closed, it leaves exiting to whichever caller closed it.
+func exit(cache *keywhizfs.Cache) {
+	err := cache.Close()
+	if err == keywhizfs.ErrCacheClosed {
+		select {}
+	}
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+	os.Exit(1)
+}
+
+// check prints the results of validating the configuration, returning the exit status.
+func check(serverURLs []string, mountpoint string, timeout time.Duration, logConfig klog.Config) int {
+	results, ok := keywhizfs.CheckSetup(*certFile, *keyFile, *caFile, serverURLs, mountpoint, timeout, logConfig)
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("FAIL %v: %v\n", r.Check, r.Err)
+		} else {
+			fmt.Printf("ok   %v: %v\n", r.Check, r.Detail)
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// newPKCS11Client connects to the servers with the client certificate and key of a PKCS#11 token.
+// The session with the token stays open for the life of the process.
+func newPKCS11Client(serverURLs []string, timeout time.Duration, logConfig klog.Config, set map[string]bool) keywhizfs.Client {
+	for _, name := range []string{"cert", "key"} {
+		if set[name] {
+			log.Fatalf("-%v cannot be used with -pkcs11-module\n", name)
+		}
+	}
+	var pin string
+	if *pkcs11PINFile != "" {
+		data, err := ioutil.ReadFile(*pkcs11PINFile)
+		if err != nil {
+			log.Fatalf("Reading PKCS#11 PIN: %v\n", err)
+		}
+		pin = strings.TrimSpace(string(data))
+	}
+	config := keywhizfs.PKCS11Config{Module: *pkcs11Module, Slot: *pkcs11Slot, PIN: pin, Label: *pkcs11Label}
+	certificate, _, err := keywhizfs.PKCS11Certificate(config)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	return keywhizfs.NewClientWithCertificate(certificate, *caFile, serverURLs, timeout, logConfig, *ping)
+}
+
+// newClient connects to the servers, or to a local proxy if the only server is a unix:// URL. The
+// TLS options do not apply to a socket, and are rejected with one.
+func newClient(serverURLs []string, timeout time.Duration, logConfig klog.Config) keywhizfs.Client {
+	socket, err := keywhizfs.SocketPath(serverURLs)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	set := flagsSet()
+	if socket == "" && *pkcs11Module != "" {
+		return newPKCS11Client(serverURLs, timeout, logConfig, set)
+	}
+	if socket == "" {
+		return keywhizfs.NewClientWithServers(*certFile, *keyFile, *caFile, serverURLs, timeout, logConfig, *ping)
+	}
+
+	for _, name := range []string{"cert", "key", "ca", "pkcs11-module"} {
+		if set[name] {
+			log.Fatalf("-%v cannot be used with unix socket %v\n", name, socket)
+		}
+	}
+	return keywhizfs.NewUnixClient(socket, timeout, logConfig, *ping)
+}
+
+// applyConfig merges command line settings with those from a configuration file. Settings given
+// on the command line take precedence, and are recorded in config.
+func applyConfig(config *keywhizfs.Config) {
+	set := flagsSet()
+
+	if flag.NArg() == 2 {
+		config.Server, config.Mountpoint = flag.Arg(0), flag.Arg(1)
+	}
+	for _, s := range []struct {
+		flag   string
+		value  *string
+		config *string
+	}{
+		{"cert", certFile, &config.Cert},
+		{"key", keyFile, &config.Key},
+		{"ca", caFile, &config.CA},
+		{"log-format", logFormat, &config.LogFormat},
+	} {
+		if set[s.flag] || *s.config == "" {
+			*s.config = *s.value
+		} else {
+			*s.value = *s.config
+		}
+	}
+	if set["debug"] || config.Debug == nil {
+		config.Debug = debug
+	} else {
+		*debug = *config.Debug
+	}
+}
+
+// keepCommandLine replaces settings in a reloaded config which were given on the command line
+// with their running values, since the command line takes precedence.
+func keepCommandLine(config *keywhizfs.Config, running keywhizfs.Config) {
+	set := flagsSet()
+	if flag.NArg() == 2 {
+		config.Server, config.Mountpoint = running.Server, running.Mountpoint
+	}
+	if set["cert"] {
+		config.Cert = running.Cert
+	}
+	if set["key"] {
+		config.Key = running.Key
+	}
+	if set["ca"] {
+		config.CA = running.CA
+	}
+	if set["log-format"] {
+		config.LogFormat = running.LogFormat
+	}
+	if set["debug"] {
+		config.Debug = running.Debug
+	}
+}
+
+// flagValues returns the value of every flag by name, including defaults.
+func flagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+// liveConfig is the effective configuration reported by the admin interface, updated as settings
+// are reloaded.
+type liveConfig struct {
+	config keywhizfs.Config
+	lock   sync.Mutex
+}
+
+func (l *liveConfig) get() keywhizfs.Config {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.config
+}
+
+// reloaded records the settings of a reloaded config which are applied while mounted. Timeouts
+// are reported from the cache instead.
+func (l *liveConfig) reloaded(config *keywhizfs.Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if config.Debug != nil {
+		debug := *config.Debug
+		l.config.Debug = &debug
+	}
+}
+
+// flagsSet returns the names of flags given on the command line.
+func flagsSet() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// reloadOnHangup re-reads the configuration file on SIGHUP, applying settings which can change
+// while mounted. An unreadable file is logged and leaves the running configuration in place.
+// Command line settings still take precedence. Applied settings are recorded in live.
+func reloadOnHangup(kwfs *keywhizfs.KeywhizFs, path string, running keywhizfs.Config, live *liveConfig) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Infof("Received SIGHUP, reloading %v", path)
+			config, err := keywhizfs.LoadConfig(path)
+			if err != nil {
+				logger.Errorf("Keeping running configuration: %v", err)
+				continue
+			}
+			keepCommandLine(config, running)
+			for _, key := range config.RestartRequired(running) {
+				logger.Warnf("Ignoring changed %v, which requires restart", key)
+			}
+			kwfs.Reload(config)
+			live.reloaded(config)
+			if config.Debug != nil {
+				logger.SetDebug(*config.Debug)
+			}
+		}
+	}()
+}
+
+// handleSignals unmounts on SIGINT or SIGTERM, which lets Serve return once in-flight requests
+// have drained.
+func handleSignals(kwfs *keywhizfs.KeywhizFs, mountpoint string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %v, unmounting %v", sig, mountpoint)
+		if err := kwfs.Unmount(); err != nil {
+			logger.Errorf("%v", err)
+			exit(kwfs.Cache)
+		}
+	}()
+}
+
+// exitOnLostMount exits with an error once the mount is lost, such as when the mountpoint was
+// shadowed or lazily unmounted while files were open, so that a supervisor can restart and
+// remount. Exiting closes the FUSE connection, detaching whatever remains of the mount.
+func exitOnLostMount(kwfs *keywhizfs.KeywhizFs, interval time.Duration) {
+	lost, _ := kwfs.WatchMount(interval)
+	go func() {
+		logger.Errorf("Exiting: %v", <-lost)
+		exit(kwfs.Cache)
+	}()
+}
+
+// persistCache restores the cache from path if it exists, then periodically writes it back, and
+// once more when the cache is closed. Returns whether the cache was restored.
+func persistCache(cache *keywhizfs.Cache, path string) (restored bool) {
+	cache.SetPersistPath(path)
+	if _, err := os.Stat(path); err == nil {
+		if err := cache.Load(path); err != nil {
+			logger.Warnf("Ignoring persisted cache: %v", err)
+		} else {
+			restored = true
+		}
+	}
+
+	go func() {
+		for range time.Tick(cachePersistInterval) {
+			if err := cache.Persist(path); err != nil {
+				logger.Errorf("%v", err)
+			}
+		}
+	}()
+	return
+}
+
+// serveMetrics publishes cache statistics for Prometheus on addr at /metrics.
+func serveMetrics(cache *keywhizfs.Cache, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(func() metrics.Snapshot { return cacheSnapshot(cache) }))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+}
+
+// serveAdmin serves the admin interface on addr, with health endpoints reporting checks, the
+// effective configuration returned by settings, and runtime profiles if profiling.
+func serveAdmin(cache *keywhizfs.Cache, checks admin.Checks, addr string, profiling bool, settings func() admin.Settings) {
+	handler := admin.WithConfig(admin.HandlerWithHealth(cache, checks), settings)
+	if profiling {
+		handler = admin.WithProfiling(handler)
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			logger.Errorf("Admin server failed: %v", err)
+		}
+	}()
+}
+
+// cacheSnapshot adapts cache statistics to metrics.
+func cacheSnapshot(cache *keywhizfs.Cache) metrics.Snapshot {
+	stats := cache.Stats()
+	latency := cache.BackendLatency()
+	bounds := make([]float64, len(latency.Bounds))
+	for i, bound := range latency.Bounds {
+		bounds[i] = bound.Seconds()
+	}
+
+	return metrics.Snapshot{
+		CacheHits:            stats.Hits,
+		CacheMisses:          stats.Misses,
+		CacheEvictions:       stats.Evictions,
+		CacheSize:            cache.Len(),
+		BackendRequests:      stats.BackendCalls,
+		BackendErrors:        stats.BackendErrors,
+		BackendTimeouts:      stats.BackendTimeouts,
+		BackendShortCircuits: stats.ShortCircuits,
+		BackendRateLimited:   stats.RateLimited,
+		BackendInFlight:      stats.BackendInFlight,
+		BackendLatency: metrics.Histogram{
+			Bounds: bounds,
+			Counts: latency.Counts,
+			Count:  latency.Count,
+			Sum:    latency.Sum.Seconds(),
+		},
+		BreakerState: int(stats.Breaker),
+	}
 }
 
 // Locks memory, preventing memory from being written to disk as swap
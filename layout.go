@@ -0,0 +1,255 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	gocontext "context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Layout determines how secret files are arranged in the mounted filesystem.
+type Layout int
+
+const (
+	// LayoutFlat places every secret in the base directory.
+	LayoutFlat Layout = iota
+	// LayoutByOwner places each secret in a directory named after its owner. Secrets without an
+	// owner remain in the base directory.
+	LayoutByOwner
+	// LayoutByGroup places each secret in a directory per group it belongs to, so a secret may
+	// appear in several directories. Secrets without a group remain in the base directory.
+	LayoutByGroup
+)
+
+// ParseLayout returns the Layout named by s, either "flat", "by-owner" or "by-group".
+func ParseLayout(s string) (Layout, error) {
+	switch s {
+	case "flat":
+		return LayoutFlat, nil
+	case "by-owner":
+		return LayoutByOwner, nil
+	case "by-group":
+		return LayoutByGroup, nil
+	}
+	return LayoutFlat, fmt.Errorf("unknown layout '%v'", s)
+}
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutFlat:
+		return "flat"
+	case LayoutByOwner:
+		return "by-owner"
+	case LayoutByGroup:
+		return "by-group"
+	}
+	return fmt.Sprintf("Layout(%d)", int(l))
+}
+
+// lookupSecret returns the secret at path under the current layout and sanitization, making any
+// backend request with ctx. In the by-owner and by-group layouts, a secret is only found inside
+// the directories it is placed in, or only in the base directory with LayoutLinks.
+func (kwfs KeywhizFs) lookupSecret(ctx gocontext.Context, path string) (*Secret, Origin, bool) {
+	name, dir, ok := kwfs.secretName(path)
+	if !ok || kwfs.linked() && dir != "" {
+		return nil, OriginCache, false
+	}
+
+	secret, origin, ok := kwfs.Cache.secretWithOrigin(ctx, name)
+	if ok && !kwfs.linked() && !kwfs.inDir(*secret, dir) {
+		return nil, origin, false
+	}
+	return secret, origin, ok
+}
+
+// lookupSecretLink resolves a path in an owner or group directory with LayoutLinks to the target
+// of its symlink, the file of the secret in the base directory, as in "../Nobody_PgPass".
+func (kwfs KeywhizFs) lookupSecretLink(ctx gocontext.Context, path string) (string, bool) {
+	if !kwfs.linked() {
+		return "", false
+	}
+	name, dir, ok := kwfs.secretName(path)
+	if !ok || dir == "" {
+		return "", false
+	}
+	secret, _, ok := kwfs.Cache.secretWithOrigin(ctx, name)
+	if !ok || !kwfs.inDir(*secret, dir) {
+		return "", false
+	}
+	return "../" + path[len(dir)+1:], true
+}
+
+// linked returns whether owner or group directories hold symlinks, rather than secret files.
+func (kwfs KeywhizFs) linked() bool {
+	return kwfs.LayoutLinks && kwfs.Layout != LayoutFlat
+}
+
+// secretName returns the name of the secret at path under the current layout and sanitization,
+// and the directory it is in, if any.
+func (kwfs KeywhizFs) secretName(path string) (name, dir string, ok bool) {
+	file := path
+	if kwfs.Layout != LayoutFlat {
+		if i := strings.Index(path, "/"); i >= 0 {
+			dir, file = path[:i], path[i+1:]
+		}
+	}
+	name, ok = kwfs.Sanitization.decode(file)
+	return name, dir, ok
+}
+
+// missingStatus returns the status of a failed lookup of the secret at path: EACCES if the backend
+// refused the secret as forbidden, OversizedStatus if the client rejected it as too large, and
+// ENOENT otherwise.
+func (kwfs KeywhizFs) missingStatus(path string) fuse.Status {
+	name, _, ok := kwfs.secretName(path)
+	switch {
+	case ok && kwfs.Cache.Forbidden(name):
+		return fuse.EACCES
+	case ok && kwfs.Client != nil && kwfs.Client.TooLarge(kwfs.Cache.resolveAlias(name)):
+		return kwfs.oversizedStatus()
+	}
+	return fuse.ENOENT
+}
+
+// secretDirs returns the directories a secret is placed in under the current layout. Secrets in
+// the base directory have none.
+func (kwfs KeywhizFs) secretDirs(s Secret) []string {
+	switch kwfs.Layout {
+	case LayoutByOwner:
+		if s.Owner != "" {
+			return []string{s.Owner}
+		}
+	case LayoutByGroup:
+		var groups []string
+		for _, g := range s.Groups {
+			if g != "" && !strings.Contains(g, "/") {
+				groups = append(groups, g)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// inDir returns whether a secret is placed in dir under the current layout, where "" is the base
+// directory.
+func (kwfs KeywhizFs) inDir(s Secret, dir string) bool {
+	dirs := kwfs.secretDirs(s)
+	if len(dirs) == 0 {
+		return dir == ""
+	}
+	for _, d := range dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// secretPaths returns the paths of a cached secret under the current layout and sanitization.
+func (kwfs KeywhizFs) secretPaths(name string) []string {
+	var dirs []string
+	if s, ok := kwfs.Cache.secretMap.Get(name); ok {
+		dirs = kwfs.secretDirs(s.Secret)
+	}
+	var paths []string
+	for _, n := range append([]string{name}, kwfs.Cache.Aliases(name)...) {
+		file := kwfs.fileName(n)
+		if len(dirs) == 0 || kwfs.linked() {
+			paths = append(paths, file)
+		}
+		for _, dir := range dirs {
+			paths = append(paths, dir+"/"+file)
+		}
+	}
+	return paths
+}
+
+// layoutDirs returns the sorted directories of all secrets under the current layout.
+func (kwfs KeywhizFs) layoutDirs() []string {
+	if kwfs.Layout == LayoutFlat {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, s := range kwfs.dirSecretList() {
+		for _, dir := range kwfs.secretDirs(s) {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// isLayoutDir returns whether name is an owner or group directory under the current layout.
+func (kwfs KeywhizFs) isLayoutDir(name string) bool {
+	if kwfs.Layout == LayoutFlat || strings.Contains(name, "/") {
+		return false
+	}
+	for _, dir := range kwfs.layoutDirs() {
+		if dir == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutDirAttr constructs a fuse.Attr for an owner or group directory. The directory of an
+// owner's secrets is owned by that user.
+func (kwfs KeywhizFs) layoutDirAttr(dir string) *fuse.Attr {
+	attr := kwfs.directoryAttr(0, 0755)
+	if kwfs.Layout == LayoutByOwner {
+		attr.Uid = kwfs.ownerUid(dir)
+	}
+	return attr
+}
+
+// baseDirListing produces the entries of the base directory under the current layout. Extra
+// entries passed to this function are included.
+func (kwfs KeywhizFs) baseDirListing(extraEntries ...fuse.DirEntry) []fuse.DirEntry {
+	if kwfs.Layout == LayoutFlat {
+		return kwfs.secretsDirListing(extraEntries...)
+	}
+	for _, dir := range kwfs.layoutDirs() {
+		extraEntries = append(extraEntries, fuse.DirEntry{Name: dir, Mode: fuse.S_IFDIR})
+	}
+	if kwfs.linked() {
+		return kwfs.secretsDirListing(extraEntries...)
+	}
+	return kwfs.layoutDirListing("", extraEntries...)
+}
+
+// layoutDirListing produces directory entries of the secret files placed in dir, or of their
+// symlinks with LayoutLinks. Extra entries passed to this function are included.
+func (kwfs KeywhizFs) layoutDirListing(dir string, extraEntries ...fuse.DirEntry) []fuse.DirEntry {
+	var mode uint32 = fuse.S_IFREG
+	if kwfs.linked() {
+		mode = fuse.S_IFLNK
+	}
+	var entries []fuse.DirEntry
+	for _, s := range kwfs.dirSecretList() {
+		if kwfs.inDir(s, dir) {
+			entries = append(entries, fuse.DirEntry{Name: kwfs.fileName(s.Name), Mode: mode})
+		}
+	}
+	return append(entries, extraEntries...)
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/square/keywhizfs/log"
+)
+
+// defaultLifecycleSampling is the interval within which one open of each secret file is traced,
+// when KeywhizFs.LifecycleSampling is zero.
+const defaultLifecycleSampling = time.Second
+
+// openTracer numbers the opens of secret files, and samples which of them are traced so that hot
+// files do not flood the debug log.
+type openTracer struct {
+	handles uint64
+	last    map[string]time.Time // when an open of each file was last traced
+	skipped map[string]int       // opens of each file not traced since
+	lock    sync.Mutex
+}
+
+// open returns a handle number for an open of name at now, whether it is traced, and how many
+// opens of name were skipped since the last traced one. Every open is traced if interval is
+// negative.
+func (t *openTracer) open(name string, now time.Time, interval time.Duration) (handle uint64, traced bool, skipped int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.handles++
+	if last, ok := t.last[name]; ok && interval >= 0 && now.Sub(last) < interval {
+		t.skipped[name]++
+		return t.handles, false, 0
+	}
+	if t.last == nil {
+		t.last, t.skipped = make(map[string]time.Time), make(map[string]int)
+	}
+	skipped = t.skipped[name]
+	t.last[name] = now
+	delete(t.skipped, name)
+	return t.handles, true, skipped
+}
+
+// traceOpen logs an open of a secret file at debug level, with the caller's pid and uid, and
+// returns a logger for the file's reads and release. Returns nil if debugging is disabled or the
+// open is not sampled. Contents are never logged.
+func (kwfs KeywhizFs) traceOpen(name string, context *fuse.Context) *log.Logger {
+	if kwfs.tracer == nil || !kwfs.Logger.Debugging() {
+		return nil
+	}
+	interval := kwfs.LifecycleSampling
+	if interval == 0 {
+		interval = defaultLifecycleSampling
+	}
+	handle, traced, skipped := kwfs.tracer.open(name, time.Now(), interval)
+	if !traced {
+		return nil
+	}
+
+	trace := kwfs.Logger.With("file", name).With("handle", handle)
+	if context != nil {
+		trace = trace.With("pid", context.Pid).With("uid", context.Uid)
+	}
+	if skipped > 0 {
+		trace.Debugf("Open, after %d opens not traced", skipped)
+	} else {
+		trace.Debugf("Open")
+	}
+	return trace
+}
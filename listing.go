@@ -0,0 +1,73 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"sync"
+	"time"
+)
+
+// listingCache holds the most recent secret listing of the filesystem for a short time, so bursts
+// of directory reads share one listing from the cache and backend. Listed secrets are held without
+// their content.
+type listingCache struct {
+	secrets []Secret
+	time    time.Time
+	lock    sync.Mutex
+}
+
+// get returns the held listing, if one was stored within ttl.
+func (l *listingCache) get(ttl time.Duration) ([]Secret, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.secrets == nil || time.Since(l.time) >= ttl {
+		return nil, false
+	}
+	return l.secrets, true
+}
+
+// put holds a copy of a listing, leaving out the content of its secrets.
+func (l *listingCache) put(secrets []Secret) {
+	held := make([]Secret, len(secrets))
+	for i, s := range secrets {
+		s.Content = nil
+		held[i] = s
+	}
+	l.lock.Lock()
+	l.secrets, l.time = held, time.Now()
+	l.lock.Unlock()
+}
+
+// invalidate drops the held listing.
+func (l *listingCache) invalidate() {
+	l.lock.Lock()
+	l.secrets = nil
+	l.lock.Unlock()
+}
+
+// dirSecretList returns the listing of secrets used for directory entries. Unless ListingTTL is
+// zero, a listing is reused for that long, or until a secret is found added or removed.
+func (kwfs KeywhizFs) dirSecretList() []Secret {
+	if kwfs.ListingTTL <= 0 || kwfs.listing == nil {
+		return kwfs.withAliases(kwfs.Cache.SecretList())
+	}
+	if secrets, ok := kwfs.listing.get(kwfs.ListingTTL); ok {
+		kwfs.Debugf("Using directory listing of %d secrets", len(secrets))
+		return kwfs.withAliases(secrets)
+	}
+	secrets := kwfs.Cache.SecretList()
+	kwfs.listing.put(secrets)
+	return kwfs.withAliases(secrets)
+}
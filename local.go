@@ -0,0 +1,129 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/square/keywhizfs/log"
+)
+
+// LocalChecksumFile names the file of a LocalBackend directory listing the SHA-256 digest of each
+// secret, in the format written by sha256sum.
+const LocalChecksumFile = "SHA256SUMS"
+
+// LocalBackend is a SecretBackend reading secrets from files in a local directory, named by the
+// secret and holding its content as is. A secret is only served if its content matches the digest
+// listed for it in LocalChecksumFile, so that a damaged or tampered copy is never used. The files
+// are read on each request, so the directory may be updated in place.
+type LocalBackend struct {
+	*log.Logger
+	Dir string
+}
+
+// NewLocalBackend returns a LocalBackend reading from dir.
+func NewLocalBackend(dir string, logConfig log.Config) *LocalBackend {
+	return &LocalBackend{Logger: log.New("kwfs_local", logConfig), Dir: dir}
+}
+
+// Secret reads a secret and verifies it against its listed checksum.
+func (b *LocalBackend) Secret(name string) (*Secret, bool) {
+	if name == "" || name == LocalChecksumFile || strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, ".") {
+		return nil, false
+	}
+	sums, err := b.checksums()
+	if err != nil {
+		b.Errorf("Error reading checksums of local secrets: %v", err)
+		return nil, false
+	}
+	sum, ok := sums[name]
+	if !ok {
+		b.Debugf("No checksum for local secret: %v", name)
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(b.Dir, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.Errorf("Error reading local secret %v: %v", name, err)
+		}
+		return nil, false
+	}
+	secret := &Secret{Name: name, Content: data, Length: uint64(len(data)), Mode: "0400", Checksum: sum}
+	if err := secret.Verify(); err != nil {
+		b.Errorf("Rejected local secret: %v", err)
+		content(data).wipe()
+		return nil, false
+	}
+	return secret, true
+}
+
+// SecretList reads every secret listed in LocalChecksumFile, leaving out those which fail
+// verification.
+func (b *LocalBackend) SecretList() ([]Secret, bool) {
+	sums, err := b.checksums()
+	if err != nil {
+		b.Errorf("Error reading checksums of local secrets: %v", err)
+		return nil, false
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	secrets := make([]Secret, 0, len(names))
+	for _, name := range names {
+		if secret, ok := b.Secret(name); ok {
+			secrets = append(secrets, *secret)
+		}
+	}
+	return secrets, true
+}
+
+// checksums parses LocalChecksumFile into a map from secret name to hex digest.
+func (b *LocalBackend) checksums() (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.Dir, LocalChecksumFile))
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v line %d: expected a digest and a name", LocalChecksumFile, line)
+		}
+		sum, name := fields[0], strings.TrimPrefix(fields[1], "*") // "*" marks binary mode
+		if digest, err := hex.DecodeString(sum); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%v line %d: invalid SHA-256 digest", LocalChecksumFile, line)
+		}
+		sums[name] = sum
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// localDir writes a LocalBackend directory holding files, with checksums listed for sums.
+func localDir(t *testing.T, files map[string]string, sums map[string]string) string {
+	dir, err := ioutil.TempDir("", "kwfs-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checksums string
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range sums {
+		sum := sha256.Sum256([]byte(data))
+		checksums += fmt.Sprintf("%v  %v\n", hex.EncodeToString(sum[:]), name)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, keywhizfs.LocalChecksumFile), []byte(checksums), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLocalBackendVerifiesChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	files := map[string]string{"Db_Pass": "hunter2", "Tampered": "changed", "Unlisted": "extra"}
+	dir := localDir(t, files, map[string]string{"Db_Pass": "hunter2", "Tampered": "original", "Missing": "gone"})
+	defer os.RemoveAll(dir)
+	backend := keywhizfs.NewLocalBackend(dir, logConfig)
+
+	secret, ok := backend.Secret("Db_Pass")
+	assert.True(ok)
+	assert.Equal("hunter2", string(secret.Content))
+	assert.EqualValues(0400, secret.ModeValue()&0777)
+
+	for _, name := range []string{"Tampered", "Unlisted", "Missing", keywhizfs.LocalChecksumFile, "../Db_Pass", ""} {
+		_, ok = backend.Secret(name)
+		assert.False(ok, "Expected %q not to be served", name)
+	}
+
+	secrets, ok := backend.SecretList()
+	assert.True(ok)
+	assert.Len(secrets, 1)
+	assert.Equal("Db_Pass", secrets[0].Name)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, keywhizfs.LocalChecksumFile), []byte("not a checksum\n"), 0600))
+	_, ok = backend.Secret("Db_Pass")
+	assert.False(ok)
+}
+
+func TestCacheFallsBackToLocalCopies(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	dir := localDir(t, map[string]string{"Nobody_PgPass": "local"}, map[string]string{"Nobody_PgPass": "local"})
+	defer os.RemoveAll(dir)
+
+	primary := SwitchBackend{secret: secretFixture, failing: new(int32), calls: new(int32)}
+	atomic.StoreInt32(primary.failing, 1)
+	backend := keywhizfs.Chain(primary, keywhizfs.Fallback(keywhizfs.NewLocalBackend(dir, logConfig)))
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	// With the primary failing and nothing cached, the local copy is served but not cached.
+	secret, origin, ok := cache.SecretWithOrigin(context.Background(), "Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal(keywhizfs.OriginFallback, origin)
+	assert.Equal("local", string(secret.Content))
+	assert.Empty(cache.Keys())
+	_, ok = cache.Secret("Other_Secret")
+	assert.False(ok)
+
+	// The primary takes precedence once it answers.
+	atomic.StoreInt32(primary.failing, 0)
+	secret, origin, ok = cache.SecretWithOrigin(context.Background(), "Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal(keywhizfs.OriginBackend, origin)
+	assert.Equal(secretFixture.Content, secret.Content)
+
+	// And a cached entry takes precedence over the local copy when the primary fails again.
+	atomic.StoreInt32(primary.failing, 1)
+	secret, origin, ok = cache.SecretWithOrigin(context.Background(), "Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal(keywhizfs.OriginCache, origin)
+	assert.Equal(secretFixture.Content, secret.Content)
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package keywhizfs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockContent copies c into a mapping of its own which is locked against swapping. Locks apply to
+// whole pages and do not nest, so sharing pages with other data would let an unlock release them.
+// The result must be freed with unlockContent.
+func lockContent(c content) (content, error) {
+	b, err := unix.Mmap(-1, 0, len(c), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("Error allocating locked memory: %v", err)
+	}
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		if err == unix.ENOMEM || err == unix.EPERM {
+			return nil, fmt.Errorf("Error locking memory (%v): RLIMIT_MEMLOCK is too low, raise it with 'ulimit -l' or LimitMEMLOCK, or grant CAP_IPC_LOCK", err)
+		}
+		return nil, fmt.Errorf("Error locking memory: %v", err)
+	}
+	copy(b, c)
+	return content(b), nil
+}
+
+// unlockContent frees memory returned by lockContent.
+func unlockContent(c content) {
+	unix.Munlock(c)
+	unix.Munmap(c)
+}
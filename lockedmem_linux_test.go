@@ -0,0 +1,74 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package keywhizfs_test
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// lockedKB reads the amount of locked memory of this process from /proc.
+func lockedKB(t *testing.T) int {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Skipf("Cannot read process status: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmLck:" {
+			kb, _ := strconv.Atoi(fields[1])
+			return kb
+		}
+	}
+	t.Skip("Process status has no VmLck")
+	return 0
+}
+
+func TestCacheLocksContent(t *testing.T) {
+	assert := assert.New(t)
+
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil || limit.Cur < 1<<20 {
+		t.Skipf("RLIMIT_MEMLOCK too low to lock memory: %v", limit.Cur)
+	}
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.SetLockContent(true)
+
+	before := lockedKB(t)
+	original := []byte("locked")
+	cache.Add(keywhizfs.Secret{Name: "foo", Content: original})
+	assert.True(lockedKB(t) > before, "Expected cached content to be locked")
+	assert.Equal(make([]byte, len(original)), original, "Expected unlocked copy to be zeroed")
+
+	s, ok := cache.Secret("foo")
+	assert.True(ok)
+	assert.EqualValues("locked", s.Content)
+
+	assert.True(cache.Delete("foo"))
+	assert.Equal(before, lockedKB(t), "Expected content to be unlocked on delete")
+}
@@ -0,0 +1,27 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package keywhizfs
+
+import "errors"
+
+// lockContent is only supported on Linux.
+func lockContent(c content) (content, error) {
+	return nil, errors.New("Locking secret memory is only supported on Linux")
+}
+
+// unlockContent is only supported on Linux.
+func unlockContent(c content) {}
@@ -15,48 +15,114 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 // Default syslog facility which is logged to.
 const _DefaultSyslogFacility = syslog.LOG_USER
 
+// Log formats accepted in Config.Format.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Levels of entries passed to a Sink.
+const (
+	LevelError = "error"
+	LevelWarn  = "warn"
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+)
+
+// Sink receives log entries, for routing them to another logging library. fields holds the
+// fields attached with With, and the "component" and "mountpoint" of the Logger. Log may be called
+// concurrently.
+type Sink interface {
+	Log(level, msg string, fields map[string]interface{})
+}
+
 // Logger maintains state of log emitters for different severity levels.
 type Logger struct {
-	syslog   *syslog.Writer
-	errorLog *log.Logger
-	warnLog  *log.Logger
-	infoLog  *log.Logger
-	debugLog *log.Logger
-	debug    bool
+	syslog    *syslog.Writer
+	errorLog  *log.Logger
+	warnLog   *log.Logger
+	infoLog   *log.Logger
+	debugLog  *log.Logger
+	debug     *int32 // shared by loggers derived with With
+	json      bool
+	component string
+	config    Config
+	fields    []field
 }
 
 // Config contains values necessary for configurating a logger.
 type Config struct {
 	Debug      bool
 	Mountpoint string
+	// Format is FormatText (the default) for human-readable lines or FormatJSON for one JSON
+	// object per entry.
+	Format string
+	// Output receives entries of every level. By default, errors and warnings are written to
+	// stderr and other entries to stdout.
+	Output io.Writer
+	// Sink, if set, receives every entry instead of Output, and Format is ignored. Debug entries
+	// are only passed on while debugging is enabled.
+	Sink Sink
+}
+
+// field is a key/value pair attached to every entry of a Logger.
+type field struct {
+	key   string
+	value interface{}
 }
 
 // New initializes a Logger for a given component and with debugging output on/off.
 func New(component string, config Config) *Logger {
 	name := fmt.Sprintf("%s[%s]", component, config.Mountpoint)
 
-	flags := log.LstdFlags
-	errorLog := log.New(os.Stderr, fmt.Sprintf("ERROR %v: ", name), flags)
-	warnLog := log.New(os.Stderr, fmt.Sprintf("WARN %v: ", name), flags)
-	infoLog := log.New(os.Stdout, fmt.Sprintf("INFO %v: ", name), flags)
-	debugLog := log.New(os.Stdout, fmt.Sprintf("DEBUG %v: ", name), flags)
+	stderr, stdout := io.Writer(os.Stderr), io.Writer(os.Stdout)
+	if config.Output != nil {
+		stderr, stdout = config.Output, config.Output
+	}
+
+	l := &Logger{debug: new(int32), json: config.Format == FormatJSON, component: component, config: config}
+	l.SetDebug(config.Debug)
+	if l.json {
+		l.errorLog = log.New(stderr, "", 0)
+		l.warnLog = log.New(stderr, "", 0)
+		l.infoLog = log.New(stdout, "", 0)
+		l.debugLog = log.New(stdout, "", 0)
+	} else {
+		flags := log.LstdFlags
+		l.errorLog = log.New(stderr, fmt.Sprintf("ERROR %v: ", name), flags)
+		l.warnLog = log.New(stderr, fmt.Sprintf("WARN %v: ", name), flags)
+		l.infoLog = log.New(stdout, fmt.Sprintf("INFO %v: ", name), flags)
+		l.debugLog = log.New(stdout, fmt.Sprintf("DEBUG %v: ", name), flags)
+	}
 
 	syslogWriter, err := syslog.New(syslog.LOG_NOTICE|_DefaultSyslogFacility, name)
 	if err != nil {
-		errorLog.Printf("Error starting syslog logging, continuing: %v\n", err)
+		l.Errorf("Error starting syslog logging, continuing: %v", err)
 	}
 	syslogWriter = nil
+	l.syslog = syslogWriter
 
-	return &Logger{syslogWriter, errorLog, warnLog, infoLog, debugLog, config.Debug}
+	return l
+}
+
+// With returns a Logger which attaches a key/value field to each entry. In text format, fields are
+// appended to the message as key=value.
+func (l Logger) With(key string, value interface{}) *Logger {
+	l.fields = append(append([]field(nil), l.fields...), field{key, value})
+	return &l
 }
 
 // Errorf emits messages at ERROR level with a printf style interface.
@@ -65,7 +131,7 @@ func (l Logger) Errorf(format string, v ...interface{}) {
 	if l.syslog != nil {
 		l.syslog.Err(msg)
 	}
-	l.errorLog.Println(msg)
+	l.emit(l.errorLog, LevelError, msg)
 }
 
 // Warnf emits messages at WARN level with a printf style interface.
@@ -74,7 +140,7 @@ func (l Logger) Warnf(format string, v ...interface{}) {
 	if l.syslog != nil {
 		l.syslog.Warning(msg)
 	}
-	l.warnLog.Println(msg)
+	l.emit(l.warnLog, LevelWarn, msg)
 }
 
 // Infof emits messages at INFO level with a printf style interface.
@@ -83,18 +149,32 @@ func (l Logger) Infof(format string, v ...interface{}) {
 	if l.syslog != nil {
 		l.syslog.Info(msg)
 	}
-	l.infoLog.Println(msg)
+	l.emit(l.infoLog, LevelInfo, msg)
 }
 
 // Debugf emits messages at DEBUG level with a printf style interface if debugging was enabled.
 func (l Logger) Debugf(format string, v ...interface{}) {
-	if l.debug {
+	if atomic.LoadInt32(l.debug) != 0 {
 		msg := fmt.Sprintf(format, v...)
 		if l.syslog != nil {
 			l.syslog.Debug(msg)
 		}
-		l.debugLog.Println(msg)
+		l.emit(l.debugLog, LevelDebug, msg)
+	}
+}
+
+// Debugging returns whether debugging output is enabled.
+func (l Logger) Debugging() bool {
+	return atomic.LoadInt32(l.debug) != 0
+}
+
+// SetDebug turns debugging output on or off, including for loggers derived with With.
+func (l Logger) SetDebug(debug bool) {
+	var value int32
+	if debug {
+		value = 1
 	}
+	atomic.StoreInt32(l.debug, value)
 }
 
 // Close closes any internal writers.
@@ -104,3 +184,41 @@ func (l Logger) Close() error {
 	}
 	return nil
 }
+
+// emit writes a single entry in the configured format, or passes it to the configured Sink.
+func (l Logger) emit(logger *log.Logger, level, msg string) {
+	if l.config.Sink != nil {
+		fields := make(map[string]interface{}, len(l.fields)+2)
+		for _, f := range l.fields {
+			fields[f.key] = f.value
+		}
+		fields["component"] = l.component
+		fields["mountpoint"] = l.config.Mountpoint
+		l.config.Sink.Log(level, msg, fields)
+		return
+	}
+
+	if !l.json {
+		for _, f := range l.fields {
+			msg += fmt.Sprintf(" %s=%v", f.key, f.value)
+		}
+		logger.Println(msg)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+5)
+	for _, f := range l.fields {
+		entry[f.key] = f.value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["component"] = l.component
+	entry["mountpoint"] = l.config.Mountpoint
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": "error", "msg": fmt.Sprintf("Unencodable log entry: %v", err)})
+	}
+	logger.Println(string(data))
+}
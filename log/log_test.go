@@ -0,0 +1,133 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/square/keywhizfs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	logger := log.New("kwfs_test", log.Config{Debug: true, Mountpoint: "/tmp/mnt", Format: log.FormatJSON, Output: &buf})
+	buf.Reset() // discard any syslog startup error
+
+	logger.With("secret", "Nobody_PgPass").Infof("Cache hit: %v", "Nobody_PgPass")
+	logger.Debugf("debugging")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 2)
+
+	var entry map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal("info", entry["level"])
+	assert.Equal("Cache hit: Nobody_PgPass", entry["msg"])
+	assert.Equal("kwfs_test", entry["component"])
+	assert.Equal("/tmp/mnt", entry["mountpoint"])
+	assert.Equal("Nobody_PgPass", entry["secret"])
+	assert.NotEmpty(entry["time"])
+
+	entry = nil
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal("debug", entry["level"])
+	assert.Nil(entry["secret"])
+}
+
+func TestTextFormatIsDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	logger := log.New("kwfs_test", log.Config{Mountpoint: "/tmp/mnt", Output: &buf})
+	buf.Reset()
+
+	logger.With("secret", "Nobody_PgPass").Warnf("Secret %v not found", "Nobody_PgPass")
+	logger.Debugf("not emitted without debug")
+
+	output := buf.String()
+	assert.Contains(output, "WARN kwfs_test[/tmp/mnt]: ")
+	assert.Contains(output, "Secret Nobody_PgPass not found secret=Nobody_PgPass\n")
+	assert.NotContains(output, "not emitted")
+	assert.Error(json.Unmarshal(buf.Bytes(), new(interface{})))
+}
+
+func TestSetDebug(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	logger := log.New("kwfs_test", log.Config{Mountpoint: "/tmp/mnt", Output: &buf})
+	derived := logger.With("secret", "Nobody_PgPass")
+	buf.Reset()
+
+	derived.Debugf("hidden")
+	logger.SetDebug(true)
+	derived.Debugf("shown")
+	logger.SetDebug(false)
+	logger.Debugf("hidden again")
+
+	assert.NotContains(buf.String(), "hidden")
+	assert.Contains(buf.String(), "shown")
+}
+
+// capturingSink records the entries passed to it.
+type capturingSink struct {
+	entries []capturedEntry
+	lock    sync.Mutex
+}
+
+type capturedEntry struct {
+	level, msg string
+	fields     map[string]interface{}
+}
+
+func (s *capturingSink) Log(level, msg string, fields map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, capturedEntry{level, msg, fields})
+}
+
+func TestSinkReceivesEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	sink := &capturingSink{}
+	logger := log.New("kwfs_test", log.Config{Mountpoint: "/tmp/mnt", Format: log.FormatJSON, Output: &buf, Sink: sink})
+	sink.entries = nil // discard any syslog startup error
+
+	logger.With("secret", "Nobody_PgPass").Warnf("Secret %v not found", "Nobody_PgPass")
+	logger.Debugf("not passed on without debug")
+	logger.SetDebug(true)
+	logger.Debugf("debugging")
+
+	assert.Empty(buf.String(), "Expected entries to bypass Output")
+	if assert.Len(sink.entries, 2) {
+		entry := sink.entries[0]
+		assert.Equal(log.LevelWarn, entry.level)
+		assert.Equal("Secret Nobody_PgPass not found", entry.msg)
+		assert.Equal(map[string]interface{}{"secret": "Nobody_PgPass", "component": "kwfs_test", "mountpoint": "/tmp/mnt"}, entry.fields)
+
+		entry = sink.entries[1]
+		assert.Equal(log.LevelDebug, entry.level)
+		assert.Equal("debugging", entry.msg)
+		assert.Nil(entry.fields["secret"])
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics publishes keywhizfs statistics in the Prometheus text exposition format, or sends
+// them to a statsd server.
+//
+// Metrics are namespaced keywhizfs_. No metric is labelled by secret name, so the number of series
+// stays bounded however many secrets are served.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Snapshot holds the values published at one scrape.
+type Snapshot struct {
+	CacheHits      uint64
+	CacheMisses    uint64
+	CacheEvictions uint64
+	// CacheSize is the number of secrets currently cached.
+	CacheSize int
+
+	BackendRequests      uint64
+	BackendErrors        uint64
+	BackendTimeouts      uint64
+	BackendShortCircuits uint64
+	BackendRateLimited   uint64
+	// BackendInFlight is the number of backend requests currently outstanding.
+	BackendInFlight int64
+	// BackendLatency is the distribution of backend request durations, in seconds.
+	BackendLatency Histogram
+	// BreakerState is the circuit breaker state: 0 closed, 1 open, 2 half-open.
+	BreakerState int
+}
+
+// Histogram is a cumulative histogram of observations.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets, in increasing order.
+	Bounds []float64
+	// Counts are the number of observations at most the corresponding bound.
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// contentType is the media type of the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an http.Handler which publishes the snapshot returned by collect on each
+// request.
+func Handler(collect func() Snapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if err := Write(w, collect()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Write formats a snapshot in the Prometheus text exposition format.
+func Write(w io.Writer, s Snapshot) error {
+	b := bufio.NewWriter(w)
+	counter(b, "keywhizfs_cache_hits_total", "Lookups answered with cached data.", s.CacheHits)
+	counter(b, "keywhizfs_cache_misses_total", "Lookups where the cache held no usable entry.", s.CacheMisses)
+	counter(b, "keywhizfs_cache_evictions_total", "Entries dropped to stay within the cache size limit.", s.CacheEvictions)
+	gauge(b, "keywhizfs_cache_entries", "Secrets currently cached.", float64(s.CacheSize))
+	counter(b, "keywhizfs_backend_requests_total", "Requests issued to the backend.", s.BackendRequests)
+	counter(b, "keywhizfs_backend_errors_total", "Backend requests which returned no value, including not found.", s.BackendErrors)
+	counter(b, "keywhizfs_backend_timeouts_total", "Lookups which stopped waiting on the backend.", s.BackendTimeouts)
+	counter(b, "keywhizfs_backend_short_circuits_total", "Backend requests skipped by the open circuit breaker.", s.BackendShortCircuits)
+	counter(b, "keywhizfs_backend_rate_limited_total", "Backend requests abandoned waiting on the rate limiter.", s.BackendRateLimited)
+	gauge(b, "keywhizfs_backend_in_flight", "Backend requests currently outstanding.", float64(s.BackendInFlight))
+	histogram(b, "keywhizfs_backend_latency_seconds", "Backend request latency.", s.BackendLatency)
+	gauge(b, "keywhizfs_breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", float64(s.BreakerState))
+	return b.Flush()
+}
+
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func counter(w io.Writer, name, help string, value uint64) {
+	header(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func gauge(w io.Writer, name, help string, value float64) {
+	header(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func histogram(w io.Writer, name, help string, h Histogram) {
+	header(w, name, help, "histogram")
+	for i, bound := range h.Bounds {
+		var n uint64
+		if i < len(h.Counts) {
+			n = h.Counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/square/keywhizfs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerPublishesMetricFamilies(t *testing.T) {
+	assert := assert.New(t)
+
+	snapshot := metrics.Snapshot{
+		CacheHits:       3,
+		CacheMisses:     1,
+		CacheSize:       2,
+		BackendRequests: 4,
+		BackendErrors:   1,
+		BackendLatency: metrics.Histogram{
+			Bounds: []float64{0.01, 0.1},
+			Counts: []uint64{1, 3},
+			Count:  4,
+			Sum:    1.5,
+		},
+		BreakerState: 1,
+	}
+	server := httptest.NewServer(metrics.Handler(func() metrics.Snapshot { return snapshot }))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	output := string(body)
+
+	assert.Contains(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+	for _, family := range []string{
+		"# TYPE keywhizfs_cache_hits_total counter",
+		"# TYPE keywhizfs_cache_misses_total counter",
+		"# TYPE keywhizfs_cache_evictions_total counter",
+		"# TYPE keywhizfs_cache_entries gauge",
+		"# TYPE keywhizfs_backend_requests_total counter",
+		"# TYPE keywhizfs_backend_errors_total counter",
+		"# TYPE keywhizfs_backend_timeouts_total counter",
+		"# TYPE keywhizfs_backend_short_circuits_total counter",
+		"# TYPE keywhizfs_backend_rate_limited_total counter",
+		"# TYPE keywhizfs_backend_in_flight gauge",
+		"# TYPE keywhizfs_backend_latency_seconds histogram",
+		"# TYPE keywhizfs_breaker_state gauge",
+	} {
+		assert.Contains(output, family)
+	}
+
+	assert.Contains(output, "keywhizfs_cache_hits_total 3\n")
+	assert.Contains(output, "keywhizfs_cache_entries 2\n")
+	assert.Contains(output, "keywhizfs_backend_latency_seconds_bucket{le=\"0.01\"} 1\n")
+	assert.Contains(output, "keywhizfs_backend_latency_seconds_bucket{le=\"0.1\"} 3\n")
+	assert.Contains(output, "keywhizfs_backend_latency_seconds_bucket{le=\"+Inf\"} 4\n")
+	assert.Contains(output, "keywhizfs_backend_latency_seconds_sum 1.5\n")
+	assert.Contains(output, "keywhizfs_backend_latency_seconds_count 4\n")
+	assert.Contains(output, "keywhizfs_breaker_state 1\n")
+	assert.NotContains(output, "secret=")
+}
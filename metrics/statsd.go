@@ -0,0 +1,116 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// statsdPrefix namespaces statsd metric names.
+const statsdPrefix = "keywhizfs."
+
+// StartStatsd spawns a goroutine which sends the snapshot returned by collect to the statsd server
+// at addr, a UDP host:port, on each tick of interval. All metrics of a tick are sent in one packet.
+//
+// Counters are sent as their increase since the previous tick, and backend latency as a timer
+// holding the mean latency of the tick's requests, sampled at one per request so that statsd and
+// DogStatsD count each request. Sending never blocks lookups, and send failures, such as an
+// unreachable server, are reported to logf at most once per tick.
+//
+// The returned function stops the goroutine. Calling stop more than once is safe.
+func StartStatsd(addr string, interval time.Duration, collect func() Snapshot, logf func(format string, args ...interface{})) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var conn net.Conn
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+
+		prev := collect()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			cur := collect()
+			var packet bytes.Buffer
+			writeStatsd(&packet, prev, cur)
+			prev = cur
+
+			if conn == nil {
+				var err error
+				if conn, err = net.Dial("udp", addr); err != nil {
+					logf("Error connecting to statsd at %v: %v", addr, err)
+					conn = nil
+					continue
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(interval))
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				logf("Error sending metrics to statsd at %v: %v", addr, err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// writeStatsd formats the metrics of cur in the statsd line format, with counters relative to prev.
+func writeStatsd(w io.Writer, prev, cur Snapshot) {
+	statsdCounter(w, "cache_hits", prev.CacheHits, cur.CacheHits)
+	statsdCounter(w, "cache_misses", prev.CacheMisses, cur.CacheMisses)
+	statsdCounter(w, "cache_evictions", prev.CacheEvictions, cur.CacheEvictions)
+	statsdGauge(w, "cache_entries", float64(cur.CacheSize))
+	statsdCounter(w, "backend_requests", prev.BackendRequests, cur.BackendRequests)
+	statsdCounter(w, "backend_errors", prev.BackendErrors, cur.BackendErrors)
+	statsdCounter(w, "backend_timeouts", prev.BackendTimeouts, cur.BackendTimeouts)
+	statsdCounter(w, "backend_short_circuits", prev.BackendShortCircuits, cur.BackendShortCircuits)
+	statsdCounter(w, "backend_rate_limited", prev.BackendRateLimited, cur.BackendRateLimited)
+	statsdGauge(w, "backend_in_flight", float64(cur.BackendInFlight))
+	if latency, prevLatency := cur.BackendLatency, prev.BackendLatency; latency.Count > prevLatency.Count {
+		n := float64(latency.Count - prevLatency.Count)
+		mean := (latency.Sum - prevLatency.Sum) / n * 1000 // in milliseconds
+		fmt.Fprintf(w, "%sbackend_latency:%s|ms|@%s\n", statsdPrefix, formatFloat(mean), formatFloat(1/n))
+	}
+	statsdGauge(w, "breaker_state", float64(cur.BreakerState))
+}
+
+// statsdCounter writes the increase of a counter. A counter which went backwards, such as after a
+// restart, is sent whole.
+func statsdCounter(w io.Writer, name string, prev, cur uint64) {
+	delta := cur
+	if cur >= prev {
+		delta = cur - prev
+	}
+	fmt.Fprintf(w, "%s%s:%d|c\n", statsdPrefix, name, delta)
+}
+
+func statsdGauge(w io.Writer, name string, value float64) {
+	fmt.Fprintf(w, "%s%s:%s|g\n", statsdPrefix, name, formatFloat(value))
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsdSendsPackets(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var hits uint64
+	collect := func() metrics.Snapshot {
+		h := atomic.AddUint64(&hits, 2)
+		return metrics.Snapshot{
+			CacheHits: h,
+			CacheSize: 5,
+			BackendLatency: metrics.Histogram{
+				Count: h,
+				Sum:   float64(h) * 0.02,
+			},
+		}
+	}
+	stop := metrics.StartStatsd(listener.LocalAddr().String(), 10*time.Millisecond, collect, t.Logf)
+	defer stop()
+
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := listener.ReadFrom(buf)
+	if !assert.NoError(err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+
+	assert.Contains(lines, "keywhizfs.cache_hits:2|c")
+	assert.Contains(lines, "keywhizfs.cache_misses:0|c")
+	assert.Contains(lines, "keywhizfs.cache_entries:5|g")
+	assert.Contains(lines, "keywhizfs.backend_latency:20|ms|@0.5")
+	assert.Contains(lines, "keywhizfs.breaker_state:0|g")
+	stop()
+	stop() // safe to call twice
+}
+
+func TestStatsdToleratesUnreachableServer(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing listens on the address, so sends fail without blocking collection.
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.LocalAddr().String()
+	listener.Close()
+
+	var collected, logged int32
+	collect := func() metrics.Snapshot {
+		atomic.AddInt32(&collected, 1)
+		return metrics.Snapshot{}
+	}
+	logf := func(format string, args ...interface{}) { atomic.AddInt32(&logged, 1) }
+	stop := metrics.StartStatsd(addr, 5*time.Millisecond, collect, logf)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	logs := atomic.LoadInt32(&logged)
+	ticks := atomic.LoadInt32(&collected) - 1 // the first collection is the baseline
+	assert.True(ticks > 1, "Expected collection to continue, got %d ticks", ticks)
+	assert.True(logs <= ticks, "Expected at most one log per tick")
+}
@@ -0,0 +1,258 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/keywhizfs/log"
+)
+
+// BackendMiddleware wraps a SecretBackend with additional behavior, such as logging or metrics.
+type BackendMiddleware func(SecretBackend) SecretBackend
+
+// Chain wraps backend with each middleware in turn. The first middleware is outermost, so it sees
+// each request first and each response last.
+func Chain(backend SecretBackend, middleware ...BackendMiddleware) SecretBackend {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		backend = middleware[i](backend)
+	}
+	return backend
+}
+
+// observedBackend calls observe after each request to a wrapped backend. The optional interfaces
+// which Cache prefers are passed through, adapted if the wrapped backend lacks them, so wrapping a
+// backend does not lose cancellation, streaming listings, conditional requests, response statuses,
+// fallback copies, or range reads.
+// Fallback copies are passed through without being observed. Batch requests cannot be adapted, so
+// they are only passed through by observedBatchBackend, for a wrapped BatchSecretFetcher.
+type observedBackend struct {
+	backend     SecretBackendContext
+	lister      StreamingSecretLister
+	partial     PartialSecretLister
+	conditional ConditionalSecretFetcher
+	forbidden   ForbiddenSecretFetcher
+	status      StatusSecretFetcher
+	fallback    FallbackSecretFetcher
+	ranges      RangeSecretFetcher
+	batch       BatchSecretFetcher // nil unless the wrapped backend is one
+	observe     func(name string, ok bool, elapsed time.Duration)
+}
+
+// Observe returns a middleware which calls observe after each request, with the secret name or ""
+// for a listing, whether the request succeeded, and how long it took. A batch request is observed
+// with its names separated by commas.
+func Observe(observe func(name string, ok bool, elapsed time.Duration)) BackendMiddleware {
+	return func(backend SecretBackend) SecretBackend {
+		b := newObservedBackend(backend, observe)
+		if b.batch != nil {
+			return observedBatchBackend{b}
+		}
+		return b
+	}
+}
+
+// newObservedBackend wraps backend, calling observe after each request.
+func newObservedBackend(backend SecretBackend, observe func(name string, ok bool, elapsed time.Duration)) observedBackend {
+	b := observedBackend{
+		backend:     withContext(backend),
+		lister:      withStreaming(backend),
+		partial:     withPartial(backend),
+		conditional: withConditional(backend),
+		forbidden:   withForbidden(backend),
+		status:      withStatus(backend),
+		fallback:    withFallback(backend),
+		ranges:      withRanges(backend),
+		observe:     observe,
+	}
+	b.batch, _ = backend.(BatchSecretFetcher)
+	return b
+}
+
+func (b observedBackend) Secret(name string) (*Secret, bool) {
+	return b.SecretCtx(context.Background(), name)
+}
+
+func (b observedBackend) SecretList() ([]Secret, bool) {
+	return b.SecretListCtx(context.Background())
+}
+
+func (b observedBackend) SecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	start := time.Now()
+	secret, ok := b.backend.SecretCtx(ctx, name)
+	b.observe(name, ok, time.Since(start))
+	return secret, ok
+}
+
+func (b observedBackend) SecretListCtx(ctx context.Context) ([]Secret, bool) {
+	start := time.Now()
+	secrets, ok := b.backend.SecretListCtx(ctx)
+	b.observe("", ok, time.Since(start))
+	return secrets, ok
+}
+
+func (b observedBackend) SecretListPartialCtx(ctx context.Context) ([]Secret, bool, bool) {
+	start := time.Now()
+	secrets, partial, ok := b.partial.SecretListPartialCtx(ctx)
+	b.observe("", ok, time.Since(start))
+	return secrets, partial, ok
+}
+
+func (b observedBackend) SecretListStreamCtx(ctx context.Context, emit func(Secret)) (bool, bool) {
+	start := time.Now()
+	partial, ok := b.lister.SecretListStreamCtx(ctx, emit)
+	b.observe("", ok, time.Since(start))
+	return partial, ok
+}
+
+func (b observedBackend) SecretIfNoneMatchCtx(ctx context.Context, name, etag string) (*Secret, bool, bool) {
+	start := time.Now()
+	secret, notModified, ok := b.conditional.SecretIfNoneMatchCtx(ctx, name, etag)
+	b.observe(name, ok, time.Since(start))
+	return secret, notModified, ok
+}
+
+func (b observedBackend) SecretOrForbiddenCtx(ctx context.Context, name, etag string) (*Secret, bool, bool, bool) {
+	start := time.Now()
+	secret, notModified, forbidden, ok := b.forbidden.SecretOrForbiddenCtx(ctx, name, etag)
+	b.observe(name, ok, time.Since(start))
+	return secret, notModified, forbidden, ok
+}
+
+func (b observedBackend) SecretWithStatusCtx(ctx context.Context, name, etag string) (*Secret, bool, int, bool) {
+	start := time.Now()
+	secret, notModified, status, ok := b.status.SecretWithStatusCtx(ctx, name, etag)
+	b.observe(name, ok, time.Since(start))
+	return secret, notModified, status, ok
+}
+
+func (b observedBackend) FallbackSecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	return b.fallback.FallbackSecretCtx(ctx, name)
+}
+
+func (b observedBackend) SecretRangeCtx(ctx context.Context, name string, off int64, size int, etag string) ([]byte, string, int, bool) {
+	start := time.Now()
+	data, tag, status, ok := b.ranges.SecretRangeCtx(ctx, name, off, size, etag)
+	b.observe(name, ok, time.Since(start))
+	return data, tag, status, ok
+}
+
+// secretsBatch observes a batch request to the wrapped BatchSecretFetcher.
+func (b observedBackend) secretsBatch(ctx context.Context, names []string) (map[string]*Secret, bool) {
+	start := time.Now()
+	secrets, ok := b.batch.SecretsBatch(ctx, names)
+	b.observe(strings.Join(names, ","), ok, time.Since(start))
+	return secrets, ok
+}
+
+// observedBatchBackend is an observedBackend wrapping a BatchSecretFetcher, which it passes through.
+type observedBatchBackend struct {
+	observedBackend
+}
+
+func (b observedBatchBackend) SecretsBatch(ctx context.Context, names []string) (map[string]*Secret, bool) {
+	return b.secretsBatch(ctx, names)
+}
+
+// fallbackBackend passes requests through to a wrapped backend, and provides copies of secrets from
+// a fallback backend as a FallbackSecretFetcher.
+type fallbackBackend struct {
+	observedBackend
+	copies SecretBackendContext
+}
+
+// Fallback returns a middleware providing last-resort copies of secrets from fallback, such as a
+// LocalBackend. Cache only reads a copy when a lookup found nothing cached and the wrapped backend
+// failed, and never caches it.
+func Fallback(fallback SecretBackend) BackendMiddleware {
+	copies := withContext(fallback)
+	return func(backend SecretBackend) SecretBackend {
+		passThrough := newObservedBackend(backend, func(string, bool, time.Duration) {})
+		if passThrough.batch != nil {
+			return fallbackBatchBackend{fallbackBackend{passThrough, copies}}
+		}
+		return fallbackBackend{passThrough, copies}
+	}
+}
+
+func (b fallbackBackend) FallbackSecretCtx(ctx context.Context, name string) (*Secret, bool) {
+	if secret, ok := b.copies.SecretCtx(ctx, name); ok {
+		return secret, true
+	}
+	return b.observedBackend.FallbackSecretCtx(ctx, name)
+}
+
+// fallbackBatchBackend is a fallbackBackend wrapping a BatchSecretFetcher, which it passes through.
+type fallbackBatchBackend struct {
+	fallbackBackend
+}
+
+func (b fallbackBatchBackend) SecretsBatch(ctx context.Context, names []string) (map[string]*Secret, bool) {
+	return b.secretsBatch(ctx, names)
+}
+
+// LoggingMiddleware returns a middleware which logs each backend request, at debug level when it
+// succeeds and as a warning when it fails.
+func LoggingMiddleware(logConfig log.Config) BackendMiddleware {
+	logger := log.New("kwfs_backend", logConfig)
+	return Observe(func(name string, ok bool, elapsed time.Duration) {
+		if name == "" {
+			name = "secretList()"
+		}
+		if ok {
+			logger.Debugf("Backend request succeeded in %v: %v", elapsed, name)
+		} else {
+			logger.Warnf("Backend request failed in %v: %v", elapsed, name)
+		}
+	})
+}
+
+// BackendMetrics counts the requests of the backends wrapped by its Middleware. The zero value is
+// ready to use.
+type BackendMetrics struct {
+	requests uint64
+	errors   uint64
+	latency  latencyHistogram
+}
+
+// Middleware wraps backend so that its requests are recorded. It may wrap several backends, whose
+// requests are recorded together.
+func (m *BackendMetrics) Middleware(backend SecretBackend) SecretBackend {
+	return Observe(func(name string, ok bool, elapsed time.Duration) {
+		count(&m.requests)
+		if !ok {
+			count(&m.errors)
+		}
+		m.latency.observe(elapsed)
+	})(backend)
+}
+
+// Requests returns the number of requests made to wrapped backends.
+func (m *BackendMetrics) Requests() uint64 {
+	return atomic.LoadUint64(&m.requests)
+}
+
+// Errors returns the number of requests to wrapped backends which failed.
+func (m *BackendMetrics) Errors() uint64 {
+	return atomic.LoadUint64(&m.errors)
+}
+
+// Latency returns a snapshot of the latency histogram of requests to wrapped backends.
+func (m *BackendMetrics) Latency() LatencyHistogram {
+	return m.latency.snapshot()
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingMiddleware counts the Secret and SecretList calls passing through it.
+func countingMiddleware(calls *int32) keywhizfs.BackendMiddleware {
+	return func(backend keywhizfs.SecretBackend) keywhizfs.SecretBackend {
+		return countingBackend{backend, calls}
+	}
+}
+
+type countingBackend struct {
+	keywhizfs.SecretBackend
+	calls *int32
+}
+
+func (b countingBackend) Secret(name string) (*keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	return b.SecretBackend.Secret(name)
+}
+
+func (b countingBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	atomic.AddInt32(b.calls, 1)
+	return b.SecretBackend.SecretList()
+}
+
+func TestChainInvokesMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	metrics := &keywhizfs.BackendMetrics{}
+	backend := keywhizfs.Chain(FailingBackend{}, keywhizfs.LoggingMiddleware(logConfig), metrics.Middleware, countingMiddleware(&calls))
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	_, ok := cache.Secret("foo")
+	assert.False(ok)
+	assert.Empty(cache.SecretList())
+
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+	assert.EqualValues(2, metrics.Requests())
+	assert.EqualValues(2, metrics.Errors())
+	assert.EqualValues(2, metrics.Latency().Count)
+}
+
+func TestChainOrdersMiddlewareOutermostFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	var order []string
+	record := func(label string) keywhizfs.BackendMiddleware {
+		return keywhizfs.Observe(func(name string, ok bool, elapsed time.Duration) {
+			order = append(order, label)
+		})
+	}
+	backend := keywhizfs.Chain(FailingBackend{}, record("outer"), record("inner"))
+	backend.SecretList()
+
+	// Observers run after the request, so the innermost observes first.
+	assert.Equal([]string{"inner", "outer"}, order)
+}
+
+func TestObservePreservesOptionalInterfaces(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	var observed []string
+	backend := keywhizfs.Observe(func(name string, ok bool, elapsed time.Duration) {
+		observed = append(observed, name)
+	})(StreamingBackend{secrets: []keywhizfs.Secret{*secretFixture}, fail: true})
+
+	streaming, ok := backend.(keywhizfs.StreamingSecretLister)
+	if assert.True(ok) {
+		var emitted []keywhizfs.Secret
+		_, ok = streaming.SecretListStreamCtx(context.Background(), func(s keywhizfs.Secret) { emitted = append(emitted, s) })
+		assert.False(ok)
+		assert.Equal([]keywhizfs.Secret{*secretFixture}, emitted)
+	}
+	assert.Implements((*keywhizfs.SecretBackendContext)(nil), backend)
+	assert.Implements((*keywhizfs.ConditionalSecretFetcher)(nil), backend)
+	assert.Equal([]string{""}, observed)
+}
+
+func TestObservePassesBatchRequestsThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	var observed []string
+	observe := keywhizfs.Observe(func(name string, ok bool, elapsed time.Duration) {
+		observed = append(observed, name)
+	})
+	_, ok := observe(FailingBackend{}).(keywhizfs.BatchSecretFetcher)
+	assert.False(ok, "Only batch backends are wrapped as one")
+
+	backend := newBatchBackend(false, "first")
+	wrapped := keywhizfs.Chain(backend, observe, keywhizfs.Fallback(FailingBackend{}))
+	batch, ok := wrapped.(keywhizfs.BatchSecretFetcher)
+	if assert.True(ok) {
+		secrets, ok := batch.SecretsBatch(context.Background(), []string{"first", "second"})
+		assert.True(ok)
+		assert.Len(secrets, 1)
+	}
+	assert.Equal([]string{"first,second"}, observed)
+}
@@ -0,0 +1,296 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// Unmount retry settings: a busy mount is retried unmountAttempts times, unmountRetryDelay apart,
+// before being lazily unmounted.
+const (
+	unmountAttempts   = 5
+	unmountRetryDelay = time.Second
+)
+
+// notifier invalidates the kernel's caches of files, as a *pathfs.PathNodeFs does once mounted.
+type notifier interface {
+	FileNotify(path string, off int64, length int64) fuse.Status
+	EntryNotify(dir string, name string) fuse.Status
+}
+
+// mountState tracks the mount of a KeywhizFs, shared by its copies.
+type mountState struct {
+	root       nodefs.Node
+	notifier   notifier
+	server     *fuse.Server
+	mountpoint string
+	device     uint64 // of the mount, identifying it among mounts at the mountpoint; zero if unknown
+	mountedAt  time.Time
+	serving    bool
+	unmounting bool // Unmount is in progress or succeeded, so the mount ending is expected
+	lock       sync.Mutex
+}
+
+// DefaultMountOptions returns the options used by Mount when none are given: the filesystem is
+// visible to other users, and the kernel enforces file permissions.
+func (kwfs KeywhizFs) DefaultMountOptions() *fuse.MountOptions {
+	return &fuse.MountOptions{
+		AllowOther: true,
+		Name:       kwfs.String(),
+		Options:    []string{"default_permissions"},
+	}
+}
+
+// mountFlags are the FUSE options without a value which are passed to the kernel as given.
+var mountFlags = map[string]bool{
+	"default_permissions": true,
+	"ro":                  true,
+	"nosuid":              true,
+	"nodev":               true,
+	"noexec":              true,
+	"noatime":             true,
+}
+
+// MountOptions returns DefaultMountOptions amended by FUSE options, each given as "name" or
+// "name=value" as with the -o flag of mount. The max_write, max_readahead, max_background, fsname
+// and subtype options set the matching MountOptions fields, while max_read and flags such as ro
+// are passed to the kernel. Secret files always use direct I/O, so direct_io changes nothing.
+// Unknown options are passed to the kernel with a warning.
+//
+// The filesystem is visible to users other than the one mounting it only if allowOther is set, as
+// it is by default, since some deployments share secrets across users and others must not. The
+// allow_other option is rejected, so that allowOther alone decides.
+func (kwfs KeywhizFs) MountOptions(options []string, allowOther bool) (*fuse.MountOptions, error) {
+	mountOptions := kwfs.DefaultMountOptions()
+	mountOptions.AllowOther = allowOther
+	sizes := map[string]*int{
+		"max_write":      &mountOptions.MaxWrite,
+		"max_readahead":  &mountOptions.MaxReadAhead,
+		"max_background": &mountOptions.MaxBackground,
+		"max_read":       nil, // passed to the kernel
+	}
+	names := map[string]*string{"fsname": &mountOptions.FsName, "subtype": &mountOptions.Name}
+
+	for _, option := range options {
+		name, value := option, ""
+		i := strings.IndexByte(option, '=')
+		if i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+		size, isSize := sizes[name]
+		field, isName := names[name]
+		switch {
+		case name == "allow_other":
+			return nil, errors.New("FUSE option allow_other must be enabled explicitly")
+		case mountFlags[name] || name == "direct_io":
+			if i >= 0 {
+				return nil, fmt.Errorf("FUSE option %v takes no value", name)
+			}
+			if name == "direct_io" {
+				kwfs.Debugf("Secret files always use direct I/O")
+			} else if name != "default_permissions" { // already a default
+				mountOptions.Options = append(mountOptions.Options, option)
+			}
+		case isSize:
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("FUSE option %v must be a positive number, not '%v'", name, value)
+			}
+			if size != nil {
+				*size = n
+			} else {
+				mountOptions.Options = append(mountOptions.Options, option)
+			}
+		case isName:
+			if value == "" {
+				return nil, fmt.Errorf("FUSE option %v needs a value", name)
+			}
+			*field = value
+		default:
+			kwfs.Warnf("Passing unknown FUSE option %v to the kernel", option)
+			mountOptions.Options = append(mountOptions.Options, option)
+		}
+	}
+	return mountOptions, nil
+}
+
+// Mount mounts the filesystem at mountpoint with options, or DefaultMountOptions if options is
+// nil. Requests are answered once Serve is called. A filesystem can be mounted only once.
+func (kwfs KeywhizFs) Mount(mountpoint string, options *fuse.MountOptions) error {
+	m := kwfs.mount
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.server != nil {
+		return fmt.Errorf("already mounted at %v", m.mountpoint)
+	}
+	if options == nil {
+		options = kwfs.DefaultMountOptions()
+	}
+
+	// Empty Options struct avoids setting a global uid/gid override.
+	conn := nodefs.NewFileSystemConnector(m.root, &nodefs.Options{})
+	server, err := fuse.NewServer(conn.RawFS(), mountpoint, options)
+	if err != nil {
+		return fmt.Errorf("mounting %v: %v", mountpoint, err)
+	}
+	device, err := mountDevice(mountpoint)
+	if err != nil {
+		kwfs.Warnf("Cannot identify the mount at %v, checking only its filesystem type: %v", mountpoint, err)
+	}
+	m.server, m.mountpoint, m.device, m.mountedAt = server, mountpoint, device, time.Now()
+	return nil
+}
+
+// Serve answers filesystem requests until the filesystem is unmounted. It must follow Mount.
+// Returns an error if the mount ended other than by Unmount, such as by an external unmount.
+func (kwfs KeywhizFs) Serve() error {
+	m := kwfs.mount
+	m.lock.Lock()
+	server := m.server
+	m.serving = server != nil
+	m.lock.Unlock()
+	if server == nil {
+		return errors.New("not mounted")
+	}
+
+	server.Serve()
+	m.lock.Lock()
+	m.serving, m.mountedAt = false, time.Time{}
+	unmounting := m.unmounting
+	m.lock.Unlock()
+	kwfs.Infof("Stopped serving %v", m.mountpoint)
+	if !unmounting {
+		return fmt.Errorf("%v was unmounted externally", m.mountpoint)
+	}
+	return nil
+}
+
+// Mounted returns whether the filesystem is mounted and being served.
+func (kwfs KeywhizFs) Mounted() bool {
+	m := kwfs.mount
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.serving
+}
+
+// MountedAt returns when the filesystem was mounted, or the zero time if it is not mounted or has
+// stopped being served.
+func (kwfs KeywhizFs) MountedAt() time.Time {
+	m := kwfs.mount
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.mountedAt
+}
+
+// mountCheckFailures is the number of consecutive failed checks after which WatchMount reports the
+// mount lost, so that a single transient failure is tolerated.
+const mountCheckFailures = 2
+
+// WatchMount verifies with CheckMount every interval that the mountpoint is still this
+// filesystem's mount, from Mount until Unmount is called. Where mounts can be told apart, as on
+// Linux, the mount must also be the one made by Mount, rather than another FUSE mount shadowing it. A mount failing consecutive checks, such
+// as when its mountpoint was removed or unmounted from under it, is reported once on lost, after
+// which watching stops. Failed and recovered checks are logged. The caller should then exit, so that a
+// supervisor can restart it. The returned function stops watching.
+func (kwfs KeywhizFs) WatchMount(interval time.Duration) (lost <-chan error, stop func()) {
+	lostc := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			m := kwfs.mount
+			m.lock.Lock()
+			mountpoint, device, watched := m.mountpoint, m.device, m.server != nil && !m.unmounting
+			m.lock.Unlock()
+			if !watched {
+				continue
+			}
+
+			err := CheckMount(mountpoint)
+			if err == nil && device != 0 {
+				err = checkMountDevice(mountpoint, device)
+			}
+			switch {
+			case err == nil && failures > 0:
+				kwfs.Infof("Mount at %v verified again", mountpoint)
+				failures = 0
+			case err == nil:
+			case failures+1 < mountCheckFailures:
+				failures++
+				kwfs.Warnf("Mount check failed: %v", err)
+			default:
+				kwfs.Errorf("Mount at %v lost: %v", mountpoint, err)
+				lostc <- fmt.Errorf("mount at %v lost: %w", mountpoint, err)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return lostc, func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Unmount unmounts the filesystem, retrying while it is busy and forcing a lazy unmount with
+// fusermount as a last resort. Serve returns once the filesystem is unmounted. If every attempt
+// fails, the filesystem stays mounted and watched as before.
+func (kwfs KeywhizFs) Unmount() error {
+	m := kwfs.mount
+	m.lock.Lock()
+	server, mountpoint := m.server, m.mountpoint
+	m.unmounting = server != nil
+	m.lock.Unlock()
+	if server == nil {
+		return errors.New("not mounted")
+	}
+
+	for attempt := 1; attempt <= unmountAttempts; attempt++ {
+		err := server.Unmount()
+		if err == nil {
+			kwfs.Infof("Unmounted %v", mountpoint)
+			return nil
+		}
+		kwfs.Warnf("Unmount attempt %d of %d failed: %v", attempt, unmountAttempts, err)
+		time.Sleep(unmountRetryDelay)
+	}
+
+	kwfs.Warnf("Forcing lazy unmount of %v", mountpoint)
+	if output, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput(); err != nil {
+		m.lock.Lock()
+		m.unmounting = false
+		m.lock.Unlock()
+		return fmt.Errorf("forced unmount of %v failed: %v (%s)", mountpoint, err, output)
+	}
+	kwfs.Infof("Lazily unmounted %v", mountpoint)
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	kwfs, _, _ := keywhizfs.NewKeywhizFsWithCache(nil, cache, keywhizfs.Ownership{}, logConfig)
+
+	assert.True(kwfs.DefaultMountOptions().AllowOther, "Expected other users to be allowed by default")
+
+	options, err := kwfs.MountOptions(nil, false)
+	assert.NoError(err)
+	assert.False(options.AllowOther, "Expected other users to be shut out unless allowed")
+	assert.Equal(kwfs.DefaultMountOptions().Options, options.Options)
+
+	options, err = kwfs.MountOptions([]string{
+		"max_read=131072", "max_write=65536", "max_background=4", "fsname=keywhiz", "subtype=secrets",
+		"ro", "direct_io", "default_permissions", "x-custom=1",
+	}, true)
+	assert.NoError(err)
+	assert.True(options.AllowOther)
+	assert.Equal(65536, options.MaxWrite)
+	assert.Equal(4, options.MaxBackground)
+	assert.Equal("keywhiz", options.FsName)
+	assert.Equal("secrets", options.Name)
+	assert.Equal([]string{"default_permissions", "max_read=131072", "ro", "x-custom=1"}, options.Options)
+
+	for _, invalid := range []string{"allow_other", "ro=1", "direct_io=yes", "max_read=0", "max_write=abc", "max_readahead", "fsname=", "subtype"} {
+		_, err = kwfs.MountOptions([]string{invalid}, true)
+		assert.Error(err, "Expected %v to be rejected", invalid)
+	}
+}
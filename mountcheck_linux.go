@@ -0,0 +1,123 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package keywhizfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// fuseSuperMagic is the filesystem type reported by statfs for FUSE mounts.
+const fuseSuperMagic = 0x65735546
+
+// CheckMount returns an error unless mountpoint is the root of a FUSE mount, as identified by
+// statfs. A removed mountpoint, or one whose mount was detached, fails.
+func CheckMount(mountpoint string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &stat); err != nil {
+		return fmt.Errorf("checking mount at %v: %w", mountpoint, err)
+	}
+	if int64(stat.Type) != fuseSuperMagic {
+		return fmt.Errorf("%v is not a FUSE mount (filesystem type %#x)", mountpoint, stat.Type)
+	}
+	return nil
+}
+
+// mountDevice returns the device of the topmost mount at mountpoint, as listed by
+// /proc/self/mountinfo. Reading the listing, unlike a stat, makes no request of the mounted
+// filesystem, so it works before the filesystem is served.
+func mountDevice(mountpoint string) (uint64, error) {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	device, ok, err := parseMountDevice(f, abs)
+	if err == nil && !ok {
+		err = fmt.Errorf("no mount at %v in /proc/self/mountinfo", abs)
+	}
+	return device, err
+}
+
+// parseMountDevice returns the device of the last mount at mountpoint, the topmost one, listed in
+// the mountinfo format of proc(5). ok is false if there is none.
+func parseMountDevice(r io.Reader, mountpoint string) (device uint64, ok bool, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Fields are: mount ID, parent ID, major:minor, root, mount point, and more.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != mountpoint {
+			continue
+		}
+		numbers := strings.SplitN(fields[2], ":", 2)
+		if len(numbers) != 2 {
+			continue
+		}
+		major, err1 := strconv.ParseUint(numbers[0], 10, 32)
+		minor, err2 := strconv.ParseUint(numbers[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		device, ok = unix.Mkdev(uint32(major), uint32(minor)), true
+	}
+	return device, ok, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes of spaces, tabs, newlines and backslashes in a path
+// listed by mountinfo, such as "\040" for a space.
+func unescapeMountinfo(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// checkMountDevice returns an error unless the root of the mount at mountpoint is on device, as
+// recorded by Mount, such as when another mount shadows it.
+func checkMountDevice(mountpoint string, device uint64) error {
+	var stat unix.Stat_t
+	if err := unix.Stat(mountpoint, &stat); err != nil {
+		return fmt.Errorf("checking mount at %v: %w", mountpoint, err)
+	}
+	if uint64(stat.Dev) != device {
+		return fmt.Errorf("%v is another mount (device %d:%d, expected %d:%d)", mountpoint,
+			unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev)), unix.Major(device), unix.Minor(device))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package keywhizfs_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckMountRejectsOtherFilesystems(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-mountcheck")
+	assert.NoError(err)
+	err = keywhizfs.CheckMount(dir)
+	assert.Error(err, "A plain directory is not a FUSE mount")
+	assert.Contains(err.Error(), dir)
+
+	assert.NoError(os.Remove(dir))
+	err = keywhizfs.CheckMount(dir)
+	assert.Error(err, "A removed mountpoint fails")
+	assert.True(os.IsNotExist(errors.Unwrap(err)))
+}
+
+func TestMountDeviceIdentifiesTopmostMount(t *testing.T) {
+	assert := assert.New(t)
+
+	mountinfo := strings.Join([]string{
+		"22 1 0:21 / /proc rw,nosuid - proc proc rw",
+		"40 22 0:45 / /mnt/secrets rw,nosuid,nodev - fuse.kwfs kwfs rw,user_id=0,group_id=0",
+		"41 40 0:46 / /mnt/secrets rw,nosuid,nodev - fuse.other other rw,user_id=0,group_id=0",
+		"42 22 0:47 / /mnt/with\\040space rw - fuse.kwfs kwfs rw",
+	}, "\n")
+	device, ok, err := keywhizfs.ParseMountDevice(strings.NewReader(mountinfo), "/mnt/secrets")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(unix.Mkdev(0, 46), device, "A mount shadowing another is the topmost")
+
+	device, ok, _ = keywhizfs.ParseMountDevice(strings.NewReader(mountinfo), "/mnt/with space")
+	assert.True(ok)
+	assert.Equal(unix.Mkdev(0, 47), device)
+
+	_, ok, _ = keywhizfs.ParseMountDevice(strings.NewReader(mountinfo), "/mnt")
+	assert.False(ok)
+}
+
+func TestCheckMountDeviceRejectsOtherMounts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-mountcheck")
+	assert.NoError(err)
+	defer os.Remove(dir)
+	var stat unix.Stat_t
+	assert.NoError(unix.Stat(dir, &stat))
+
+	assert.NoError(keywhizfs.CheckMountDevice(dir, uint64(stat.Dev)))
+	err = keywhizfs.CheckMountDevice(dir, uint64(stat.Dev)+1)
+	assert.Error(err, "A mount on another device is not this one")
+	assert.Contains(err.Error(), "another mount")
+}
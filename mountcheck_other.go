@@ -0,0 +1,45 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package keywhizfs
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckMount returns an error if mountpoint is not a directory. The filesystem type is only
+// verified on Linux.
+func CheckMount(mountpoint string) error {
+	info, err := os.Stat(mountpoint)
+	if err != nil {
+		return fmt.Errorf("checking mount at %v: %w", mountpoint, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", mountpoint)
+	}
+	return nil
+}
+
+// mountDevice returns zero, since mounts are only told apart on Linux.
+func mountDevice(mountpoint string) (uint64, error) {
+	return 0, nil
+}
+
+// checkMountDevice succeeds, since mounts are only told apart on Linux.
+func checkMountDevice(mountpoint string, device uint64) error {
+	return nil
+}
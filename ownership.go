@@ -15,6 +15,7 @@
 package keywhizfs
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/user"
@@ -37,34 +38,48 @@ func NewOwnership(username, groupname string) Ownership {
 
 // lookupUid resolves a username to a numeric id. Current euid is returned on failure.
 func lookupUid(username string) uint32 {
-	u, err := user.Lookup(username)
+	uid, err := resolveUid(username)
 	if err != nil {
-		log.Printf("Error resolving uid for %v: %v\n", username, err)
+		log.Printf("%v\n", err)
 		return uint32(os.Geteuid())
 	}
+	return uid
+}
 
-	uid, err := strconv.ParseUint(u.Uid, 10 /* base */, 32 /* bits */)
+// lookupGid resolves a groupname to a numeric id. Current egid is returned on failure.
+func lookupGid(groupname string) uint32 {
+	gid, err := resolveGid(groupname)
 	if err != nil {
-		log.Printf("Error resolving uid for %v: %v\n", username, err)
-		return uint32(os.Geteuid())
+		log.Printf("%v\n", err)
+		return uint32(os.Getegid())
+	}
+	return gid
+}
+
+// resolveUid resolves a username to a numeric id.
+func resolveUid(username string) (uint32, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, fmt.Errorf("Error resolving uid for %v: %v", username, err)
 	}
 
-	return uint32(uid)
+	uid, err := strconv.ParseUint(u.Uid, 10 /* base */, 32 /* bits */)
+	if err != nil {
+		return 0, fmt.Errorf("Error resolving uid for %v: %v", username, err)
+	}
+	return uint32(uid), nil
 }
 
-// lookupGid resolves a groupname to a numeric id. Current egid is returned on failure.
-func lookupGid(groupname string) uint32 {
-	g, err := user.Lookup(groupname)
+// resolveGid resolves a groupname to a numeric id.
+func resolveGid(groupname string) (uint32, error) {
+	g, err := user.LookupGroup(groupname)
 	if err != nil {
-		log.Printf("Error resolving gid for %v: %v\n", groupname, err)
-		return uint32(os.Getegid())
+		return 0, fmt.Errorf("Error resolving gid for %v: %v", groupname, err)
 	}
 
 	gid, err := strconv.ParseUint(g.Gid, 10 /* base */, 32 /* bits */)
 	if err != nil {
-		log.Printf("Error resolving gid for %v: %v\n", groupname, err)
-		return uint32(os.Getegid())
+		return 0, fmt.Errorf("Error resolving gid for %v: %v", groupname, err)
 	}
-
-	return uint32(gid)
+	return uint32(gid), nil
 }
@@ -0,0 +1,97 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// persistedCache is the on-disk representation of cache entries.
+type persistedCache struct {
+	Entries []SecretTime
+}
+
+// Persist writes every cached entry, including when it was fetched, to the file at path. The file
+// holds secret material, so it is only readable by the owner. It is replaced atomically so a
+// crash never leaves a partially written file behind.
+func (c *Cache) Persist(path string) error {
+	if c.isClosed() {
+		return ErrCacheClosed
+	}
+	return c.persist(path)
+}
+
+// persist implements Persist, also for Close.
+func (c *Cache) persist(path string) error {
+	entries := c.secretMap.Values()
+	data, err := json.Marshal(persistedCache{entries})
+	if err != nil {
+		return fmt.Errorf("Fail to serialize cache: %v", err)
+	}
+
+	// TempFile creates files with 0600 permissions.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Fail to persist cache to %v: %v", path, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("Fail to persist cache to %v: %v", path, err)
+	}
+
+	c.Infof("Persisted %d cache entries to %v", len(entries), path)
+	return nil
+}
+
+// Load restores entries written by Persist into the cache, keeping their original fetch times.
+// Entries older than the Fresh threshold are therefore stale, but still usable as a fallback when
+// the backend is unavailable. Entries already in the cache and newer than their persisted
+// counterpart are kept.
+func (c *Cache) Load(path string) error {
+	if c.isClosed() {
+		return ErrCacheClosed
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Fail to load cache from %v: %v", path, err)
+	}
+
+	var persisted persistedCache
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("Fail to deserialize cache from %v: %v", path, err)
+	}
+
+	// Entries were persisted most recently used first; insert in reverse to keep that order.
+	for i := len(persisted.Entries) - 1; i >= 0; i-- {
+		entry := persisted.Entries[i]
+		c.secretMap.putIfOlder(entry.Secret.Name, entry)
+	}
+	c.Infof("Loaded %d cache entries from %v", len(persisted.Entries), path)
+	return nil
+}
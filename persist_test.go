@@ -0,0 +1,132 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePersistAndLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-persist")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+
+	clock := newFakeClock()
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCacheWithClock(FailingBackend{}, timeouts, logConfig, clock.Now)
+	cache.Add(*fixture1)
+	cache.Add(*fixture2)
+	assert.NoError(cache.Persist(path))
+
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	assert.EqualValues(0600, info.Mode().Perm())
+
+	// Entries fetched more than Fresh ago are stale: the backend is consulted and, as it fails,
+	// the loaded entries serve as fallback.
+	clock.Advance(time.Hour)
+	secretc := make(chan *keywhizfs.Secret, 1)
+	loaded := keywhizfs.NewCacheWithClock(ChannelBackend{secretc: secretc}, timeouts, logConfig, clock.Now)
+	assert.NoError(loaded.Load(path))
+	assert.Equal(2, loaded.Len())
+
+	secret, ok := loaded.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1, secret)
+	assert.EqualValues(1, loaded.Stats().BackendTimeouts)
+	secretc <- fixture1 // unblock the stale revalidation
+
+	// Within the Fresh threshold loaded entries are served directly.
+	fresh := keywhizfs.NewCacheWithClock(ChannelBackend{}, timeouts, logConfig, newFakeClock().Now)
+	assert.NoError(fresh.Load(path))
+	secret, ok = fresh.Secret(fixture2.Name)
+	assert.True(ok)
+	assert.Equal(fixture2, secret)
+	assert.Zero(fresh.Stats().BackendCalls)
+}
+
+func TestCacheWarmupServesLoadedEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-persist")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	clock := newFakeClock()
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	persisted := keywhizfs.NewCacheWithClock(FailingBackend{}, timeouts, logConfig, clock.Now)
+	persisted.Add(*fixture1)
+	assert.NoError(persisted.Persist(path))
+
+	// On startup the loaded entry is stale, and the backend is slow to answer.
+	clock.Advance(time.Hour)
+	secretc := make(chan *keywhizfs.Secret)
+	cache := keywhizfs.NewCacheWithClock(ChannelBackend{secretc: secretc}, timeouts, logConfig, clock.Now)
+	assert.NoError(cache.Load(path))
+	done := cache.StartWarmup(time.Minute, 1)
+
+	secret, ok := cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal(fixture1, secret)
+	_, stale := cache.StaleSince(fixture1.Name)
+	assert.False(stale, "Expected the loaded entry to be served as fresh while warming up")
+
+	rotated := *fixture1
+	rotated.Version = "2"
+	secretc <- &rotated
+	assert.NoError(<-done)
+	secret, ok = cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal("2", secret.Version)
+
+	// After the warmup, entries older than Fresh wait for the backend again.
+	clock.Advance(time.Hour)
+	secret, ok = cache.Secret(fixture1.Name)
+	assert.True(ok)
+	assert.Equal("2", secret.Version)
+	_, stale = cache.StaleSince(fixture1.Name)
+	assert.True(stale)
+	secretc <- &rotated // unblock the stale revalidation
+}
+
+func TestCacheLoadCorruptFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "kwfs-persist")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"Entries": [{"Secret": {"name": "foo", "secret": 42}`)
+	file.Close()
+
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	assert.Error(cache.Load(file.Name()))
+	assert.Error(cache.Load(file.Name() + ".missing"))
+	assert.Equal(0, cache.Len())
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build pkcs11
+
+package keywhizfs
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// PKCS11Certificate logs in to the PKCS#11 token described by config, and returns a
+// CertificateSource presenting the certificate labelled config.Label. Handshakes are signed by the
+// private key with the same label, which never leaves the token. The returned function closes the
+// session with the token.
+func PKCS11Certificate(config PKCS11Config) (source CertificateSource, close func() error, err error) {
+	slot := config.Slot
+	token, err := crypto11.Configure(&crypto11.Config{Path: config.Module, SlotNumber: &slot, Pin: config.PIN})
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening PKCS#11 token in slot %d: %w", config.Slot, err)
+	}
+
+	source = func() (tls.Certificate, error) {
+		label := []byte(config.Label)
+		key, err := token.FindKeyPair(nil, label)
+		if err == nil && key == nil {
+			err = fmt.Errorf("no private key labelled %q", config.Label)
+		}
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("finding PKCS#11 key: %w", err)
+		}
+		cert, err := token.FindCertificate(nil, label, nil)
+		if err == nil && cert == nil {
+			err = fmt.Errorf("no certificate labelled %q", config.Label)
+		}
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("finding PKCS#11 certificate: %w", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+	}
+	if _, err := source(); err != nil {
+		token.Close()
+		return nil, nil, err
+	}
+	return source, token.Close, nil
+}
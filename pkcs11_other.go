@@ -0,0 +1,24 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !pkcs11
+
+package keywhizfs
+
+import "errors"
+
+// PKCS11Certificate is only supported when built with the pkcs11 tag.
+func PKCS11Certificate(config PKCS11Config) (source CertificateSource, close func() error, err error) {
+	return nil, nil, errors.New("PKCS#11 support requires building with -tags pkcs11")
+}
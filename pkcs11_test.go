@@ -0,0 +1,127 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build pkcs11
+
+// PKCS#11 tests need a token, such as one initialized with SoftHSM:
+//   softhsm2-util --init-token --free --label kwfs --pin 1234 --so-pin 1234
+// Run with the module, the slot it reports, and the PIN in the environment:
+//   KEYWHIZFS_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so KEYWHIZFS_PKCS11_SLOT=<slot> \
+//   KEYWHIZFS_PKCS11_PIN=1234 go test -tags pkcs11
+
+package keywhizfs_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// pkcs11Config returns the token configured by the environment, skipping the test if there is none.
+func pkcs11Config(t *testing.T) keywhizfs.PKCS11Config {
+	module := os.Getenv("KEYWHIZFS_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("KEYWHIZFS_PKCS11_MODULE not set")
+	}
+	slot, err := strconv.Atoi(os.Getenv("KEYWHIZFS_PKCS11_SLOT"))
+	if err != nil {
+		t.Fatalf("Invalid KEYWHIZFS_PKCS11_SLOT: %v", err)
+	}
+	label := fmt.Sprintf("kwfs-test-%d", time.Now().UnixNano())
+	return keywhizfs.PKCS11Config{Module: module, Slot: slot, PIN: os.Getenv("KEYWHIZFS_PKCS11_PIN"), Label: label}
+}
+
+// storeClientIdentity generates a key pair on the token with a self-signed certificate, both
+// labelled config.Label, and returns the certificate.
+func storeClientIdentity(t *testing.T, config keywhizfs.PKCS11Config) *x509.Certificate {
+	slot := config.Slot
+	token, err := crypto11.Configure(&crypto11.Config{Path: config.Module, SlotNumber: &slot, Pin: config.PIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+
+	label := []byte(config.Label)
+	key, err := token.GenerateRSAKeyPairWithLabel(label, label, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: config.Label},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := token.ImportCertificateWithLabel(label, label, cert); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientPresentsPKCS11Certificate(t *testing.T) {
+	assert := assert.New(t)
+
+	config := pkcs11Config(t)
+	cert := storeClientIdentity(t, config)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || !bytes.Equal(r.TLS.PeerCertificates[0].Raw, cert.Raw) {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write(fixture("secret.json"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	certificate, closeToken, err := keywhizfs.PKCS11Certificate(config)
+	if !assert.NoError(err) {
+		return
+	}
+	defer closeToken()
+
+	client := keywhizfs.NewClientWithCertificate(certificate, caFile, []string{server.URL}, time.Second, logConfig, false)
+	secret, ok := client.Secret("Nobody_PgPass")
+	assert.True(ok)
+	assert.Equal("Nobody_PgPass", secret.Name)
+
+	config.Label = "missing"
+	_, _, err = keywhizfs.PKCS11Certificate(config)
+	assert.Error(err)
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SetRateLimit limits backend requests to rps per second on average, allowing bursts of up to
+// burst requests. A request waits for its turn until BackendTimeout, after which it is abandoned
+// and lookups fall back to the cache. An rps of zero or less removes the limit.
+func (c *Cache) SetRateLimit(rps float64, burst int) {
+	c.limiter.lock.Lock()
+	defer c.limiter.lock.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	c.limiter.rate = rps
+	c.limiter.burst = float64(burst)
+	c.limiter.tokens = float64(burst)
+	c.limiter.last = time.Now()
+}
+
+// limit waits for the rate limiter to allow a backend request, for up to BackendTimeout. Returns
+// whether the request may proceed.
+func (c *Cache) limit(ctx context.Context, name string) bool {
+	if c.limiter.acquire(ctx, c.Timeouts().BackendTimeout) {
+		return true
+	}
+	c.Debugf("Rate limited, skipping backend: %v", name)
+	count(&c.stats.rateLimited)
+	return false
+}
+
+// tokenBucket is a token bucket rate limiter. The zero value is disabled.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // capacity
+	tokens float64 // negative when requests are waiting for tokens already reserved
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// acquire takes a token, waiting up to max for one to become available. Returns false without
+// taking a token if the wait would exceed max, or if ctx is done while waiting.
+func (b *tokenBucket) acquire(ctx context.Context, max time.Duration) bool {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if b.tokens >= 1 {
+		wait = 0
+	}
+	if wait > max {
+		b.lock.Unlock()
+		return false
+	}
+	b.tokens-- // Reserve a token, which may only be refilled after the wait.
+	b.lock.Unlock()
+	if wait == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		b.lock.Lock()
+		b.tokens++
+		b.lock.Unlock()
+		return false
+	}
+}
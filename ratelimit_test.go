@@ -0,0 +1,114 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheRateLimitsBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: 10 * time.Millisecond, BackendTimeout: 50 * time.Millisecond}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	cache.SetRateLimit(1, 2)
+
+	// The burst is served immediately.
+	for i := 0; i < 2; i++ {
+		_, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+	}
+
+	// The next token is a second away, longer than BackendTimeout, so the cached value is served.
+	start := time.Now()
+	s, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture.Name, s.Name)
+	assert.True(time.Since(start) < time.Second, "lookup waited on the rate limiter")
+
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+	assert.EqualValues(1, cache.Stats().RateLimited)
+}
+
+func TestCacheRateLimitWaitsForTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Second}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	cache.SetRateLimit(20, 1)
+
+	// At 20 per second, five requests beyond the burst take about 250ms in total.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+	}
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 200*time.Millisecond, "requests were not limited: %v", elapsed)
+
+	assert.EqualValues(6, atomic.LoadInt32(backend.calls))
+	assert.EqualValues(0, cache.Stats().RateLimited)
+}
+
+func TestCacheWithoutRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.SetRateLimit(0, 1)
+
+	for i := 0; i < 20; i++ {
+		_, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+	}
+	assert.EqualValues(20, atomic.LoadInt32(backend.calls))
+	assert.EqualValues(0, cache.Stats().RateLimited)
+}
+
+func TestCacheRateLimitedMissIsNotRemembered(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond, NegativeTTL: time.Minute}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	cache.SetRateLimit(0.1, 1)
+
+	_, ok := cache.Secret("missing")
+	assert.False(ok)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.False(ok, "Expected the limiter to skip the request")
+
+	// Lifting the limit finds the secret, since a skipped request says nothing about existence.
+	cache.SetRateLimit(0, 1)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+}
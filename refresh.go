@@ -0,0 +1,398 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRefreshBackoff is the factor of the refresh interval up to which StartRefresh backs off,
+// unless SetRefreshMaxInterval is called.
+const defaultRefreshBackoff = 8
+
+// StartRefresh spawns a goroutine which re-fetches every cached secret from the backend every
+// interval, keeping frequently read secrets warm. Entries are only replaced when the backend
+// succeeds; failures leave the cached value intact.
+//
+// While the backend fails every refresh, the interval doubles after each round, up to the maximum
+// set by SetRefreshMaxInterval, and returns to interval once a refresh succeeds.
+//
+// The returned function stops the goroutine, as does Close. A secret being fetched when stop is
+// called is still completed. Calling stop more than once is safe.
+func (c *Cache) StartRefresh(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	c.refreshIn.Store(interval)
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		var failures int
+		for {
+			select {
+			case <-timer.C:
+				if c.refreshAll(done) {
+					if failures > 0 {
+						c.Infof("Refresh succeeded after %d failed rounds, refreshing every %v", failures, interval)
+					}
+					failures = 0
+				} else {
+					failures++
+				}
+				next := refreshBackoff(interval, c.refreshMaxInterval(interval), failures)
+				if failures > 0 && next != c.RefreshInterval() {
+					c.Warnf("Refresh failed %d rounds in a row, backing off to %v", failures, next)
+				}
+				c.refreshIn.Store(next)
+				timer.Reset(next)
+			case <-done:
+				return
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Refresh fetches a secret from the backend right away, regardless of the freshness of its cached
+// entry or of the backend having reported it missing, and updates the cache as a lookup would. It
+// is meant for a secret known to have just rotated. Unlike lookups, it never joins a request
+// already in flight, which may have started before the rotation. Returns a copy of the fetched
+// secret, or false if the backend failed within Timeouts.BackendTimeout, or denied or lacks the
+// secret.
+func (c *Cache) Refresh(name string) (*Secret, bool) {
+	name = c.resolveAlias(name)
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeouts().BackendTimeout)
+	defer cancel()
+	name = c.canonicalName(ctx, name)
+	if !c.Permits(name) {
+		c.Debugf("Secret excluded by name filter: %v", name)
+		return nil, false
+	}
+
+	c.Infof("Forcing refresh of %v", name)
+	secret, ok := c.fetchSecret(ctx, name)
+	var copied *Secret
+	if !ok || c.expired(*secret, c.clock()) || !c.withContent(secret, func(s *Secret) { copied = s.Clone() }) {
+		c.Warnf("Forced refresh of %v failed", name)
+		return nil, false
+	}
+	return copied, true
+}
+
+// SetRefreshMaxInterval sets the longest interval StartRefresh backs off to while the backend
+// fails. A max no longer than the refresh interval disables backing off. Zero, the default, means
+// eight times the refresh interval.
+func (c *Cache) SetRefreshMaxInterval(max time.Duration) {
+	c.refreshMax.Store(max)
+}
+
+// RefreshInterval returns the time StartRefresh waits before its next round, the refresh interval
+// unless backing off. Zero means StartRefresh was not called.
+func (c *Cache) RefreshInterval() time.Duration {
+	next, _ := c.refreshIn.Load().(time.Duration)
+	return next
+}
+
+// refreshMaxInterval returns the longest interval to back off to from interval.
+func (c *Cache) refreshMaxInterval(interval time.Duration) time.Duration {
+	if max, _ := c.refreshMax.Load().(time.Duration); max != 0 {
+		return max
+	}
+	return defaultRefreshBackoff * interval
+}
+
+// refreshBackoff returns interval doubled for each failure, up to max.
+func refreshBackoff(interval, max time.Duration, failures int) time.Duration {
+	if max <= interval {
+		return interval
+	}
+	next := interval
+	for i := 0; i < failures && next < max; i++ {
+		next *= 2
+	}
+	if next > max {
+		return max
+	}
+	return next
+}
+
+// refreshAll re-fetches each cached secret, returning early if done is closed. Returns false if
+// every refresh failed, as when the backend is down.
+func (c *Cache) refreshAll(done <-chan struct{}) (ok bool) {
+	values := c.secretMap.Values()
+	c.Debugf("Refreshing %d cached secrets", len(values))
+	var failed int
+	for _, v := range values {
+		select {
+		case <-done:
+			return true
+		case <-c.done:
+			return true
+		default:
+		}
+		if _, ok := c.refreshSecret(context.Background(), v.Secret.Name); !ok {
+			c.Debugf("Refresh failed, keeping cached value: %v", v.Secret.Name)
+			failed++
+		}
+	}
+	return len(values) == 0 || failed < len(values)
+}
+
+// PrefetchError reports secrets which Prefetch failed to fetch.
+type PrefetchError struct {
+	Failed []string // sorted names
+}
+
+func (e *PrefetchError) Error() string {
+	return fmt.Sprintf("Failed to prefetch %d secrets: %v", len(e.Failed), strings.Join(e.Failed, ", "))
+}
+
+// Prefetch warms the cache by fetching the content of every listed secret, with up to concurrency
+// requests at a time. A secret failing to fetch does not stop the others; failures are reported
+// together as a *PrefetchError, and ErrCacheClosed is returned once the cache is closed.
+func (c *Cache) Prefetch(concurrency int) error {
+	if c.isClosed() {
+		return ErrCacheClosed
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	secrets := c.SecretList()
+
+	names := make(chan string)
+	var failed []string
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if _, ok := c.refreshSecret(context.Background(), name); !ok {
+					lock.Lock()
+					failed = append(failed, name)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, s := range secrets {
+		if c.isClosed() {
+			break
+		}
+		names <- s.Name
+	}
+	close(names)
+	wg.Wait()
+	if c.isClosed() {
+		return ErrCacheClosed
+	}
+
+	c.Infof("Prefetched %d of %d secrets", len(secrets)-len(failed), len(secrets))
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return &PrefetchError{Failed: failed}
+	}
+	return nil
+}
+
+// StartWarmup prefetches every secret in the background, as Prefetch does, while serving cached
+// entries as fresh for up to grace. Entries restored by Load are then read without waiting for a
+// slow backend after startup. Normal freshness resumes once the prefetch completes or grace
+// passes. The returned channel receives the result of the prefetch.
+func (c *Cache) StartWarmup(grace time.Duration, concurrency int) <-chan error {
+	c.warmUntil.Store(c.clock().Add(grace))
+	done := make(chan error, 1)
+	go func() {
+		err := c.Prefetch(concurrency)
+		c.warmUntil.Store(time.Time{})
+		c.Infof("Warmup complete")
+		done <- err
+	}()
+	return done
+}
+
+// warming returns whether cached entries are served as fresh during a warmup.
+func (c *Cache) warming() bool {
+	until, _ := c.warmUntil.Load().(time.Time)
+	return c.clock().Before(until)
+}
+
+// refreshSecret fetches a secret from the backend, updating the cache on success. Requests are
+// shared with concurrent lookups of the same name, so a shared request is not bound to ctx: it runs
+// for up to BackendTimeout, and is cancelled early only once every lookup sharing it is cancelled.
+func (c *Cache) refreshSecret(ctx context.Context, name string) (*Secret, bool) {
+	return c.flight.do(ctx, name, c.fetchSecretWithTimeout(name))
+}
+
+// revalidate starts a background refresh of a secret, unless one is already in flight. Returns
+// whether a refresh was started.
+func (c *Cache) revalidate(name string) bool {
+	return c.flight.start(name, c.fetchSecretWithTimeout(name))
+}
+
+// fetchSecretWithTimeout returns a function fetching a secret as fetchSecret does, giving up after
+// BackendTimeout.
+func (c *Cache) fetchSecretWithTimeout(name string) func(context.Context) (*Secret, bool) {
+	return func(ctx context.Context) (*Secret, bool) {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeouts().BackendTimeout)
+		defer cancel()
+		return c.fetchSecret(ctx, name)
+	}
+}
+
+// fetchSecret requests a secret from the backend and updates the cache on success. A secret
+// failing validation is not cached, and the cached value, if any, is returned instead. The outcome
+// is recorded by the circuit breaker, which may skip the request altogether, as may the rate and
+// concurrency limits.
+func (c *Cache) fetchSecret(ctx context.Context, name string) (*Secret, bool) {
+	if c.isClosed() {
+		return nil, false
+	}
+	if !c.limit(ctx, name) {
+		return nil, false
+	}
+	release, ok := c.admit(ctx, name)
+	if !ok {
+		return nil, false
+	}
+	defer release()
+	if !c.breaker.allow(c.clock()) {
+		c.Debugf("Circuit breaker open, skipping backend: %v", name)
+		count(&c.stats.shortCircuits)
+		return nil, false
+	}
+
+	count(&c.stats.backendCalls)
+	start := time.Now()
+	secret, notModified, status, ok := c.requestSecret(ctx, name)
+	elapsed := time.Since(start)
+	c.stats.latency.observe(elapsed)
+	c.stats.secretLatency.observe(elapsed)
+	switch {
+	case ok:
+		c.breaker.success()
+		c.contacted(&c.stats.lastSecret)
+		if notModified {
+			c.found(name)
+			break
+		}
+		return c.storeSecret(name, secret)
+	case status == http.StatusForbidden: // The backend no longer lets the client read the secret.
+		count(&c.stats.backendErrors)
+		c.breaker.success()
+		c.contacted(&c.stats.lastSecret)
+		c.notFound.remove(name)
+		c.stale.remove(name)
+		c.forbidden.add(name, c.clock(), c.Timeouts().NegativeTTL)
+		if c.secretMap.Delete(name) {
+			c.publish(SecretRemoved, name)
+		}
+	case ctx.Err() != nil:
+		c.breaker.ignore()
+	case status == 0, status >= 500, status == statusUnknown && c.secretMap.Contains(name):
+		// No answer, a server failure, or a known secret failing, which is not taken as a deletion.
+		count(&c.stats.backendErrors)
+		c.breaker.failure(c.clock())
+	case status == http.StatusNotFound: // The backend answered, so it is healthy.
+		count(&c.stats.backendErrors)
+		c.breaker.success()
+		c.contacted(&c.stats.lastSecret)
+		c.missing(name)
+	case status == statusUnknown: // The backend cannot tell a missing secret from an error.
+		count(&c.stats.backendErrors)
+		c.breaker.ignore()
+		c.missing(name)
+	default: // The backend answered without saying whether the secret exists.
+		count(&c.stats.backendErrors)
+		c.breaker.ignore()
+	}
+	return secret, ok
+}
+
+// found forgets that name was reported missing, forbidden, or served stale, once the backend
+// answered with the secret.
+func (c *Cache) found(name string) {
+	c.notFound.remove(name)
+	c.forbidden.remove(name)
+	c.stale.remove(name)
+}
+
+// missing remembers that the backend reported name not found, for NegativeTTL. A cached secret is
+// still served, rather than removed on a single answer.
+func (c *Cache) missing(name string) {
+	if c.secretMap.Contains(name) {
+		return
+	}
+	c.forbidden.remove(name)
+	if ttl := c.Timeouts().NegativeTTL; ttl > 0 {
+		c.notFound.add(name, c.clock(), ttl)
+	}
+}
+
+// storeSecret caches a secret the backend answered with. Unless its conflict policy is
+// ConflictBackendWins, a secret failing validation is not cached, and the cached value, if any, is
+// returned instead.
+func (c *Cache) storeSecret(name string, secret *Secret) (*Secret, bool) {
+	c.found(name)
+	if err := c.validate(*secret); err != nil {
+		policy := c.conflicts.get(name)
+		if policy != ConflictBackendWins {
+			return c.rejectSecret(name, policy, err)
+		}
+		c.Warnf("Caching secret %v despite failed validation, under the %v policy: %v", name, policy, err)
+	}
+	stored := *secret
+	stored.Content = secret.Content.clone() // The cache zeroes its copy, not the caller's.
+	added, changed := c.secretMap.putChanged(name, stored)
+	if c.isClosed() { // Close may have zeroed the cache before the secret was stored.
+		c.secretMap.Delete(name)
+		return secret, true
+	}
+	if added {
+		c.publish(SecretAdded, name)
+	} else if changed {
+		c.changed(name)
+	}
+	return secret, true
+}
+
+// requestSecret requests a secret from the backend, conditionally on the ETag of its cached entry,
+// returning the status of the response as StatusSecretFetcher does. If the backend reports the
+// secret not modified, the entry's timestamp is refreshed and a copy of it is returned.
+func (c *Cache) requestSecret(ctx context.Context, name string) (secret *Secret, notModified bool, status int, ok bool) {
+	etag := c.secretMap.etag(name)
+	secret, notModified, status, ok = c.fetcher.SecretWithStatusCtx(ctx, name, etag)
+	if !ok || !notModified {
+		return secret, false, status, ok
+	}
+	if cached, touched := c.secretMap.touch(name, etag); touched {
+		c.Debugf("Secret not modified: %v", name)
+		return &cached.Secret, true, status, true
+	}
+	// The entry changed or left the cache during the request, so fetch the content again.
+	secret, _, status, ok = c.fetcher.SecretWithStatusCtx(ctx, name, "")
+	return secret, false, status, ok
+}
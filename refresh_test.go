@@ -0,0 +1,308 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheRefreshReplacesEntriesOnTick(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+	fixture2.Name = fixture1.Name
+
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+
+	// Fresh for an hour, so lookups only see what the refresh stored.
+	timeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*fixture1)
+
+	stop := cache.StartRefresh(time.Millisecond)
+	defer stop()
+
+	secretc <- fixture2
+	assert.True(eventually(func() bool {
+		secret, ok := cache.Secret(fixture1.Name)
+		return ok && secret.Owner == fixture2.Owner && len(secretc) == 0
+	}, time.Second))
+
+	stop()
+	stop() // safe to call twice
+}
+
+func TestCacheRefreshKeepsEntriesOnFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*secretFixture)
+
+	stop := cache.StartRefresh(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+
+	assert.Equal(1, cache.Len())
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+}
+
+func TestCacheRefreshBacksOffWhileFailing(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	failing := int32(1)
+	backend := SwitchBackend{secret: secretFixture, failing: &failing, calls: new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*secretFixture)
+	cache.SetRefreshMaxInterval(40 * time.Millisecond)
+	assert.Zero(cache.RefreshInterval())
+
+	stop := cache.StartRefresh(5 * time.Millisecond)
+	defer stop()
+	assert.Equal(5*time.Millisecond, cache.RefreshInterval())
+
+	// The interval doubles with each failed round, up to the maximum.
+	var seen []time.Duration
+	assert.True(eventually(func() bool {
+		interval := cache.RefreshInterval()
+		if len(seen) == 0 || seen[len(seen)-1] != interval {
+			seen = append(seen, interval)
+		}
+		return interval == 40*time.Millisecond
+	}, time.Second))
+	assert.Equal([]time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}, seen)
+
+	// Fewer requests are made while backed off.
+	start := atomic.LoadInt32(backend.calls)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(atomic.LoadInt32(backend.calls)-start <= 4, "Expected at most one request per backed off round")
+
+	atomic.StoreInt32(&failing, 0)
+	assert.True(eventually(func() bool {
+		return cache.RefreshInterval() == 5*time.Millisecond
+	}, time.Second), "Expected the interval to reset once a refresh succeeds")
+}
+
+func TestRefreshDoesNotBackOffWithoutMaximum(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*secretFixture)
+	cache.SetRefreshMaxInterval(time.Millisecond)
+
+	stop := cache.StartRefresh(2 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	assert.Equal(2*time.Millisecond, cache.RefreshInterval())
+}
+
+func TestRefreshReportsChangedContent(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	updated := *secretFixture
+	updated.Content = []byte("rotated")
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	changes := make(chan string, 2)
+	cache.SetOnChange(func(name string) { changes <- name })
+
+	// The first fetch and unchanged content are not changes.
+	cache.Secret(secretFixture.Name)
+	cache.Secret(secretFixture.Name)
+
+	backend.secrets[secretFixture.Name] = &updated
+	cache.Secret(secretFixture.Name)
+
+	select {
+	case name := <-changes:
+		assert.Equal(secretFixture.Name, name)
+	case <-time.After(time.Second):
+		t.Fatal("Change was not reported")
+	}
+	select {
+	case name := <-changes:
+		t.Errorf("Unexpected change reported: %v", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRefreshReplacesEntryWithNewVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	secretFixture.Version = "1"
+	rotated := *secretFixture
+	rotated.Version = "2"
+	backend := CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)}
+
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	changes := make(chan string, 1)
+	cache.SetOnChange(func(name string) { changes <- name })
+	cache.Secret(secretFixture.Name)
+
+	// The same content under a new version is a rotation.
+	backend.secrets[secretFixture.Name] = &rotated
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal("2", secret.Version)
+	assert.Equal(secretFixture.Content, secret.Content)
+
+	select {
+	case name := <-changes:
+		assert.Equal(secretFixture.Name, name)
+	case <-time.After(time.Second):
+		t.Fatal("Change was not reported")
+	}
+
+	// A listing with a newer version replaces the cached entry rather than keeping its content.
+	listed := rotated
+	listed.Version = "3"
+	listed.Content = nil
+	backend.secrets[secretFixture.Name] = &listed
+	list := cache.SecretList()
+	if assert.Len(list, 1) {
+		assert.Equal("3", list[0].Version)
+	}
+	select {
+	case name := <-changes:
+		assert.Equal(secretFixture.Name, name)
+	case <-time.After(time.Second):
+		t.Fatal("Change was not reported")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	fixture2, _ := keywhizfs.ParseSecret(fixture("secretNormalOwner.json"))
+
+	secretc := make(chan *keywhizfs.Secret, 2)
+	secretListc := make(chan []keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc, secretListc: secretListc}
+	secretListc <- []keywhizfs.Secret{{Name: fixture1.Name}, {Name: fixture2.Name}}
+	secretc <- fixture1
+	secretc <- fixture2
+
+	cacheTimeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	assert.NoError(cache.Prefetch(2))
+	assert.Equal([]string{fixture1.Name, fixture2.Name}, cache.Keys())
+
+	// Both contents are cached. Requests run concurrently, so either may be stored under either name.
+	var contents []string
+	for _, name := range cache.Keys() {
+		s, ok := cache.Secret(name)
+		assert.True(ok)
+		contents = append(contents, string(s.Content))
+	}
+	assert.Contains(contents, string(fixture1.Content))
+	assert.Contains(contents, string(fixture2.Content))
+}
+
+func TestCachePrefetchReportsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := ListingBackend{
+		CountingBackend: CountingBackend{secrets: map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, calls: new(int32)},
+		names:           []string{"missing", secretFixture.Name, "absent"},
+	}
+
+	cacheTimeouts := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+	err := cache.Prefetch(4)
+	if assert.IsType(&keywhizfs.PrefetchError{}, err) {
+		assert.Equal([]string{"absent", "missing"}, err.(*keywhizfs.PrefetchError).Failed)
+	}
+
+	s, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture.Content, s.Content)
+}
+
+// ListingBackend lists names, some of which its CountingBackend may not serve.
+type ListingBackend struct {
+	CountingBackend
+	names []string
+}
+
+func (b ListingBackend) SecretList() ([]keywhizfs.Secret, bool) {
+	var secrets []keywhizfs.Secret
+	for _, name := range b.names {
+		secrets = append(secrets, keywhizfs.Secret{Name: name})
+	}
+	return secrets, true
+}
+
+func TestCacheForcedRefreshBypassesFreshness(t *testing.T) {
+	assert := assert.New(t)
+
+	secrets := map[string]*keywhizfs.Secret{"foo": {Name: "foo", Content: []byte("old"), Version: "1"}}
+	backend := CountingBackend{secrets: secrets, calls: new(int32)}
+	fresh := keywhizfs.Timeouts{Fresh: time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache := keywhizfs.NewCache(backend, fresh, logConfig)
+
+	s, _ := cache.Secret("foo")
+	assert.EqualValues("old", s.Content)
+	secrets["foo"] = &keywhizfs.Secret{Name: "foo", Content: []byte("new"), Version: "2"}
+	s, _ = cache.Secret("foo")
+	assert.EqualValues("old", s.Content, "Expected the fresh entry to be served")
+
+	s, ok := cache.Refresh("foo")
+	assert.True(ok)
+	assert.EqualValues("new", s.Content)
+	s, _ = cache.Secret("foo")
+	assert.EqualValues("new", s.Content, "Expected the refresh to update the cache")
+	assert.EqualValues(2, atomic.LoadInt32(backend.calls))
+
+	_, ok = cache.Refresh("missing")
+	assert.False(ok)
+
+	// Forced refreshes are safe alongside lookups.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var s *keywhizfs.Secret
+				if i%2 == 0 {
+					s, _ = cache.Refresh("foo")
+				} else {
+					s, _ = cache.Secret("foo")
+				}
+				if assert.NotNil(s) {
+					assert.EqualValues("new", s.Content)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// defaultRootMode is the permission bits of the base directory unless RootMode is set. Writability
+// is necessary for .clear_cache.
+const defaultRootMode = 0755
+
+// ParseRootMode parses an octal permission mode for the base directory, such as "0750".
+func ParseRootMode(s string) (uint32, error) {
+	mode, err := strconv.ParseUint(s, 8 /* base */, 32 /* bits */)
+	if err != nil || mode > 0777 || mode == 0 {
+		return 0, fmt.Errorf("invalid root mode '%v', expected octal permissions such as 0750", s)
+	}
+	return uint32(mode), nil
+}
+
+// ParseRootOwner resolves an owner of the base directory given as "user" or "user:group". The
+// group defaults to defaultGroup. Unknown names fall back like NewOwnership.
+func ParseRootOwner(s, defaultGroup string) Ownership {
+	username, groupname := s, defaultGroup
+	if i := strings.Index(s, ":"); i >= 0 {
+		username, groupname = s[:i], s[i+1:]
+	}
+	return NewOwnership(username, groupname)
+}
+
+// rootAttr constructs the fuse.Attr of the base directory, with RootMode and RootOwnership.
+func (kwfs KeywhizFs) rootAttr(subdirCount uint32) *fuse.Attr {
+	attr := kwfs.directoryAttr(subdirCount, kwfs.rootMode())
+	if kwfs.RootOwnership != nil {
+		attr.Uid, attr.Gid = kwfs.RootOwnership.Uid, kwfs.RootOwnership.Gid
+	}
+	return attr
+}
+
+func (kwfs KeywhizFs) rootMode() uint32 {
+	if kwfs.RootMode == 0 {
+		return defaultRootMode
+	}
+	return kwfs.RootMode
+}
+
+// rootPermitted returns whether the caller may access the base directory for want, a combination
+// of the R_OK, W_OK, and X_OK bits, judged by its mode like the kernel would. Root is always
+// permitted. Only the caller's primary group is considered.
+func (kwfs KeywhizFs) rootPermitted(want uint32, context *fuse.Context) bool {
+	if context == nil {
+		kwfs.Warnf("Denied access to base directory without a caller")
+		return false
+	}
+	if context.Uid == 0 {
+		return true
+	}
+	attr := kwfs.rootAttr(0)
+	bits := attr.Mode & 07 // other
+	switch {
+	case context.Uid == attr.Uid:
+		bits = attr.Mode >> 6 & 07
+	case context.Gid == attr.Gid:
+		bits = attr.Mode >> 3 & 07
+	}
+	if bits&want != want {
+		kwfs.Warnf("Denied access to base directory by uid %d, with gid %d", context.Uid, context.Gid)
+		return false
+	}
+	return true
+}
+
+// Access is a FUSE function which checks whether the caller may access a file. Access to the base
+// directory is judged by its mode, and other files are left to the kernel's permission checks.
+func (kwfs KeywhizFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if name != "" {
+		return kwfs.FileSystem.Access(name, mode, context)
+	}
+	if !kwfs.rootPermitted(mode&07, context) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Sanitization determines how characters of secret names which are unsafe in file names are
+// encoded. Encoded characters are replaced by '%' and two uppercase hexadecimal digits per byte.
+type Sanitization int
+
+const (
+	// SanitizeNone uses secret names as file names unchanged.
+	SanitizeNone Sanitization = iota
+	// SanitizePercent encodes '/', '%', control characters, and a leading '.'.
+	SanitizePercent
+	// SanitizeStrict encodes every byte other than ASCII letters, digits, '-', '_', and a '.' which
+	// does not lead the name.
+	SanitizeStrict
+)
+
+// ParseSanitization returns the Sanitization named by s, either "none", "percent", or "strict".
+func ParseSanitization(s string) (Sanitization, error) {
+	switch s {
+	case "none":
+		return SanitizeNone, nil
+	case "percent":
+		return SanitizePercent, nil
+	case "strict":
+		return SanitizeStrict, nil
+	}
+	return SanitizeNone, fmt.Errorf("unknown sanitization '%v'", s)
+}
+
+func (s Sanitization) String() string {
+	switch s {
+	case SanitizeNone:
+		return "none"
+	case SanitizePercent:
+		return "percent"
+	case SanitizeStrict:
+		return "strict"
+	}
+	return fmt.Sprintf("Sanitization(%d)", int(s))
+}
+
+// encode returns the file name of the secret name.
+func (s Sanitization) encode(name string) string {
+	if s == SanitizeNone {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; s.safe(c) && (i > 0 || c != '.') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decode returns the secret name of a file name. Returns false if fileName is not the encoding of
+// any name, so that each secret has exactly one file name.
+func (s Sanitization) decode(fileName string) (string, bool) {
+	if s == SanitizeNone {
+		return fileName, true
+	}
+	name, err := url.PathUnescape(fileName)
+	if err != nil || s.encode(name) != fileName {
+		return "", false
+	}
+	return name, true
+}
+
+// safe returns whether c is left unencoded.
+func (s Sanitization) safe(c byte) bool {
+	if s == SanitizeStrict {
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.'
+	}
+	return c != '/' && c != '%' && c >= 0x20 && c != 0x7f
+}
+
+// fileName returns the file name of a secret under the current sanitization.
+func (kwfs KeywhizFs) fileName(name string) string {
+	return kwfs.Sanitization.encode(name)
+}
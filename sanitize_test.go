@@ -0,0 +1,138 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// unsafeNames are secret names which are unsafe or awkward as file names.
+var unsafeNames = []string{"team/db", "db password", "café", "100%", ".hidden"}
+
+var rootContext = &fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 0}}
+
+// newUnsafeNameFs returns a KeywhizFs whose server holds secrets named unsafeNames, each with its
+// name as content.
+func newUnsafeNameFs(t *testing.T, sanitization keywhizfs.Sanitization) (*keywhizfs.KeywhizFs, func()) {
+	secret := func(name string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "secret": base64.StdEncoding.EncodeToString([]byte(name))}
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/secrets" {
+			var secrets []map[string]interface{}
+			for _, name := range unsafeNames {
+				secrets = append(secrets, secret(name))
+			}
+			json.NewEncoder(w).Encode(secrets)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/secret/")
+		for _, n := range unsafeNames {
+			if n == name {
+				json.NewEncoder(w).Encode(secret(name))
+				return
+			}
+		}
+		w.WriteHeader(404)
+	}))
+
+	timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: time.Second, BackendTimeout: time.Second}
+	client := keywhizfs.NewClient(clientFile, clientFile, caFile, server.URL, time.Second, logConfig, false)
+	kwfs, _, err := keywhizfs.NewKeywhizFs(&client, keywhizfs.Ownership{}, timeouts, logConfig)
+	assert.NoError(t, err)
+	kwfs.Sanitization = sanitization
+	return kwfs, server.Close
+}
+
+func TestSanitizedFileNames(t *testing.T) {
+	cases := []struct {
+		sanitization keywhizfs.Sanitization
+		files        map[string]string // file name -> secret name
+	}{
+		{keywhizfs.SanitizePercent, map[string]string{
+			"team%2Fdb":   "team/db",
+			"db password": "db password",
+			"café":        "café",
+			"100%25":      "100%",
+			"%2Ehidden":   ".hidden",
+		}},
+		{keywhizfs.SanitizeStrict, map[string]string{
+			"team%2Fdb":     "team/db",
+			"db%20password": "db password",
+			"caf%C3%A9":     "café",
+			"100%25":        "100%",
+			"%2Ehidden":     ".hidden",
+		}},
+	}
+
+	for _, c := range cases {
+		assert := assert.New(t)
+		kwfs, stop := newUnsafeNameFs(t, c.sanitization)
+
+		entries, status := kwfs.OpenDir("", rootContext)
+		assert.Equal(fuse.OK, status)
+		listed := make(map[string]bool)
+		for _, e := range entries {
+			listed[e.Name] = true
+		}
+
+		for file, name := range c.files {
+			assert.True(listed[file], "%v: expected %v to be listed", c.sanitization, file)
+			f, status := kwfs.Open(file, 0, rootContext)
+			if assert.Equal(fuse.OK, status, "%v: expected %v to open", c.sanitization, file) {
+				buf := make([]byte, 100)
+				res, _ := f.Read(buf, 0)
+				data, _ := res.Bytes(buf)
+				assert.Equal(name, string(data))
+			}
+			_, status = kwfs.GetAttr(".json/secret/"+file, rootContext)
+			assert.Equal(fuse.OK, status, "%v: expected .json/secret/%v to exist", c.sanitization, file)
+		}
+		stop()
+	}
+}
+
+func TestSanitizedFileNamesAreUnique(t *testing.T) {
+	assert := assert.New(t)
+	kwfs, stop := newUnsafeNameFs(t, keywhizfs.SanitizePercent)
+	defer stop()
+
+	for _, file := range []string{"db%20password", "100%", "100%25x", "team%2fdb", ".hidden", "%"} {
+		_, status := kwfs.GetAttr(file, rootContext)
+		assert.Equal(fuse.ENOENT, status, "Expected %v not to resolve to a secret", file)
+	}
+}
+
+func TestParseSanitization(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range []string{"none", "percent", "strict"} {
+		sanitization, err := keywhizfs.ParseSanitization(name)
+		assert.NoError(err)
+		assert.Equal(name, sanitization.String())
+	}
+	_, err := keywhizfs.ParseSanitization("base64")
+	assert.Error(err)
+}
@@ -15,8 +15,11 @@
 package keywhizfs
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -26,20 +29,89 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// ParseSecret deserializes raw JSON into a Secret struct.
+// Errors returned by ParseSecret and ParseSecretList, wrapped with details, to be matched with
+// errors.Is.
+var (
+	// ErrInvalidJSON reports data which is not JSON of the expected shape.
+	ErrInvalidJSON = errors.New("invalid JSON")
+	// ErrMissingName reports a secret without a name.
+	ErrMissingName = errors.New("missing secret name")
+	// ErrBadContentEncoding reports content which cannot be decoded according to its encoding.
+	ErrBadContentEncoding = errors.New("bad secret content encoding")
+	// ErrUnknownEncoding reports an encoding other than EncodingBase64 or EncodingRaw.
+	ErrUnknownEncoding = errors.New("unknown secret encoding")
+	// ErrUnknownFormat reports a format unknown to Formatted.
+	ErrUnknownFormat = errors.New("unknown secret format")
+	// ErrChecksumMismatch reports content which does not match its checksum.
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+	// ErrSecretTooLarge reports content exceeding the size limit of ParseSecretWithLimit or of a
+	// Client.
+	ErrSecretTooLarge = errors.New("secret too large")
+)
+
+// secretErrors are the errors ParseSecret reports other than ErrInvalidJSON.
+var secretErrors = []error{ErrMissingName, ErrBadContentEncoding, ErrUnknownEncoding, ErrUnknownFormat, ErrChecksumMismatch, ErrSecretTooLarge}
+
+// ParseSecret deserializes raw JSON into a Secret struct. If the secret carries both content and
+// a checksum, the content is verified against the checksum. Errors wrap one of ErrInvalidJSON,
+// ErrMissingName, ErrBadContentEncoding, ErrUnknownEncoding, ErrUnknownFormat, or
+// ErrChecksumMismatch.
 func ParseSecret(data []byte) (s *Secret, err error) {
 	if err = json.Unmarshal(data, &s); err != nil {
-		return nil, fmt.Errorf("Fail to deserialize JSON Secret: %v", err)
+		if !isSecretError(err) {
+			err = fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+		}
+		return nil, fmt.Errorf("Fail to deserialize JSON Secret: %w", err)
+	}
+	if s != nil && s.Name == "" {
+		return nil, fmt.Errorf("Fail to deserialize JSON Secret: %w", ErrMissingName)
+	}
+	if s != nil && s.Checksum != "" && len(s.Content) > 0 {
+		if err = s.Verify(); err != nil {
+			return nil, err
+		}
 	}
 	return
 }
 
-// ParseSecretList deserializes raw JSON into a list of Secret structs.
+// ParseSecretWithLimit deserializes a secret like ParseSecret, returning an error wrapping
+// ErrSecretTooLarge if its content is longer than maxSize bytes. A maxSize of zero or less means no
+// limit.
+func ParseSecretWithLimit(data []byte, maxSize int) (*Secret, error) {
+	s, err := ParseSecret(data)
+	if err == nil && s != nil && maxSize > 0 && len(s.Content) > maxSize {
+		s.Content.wipe()
+		return nil, fmt.Errorf("%w: %v has %d bytes, limit is %d", ErrSecretTooLarge, s.Name, len(s.Content), maxSize)
+	}
+	return s, err
+}
+
+func isSecretError(err error) bool {
+	for _, target := range secretErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSecretList deserializes a raw JSON array into a list of Secret structs. Each element is
+// handled as by ParseSecret, and errors identify the index of the offending element.
 func ParseSecretList(data []byte) (secrets []Secret, err error) {
-	if err = json.Unmarshal(data, &secrets); err != nil {
-		return nil, fmt.Errorf("Fail to deserialize JSON []Secret: %v", err)
+	var elements []json.RawMessage
+	if err = json.Unmarshal(data, &elements); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize JSON []Secret: %w: %v", ErrInvalidJSON, err)
 	}
-	return
+
+	secrets = make([]Secret, 0, len(elements))
+	for i, element := range elements {
+		s, err := ParseSecret(element)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to deserialize JSON []Secret at index %d: %w", i, err)
+		}
+		secrets = append(secrets, *s)
+	}
+	return secrets, nil
 }
 
 // Secret represents data returned after processing a server request.
@@ -50,10 +122,143 @@ type Secret struct {
 	Content     content   `json:"secret"`
 	Length      uint64    `json:"secretLength"`
 	CreatedAt   time.Time `json:"creationDate"`
+	UpdatedAt   time.Time `json:"updateDate"`
 	IsVersioned bool
 	Mode        string
 	Owner       string
 	Group       string
+	// Groups names the Keywhiz groups the secret belongs to, arranging it with LayoutByGroup.
+	Groups []string `json:"groups,omitempty"`
+	// TTL optionally overrides the cache freshness threshold for this secret. It is expressed in
+	// seconds in JSON.
+	TTL time.Duration `json:"ttl"`
+	// Checksum is the hex-encoded SHA-256 digest of the decoded content.
+	Checksum string
+	// ExpiresAt is when the secret stops being valid. The zero value means it never expires.
+	ExpiresAt time.Time `json:"expiry"`
+	// Encoding describes how content is represented in JSON: "base64" (the default) or "raw".
+	Encoding string `json:"encoding,omitempty"`
+	// Format optionally transforms the content when read from the filesystem. See Formatted.
+	Format string `json:"format,omitempty"`
+	// Version identifies a revision of the secret, changing whenever the secret rotates.
+	Version string `json:"version,omitempty"`
+	// ETag is the validator of the HTTP response carrying the secret, if the server sent one.
+	ETag string `json:"etag,omitempty"`
+	// Type optionally names the kind of content, selecting the Validator applied before caching.
+	Type string `json:"type,omitempty"`
+	// Bundle optionally names a set of secrets which are replaced together, such as a certificate
+	// and its key. See Cache.Bundle.
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// Clone returns a deep copy of the secret, sharing neither its content nor its groups, so either
+// may be modified without affecting the other.
+func (s Secret) Clone() *Secret {
+	s.Content = s.Content.clone()
+	if s.Groups != nil {
+		s.Groups = append([]string(nil), s.Groups...)
+	}
+	return &s
+}
+
+// ModifiedAt returns when the secret was last updated, or its creation time if it never was.
+func (s Secret) ModifiedAt() time.Time {
+	if s.UpdatedAt.IsZero() {
+		return s.CreatedAt
+	}
+	return s.UpdatedAt
+}
+
+// Content encodings understood by ParseSecret.
+const (
+	EncodingBase64 = "base64"
+	EncodingRaw    = "raw"
+)
+
+// secretFields has the fields of Secret without its JSON methods, to allow default decoding of
+// fields which need no conversion.
+type secretFields Secret
+
+// UnmarshalJSON decodes a Secret, converting the ttl from seconds and decoding content according
+// to its encoding.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		*secretFields
+		Content json.RawMessage `json:"secret"`
+		TTL     *float64        `json:"ttl"`
+	}{secretFields: (*secretFields)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	if aux.TTL != nil {
+		s.TTL = time.Duration(*aux.TTL * float64(time.Second))
+	}
+	if err := checkFormat(s.Format); err != nil {
+		return err
+	}
+
+	if len(aux.Content) == 0 || string(aux.Content) == "null" {
+		return nil
+	}
+	switch s.Encoding {
+	case "", EncodingBase64:
+		return s.Content.UnmarshalJSON(aux.Content)
+	case EncodingRaw:
+		var raw string
+		if err := json.Unmarshal(aux.Content, &raw); err != nil {
+			return fmt.Errorf("%w: secret should be a string (%v)", ErrBadContentEncoding, err)
+		}
+		s.Content = content(raw)
+		return nil
+	default:
+		return fmt.Errorf("%w '%v'", ErrUnknownEncoding, s.Encoding)
+	}
+}
+
+// MarshalJSON encodes a Secret in the same form accepted by UnmarshalJSON.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	var c interface{} = []byte(s.Content)
+	if s.Encoding == EncodingRaw {
+		c = string(s.Content)
+	}
+	aux := struct {
+		secretFields
+		Content interface{} `json:"secret"`
+		TTL     float64     `json:"ttl,omitempty"`
+	}{secretFields(s), c, s.TTL.Seconds()}
+	return json.Marshal(aux)
+}
+
+// ContentLength returns the size in bytes of the decoded content. Secrets fetched without content,
+// such as those from a listing, report the length given by the server.
+func (s Secret) ContentLength() int {
+	if len(s.Content) == 0 {
+		return int(s.Length)
+	}
+	return len(s.Content)
+}
+
+// Expired returns whether the secret has an expiration at or before now.
+func (s Secret) Expired(now time.Time) bool {
+	return s.ExpiredWithSkew(now, 0)
+}
+
+// ExpiredWithSkew returns whether the secret has an expiration at or before now, tolerating a
+// clock skew of skew. A positive skew postpones the expiration, so a slow clock does not hide a
+// secret early, at the cost of serving it up to skew too long; a negative skew advances it.
+func (s Secret) ExpiredWithSkew(now time.Time, skew time.Duration) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt.Add(skew))
+}
+
+// Verify recomputes the SHA-256 digest of the content and compares it to the stored checksum.
+func (s Secret) Verify() error {
+	sum := sha256.Sum256(s.Content)
+	actual := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(actual, s.Checksum) {
+		return fmt.Errorf("%w for secret %v: expected '%v', got '%v'", ErrChecksumMismatch, s.Name, s.Checksum, actual)
+	}
+	return nil
 }
 
 // ModeValue function helps by converting a textual mode to the expected value for fuse.
@@ -73,10 +278,36 @@ func (s Secret) ModeValue() uint32 {
 // content is a helper type used to convert base64-encoded data from the server.
 type content []byte
 
+// Format redacts content whenever it is formatted, so secrets never reach logs.
+func (c content) Format(f fmt.State, verb rune) {
+	fmt.Fprintf(f, "[REDACTED %d bytes]", len(c))
+}
+
+// clone returns a copy of content with its own backing array.
+func (c content) clone() content {
+	if c == nil {
+		return nil
+	}
+	return append(content(nil), c...)
+}
+
+// wipe overwrites content with zeros. This is best-effort: copies made elsewhere, including by the
+// runtime, are not affected.
+func (c content) wipe() {
+	for i := range c {
+		c[i] = 0
+	}
+}
+
+// sameArray returns whether c and other share a backing array.
+func (c content) sameArray(other content) bool {
+	return cap(c) > 0 && cap(other) > 0 && &c[:cap(c)][cap(c)-1] == &other[:cap(other)][cap(other)-1]
+}
+
 func (c *content) UnmarshalJSON(data []byte) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
-		return fmt.Errorf("secret should be a string, got '%s' (%v)", data, err)
+		return fmt.Errorf("%w: secret should be a string (%v)", ErrBadContentEncoding, err)
 	}
 
 	// Go's base64 requires padding to be present so we add it if necessary.
@@ -86,7 +317,7 @@ func (c *content) UnmarshalJSON(data []byte) error {
 
 	decoded, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		return fmt.Errorf("secret not valid base64, got '%+v' (%v)", s, err)
+		return fmt.Errorf("%w: secret not valid base64 (%v)", ErrBadContentEncoding, err)
 	}
 
 	*c = decoded
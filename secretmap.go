@@ -15,13 +15,50 @@
 package keywhizfs
 
 import (
+	"bytes"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// secretMapShards is the number of independently locked shards of a SecretMap.
+const secretMapShards = 16
+
 // SecretMap is a thread-safe map for storing key -> secret mapping.
+//
+// Entries are spread over shards by a hash of their key, each with its own lock, so concurrent
+// lookups and updates of different secrets rarely contend. Operations spanning every entry, such as
+// Values and Len, lock all shards so they see a consistent view.
+//
+// A SecretMap may be bounded to a maximum number of entries, in which case the least recently
+// used entry is evicted when a new entry would exceed the limit. Recency is tracked with an
+// intrusive doubly-linked list per shard, ordered by a use counter shared by the shards, so
+// lookups stay O(1) and evictions O(shards). Inserting while below the limit locks only the shard
+// of the new entry; only an insert which must evict locks every shard.
+//
+// The map owns the content of stored secrets, so callers must not modify or retain content they
+// store. Content is zeroed when its entry is replaced, deleted, evicted, or overwritten, to limit
+// how long secrets linger in memory. Get and Values return copies which are unaffected, while the
+// cache itself reads content in place, under the lock of its shard, so that lookups leave no copies
+// behind. Entries
+// are replaced whole under the write lock, so a reader sees either the old or the new content of a
+// secret, never a mix.
 type SecretMap struct {
-	m    map[string]SecretTime
+	uses        uint64 // first, so 64-bit atomic operations are aligned; last use of any entry
+	size        int64  // count of entries, updated under the lock of the shard changed
+	shards      [secretMapShards]secretShard
+	maxEntries  int // zero means unbounded
+	onEvict     func(SecretTime)
+	now         func() time.Time // source of insertion timestamps
+	lockContent bool             // move stored content to memory locked against swapping
+	onLockError func(error)
+}
+
+// secretShard holds the entries of a SecretMap whose keys hash to it.
+type secretShard struct {
+	m    map[string]*secretEntry
+	root *secretEntry // sentinel of the recency list; root.next is most recently used
 	lock sync.RWMutex
 }
 
@@ -31,63 +68,453 @@ type SecretTime struct {
 	Time   time.Time
 }
 
-// NewSecretMap initializes a new SecretMap.
+// secretEntry is a SecretTime linked into the recency list of a shard.
+type secretEntry struct {
+	SecretTime
+	key        string
+	used       uint64 // value of SecretMap.uses when last used
+	locked     bool   // content is held by lockContent
+	prev, next *secretEntry
+}
+
+// NewSecretMap initializes a new, unbounded SecretMap.
 func NewSecretMap() *SecretMap {
-	return &SecretMap{make(map[string]SecretTime), sync.RWMutex{}}
+	return NewSecretMapWithLimit(0)
+}
+
+// NewSecretMapWithLimit initializes a new SecretMap holding at most maxEntries values. A
+// maxEntries of zero or less leaves the map unbounded.
+func NewSecretMapWithLimit(maxEntries int) *SecretMap {
+	if maxEntries < 0 {
+		maxEntries = 0
+	}
+	m := &SecretMap{maxEntries: maxEntries, now: time.Now}
+	for i := range m.shards {
+		root := &secretEntry{}
+		root.prev, root.next = root, root
+		m.shards[i] = secretShard{m: make(map[string]*secretEntry), root: root}
+	}
+	return m
 }
 
-// Get retrieves a values from the map and indicates if the lookup was ok.
+// Get retrieves a values from the map and indicates if the lookup was ok. A successful lookup
+// marks the entry as most recently used. The content is copied; internal callers borrow it with
+// view instead.
 func (m *SecretMap) Get(key string) (s SecretTime, ok bool) {
-	m.lock.RLock()
-	s, ok = m.m[key]
-	m.lock.RUnlock()
-	return
+	ok = m.view(key, func(e SecretTime) {
+		s = e
+		s.Secret.Content = e.Secret.Content.clone()
+	})
+	return s, ok
+}
+
+// view calls use with the value stored with key while holding the lock of its shard, without
+// copying its content, and marks the entry as most recently used. use must not modify or retain
+// the content, which is zeroed once it leaves the map, nor call back into the map. Returns false,
+// without calling use, if there is no entry.
+func (m *SecretMap) view(key string, use func(SecretTime)) bool {
+	shard := m.shard(key)
+	// Unbounded maps never evict, so recency is not tracked and a read lock suffices.
+	if m.maxEntries == 0 {
+		shard.lock.RLock()
+		defer shard.lock.RUnlock()
+		e, ok := shard.m[key]
+		if ok {
+			use(e.SecretTime)
+		}
+		return ok
+	}
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	e, ok := shard.m[key]
+	if ok {
+		m.moveToFront(shard, e)
+		use(e.SecretTime)
+	}
+	return ok
 }
 
 // Put places a value in the map with a key, possibly overwriting an existing entry.
 func (m *SecretMap) Put(key string, value Secret) {
-	m.lock.Lock()
-	m.m[key] = SecretTime{value, time.Now()}
-	m.lock.Unlock()
+	m.putChanged(key, value)
 }
 
 // PutIfAbsent places a value in the map with a key, if that key did not exist.
 // Returns whether the value was placed.
 func (m *SecretMap) PutIfAbsent(key string, value Secret) (put bool) {
-	m.lock.Lock()
-	if _, ok := m.m[key]; !ok {
-		m.m[key] = SecretTime{value, time.Now()}
-		put = true
+	shard := m.shard(key)
+	unlock := m.lockFor(shard, key)
+	defer unlock()
+	if _, ok := shard.m[key]; ok {
+		return false
+	}
+	m.insert(shard, key, SecretTime{value, m.now()})
+	return true
+}
+
+// putChanged places a value in the map with a key like Put. Returns whether there was no entry
+// before, or whether it replaced an entry with different content or a different version.
+func (m *SecretMap) putChanged(key string, value Secret) (added, changed bool) {
+	shard := m.shard(key)
+	unlock := m.lockFor(shard, key)
+	defer unlock()
+	e, ok := shard.m[key]
+	if !ok {
+		m.insert(shard, key, SecretTime{value, m.now()})
+		return true, false
+	}
+	changed = e.Secret.Version != value.Version ||
+		len(e.Secret.Content) > 0 && !bytes.Equal(e.Secret.Content, value.Content)
+	m.store(e, SecretTime{value, m.now()})
+	m.moveToFront(shard, e)
+	return false, changed
+}
+
+// etag returns the ETag of the entry stored with key, or "" if there is none.
+func (m *SecretMap) etag(key string) string {
+	shard := m.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	if e, ok := shard.m[key]; ok {
+		return e.Secret.ETag
+	}
+	return ""
+}
+
+// touch resets the timestamp of the entry stored with key and marks it most recently used, if its
+// ETag is etag. Returns the metadata of the entry, and whether it was touched.
+func (m *SecretMap) touch(key, etag string) (s SecretTime, touched bool) {
+	shard := m.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	e, ok := shard.m[key]
+	if !ok || etag == "" || e.Secret.ETag != etag {
+		return s, false
 	}
-	m.lock.Unlock()
+	e.Time = m.now()
+	m.moveToFront(shard, e)
+	return e.SecretTime.metadata(), true
+}
+
+// renew resets the timestamp of the entry stored with key and marks it most recently used, as
+// though it was stored again. Returns the metadata of the entry, and whether there was one.
+func (m *SecretMap) renew(key string) (s SecretTime, ok bool) {
+	shard := m.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	e, ok := shard.m[key]
+	if !ok {
+		return s, false
+	}
+	e.Time = m.now()
+	m.moveToFront(shard, e)
+	return e.SecretTime.metadata(), true
+}
+
+// putIfOlder places a value with its original timestamp, unless the existing entry for key is
+// more recent. Returns whether the value was placed.
+func (m *SecretMap) putIfOlder(key string, value SecretTime) (put bool) {
+	shard := m.shard(key)
+	unlock := m.lockFor(shard, key)
+	defer unlock()
+	if e, ok := shard.m[key]; ok {
+		if !e.Time.Before(value.Time) {
+			return false
+		}
+		m.store(e, value)
+		m.moveToFront(shard, e)
+		return true
+	}
+	m.insert(shard, key, value)
+	return true
+}
+
+// Delete removes the value stored with a key. Returns whether a value was present.
+func (m *SecretMap) Delete(key string) (deleted bool) {
+	shard := m.shard(key)
+	shard.lock.Lock()
+	if e, ok := shard.m[key]; ok {
+		m.unlink(e)
+		delete(shard.m, key)
+		atomic.AddInt64(&m.size, -1)
+		m.release(e)
+		deleted = true
+	}
+	shard.lock.Unlock()
 	return
 }
 
-// Values returns a slice of stored secrets in no particular order.
+// Values returns a slice of stored secrets, most recently used first. Listing touches every entry
+// equally, so it does not change their relative recency.
 func (m *SecretMap) Values() []SecretTime {
-	m.lock.RLock()
-	values := make([]SecretTime, len(m.m))
-	i := 0
-	for _, value := range m.m {
-		values[i] = value
-		i++
-	}
-	m.lock.RUnlock()
+	m.rlockAll()
+	var entries []*secretEntry
+	for i := range m.shards {
+		shard := &m.shards[i]
+		for e := shard.root.next; e != shard.root; e = e.next {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used > entries[j].used })
+	values := make([]SecretTime, len(entries))
+	for i, e := range entries {
+		values[i] = e.copy()
+	}
+	m.runlockAll()
 	return values
 }
 
+// Keys returns the keys of stored secrets in sorted order.
+func (m *SecretMap) Keys() []string {
+	m.rlockAll()
+	var keys []string
+	for i := range m.shards {
+		for key := range m.shards[i].m {
+			keys = append(keys, key)
+		}
+	}
+	m.runlockAll()
+	sort.Strings(keys)
+	return keys
+}
+
+// Contains returns whether key is in the map, without marking the entry as recently used.
+func (m *SecretMap) Contains(key string) bool {
+	shard := m.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	_, ok := shard.m[key]
+	return ok
+}
+
+// setLockContent sets whether content stored afterwards is moved to locked memory, reporting
+// failures to onLockError.
+func (m *SecretMap) setLockContent(enabled bool, onLockError func(error)) {
+	m.lockAll()
+	defer m.unlockAll()
+	m.lockContent = enabled
+	m.onLockError = onLockError
+}
+
 // Len returns the count of values stored.
 func (m *SecretMap) Len() int {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	return len(m.m)
+	m.rlockAll()
+	defer m.runlockAll()
+	return m.len()
 }
 
-// Overwrite will copy and overwrite data from another SecretMap.
+// Overwrite will copy and overwrite data from another SecretMap. If m2 holds more entries than
+// this map allows, the least recently used are evicted. Content of the replaced entries is zeroed,
+// unless it is shared with m2.
 func (m *SecretMap) Overwrite(m2 *SecretMap) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	m2.lock.RLock()
-	defer m2.lock.RUnlock()
-	m.m = m2.m
+	m.lockAll()
+	defer m.unlockAll()
+	m2.rlockAll()
+	defer m2.runlockAll()
+	for i := range m.shards {
+		shard, shard2 := &m.shards[i], &m2.shards[i]
+		for key, e := range shard.m {
+			if e2, ok := shard2.m[key]; !ok || !e.Secret.Content.sameArray(e2.Secret.Content) {
+				m.release(e)
+			}
+		}
+		shard.m = shard2.m
+		shard.root = shard2.root
+	}
+	atomic.StoreInt64(&m.size, int64(m.len()))
+	// Keep recency stamps increasing past those of the entries taken from m2.
+	if uses := atomic.LoadUint64(&m2.uses); uses > atomic.LoadUint64(&m.uses) {
+		atomic.StoreUint64(&m.uses, uses)
+	}
+	m.evict()
+}
+
+// shard returns the shard holding key, by its 32-bit FNV-1a hash.
+func (m *SecretMap) shard(key string) *secretShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &m.shards[h%secretMapShards]
+}
+
+// lockFor write-locks the shard of key for an update. Inserting key into a bounded map which is
+// full evicts the entries of any shard, so then every shard is locked. If key is absent, it counts
+// the entry the caller must then insert. Returns the function releasing the locks.
+func (m *SecretMap) lockFor(shard *secretShard, key string) (unlock func()) {
+	shard.lock.Lock()
+	if _, ok := shard.m[key]; ok || m.reserve() {
+		return shard.lock.Unlock
+	}
+	shard.lock.Unlock()
+	m.lockAll()
+	if _, ok := shard.m[key]; !ok {
+		atomic.AddInt64(&m.size, 1)
+	}
+	return m.unlockAll
+}
+
+// reserve counts an entry about to be inserted, if the map is below its limit. Returns whether it
+// was counted. Inserts holding a single shard lock reserve their entry first, so that concurrent
+// inserts into other shards cannot together exceed the limit, and never need to evict.
+func (m *SecretMap) reserve() bool {
+	if m.maxEntries == 0 {
+		atomic.AddInt64(&m.size, 1)
+		return true
+	}
+	for {
+		size := atomic.LoadInt64(&m.size)
+		if size >= int64(m.maxEntries) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.size, size, size+1) {
+			return true
+		}
+	}
+}
+
+// lockAll write-locks every shard, in order so concurrent callers cannot deadlock.
+func (m *SecretMap) lockAll() {
+	for i := range m.shards {
+		m.shards[i].lock.Lock()
+	}
+}
+
+func (m *SecretMap) unlockAll() {
+	for i := range m.shards {
+		m.shards[i].lock.Unlock()
+	}
+}
+
+// rlockAll read-locks every shard, for a consistent view of the map.
+func (m *SecretMap) rlockAll() {
+	for i := range m.shards {
+		m.shards[i].lock.RLock()
+	}
+}
+
+func (m *SecretMap) runlockAll() {
+	for i := range m.shards {
+		m.shards[i].lock.RUnlock()
+	}
+}
+
+// len returns the count of values stored. The caller must hold the locks of every shard.
+func (m *SecretMap) len() int {
+	var n int
+	for i := range m.shards {
+		n += len(m.shards[i].m)
+	}
+	return n
+}
+
+// insert adds an entry for key as most recently used, evicting others beyond the limit. The caller
+// must hold the write lock of the shard, and have counted the entry, as lockFor does. Evicting
+// requires holding the lock of every shard, which lockFor takes whenever the entry exceeds the
+// limit.
+func (m *SecretMap) insert(shard *secretShard, key string, value SecretTime) {
+	e := &secretEntry{key: key}
+	m.store(e, value)
+	shard.m[key] = e
+	m.insertFront(shard, e)
+	m.evict()
+}
+
+// evict removes least recently used entries until the map is within its limit. The caller must
+// hold the write locks of every shard if the map may be beyond its limit.
+func (m *SecretMap) evict() {
+	if m.maxEntries == 0 {
+		return
+	}
+	for atomic.LoadInt64(&m.size) > int64(m.maxEntries) {
+		// The oldest entry of each shard is last in its list, so the oldest of all is among those.
+		var oldest *secretEntry
+		var from *secretShard
+		for i := range m.shards {
+			shard := &m.shards[i]
+			if last := shard.root.prev; last != shard.root && (oldest == nil || last.used < oldest.used) {
+				oldest, from = last, shard
+			}
+		}
+		m.unlink(oldest)
+		delete(from.m, oldest.key)
+		atomic.AddInt64(&m.size, -1)
+		if m.onEvict != nil {
+			m.onEvict(oldest.copy())
+		}
+		m.release(oldest)
+	}
+}
+
+// metadata returns s without its content, whose length is kept as the Length of the secret. The
+// content of a cached secret is read by borrowing it from the map, as by Cache.withContent.
+func (s SecretTime) metadata() SecretTime {
+	s.Secret.Length = uint64(s.Secret.ContentLength())
+	s.Secret.Content = nil
+	return s
+}
+
+// copy returns the entry's SecretTime with a private copy of its content.
+func (e *secretEntry) copy() SecretTime {
+	s := e.SecretTime
+	s.Secret.Content = s.Secret.Content.clone()
+	return s
+}
+
+// store sets the value of an entry, zeroing the content it replaces. If content locking is enabled,
+// the content is moved to locked memory. The caller must hold the write lock of its shard.
+func (m *SecretMap) store(e *secretEntry, value SecretTime) {
+	if !e.Secret.Content.sameArray(value.Secret.Content) {
+		m.release(e)
+	}
+	e.SecretTime, e.locked = value, false
+	if !m.lockContent || len(value.Secret.Content) == 0 {
+		return
+	}
+
+	locked, err := lockContent(value.Secret.Content)
+	if err != nil {
+		if m.onLockError != nil {
+			m.onLockError(err)
+		}
+		return
+	}
+	value.Secret.Content.wipe()
+	e.Secret.Content, e.locked = locked, true
+}
+
+// release zeroes the content of an entry which is leaving the map, and frees it if locked. The
+// caller must hold the write lock of its shard.
+func (m *SecretMap) release(e *secretEntry) {
+	e.Secret.Content.wipe()
+	if e.locked {
+		unlockContent(e.Secret.Content)
+		e.Secret.Content, e.locked = nil, false
+	}
+}
+
+// insertFront links e first in the recency list of shard, stamping it as most recently used.
+func (m *SecretMap) insertFront(shard *secretShard, e *secretEntry) {
+	e.used = atomic.AddUint64(&m.uses, 1)
+	e.prev = shard.root
+	e.next = shard.root.next
+	shard.root.next.prev = e
+	shard.root.next = e
+}
+
+func (m *SecretMap) unlink(e *secretEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (m *SecretMap) moveToFront(shard *secretShard, e *secretEntry) {
+	if shard.root.next == e {
+		e.used = atomic.AddUint64(&m.uses, 1)
+		return
+	}
+	m.unlink(e)
+	m.insertFront(shard, e)
 }
@@ -15,6 +15,10 @@
 package keywhizfs_test
 
 import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/square/keywhizfs"
@@ -57,6 +61,17 @@ func TestSecretMapOperations(t *testing.T) {
 	lookup, ok = secretMap.Get("foo")
 	assert.True(ok)
 	assert.NotEqual(*s, lookup.Secret)
+
+	secretMap.Put("bar", keywhizfs.Secret{})
+	assert.Equal([]string{"bar", "foo"}, secretMap.Keys())
+	assert.True(secretMap.Delete("bar"))
+
+	assert.True(secretMap.Delete("foo"))
+	assert.False(secretMap.Delete("foo"))
+	assert.Equal(0, secretMap.Len())
+
+	_, ok = secretMap.Get("foo")
+	assert.False(ok)
 }
 
 func TestSecretMapOverwrite(t *testing.T) {
@@ -93,3 +108,160 @@ func TestSecretMapTimestamp(t *testing.T) {
 	assert.True(ok)
 	assert.True(val.Time.After(earlierTime))
 }
+
+func TestSecretMapEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	secretMap := keywhizfs.NewSecretMapWithLimit(2)
+	secretMap.Put("foo", keywhizfs.Secret{Name: "foo"})
+	secretMap.Put("bar", keywhizfs.Secret{Name: "bar"})
+
+	// Reading foo makes bar the least recently used entry.
+	_, ok := secretMap.Get("foo")
+	assert.True(ok)
+
+	secretMap.Put("baz", keywhizfs.Secret{Name: "baz"})
+	assert.Equal(2, secretMap.Len())
+
+	_, ok = secretMap.Get("bar")
+	assert.False(ok)
+	_, ok = secretMap.Get("foo")
+	assert.True(ok)
+	_, ok = secretMap.Get("baz")
+	assert.True(ok)
+
+	// Replacing an existing entry does not evict.
+	secretMap.Put("foo", keywhizfs.Secret{Name: "foo"})
+	assert.Equal(2, secretMap.Len())
+}
+
+func TestSecretMapOverwriteRespectsLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	newMap := keywhizfs.NewSecretMap()
+	newMap.Put("foo", keywhizfs.Secret{})
+	newMap.Put("bar", keywhizfs.Secret{})
+	newMap.Put("baz", keywhizfs.Secret{})
+
+	secretMap := keywhizfs.NewSecretMapWithLimit(2)
+	secretMap.Overwrite(newMap)
+	assert.Equal(2, secretMap.Len())
+
+	_, ok := secretMap.Get("foo")
+	assert.False(ok)
+}
+
+func TestSecretMapConcurrentInsertsRespectLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	const limit = 50
+	secretMap := keywhizfs.NewSecretMapWithLimit(limit)
+	var wg sync.WaitGroup
+	var exceeded int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprintf("secret-%d-%d", g, i)
+				secretMap.Put(name, keywhizfs.Secret{Name: name})
+				if i%2 == 0 {
+					secretMap.Delete(name)
+				}
+				if secretMap.Len() > limit {
+					atomic.StoreInt32(&exceeded, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.EqualValues(0, exceeded, "Expected at most %d entries at any time", limit)
+	assert.Equal(limit, secretMap.Len())
+
+	// Deleted entries free their place, so the map refills without evicting.
+	for _, key := range secretMap.Keys() {
+		secretMap.Delete(key)
+	}
+	for i := 0; i < limit; i++ {
+		secretMap.Put(fmt.Sprint(i), keywhizfs.Secret{})
+	}
+	assert.Equal(limit, secretMap.Len())
+	_, ok := secretMap.Get("0")
+	assert.True(ok)
+}
+
+func TestSecretMapZeroesRemovedContent(t *testing.T) {
+	assert := assert.New(t)
+
+	zeroed := func(b []byte) bool {
+		return bytes.Equal(b, make([]byte, len(b)))
+	}
+
+	secretMap := keywhizfs.NewSecretMapWithLimit(2)
+	deleted, replaced, evicted, kept := []byte("deleted"), []byte("replaced"), []byte("evicted"), []byte("kept")
+
+	secretMap.Put("foo", keywhizfs.Secret{Content: deleted})
+	lookup, _ := secretMap.Get("foo")
+	secretMap.Delete("foo")
+	assert.True(zeroed(deleted), "Expected deleted content to be zeroed")
+	assert.EqualValues("deleted", lookup.Secret.Content, "Expected Get to return a copy")
+
+	secretMap.Put("foo", keywhizfs.Secret{Content: replaced})
+	secretMap.Put("foo", keywhizfs.Secret{Content: []byte("new")})
+	assert.True(zeroed(replaced), "Expected replaced content to be zeroed")
+
+	secretMap.Put("bar", keywhizfs.Secret{Content: evicted})
+	secretMap.Get("foo")
+	secretMap.Put("baz", keywhizfs.Secret{Content: kept})
+	assert.True(zeroed(evicted), "Expected evicted content to be zeroed")
+	assert.EqualValues("kept", kept)
+
+	secretMap.Overwrite(keywhizfs.NewSecretMap())
+	assert.True(zeroed(kept), "Expected overwritten content to be zeroed")
+}
+
+func BenchmarkSecretMapParallel(b *testing.B) {
+	for _, limit := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			secretMap := keywhizfs.NewSecretMapWithLimit(limit)
+			names := make([]string, 256)
+			for i := range names {
+				names[i] = fmt.Sprintf("secret-%d", i)
+				secretMap.Put(names[i], keywhizfs.Secret{Name: names[i], Content: []byte(names[i])})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					name := names[i%len(names)]
+					if i%16 == 0 {
+						secretMap.Put(name, keywhizfs.Secret{Name: name, Content: []byte(name)})
+					} else {
+						secretMap.Get(name)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSecretMapParallelInsert(b *testing.B) {
+	for _, limit := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			secretMap := keywhizfs.NewSecretMapWithLimit(limit)
+			var id int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// Each new key is deleted again, keeping a bounded map below its limit.
+					name := fmt.Sprintf("secret-%d", atomic.AddInt64(&id, 1))
+					secretMap.Put(name, keywhizfs.Secret{Name: name})
+					secretMap.Delete(name)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"sync"
+	"time"
+)
+
+// staleSet remembers since when cached secrets have been served because the backend failed them.
+type staleSet struct {
+	m    map[string]time.Time
+	lock sync.Mutex
+}
+
+// add records name as served stale as of now, keeping an earlier time if already stale. Returns
+// whether name was newly marked.
+func (s *staleSet) add(name string, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.m[name]; ok {
+		return false
+	}
+	s.m[name] = now
+	return true
+}
+
+// since returns when name began being served stale, if it is.
+func (s *staleSet) since(name string) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.m[name]
+	return t, ok
+}
+
+// snapshot returns a copy of the stale names and times.
+func (s *staleSet) snapshot() map[string]time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m := make(map[string]time.Time, len(s.m))
+	for name, t := range s.m {
+		m[name] = t
+	}
+	return m
+}
+
+func (s *staleSet) remove(name string) {
+	s.lock.Lock()
+	delete(s.m, name)
+	s.lock.Unlock()
+}
+
+func (s *staleSet) clear() {
+	s.lock.Lock()
+	s.m = make(map[string]time.Time)
+	s.lock.Unlock()
+}
+
+// StaleSince returns when the cache began serving a secret in place of a failing backend, if it
+// still is. A successful backend request for the secret ends its staleness.
+func (c *Cache) StaleSince(name string) (time.Time, bool) {
+	return c.stale.since(name)
+}
+
+// Stale returns the names of secrets currently served in place of a failing backend, with when
+// that began for each.
+func (c *Cache) Stale() map[string]time.Time {
+	return c.stale.snapshot()
+}
+
+// servedStale records a cached secret being served because the backend failed or was too slow.
+func (c *Cache) servedStale(name string) {
+	if c.stale.add(name, c.clock()) {
+		c.Warnf("Backend unavailable, serving cached secret which may be outdated: %v", name)
+	}
+}
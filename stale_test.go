@@ -0,0 +1,73 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheMarksStaleOnBackendFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := SwitchBackend{secret: secretFixture, failing: new(int32), calls: new(int32)}
+	atomic.StoreInt32(backend.failing, 1)
+
+	clock := newFakeClock()
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	cache.Add(*secretFixture)
+	_, stale := cache.StaleSince(secretFixture.Name)
+	assert.False(stale)
+
+	// Falling back to the cache marks the secret stale, from the first fallback on.
+	start := clock.Now()
+	for i := 0; i < 2; i++ {
+		secret, ok := cache.Secret(secretFixture.Name)
+		assert.True(ok)
+		assert.Equal(secretFixture, secret)
+		clock.Advance(time.Minute)
+	}
+	since, stale := cache.StaleSince(secretFixture.Name)
+	assert.True(stale)
+	assert.Equal(start, since)
+	assert.Equal(map[string]time.Time{secretFixture.Name: start}, cache.Stale())
+
+	// A successful backend request ends staleness.
+	atomic.StoreInt32(backend.failing, 0)
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	_, stale = cache.StaleSince(secretFixture.Name)
+	assert.False(stale)
+	assert.Empty(cache.Stale())
+}
+
+func TestCacheClearsStaleOnDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+	cache.Add(*secretFixture)
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Len(cache.Stale(), 1)
+
+	cache.Delete(secretFixture.Name)
+	assert.Empty(cache.Stale())
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats is a snapshot of counters describing how a Cache has served requests.
+type CacheStats struct {
+	// Hits counts lookups answered with cached data, either because the entry was fresh or as a
+	// fallback when the backend was slow or failed.
+	Hits uint64
+	// Misses counts lookups where the cache held no usable entry.
+	Misses uint64
+	// BackendCalls counts requests issued to the backend.
+	BackendCalls uint64
+	// BackendTimeouts counts lookups which stopped waiting on the backend, either at the
+	// optimistic BackendDeadline or at BackendTimeout.
+	BackendTimeouts uint64
+	// BackendErrors counts backend requests which returned no value, other than those cancelled.
+	// A backend reports a missing secret the same way, so not found answers are included.
+	BackendErrors uint64
+	// Evictions counts entries dropped to stay within the cache size limit.
+	Evictions uint64
+	// ShortCircuits counts backend requests skipped because the circuit breaker was open.
+	ShortCircuits uint64
+	// RateLimited counts backend requests abandoned while waiting on the rate limiter or for a
+	// slot under the concurrency limit.
+	RateLimited uint64
+	// BackendInFlight is the number of backend requests currently outstanding.
+	BackendInFlight int64
+	// Breaker is the current state of the circuit breaker.
+	Breaker BreakerState
+}
+
+// cacheCounters holds the live counters behind CacheStats. Fields are only accessed atomically so
+// the lookup path never takes a lock to record a statistic.
+type cacheCounters struct {
+	hits            uint64
+	misses          uint64
+	backendCalls    uint64
+	backendTimeouts uint64
+	backendErrors   uint64
+	evictions       uint64
+	shortCircuits   uint64
+	rateLimited     uint64
+	lastContact     int64 // Unix nanoseconds of the last successful backend request, zero if none
+	lastSecret      int64 // likewise, of a request for one secret
+	lastSecretList  int64 // likewise, of a listing
+	lastRefresh     int64 // Unix nanoseconds of the last complete listing replacing the cache
+	inFlight        int64
+	latency         latencyHistogram // all backend requests
+	secretLatency   latencyHistogram
+	listLatency     latencyHistogram
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:            atomic.LoadUint64(&c.stats.hits),
+		Misses:          atomic.LoadUint64(&c.stats.misses),
+		BackendCalls:    atomic.LoadUint64(&c.stats.backendCalls),
+		BackendTimeouts: atomic.LoadUint64(&c.stats.backendTimeouts),
+		BackendErrors:   atomic.LoadUint64(&c.stats.backendErrors),
+		Evictions:       atomic.LoadUint64(&c.stats.evictions),
+		ShortCircuits:   atomic.LoadUint64(&c.stats.shortCircuits),
+		RateLimited:     atomic.LoadUint64(&c.stats.rateLimited),
+		BackendInFlight: atomic.LoadInt64(&c.stats.inFlight),
+		Breaker:         c.breaker.current(c.clock()),
+	}
+}
+
+// LastBackendContact returns when a backend request last succeeded, or the zero time if none has
+// since the cache was created.
+func (c *Cache) LastBackendContact() time.Time {
+	return loadTime(&c.stats.lastContact)
+}
+
+// BackendTimes are when backend requests last succeeded, by kind of request. Each is the zero time
+// if no such request has succeeded since the cache was created.
+type BackendTimes struct {
+	// Contact is the last successful request of any kind, as reported by LastBackendContact.
+	Contact time.Time
+	// Secret and SecretList are the last successful requests for one secret and for a listing.
+	Secret     time.Time
+	SecretList time.Time
+	// Refresh is when a complete listing last replaced the cached entries. Partial listings,
+	// which are merged with the cache, do not count.
+	Refresh time.Time
+}
+
+// BackendTimes returns when backend requests last succeeded.
+func (c *Cache) BackendTimes() BackendTimes {
+	return BackendTimes{
+		Contact:    loadTime(&c.stats.lastContact),
+		Secret:     loadTime(&c.stats.lastSecret),
+		SecretList: loadTime(&c.stats.lastSecretList),
+		Refresh:    loadTime(&c.stats.lastRefresh),
+	}
+}
+
+// contacted records a successful backend request, overall and in last, the timestamp of its kind
+// of request.
+func (c *Cache) contacted(last *int64) {
+	now := c.clock().UnixNano()
+	atomic.StoreInt64(&c.stats.lastContact, now)
+	atomic.StoreInt64(last, now)
+}
+
+// loadTime atomically reads a timestamp in Unix nanoseconds, of which zero is the zero time.
+func loadTime(nanos *int64) time.Time {
+	n := atomic.LoadInt64(nanos)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// LatencyHistogram is a snapshot of the distribution of backend request latencies.
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of the histogram buckets, in increasing order.
+	Bounds []time.Duration
+	// Counts are the number of requests which took at most the corresponding bound.
+	Counts []uint64
+	// Count is the total number of requests, and Sum their total duration.
+	Count uint64
+	Sum   time.Duration
+}
+
+// latencyBounds are the bucket bounds of backend latency histograms.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram holds live counts behind LatencyHistogram. The last bucket counts requests
+// exceeding every bound.
+type latencyHistogram struct {
+	buckets [len(latencyBounds) + 1]uint64
+	count   uint64
+	sum     uint64
+}
+
+// observe records a request which took d.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// BackendLatency returns a snapshot of the latency histogram of backend requests.
+func (c *Cache) BackendLatency() LatencyHistogram {
+	return c.stats.latency.snapshot()
+}
+
+// SecretLatency returns a snapshot of the latency histogram of backend requests for one secret.
+func (c *Cache) SecretLatency() LatencyHistogram {
+	return c.stats.secretLatency.snapshot()
+}
+
+// SecretListLatency returns a snapshot of the latency histogram of backend listing requests.
+func (c *Cache) SecretListLatency() LatencyHistogram {
+	return c.stats.listLatency.snapshot()
+}
+
+// LatencyPercentiles are estimated latency percentiles.
+type LatencyPercentiles struct {
+	P50, P95, P99 time.Duration
+}
+
+// Percentiles estimates the 50th, 95th, and 99th percentiles of the histogram.
+func (h LatencyHistogram) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{h.Percentile(0.5), h.Percentile(0.95), h.Percentile(0.99)}
+}
+
+// Percentile estimates the latency below which a fraction q of requests fall, interpolating
+// linearly within the bucket holding it. Estimates beyond the last bound are reported as the last
+// bound. An empty histogram reports zero.
+func (h LatencyHistogram) Percentile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var lower time.Duration
+	var below uint64
+	for i, bound := range h.Bounds {
+		if n := h.Counts[i]; float64(n) >= rank && n > below {
+			fraction := (rank - float64(below)) / float64(n-below)
+			return lower + time.Duration(fraction*float64(bound-lower))
+		}
+		lower, below = bound, h.Counts[i]
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// snapshot returns the current counts of the histogram.
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	snapshot := LatencyHistogram{
+		Bounds: append([]time.Duration(nil), latencyBounds[:]...),
+		Counts: make([]uint64, len(latencyBounds)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadUint64(&h.sum)),
+	}
+	var cumulative uint64
+	for i := range latencyBounds {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+// count atomically increments a counter by one.
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStatsWithFailingBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+
+	// Empty cache and failing backend is a miss.
+	cache.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.CacheStats{Misses: 1, BackendCalls: 1, BackendErrors: 1}, cache.Stats())
+
+	// Failing backend falls back to the cached entry.
+	cache.Add(*secretFixture)
+	cache.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.CacheStats{Hits: 1, Misses: 1, BackendCalls: 2, BackendErrors: 2}, cache.Stats())
+}
+
+func TestCacheStatsWithChannelBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	secretc := make(chan *keywhizfs.Secret, 1)
+	backend := ChannelBackend{secretc: secretc}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	// Backend success.
+	secretc <- secretFixture
+	cache.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.CacheStats{Misses: 1, BackendCalls: 1}, cache.Stats())
+
+	// Backend blocks, so the cached entry is used after the backend deadline.
+	cache.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.CacheStats{Hits: 1, Misses: 1, BackendCalls: 2, BackendTimeouts: 1, BackendInFlight: 1}, cache.Stats())
+	secretc <- secretFixture // unblock the pending backend request
+
+	// A fresh entry is served without a backend call.
+	timeouts := keywhizfs.Timeouts{Fresh: 1 * time.Hour, BackendDeadline: 10 * time.Millisecond, BackendTimeout: 20 * time.Millisecond}
+	cache = keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.Add(*secretFixture)
+	cache.Secret(secretFixture.Name)
+	assert.Equal(keywhizfs.CacheStats{Hits: 1}, cache.Stats())
+}
+
+func TestCacheStatsCountsEvictions(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := keywhizfs.NewCacheWithLimit(FailingBackend{}, timeouts, logConfig, 1)
+	cache.Add(keywhizfs.Secret{Name: "foo"})
+	cache.Add(keywhizfs.Secret{Name: "bar"})
+	cache.Add(keywhizfs.Secret{Name: "baz"})
+
+	assert.EqualValues(2, cache.Stats().Evictions)
+}
+
+func TestCacheBackendLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	backend := SlowBackend{FailingBackend{}, 30 * time.Millisecond}
+	cacheTimeouts := keywhizfs.Timeouts{BackendDeadline: time.Second, BackendTimeout: time.Minute}
+	cache := keywhizfs.NewCache(backend, cacheTimeouts, logConfig)
+
+	latency := cache.BackendLatency()
+	assert.Zero(latency.Count)
+	assert.Len(latency.Counts, len(latency.Bounds))
+
+	cache.Secret(secretFixture.Name)
+	latency = cache.BackendLatency()
+	assert.EqualValues(1, latency.Count)
+	assert.True(latency.Sum >= 30*time.Millisecond)
+	for i, bound := range latency.Bounds {
+		if bound < 30*time.Millisecond {
+			assert.Zero(latency.Counts[i], "bucket %v", bound)
+		} else {
+			assert.EqualValues(1, latency.Counts[i], "bucket %v", bound)
+		}
+	}
+}
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	assert := assert.New(t)
+
+	histogram := keywhizfs.LatencyHistogram{
+		Bounds: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+		Counts: []uint64{50, 90, 99},
+		Count:  100,
+	}
+	assert.Equal(10*time.Millisecond, histogram.Percentile(0.5))
+	assert.Equal(15*time.Millisecond, histogram.Percentile(0.7))
+	assert.Equal(40*time.Millisecond, histogram.Percentile(0.99))
+	assert.Equal(40*time.Millisecond, histogram.Percentile(1), "beyond the last bound")
+
+	percentiles := histogram.Percentiles()
+	assert.Equal(10*time.Millisecond, percentiles.P50)
+	assert.InDelta(float64(31*time.Millisecond), float64(percentiles.P95), float64(time.Millisecond))
+	assert.Equal(40*time.Millisecond, percentiles.P99)
+
+	assert.Zero(keywhizfs.LatencyHistogram{}.Percentile(0.5))
+}
+
+func TestCacheLatencyByRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	cache := keywhizfs.NewCache(FailingBackend{}, timeouts, logConfig)
+
+	cache.Secret(secretFixture.Name)
+	assert.EqualValues(1, cache.SecretLatency().Count)
+	assert.Zero(cache.SecretListLatency().Count)
+
+	cache.SecretList()
+	assert.EqualValues(1, cache.SecretLatency().Count)
+	assert.EqualValues(1, cache.SecretListLatency().Count)
+	assert.EqualValues(2, cache.BackendLatency().Count)
+}
+
+func TestCacheBackendTimesAdvance(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := keywhizfs.ParseSecret(fixture("secret.json"))
+	var calls int32
+	backend := CountingBackend{map[string]*keywhizfs.Secret{secretFixture.Name: secretFixture}, &calls}
+	clock := newFakeClock()
+	cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+	assert.Equal(keywhizfs.BackendTimes{}, cache.BackendTimes())
+
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	first := cache.BackendTimes()
+	assert.True(clock.Now().Equal(first.Secret))
+	assert.True(clock.Now().Equal(first.Contact))
+	assert.True(first.SecretList.IsZero())
+	assert.True(first.Refresh.IsZero())
+
+	clock.Advance(time.Minute)
+	assert.Len(cache.SecretList(), 1)
+	assert.True(eventually(func() bool { return cache.BackendTimes().Refresh.Equal(clock.Now()) }, time.Second))
+	second := cache.BackendTimes()
+	assert.True(clock.Now().Equal(second.SecretList))
+	assert.True(clock.Now().Equal(second.Contact))
+	assert.Equal(first.Secret, second.Secret)
+
+	clock.Advance(time.Minute)
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.True(cache.BackendTimes().Secret.After(second.Secret))
+}
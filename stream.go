@@ -0,0 +1,193 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	gocontext "context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/square/keywhizfs/log"
+)
+
+// SecretRange reads size bytes of the content of a secret from offset off, straight from the
+// backend as a RangeSecretFetcher, waiting up to Timeouts.BackendTimeout. Nothing is cached. If
+// etag is not empty, only that version of the content is read, and tag is the version read from.
+// Returns false if the backend does not support ranges, the request failed, or the secret changed
+// from etag, as well as for secrets excluded by the name filter.
+//
+// The request is subject to the circuit breaker and the concurrency limit, like fetchSecret, and
+// to the rate limit unless etag is set: the reads of a streamed file, pinned to the version found
+// by the request opening it, are not rate limited again.
+func (c *Cache) SecretRange(ctx gocontext.Context, name string, off int64, size int, etag string) (data []byte, tag string, ok bool) {
+	if c.isClosed() {
+		return nil, "", false
+	}
+	name = c.resolveAlias(name)
+	if !c.Permits(name) {
+		c.Debugf("Secret excluded by name filter: %v", name)
+		return nil, "", false
+	}
+	ctx, cancel := gocontext.WithTimeout(ctx, c.Timeouts().BackendTimeout)
+	defer cancel()
+	if etag == "" && !c.limit(ctx, name) {
+		return nil, "", false
+	}
+	release, ok := c.admit(ctx, name)
+	if !ok {
+		return nil, "", false
+	}
+	defer release()
+	if !c.breaker.allow(c.clock()) {
+		c.Debugf("Circuit breaker open, skipping backend: %v", name)
+		count(&c.stats.shortCircuits)
+		return nil, "", false
+	}
+
+	count(&c.stats.backendCalls)
+	data, tag, status, ok := c.ranges.SecretRangeCtx(ctx, name, off, size, etag)
+	switch {
+	case ok:
+		c.breaker.success()
+	case ctx.Err() != nil:
+		count(&c.stats.backendErrors)
+		c.breaker.ignore()
+	case status == 0, status >= 500:
+		count(&c.stats.backendErrors)
+		c.breaker.failure(c.clock())
+	case status == statusUnknown: // The backend does not support ranges.
+		count(&c.stats.backendErrors)
+		c.breaker.ignore()
+	default: // The backend answered, without the range.
+		count(&c.stats.backendErrors)
+		c.breaker.success()
+	}
+	return data, tag, ok
+}
+
+// streamedSecret returns the listed secret at path, without content, if it is large enough to be
+// streamed: its listed length is at least StreamThreshold, and it has no Format, which would need
+// the whole content.
+func (kwfs KeywhizFs) streamedSecret(path string) (*Secret, bool) {
+	if kwfs.StreamThreshold <= 0 {
+		return nil, false
+	}
+	name, dir, ok := kwfs.secretName(path)
+	if !ok || kwfs.linked() && dir != "" {
+		return nil, false
+	}
+	for _, s := range kwfs.dirSecretList() {
+		if s.Name != name {
+			continue
+		}
+		if s.ContentLength() < kwfs.StreamThreshold || s.Format != "" || !kwfs.linked() && !kwfs.inDir(s, dir) {
+			return nil, false
+		}
+		s.Content = nil
+		return &s, true
+	}
+	return nil, false
+}
+
+// openStreamed opens the secret at path as a streamedFile if it is large enough to be streamed,
+// and the backend answers a range request for its first byte with an ETag, which every later read
+// must match. Otherwise ok is false, and the secret is opened with its whole content instead.
+func (kwfs KeywhizFs) openStreamed(ctx gocontext.Context, path string, context *fuse.Context, requestID string) (file nodefs.File, status fuse.Status, ok bool) {
+	secret, ok := kwfs.streamedSecret(path)
+	if !ok {
+		return nil, fuse.ENOENT, false
+	}
+	attr := kwfs.secretAttr(secret)
+	if !kwfs.permitted(path, attr.Uid, context) {
+		return nil, fuse.EACCES, true
+	}
+	_, etag, ok := kwfs.Cache.SecretRange(ctx, secret.Name, 0, 1, "")
+	switch {
+	case !ok:
+		kwfs.Debugf("No range of %v, reading it whole", secret.Name)
+		return nil, fuse.ENOENT, false
+	case etag == "":
+		kwfs.Debugf("No ETag to stream %v by, reading it whole", secret.Name)
+		return nil, fuse.ENOENT, false
+	}
+
+	file = newStreamedFile(kwfs.Cache, secret.Name, etag, attr, kwfs.traceOpen(path, context))
+	kwfs.Infof("Access to %s by uid %d, with gid %d, request_id=%v, streamed", secret.Name, context.Uid, context.Gid, requestID)
+	kwfs.audit(secret.Name, OriginBackend, context, requestID)
+	return file, fuse.OK, true
+}
+
+// streamedFile is an open file of a secret too large to hold in memory, each read of which is
+// requested from the backend as a range of the content. Every read is of the version of the
+// content found at Open, tagged etag, and fails once the secret has rotated.
+type streamedFile struct {
+	nodefs.File
+	cache *Cache
+	name  string
+	etag  string
+	attr  *fuse.Attr
+	trace *log.Logger // logs reads and the release at debug level, if set
+	reads int32
+}
+
+// newStreamedFile returns an open file of the version etag of the secret name, read from the
+// backend of cache, with the attributes attr of the secret. Reads and the release are logged to
+// trace, if not nil.
+func newStreamedFile(cache *Cache, name, etag string, attr *fuse.Attr, trace *log.Logger) nodefs.File {
+	return &streamedFile{File: nodefs.NewDefaultFile(), cache: cache, name: name, etag: etag, attr: attr, trace: trace}
+}
+
+func (f *streamedFile) String() string {
+	return fmt.Sprintf("streamedFile(%v, %d bytes)", f.name, f.attr.Size)
+}
+
+func (f *streamedFile) GetAttr(out *fuse.Attr) fuse.Status {
+	*out = *f.attr
+	return fuse.OK
+}
+
+// Read requests the range of content to be read from the backend, returning EIO if it fails,
+// including once the secret has changed from the version opened. Ranges extending past the end are
+// truncated, and those starting at or after the end are empty.
+func (f *streamedFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if f.trace != nil {
+		atomic.AddInt32(&f.reads, 1)
+		f.trace.Debugf("Read offset=%d size=%d", off, len(buf))
+	}
+	if off < 0 {
+		return nil, fuse.EINVAL
+	}
+	size := int64(len(buf))
+	if end := int64(f.attr.Size); off+size > end {
+		size = end - off
+	}
+	if size <= 0 {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	data, _, ok := f.cache.SecretRange(gocontext.Background(), f.name, off, int(size), f.etag)
+	if !ok {
+		return nil, fuse.EIO
+	}
+	return fuse.ReadResultData(data), fuse.OK
+}
+
+// Release logs the release of the file. No content is held between reads.
+func (f *streamedFile) Release() {
+	if f.trace != nil {
+		f.trace.Debugf("Release after %d reads", atomic.LoadInt32(&f.reads))
+	}
+}
@@ -14,7 +14,11 @@
 
 package keywhizfs_test
 
-import "io/ioutil"
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+)
 
 // fixture fully reads test data from a file in the fixtures/ subdirectory.
 func fixture(file string) (content []byte) {
@@ -24,3 +28,39 @@ func fixture(file string) (content []byte) {
 	}
 	return
 }
+
+// fakeClock is a manually advanced clock for deterministic freshness tests.
+type fakeClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the current fake time.
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the fake time forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// eventually polls cond until it holds or timeout elapses, returning the last result.
+func eventually(cond func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Validator checks the content of a secret, returning an error if it is malformed.
+type Validator func(Secret) error
+
+// Secret types with built-in validators.
+const (
+	TypePEM  = "pem"
+	TypeJSON = "json"
+)
+
+// ValidatePEM accepts content made only of one or more PEM blocks, separated by whitespace.
+func ValidatePEM(s Secret) error {
+	rest := []byte(s.Content)
+	var blocks int
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		blocks++
+	}
+	if blocks == 0 {
+		return errors.New("no PEM block found")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("unexpected data after %d PEM blocks", blocks)
+	}
+	return nil
+}
+
+// ValidateJSON accepts content which is a single well-formed JSON value.
+func ValidateJSON(s Secret) error {
+	if !json.Valid(s.Content) {
+		return errors.New("content is not valid JSON")
+	}
+	return nil
+}
+
+// validators maps secret types to their Validator.
+type validators struct {
+	m    map[string]Validator
+	lock sync.RWMutex
+}
+
+func (v *validators) set(typ string, fn Validator) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if fn == nil {
+		delete(v.m, typ)
+		return
+	}
+	if v.m == nil {
+		v.m = make(map[string]Validator)
+	}
+	v.m[typ] = fn
+}
+
+func (v *validators) get(typ string) Validator {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.m[typ]
+}
+
+// SetValidator registers fn to check the content of secrets whose type is typ before they are
+// cached, replacing any validator registered for typ. A nil fn removes it. Validators for TypePEM
+// and TypeJSON are registered by default.
+func (c *Cache) SetValidator(typ string, fn Validator) {
+	c.validators.set(typ, fn)
+}
+
+// validate runs the validator registered for the type of s, if any. Secrets without content, such
+// as those from a listing, are not validated.
+func (c *Cache) validate(s Secret) error {
+	if s.Type == "" || len(s.Content) == 0 {
+		return nil
+	}
+	fn := c.validators.get(s.Type)
+	if fn == nil {
+		return nil
+	}
+	if err := fn(s); err != nil {
+		return fmt.Errorf("invalid %v content: %v", s.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/square/keywhizfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePEM(t *testing.T) {
+	assert := assert.New(t)
+
+	cert := string(fixture("cacert.crt"))
+	cases := []struct {
+		content string
+		valid   bool
+	}{
+		{cert, true},
+		{cert + "\n" + cert, true},
+		{"", false},
+		{"not a certificate", false},
+		{cert + "trailing garbage", false},
+	}
+	for _, c := range cases {
+		err := keywhizfs.ValidatePEM(keywhizfs.Secret{Content: []byte(c.content)})
+		assert.Equal(c.valid, err == nil, "%q: %v", c.content, err)
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		content string
+		valid   bool
+	}{
+		{`{"user": "app", "password": "hunter2"}`, true},
+		{`["a", 1, null]`, true},
+		{`{"user": "app",`, false},
+		{`{} {}`, false},
+		{"hunter2", false},
+	}
+	for _, c := range cases {
+		err := keywhizfs.ValidateJSON(keywhizfs.Secret{Content: []byte(c.content)})
+		assert.Equal(c.valid, err == nil, "%q: %v", c.content, err)
+	}
+}
+
+func TestParseSecretType(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := keywhizfs.ParseSecret([]byte(`{"name": "db.json", "secret": "e30=", "type": "json"}`))
+	assert.NoError(err)
+	assert.Equal(keywhizfs.TypeJSON, s.Type)
+}
+
+func TestCacheRejectsInvalidSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := &keywhizfs.Secret{Name: "db.json", Content: []byte(`{"password": "hunter2"}`), Type: keywhizfs.TypeJSON, Version: "1"}
+	invalid := &keywhizfs.Secret{Name: "db.json", Content: []byte(`{"password": `), Type: keywhizfs.TypeJSON, Version: "2"}
+	var calls int32
+	backend := CountingBackend{map[string]*keywhizfs.Secret{valid.Name: valid}, &calls}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+
+	secret, ok := cache.Secret(valid.Name)
+	assert.True(ok)
+	assert.Equal(valid, secret)
+
+	// An invalid update is rejected, and the previous value is kept.
+	backend.secrets[valid.Name] = invalid
+	secret, ok = cache.Secret(valid.Name)
+	assert.True(ok)
+	assert.Equal(valid, secret)
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+
+	// An invalid secret which was never cached is not served.
+	invalid.Name = "other.json"
+	backend.secrets[invalid.Name] = invalid
+	_, ok = cache.Secret(invalid.Name)
+	assert.False(ok)
+	assert.Equal([]string{valid.Name}, cache.Keys())
+}
+
+func TestCacheConflictPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	good := &keywhizfs.Secret{Name: "token", Content: []byte("long enough"), Type: "token", Version: "1"}
+	bad := &keywhizfs.Secret{Name: "token", Content: []byte("short"), Type: "token", Version: "2"}
+	cases := []struct {
+		policy   keywhizfs.ConflictPolicy
+		served   *keywhizfs.Secret
+		requests int32 // backend requests by two lookups within Timeouts.Fresh of the rejection
+	}{
+		{keywhizfs.ConflictBackendWins, bad, 1},
+		{keywhizfs.ConflictValidatedBackendWins, good, 2},
+		{keywhizfs.ConflictSticky, good, 1},
+	}
+	for _, c := range cases {
+		var calls int32
+		backend := CountingBackend{map[string]*keywhizfs.Secret{good.Name: good}, &calls}
+		clock := newFakeClock()
+		timeouts := keywhizfs.Timeouts{Fresh: time.Minute, BackendDeadline: time.Second, BackendTimeout: time.Second}
+		cache := keywhizfs.NewCacheWithClock(backend, timeouts, logConfig, clock.Now)
+		cache.SetValidator("token", func(s keywhizfs.Secret) error {
+			if len(s.Content) < 8 {
+				return errors.New("token too short")
+			}
+			return nil
+		})
+		cache.SetConflictPolicy(c.policy)
+
+		_, ok := cache.Secret(good.Name)
+		assert.True(ok, "%v", c.policy)
+
+		backend.secrets[good.Name] = bad
+		clock.Advance(2 * time.Minute)
+		atomic.StoreInt32(&calls, 0)
+		for i := 0; i < 2; i++ {
+			secret, ok := cache.Secret(good.Name)
+			assert.True(ok, "%v", c.policy)
+			assert.Equal(c.served, secret, "%v", c.policy)
+		}
+		assert.Equal(c.requests, atomic.LoadInt32(&calls), "%v", c.policy)
+	}
+}
+
+func TestCacheSecretConflictPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	bad := &keywhizfs.Secret{Name: "db.json", Content: []byte(`{"password": `), Type: keywhizfs.TypeJSON}
+	other := &keywhizfs.Secret{Name: "other.json", Content: []byte(`{"password": `), Type: keywhizfs.TypeJSON}
+	backend := CountingBackend{map[string]*keywhizfs.Secret{bad.Name: bad, other.Name: other}, new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.SetSecretConflictPolicy(bad.Name, keywhizfs.ConflictBackendWins)
+
+	// Only the secret with its own policy is served despite failing validation.
+	_, ok := cache.Secret(bad.Name)
+	assert.True(ok)
+	_, ok = cache.Secret(other.Name)
+	assert.False(ok)
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, p := range []keywhizfs.ConflictPolicy{keywhizfs.ConflictValidatedBackendWins, keywhizfs.ConflictBackendWins, keywhizfs.ConflictSticky} {
+		parsed, err := keywhizfs.ParseConflictPolicy(p.String())
+		assert.NoError(err)
+		assert.Equal(p, parsed)
+	}
+	_, err := keywhizfs.ParseConflictPolicy("client-wins")
+	assert.Error(err)
+}
+
+func TestCacheCustomValidator(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &keywhizfs.Secret{Name: "token", Content: []byte("abc"), Type: "token"}
+	backend := CountingBackend{map[string]*keywhizfs.Secret{s.Name: s}, new(int32)}
+	cache := keywhizfs.NewCache(backend, timeouts, logConfig)
+	cache.SetValidator("token", func(s keywhizfs.Secret) error {
+		if len(s.Content) < 8 {
+			return errors.New("token too short")
+		}
+		return nil
+	})
+
+	_, ok := cache.Secret(s.Name)
+	assert.False(ok)
+
+	cache.SetValidator("token", nil)
+	_, ok = cache.Secret(s.Name)
+	assert.True(ok)
+}
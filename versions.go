@@ -0,0 +1,48 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"context"
+	"strings"
+)
+
+// versionSeparator separates a secret path from a version of the secret, as in "Nobody_PgPass@3".
+const versionSeparator = "@"
+
+// splitVersion splits a path of the form "<secret>@<version>". Returns false if the path has no
+// version.
+func splitVersion(path string) (secretPath, version string, ok bool) {
+	i := strings.LastIndex(path, versionSeparator)
+	if i <= 0 || i == len(path)-len(versionSeparator) {
+		return "", "", false
+	}
+	return path[:i], path[i+len(versionSeparator):], true
+}
+
+// lookupSecretVersion resolves a versioned path to that version of a secret, fetched from the
+// backend with ctx, without caching. The secret itself must currently be accessible at the
+// unversioned path.
+func (kwfs KeywhizFs) lookupSecretVersion(ctx context.Context, path string) (*Secret, bool) {
+	secretPath, version, ok := splitVersion(path)
+	if !ok {
+		return nil, false
+	}
+	current, _, ok := kwfs.lookupSecret(ctx, secretPath)
+	if !ok {
+		return nil, false
+	}
+	return kwfs.Client.SecretVersionCtx(ctx, current.Name, version)
+}
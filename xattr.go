@@ -0,0 +1,99 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhizfs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// xattrPrefix is the namespace of extended attributes exposing secret metadata.
+const xattrPrefix = "user.keywhiz."
+
+// secretXAttrs returns the extended attributes of a secret, omitting unset metadata. Secret content
+// is never exposed as an attribute.
+func secretXAttrs(s *Secret) map[string]string {
+	attrs := map[string]string{
+		xattrPrefix + "mode":      fmt.Sprintf("%04o", s.ModeValue()&0777),
+		xattrPrefix + "updatedAt": s.ModifiedAt().UTC().Format(time.RFC3339Nano),
+	}
+	if s.Owner != "" {
+		attrs[xattrPrefix+"owner"] = s.Owner
+	}
+	if !s.CreatedAt.IsZero() {
+		attrs[xattrPrefix+"createdAt"] = s.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if s.Checksum != "" {
+		attrs[xattrPrefix+"checksum"] = s.Checksum
+	}
+	if s.Version != "" {
+		attrs[xattrPrefix+"version"] = s.Version
+	}
+	if !s.ExpiresAt.IsZero() {
+		attrs[xattrPrefix+"expiry"] = s.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	return attrs
+}
+
+// GetXAttr is a FUSE function which reads an extended attribute of a file.
+func (kwfs KeywhizFs) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	kwfs.Debugf("GetXAttr called with '%v', '%v'", name, attribute)
+
+	attrs, status := kwfs.xattrs(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	value, ok := attrs[attribute]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	return []byte(value), fuse.OK
+}
+
+// ListXAttr is a FUSE function which lists the extended attributes of a file.
+func (kwfs KeywhizFs) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	kwfs.Debugf("ListXAttr called with '%v'", name)
+
+	attrs, status := kwfs.xattrs(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	names := make([]string, 0, len(attrs))
+	for attribute := range attrs {
+		names = append(names, attribute)
+	}
+	sort.Strings(names)
+	return names, fuse.OK
+}
+
+// xattrs returns the extended attributes of a file. Only secret files have attributes. The secret
+// is looked up for the FUSE request of context.
+func (kwfs KeywhizFs) xattrs(name string, context *fuse.Context) (map[string]string, fuse.Status) {
+	if name == "" || name[0] == '.' || kwfs.isLayoutDir(name) {
+		return nil, fuse.OK
+	}
+	secret, _, ok := kwfs.lookupSecret(kwfs.requestContext(context), name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	attrs := secretXAttrs(secret)
+	_, stale := kwfs.Cache.StaleSince(secret.Name)
+	attrs[xattrPrefix+"stale"] = strconv.FormatBool(stale)
+	return attrs, fuse.OK
+}